@@ -1,37 +1,291 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
 	"strconv"
 
 	"github.com/labstack/echo/v4"
 
+	"github.com/mick-io/duplo_go_cloud/internal/alerts"
 	"github.com/mick-io/duplo_go_cloud/internal/api"
+	"github.com/mick-io/duplo_go_cloud/internal/auth"
 	"github.com/mick-io/duplo_go_cloud/internal/config"
 	"github.com/mick-io/duplo_go_cloud/internal/database"
 	"github.com/mick-io/duplo_go_cloud/internal/datastore"
+	"github.com/mick-io/duplo_go_cloud/internal/derived"
+	"github.com/mick-io/duplo_go_cloud/internal/enrichment"
+	"github.com/mick-io/duplo_go_cloud/internal/handlers"
+	"github.com/mick-io/duplo_go_cloud/internal/health"
+	"github.com/mick-io/duplo_go_cloud/internal/jobs"
+	"github.com/mick-io/duplo_go_cloud/internal/lifecycle"
+	"github.com/mick-io/duplo_go_cloud/internal/logging"
+	"github.com/mick-io/duplo_go_cloud/internal/metrics"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/pubsub"
+	"github.com/mick-io/duplo_go_cloud/internal/ratelimit"
+	"github.com/mick-io/duplo_go_cloud/internal/refresh"
 	"github.com/mick-io/duplo_go_cloud/internal/routes"
+	"github.com/mick-io/duplo_go_cloud/internal/tenancy"
+	"github.com/mick-io/duplo_go_cloud/internal/tracing"
+	"github.com/mick-io/duplo_go_cloud/internal/units"
 )
 
 func main() {
 	cfgFP := flag.String("config", "./config/dev.toml", "Path to the config file")
+	adminKey := flag.String("create-admin-key", "", "Create an admin API key with the given name, print it and exit")
+	tenant := flag.String("tenant", database.DefaultTenant, "Tenant of the admin API key, created if it does not exist")
 	flag.Parse()
 
 	cfg, err := config.Load(*cfgFP)
 	if err != nil {
-		log.Fatalf("Error loading config: %v", err)
+		fatal("Error loading config", err)
+	}
+
+	logger, err := logging.New(os.Stderr, logging.Options{
+		Level:  cfg.Log.Level,
+		Format: cfg.Log.Format,
+	})
+	if err != nil {
+		fatal("Error loading config", err)
+	}
+	slog.SetDefault(logger)
+
+	defaultUnits, err := units.Parse(cfg.Units.Default)
+	if err != nil {
+		fatal("Error loading config", err)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Options{
+		Exporter:    cfg.Tracing.Exporter,
+		Endpoint:    cfg.Tracing.Endpoint,
+		ServiceName: cfg.Tracing.ServiceName,
+		SampleRatio: cfg.Tracing.SampleRatio,
+	})
+	if err != nil {
+		fatal("Error configuring tracing", err)
 	}
 
 	db, err := database.Initialize(cfg.Database)
 	if err != nil {
-		log.Fatalf("Error initializing database: %v", err)
+		fatal("Error initializing database", err)
 	}
 
-	client := api.NewClient(cfg.API.ForecastAPIBaseURL)
 	store := datastore.NewGormDatastore(db)
+	if *adminKey != "" {
+		record := models.TenantRecord{Name: *tenant}
+		if err := db.Where("name = ?", record.Name).FirstOrCreate(&record).Error; err != nil {
+			fatal("Error creating tenant", err)
+		}
+		ctx := database.WithTenant(context.Background(), record.ID)
+		_, key, err := auth.CreateKey(store.WithContext(ctx), *adminKey, []string{auth.ScopeAdmin}, nil)
+		if err != nil {
+			fatal("Error creating API key", err)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		fatal("Error initializing database", err)
+	}
+	if err := metrics.RegisterDBStats(sqlDB); err != nil {
+		fatal("Error registering metrics", err)
+	}
+	if err := metrics.RegisterStaleForecasts(store, cfg.Metrics.StaleAfter); err != nil {
+		fatal("Error registering metrics", err)
+	}
+
+	client := api.NewClient(cfg.API.ForecastAPIBaseURL)
+	instrumentClient(client.HTTPClient, "forecast")
+	geocoder := api.NewGeocodingClient(cfg.API.GeocodingAPIBaseURL)
+	instrumentClient(geocoder.HTTPClient, "geocoding")
+	nominatim := api.NewNominatimClient(cfg.API.ReverseGeocodingAPIBaseURL)
+	instrumentClient(nominatim.HTTPClient, "reverse_geocoding")
+	enricher := enrichment.NewPipeline(
+		&enrichment.ReverseGeocodeStep{Client: nominatim},
+		&enrichment.TimezoneStep{Client: client},
+	)
+	hub := pubsub.NewHub(cfg.Stream.HistorySize)
+	alertRules := make([]alerts.Rule, len(cfg.Alerts))
+	for i, rule := range cfg.Alerts {
+		alertRules[i] = alerts.Rule{Name: rule.Name, Variable: rule.Variable, Above: rule.Above, Below: rule.Below}
+	}
+	engine := refresh.NewEngine(store, client, refresh.Options{
+		Concurrency: cfg.Refresh.Concurrency,
+		Hub:         hub,
+		Alerts:      alertRules,
+	})
+
+	archive := api.NewArchiveClient(cfg.API.ArchiveAPIBaseURL)
+	instrumentClient(archive.HTTPClient, "archive")
+	runner := jobs.NewRunner(store)
+	runner.Register(jobs.TypeRefresh, jobs.RefreshHandler(store, engine))
+	runner.Register(jobs.TypeBackfill, jobs.BackfillHandler(store, archive))
+	runner.Register(jobs.TypeVerification, jobs.VerificationHandler(store, cfg.Verification.LeadTimes))
+	runner.Register(jobs.TypeEnrichment, jobs.EnrichmentHandler(store, enricher, cfg.Enrichment.Interval))
+	if err := runner.Resume(); err != nil {
+		fatal("Error resuming jobs", err)
+	}
+
+	authenticators := []auth.Authenticator{auth.NewKeyAuthenticator(store)}
+	if cfg.Auth.JWT.Issuer != "" {
+		authenticator, err := newJWTAuthenticator(store, cfg)
+		if err != nil {
+			fatal("Error configuring JWT authentication", err)
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+
+	var rateLimitStore ratelimit.Store = ratelimit.NewMemoryStore()
+	if cfg.RateLimit.Store == "postgres" {
+		rateLimitStore = ratelimit.NewPostgresStore(db)
+	}
+
+	checker := health.NewChecker(store, health.HTTPProbe(client.HTTPClient, weatherProbeURL(cfg)), runner, health.Options{
+		DatabaseTimeout:   cfg.Health.DatabaseTimeout,
+		WeatherAPITimeout: cfg.Health.WeatherAPITimeout,
+		WeatherAPITTL:     cfg.Health.WeatherAPITTL,
+		StaleAfter:        cfg.Metrics.StaleAfter,
+	})
+
+	enforcer := tenancy.NewEnforcer(tenancy.Limits{
+		MaxLocations:  cfg.Tenants.MaxLocations,
+		RefreshBudget: cfg.Tenants.RefreshBudget,
+	})
+
 	e := echo.New()
 
-	routes.Initialize(e, store, client)
-	e.Start(":" + strconv.Itoa(cfg.Server.Port))
+	routes.Initialize(e, routes.Dependencies{
+		Datastore:      store,
+		Health:         checker,
+		Authenticators: authenticators,
+		RateLimits: routes.RateLimits{
+			Limiter: ratelimit.NewLimiter(rateLimitStore),
+			IP: ratelimit.Rule{
+				Name:     "ip",
+				Requests: cfg.RateLimit.IP.Requests,
+				Window:   cfg.RateLimit.IP.Window,
+			},
+			Default: ratelimit.Rule{
+				Name:     "default",
+				Requests: cfg.RateLimit.Default.Requests,
+				Window:   cfg.RateLimit.Default.Window,
+			},
+			Expensive: ratelimit.Rule{
+				Name:     "expensive",
+				Requests: cfg.RateLimit.Expensive.Requests,
+				Window:   cfg.RateLimit.Expensive.Window,
+			},
+		},
+		WeatherClient:  client,
+		ArchiveClient:  archive,
+		Geocoder:       geocoder,
+		Enricher:       enricher,
+		RefreshEngine:  engine,
+		RefreshTimeout: cfg.Refresh.Timeout,
+		BackfillChunk:  cfg.Backfill.ChunkDays,
+		DegreeDayBases: derived.Bases{
+			Heating: cfg.Derived.HeatingBase,
+			Cooling: cfg.Derived.CoolingBase,
+		},
+		DefaultUnits: defaultUnits,
+		Jobs:         runner,
+		Tenancy:      enforcer,
+		Hub:          hub,
+		Heartbeat:    cfg.Stream.Heartbeat,
+		Socket: handlers.SocketOptions{
+			MaxSubscriptions: cfg.WebSocket.MaxSubscriptions,
+			SendBuffer:       cfg.WebSocket.SendBuffer,
+			ReadLimit:        cfg.WebSocket.ReadLimit,
+			PingInterval:     cfg.WebSocket.PingInterval,
+			WriteTimeout:     cfg.WebSocket.WriteTimeout,
+		},
+	})
+
+	// Components are stopped in the reverse order: the HTTP server stops
+	// accepting requests and drains them first, then running jobs are
+	// stopped, the pending spans flushed and the database pool closed.
+	manager := lifecycle.NewManager(cfg.Server.ShutdownTimeout)
+	manager.Add(lifecycle.Component{
+		Name: "database",
+		Stop: func(context.Context) error { return sqlDB.Close() },
+	})
+	manager.Add(lifecycle.Component{Name: "tracing", Stop: shutdownTracing})
+	manager.Add(lifecycle.Component{Name: "jobs", Stop: runner.Shutdown})
+	manager.Add(lifecycle.Component{
+		Name: "http",
+		Run: func() error {
+			err := e.Start(":" + strconv.Itoa(cfg.Server.Port))
+			if errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
+			return err
+		},
+		Stop: func(ctx context.Context) error {
+			// Closing the event streams first, since they never end on
+			// their own
+			hub.Close()
+			return e.Shutdown(ctx)
+		},
+	})
+	os.Exit(manager.Run(context.Background()))
+}
+
+// instrumentClient records the metrics and spans of the requests made by
+// 'client' to 'api', and sends the request IDs along with them.
+func instrumentClient(client *http.Client, api string) {
+	metrics.InstrumentClient(client, api)
+	tracing.InstrumentClient(client, api)
+	logging.InstrumentClient(client)
+}
+
+// weatherProbeURL returns the URL requested to check that the weather API is
+// reachable: a forecast without any weather variable.
+func weatherProbeURL(cfg *config.Config) string {
+	return cfg.API.ForecastAPIBaseURL + "/forecast?latitude=0&longitude=0&forecast_days=1"
+}
+
+// fatal logs 'err' and exits with lifecycle.ExitInit.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(lifecycle.ExitInit)
+}
+
+// newJWTAuthenticator returns the authenticator of the JWT bearer tokens
+// described by the auth configuration.
+func newJWTAuthenticator(store database.Datastore, cfg *config.Config) (*auth.JWTAuthenticator, error) {
+	jwtCfg := cfg.Auth.JWT
+
+	var keys auth.KeySource
+	switch {
+	case jwtCfg.JWKSURL != "":
+		keys = auth.NewJWKS(jwtCfg.JWKSURL, jwtCfg.JWKSRefresh)
+	case len(jwtCfg.StaticKeys) > 0:
+		staticKeys, err := auth.LoadStaticKeys(jwtCfg.StaticKeys)
+		if err != nil {
+			return nil, err
+		}
+		keys = staticKeys
+	default:
+		return nil, errors.New("either jwks_url or static_keys is required")
+	}
+
+	return auth.NewJWTAuthenticator(store, auth.JWTOptions{
+		Issuer:        jwtCfg.Issuer,
+		Audience:      jwtCfg.Audience,
+		Keys:          keys,
+		ScopesClaim:   jwtCfg.ScopesClaim,
+		RolesClaim:    jwtCfg.RolesClaim,
+		Roles:         jwtCfg.Roles,
+		TenantClaim:   jwtCfg.TenantClaim,
+		DefaultTenant: jwtCfg.DefaultTenant,
+		Leeway:        jwtCfg.Leeway,
+	})
 }
@@ -0,0 +1,92 @@
+// Package alerts checks forecast snapshots against threshold rules.
+package alerts
+
+import (
+	"fmt"
+
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// Rule fires when a forecast variable rises above Above or falls below
+// Below, in the canonical units of the weather API. A nil threshold is not
+// checked.
+type Rule struct {
+	Name     string
+	Variable string
+	Above    *float64
+	Below    *float64
+}
+
+// series returns the hourly values of 'variable'.
+func series(hourly *models.Hourly, variable string) ([]float64, error) {
+	switch variable {
+	case "temperature_2m":
+		return hourly.Temperature2M, nil
+	case "precipitation":
+		return hourly.Precipitation, nil
+	case "relative_humidity_2m":
+		return hourly.RelativeHumidity2M, nil
+	case "wind_speed_10m":
+		return hourly.WindSpeed10M, nil
+	case "surface_pressure":
+		return hourly.SurfacePressure, nil
+	}
+	return nil, fmt.Errorf("unknown variable %q", variable)
+}
+
+// excess returns how far 'value' is past a threshold of the rule, or zero
+// if it crosses none.
+func (r *Rule) excess(value float64) float64 {
+	if r.Above != nil && value > *r.Above {
+		return value - *r.Above
+	}
+	if r.Below != nil && value < *r.Below {
+		return *r.Below - value
+	}
+	return 0
+}
+
+// Evaluate returns the alerts fired by a forecast snapshot, one per rule
+// crossing its thresholds in any hour. The location and forecast IDs of the
+// events are left to the caller.
+func Evaluate(rules []Rule, hourly *models.Hourly) []models.AlertFiredEvent {
+	fired := []models.AlertFiredEvent{}
+	for i := range rules {
+		rule := &rules[i]
+		values, err := series(hourly, rule.Variable)
+		if err != nil {
+			continue
+		}
+
+		var alert *models.AlertFiredEvent
+		var maxExcess float64
+		for hour, value := range values {
+			if hour >= len(hourly.Time) {
+				break
+			}
+			excess := rule.excess(value)
+			if excess == 0 {
+				continue
+			}
+			if alert == nil {
+				alert = &models.AlertFiredEvent{
+					Rule:      rule.Name,
+					Variable:  rule.Variable,
+					Above:     rule.Above,
+					Below:     rule.Below,
+					FirstTime: hourly.Time[hour],
+				}
+			}
+			if excess > maxExcess {
+				maxExcess = excess
+				alert.Value = value
+				alert.Time = hourly.Time[hour]
+			}
+			alert.Hours++
+		}
+		if alert != nil {
+			fired = append(fired, *alert)
+		}
+	}
+	return fired
+}
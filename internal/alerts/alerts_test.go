@@ -0,0 +1,68 @@
+package alerts_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mick-io/duplo_go_cloud/internal/alerts"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+func TestEvaluate(t *testing.T) {
+	hourly := &models.Hourly{
+		Time:               []string{"2024-07-01T12:00", "2024-07-01T13:00", "2024-07-01T14:00", "2024-07-01T15:00"},
+		Temperature2M:      []float64{34, 36, 38, 37},
+		Precipitation:      []float64{0, 0, 0, 0},
+		RelativeHumidity2M: []float64{40, 30, 25, 35},
+		WindSpeed10M:       []float64{3, 18, 4, 2},
+		SurfacePressure:    []float64{1013, 1012, 1011, 1011},
+	}
+	threshold := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name string
+		rule alerts.Rule
+		want string
+	}{
+		{
+			name: "above, most extreme hour",
+			rule: alerts.Rule{Name: "heat", Variable: "temperature_2m", Above: threshold(35)},
+			want: "heat 38 at 2024-07-01T14:00, from 2024-07-01T13:00 for 3h",
+		},
+		{
+			name: "below",
+			rule: alerts.Rule{Name: "dry", Variable: "relative_humidity_2m", Below: threshold(30)},
+			want: "dry 25 at 2024-07-01T14:00, from 2024-07-01T14:00 for 1h",
+		},
+		{
+			name: "both thresholds, furthest past either",
+			rule: alerts.Rule{Name: "pressure", Variable: "surface_pressure", Above: threshold(1012.5), Below: threshold(1011.8)},
+			want: "pressure 1011 at 2024-07-01T14:00, from 2024-07-01T12:00 for 3h",
+		},
+		{
+			name: "threshold not crossed",
+			rule: alerts.Rule{Name: "rain", Variable: "precipitation", Above: threshold(0)},
+		},
+		{
+			name: "threshold reached",
+			rule: alerts.Rule{Name: "wind", Variable: "wind_speed_10m", Above: threshold(18)},
+		},
+		{
+			name: "unknown variable",
+			rule: alerts.Rule{Name: "snow", Variable: "snowfall", Above: threshold(0)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fired := alerts.Evaluate([]alerts.Rule{tt.rule}, hourly)
+			got := ""
+			for _, alert := range fired {
+				got = fmt.Sprintf("%s %v at %s, from %s for %dh", alert.Rule, alert.Value, alert.Time, alert.FirstTime, alert.Hours)
+			}
+			if len(fired) > 1 || got != tt.want {
+				t.Errorf("Evaluate = %q (%d alerts), want %q", got, len(fired), tt.want)
+			}
+		})
+	}
+}
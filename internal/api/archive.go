@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// ArchiveOptions selects the location and the inclusive date range, as
+// YYYY-MM-DD, of a historical weather request.
+type ArchiveOptions struct {
+	Latitude  string
+	Longitude string
+	StartDate string
+	EndDate   string
+}
+
+type ArchiveClient struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+type ArchiveAPIClient interface {
+	GetArchive(ctx context.Context, opts ArchiveOptions, result *models.Archive) error
+}
+
+func NewArchiveClient(baseURL string) *ArchiveClient {
+	return &ArchiveClient{
+		BaseURL:    baseURL,
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+	}
+}
+
+// GetArchive fetches observed hourly weather from the Open-Meteo historical
+// weather API. Times are returned in UTC and values in the same units as
+// forecasts.
+func (c *ArchiveClient) GetArchive(ctx context.Context, opts ArchiveOptions, result *models.Archive) error {
+	reqURL, err := url.Parse(c.BaseURL + "/archive")
+	if err != nil {
+		return err
+	}
+
+	if opts.Latitude == "" || opts.Longitude == "" {
+		return errors.New("latitude and longitude are required")
+	}
+	if opts.StartDate == "" || opts.EndDate == "" {
+		return errors.New("start and end dates are required")
+	}
+
+	params := url.Values{}
+	params.Add("latitude", opts.Latitude)
+	params.Add("longitude", opts.Longitude)
+	params.Add("start_date", opts.StartDate)
+	params.Add("end_date", opts.EndDate)
+	params.Add("hourly", "temperature_2m,precipitation")
+	params.Add("timezone", "GMT")
+	reqURL.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from archive API: %s", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -1,14 +1,25 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/tracing"
 )
 
+// DefaultTimeout bounds the requests of the clients, so that a provider that
+// stops answering cannot hold a request or a job forever.
+const DefaultTimeout = 30 * time.Second
+
 type ForecastOptions struct {
 	Latitude  string
 	Longitude string
@@ -20,17 +31,116 @@ type Client struct {
 }
 
 type WeatherAPIClient interface {
-	GetForecast(opts ForecastOptions, result *models.Forecast) error
+	GetForecast(ctx context.Context, opts ForecastOptions, result *models.Forecast) error
+	GetCurrent(ctx context.Context, opts []ForecastOptions, result *[]models.CurrentForecast) error
+}
+
+type TimezoneAPIClient interface {
+	GetTimezone(opts ForecastOptions, result *models.Timezone) error
 }
 
 func NewClient(baseURL string) *Client {
 	return &Client{
 		BaseURL:    baseURL,
-		HTTPClient: &http.Client{},
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+	}
+}
+
+// GetForecast fetches the hourly forecast of a location in the canonical
+// units: degrees Celsius, meters per second, millimeters and hectopascals.
+func (c *Client) GetForecast(ctx context.Context, opts ForecastOptions, result *models.Forecast) (err error) {
+	ctx, span := tracing.Start(ctx, "api.GetForecast",
+		attribute.String("forecast.latitude", opts.Latitude),
+		attribute.String("forecast.longitude", opts.Longitude),
+	)
+	defer tracing.End(span, &err)
+
+	reqURL, err := url.Parse(c.BaseURL + "/forecast")
+	if err != nil {
+		return err
+	}
+
+	if opts.Latitude == "" || opts.Longitude == "" {
+		return errors.New("latitude and longitude are required")
 	}
+
+	params := url.Values{}
+	params.Add("latitude", opts.Latitude)
+	params.Add("longitude", opts.Longitude)
+	params.Add("hourly", "temperature_2m,precipitation,relative_humidity_2m,wind_speed_10m,surface_pressure")
+	params.Add("wind_speed_unit", "ms")
+	params.Add("timezone", "auto")
+	reqURL.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from forecast API: %s", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// GetCurrent fetches the current conditions for several coordinates in a
+// single request. Results are in the same order as opts.
+func (c *Client) GetCurrent(ctx context.Context, opts []ForecastOptions, result *[]models.CurrentForecast) error {
+	reqURL, err := url.Parse(c.BaseURL + "/forecast")
+	if err != nil {
+		return err
+	}
+
+	if len(opts) == 0 {
+		return errors.New("at least one location is required")
+	}
+
+	latitudes := make([]string, len(opts))
+	longitudes := make([]string, len(opts))
+	for i, opt := range opts {
+		if opt.Latitude == "" || opt.Longitude == "" {
+			return errors.New("latitude and longitude are required")
+		}
+		latitudes[i] = opt.Latitude
+		longitudes[i] = opt.Longitude
+	}
+
+	params := url.Values{}
+	params.Add("latitude", strings.Join(latitudes, ","))
+	params.Add("longitude", strings.Join(longitudes, ","))
+	params.Add("current", "temperature_2m,precipitation")
+	params.Add("timezone", "GMT")
+	reqURL.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// A single location is returned as an object rather than an array.
+	if len(opts) == 1 {
+		*result = make([]models.CurrentForecast, 1)
+		return json.NewDecoder(resp.Body).Decode(&(*result)[0])
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
 }
 
-func (c *Client) GetForecast(opts ForecastOptions, result *models.Forecast) error {
+// GetTimezone resolves the IANA timezone for the given coordinates by
+// requesting a forecast without any weather variables.
+func (c *Client) GetTimezone(opts ForecastOptions, result *models.Timezone) error {
 	reqURL, err := url.Parse(c.BaseURL + "/forecast")
 	if err != nil {
 		return err
@@ -43,10 +153,8 @@ func (c *Client) GetForecast(opts ForecastOptions, result *models.Forecast) erro
 	params := url.Values{}
 	params.Add("latitude", opts.Latitude)
 	params.Add("longitude", opts.Longitude)
-	params.Add("hourly", "temperature_2m")
-	params.Add("temperature_unit", "fahrenheit")
-	params.Add("wind_speed_unit", "mph")
 	params.Add("timezone", "auto")
+	params.Add("forecast_days", "1")
 	reqURL.RawQuery = params.Encode()
 
 	resp, err := c.HTTPClient.Get(reqURL.String())
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+type GeocodeOptions struct {
+	// Name is a place name or postal code.
+	Name     string
+	Count    int
+	Language string
+}
+
+type GeocodingClient struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+type GeocodingAPIClient interface {
+	Search(opts GeocodeOptions, result *models.Geocoding) error
+	Get(id int64, result *models.GeocodingResult) error
+}
+
+func NewGeocodingClient(baseURL string) *GeocodingClient {
+	return &GeocodingClient{
+		BaseURL:    baseURL,
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+	}
+}
+
+func (c *GeocodingClient) Search(opts GeocodeOptions, result *models.Geocoding) error {
+	reqURL, err := url.Parse(strings.TrimSuffix(c.BaseURL, "/") + "/search")
+	if err != nil {
+		return err
+	}
+
+	if opts.Name == "" {
+		return errors.New("name is required")
+	}
+	if opts.Count == 0 {
+		opts.Count = 10
+	}
+	if opts.Language == "" {
+		opts.Language = "en"
+	}
+
+	params := url.Values{}
+	params.Add("name", opts.Name)
+	params.Add("count", strconv.Itoa(opts.Count))
+	params.Add("language", opts.Language)
+	params.Add("format", "json")
+	reqURL.RawQuery = params.Encode()
+
+	return c.get(reqURL, result)
+}
+
+func (c *GeocodingClient) Get(id int64, result *models.GeocodingResult) error {
+	reqURL, err := url.Parse(strings.TrimSuffix(c.BaseURL, "/") + "/get")
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Add("id", strconv.FormatInt(id, 10))
+	reqURL.RawQuery = params.Encode()
+
+	return c.get(reqURL, result)
+}
+
+func (c *GeocodingClient) get(reqURL *url.URL, result interface{}) error {
+	resp, err := c.HTTPClient.Get(reqURL.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from geocoding API: %s", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
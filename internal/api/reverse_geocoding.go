@@ -0,0 +1,74 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// userAgent identifies the service to providers whose usage policies require it.
+const userAgent = "duplo_go_raincloud"
+
+type ReverseGeocodeOptions struct {
+	Latitude  string
+	Longitude string
+}
+
+type ReverseGeocodingAPIClient interface {
+	ReverseGeocode(opts ReverseGeocodeOptions, result *models.ReverseGeocoding) error
+}
+
+// NominatimClient reverse geocodes coordinates using the OpenStreetMap
+// Nominatim API.
+type NominatimClient struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+func NewNominatimClient(baseURL string) *NominatimClient {
+	return &NominatimClient{
+		BaseURL:    baseURL,
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+	}
+}
+
+func (c *NominatimClient) ReverseGeocode(opts ReverseGeocodeOptions, result *models.ReverseGeocoding) error {
+	reqURL, err := url.Parse(strings.TrimSuffix(c.BaseURL, "/") + "/reverse")
+	if err != nil {
+		return err
+	}
+
+	if opts.Latitude == "" || opts.Longitude == "" {
+		return errors.New("latitude and longitude are required")
+	}
+
+	params := url.Values{}
+	params.Add("lat", opts.Latitude)
+	params.Add("lon", opts.Longitude)
+	params.Add("format", "jsonv2")
+	params.Add("accept-language", "en")
+	reqURL.RawQuery = params.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, reqURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from reverse geocoding API: %s", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,138 @@
+// Package auth authenticates API requests and checks that the caller was
+// granted the scope a route requires.
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+)
+
+// Scopes granted to callers. The admin scope grants every other scope.
+const (
+	ScopeLocationsRead   = "locations:read"
+	ScopeLocationsWrite  = "locations:write"
+	ScopeForecastRefresh = "forecast:refresh"
+	ScopeAdmin           = "admin"
+)
+
+// Scopes lists every scope.
+var Scopes = []string{ScopeLocationsRead, ScopeLocationsWrite, ScopeForecastRefresh, ScopeAdmin}
+
+// ErrNoCredentials is returned by an Authenticator when a request carries no
+// credentials it handles.
+var ErrNoCredentials = errors.New("no credentials")
+
+// CredentialsError is returned by an Authenticator when a request carries
+// invalid credentials.
+type CredentialsError struct {
+	Reason string
+}
+
+func (e *CredentialsError) Error() string {
+	return "invalid credentials: " + e.Reason
+}
+
+// principalKey is the context key of the authenticated principal.
+const principalKey = "auth.principal"
+
+// Principal is an authenticated caller.
+type Principal struct {
+	// Subject identifies the caller, e.g. "key:12".
+	Subject string
+	// KeyID is the ID of the API key used, if any.
+	KeyID uint
+	// TenantID is the ID of the tenant the caller acts for. Requests only
+	// see and change the rows of that tenant.
+	TenantID uint
+	Scopes   []string
+}
+
+// HasScope reports whether the principal was granted 'scope'.
+func (p *Principal) HasScope(scope string) bool {
+	for _, granted := range p.Scopes {
+		if granted == scope || granted == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator resolves the principal of a request from its credentials.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Authenticate authenticates every request with the first authenticator
+// that handles its credentials, and rejects requests without valid
+// credentials with 401 Unauthorized. Other errors of the authenticators are
+// reported as 500 Internal Server Error. The context of authenticated
+// requests carries the tenant of the principal, see database.WithTenant.
+func Authenticate(authenticators ...Authenticator) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			for _, authenticator := range authenticators {
+				principal, err := authenticator.Authenticate(c.Request())
+				if errors.Is(err, ErrNoCredentials) {
+					continue
+				}
+				var credentialsErr *CredentialsError
+				if errors.As(err, &credentialsErr) {
+					return unauthorized(c, fmt.Sprintf("Invalid credentials: %s", credentialsErr.Reason))
+				}
+				if err != nil {
+					msg := fmt.Sprintf("Error authenticating request: %v", err)
+					return echo.NewHTTPError(http.StatusInternalServerError, msg)
+				}
+				c.Set(principalKey, principal)
+				req := c.Request()
+				c.SetRequest(req.WithContext(database.WithTenant(req.Context(), principal.TenantID)))
+				return next(c)
+			}
+			return unauthorized(c, "Missing credentials")
+		}
+	}
+}
+
+// Require rejects requests whose principal was not granted 'scope' with 403
+// Forbidden. It must run after Authenticate.
+func Require(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			principal := PrincipalFrom(c)
+			if principal == nil {
+				return unauthorized(c, "Missing credentials")
+			}
+			if !principal.HasScope(scope) {
+				msg := fmt.Sprintf("Missing scope: %s", scope)
+				return echo.NewHTTPError(http.StatusForbidden, msg)
+			}
+			return next(c)
+		}
+	}
+}
+
+// PrincipalFrom returns the authenticated principal of a request, or nil.
+func PrincipalFrom(c echo.Context) *Principal {
+	principal, _ := c.Get(principalKey).(*Principal)
+	return principal
+}
+
+func unauthorized(c echo.Context, msg string) error {
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+	return echo.NewHTTPError(http.StatusUnauthorized, msg)
+}
+
+// bearerToken returns the token of a "Bearer" Authorization header.
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get(echo.HeaderAuthorization), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
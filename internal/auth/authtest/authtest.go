@@ -0,0 +1,106 @@
+// Package authtest mints JWT bearer tokens from a local keypair, so that
+// the JWT authentication flow can be exercised without an identity
+// provider.
+//
+// For example:
+//
+//	issuer, _ := authtest.NewIssuer("https://issuer.test", "duplo")
+//	srv := httptest.NewServer(issuer)
+//	authenticator, _ := auth.NewJWTAuthenticator(db, auth.JWTOptions{
+//		Issuer:   issuer.Issuer,
+//		Audience: issuer.Audience,
+//		Keys:     auth.NewJWKS(srv.URL, 0),
+//	})
+//	token, _ := issuer.Mint("alice", authtest.Claims{"scope": "locations:read"})
+package authtest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/mick-io/duplo_go_cloud/internal/auth"
+)
+
+// KeyID is the ID of the signing key of an Issuer.
+const KeyID = "authtest"
+
+// Claims are claims added to, or overriding, the defaults of a minted
+// token.
+type Claims map[string]interface{}
+
+// Issuer mints RS256 tokens signed with a key generated on creation. It
+// serves its key set as a JWKS.
+type Issuer struct {
+	Issuer   string
+	Audience string
+	// TTL is the lifetime of minted tokens. It defaults to an hour.
+	TTL time.Duration
+
+	key *rsa.PrivateKey
+}
+
+// NewIssuer returns an issuer of tokens for 'audience' with a new keypair.
+func NewIssuer(issuer, audience string) (*Issuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &Issuer{Issuer: issuer, Audience: audience, TTL: time.Hour, key: key}, nil
+}
+
+// Keys returns the public key verifying minted tokens.
+func (i *Issuer) Keys() auth.StaticKeys {
+	return auth.StaticKeys{KeyID: &i.key.PublicKey}
+}
+
+// Options returns JWT options accepting the minted tokens.
+func (i *Issuer) Options() auth.JWTOptions {
+	return auth.JWTOptions{
+		Issuer:   i.Issuer,
+		Audience: i.Audience,
+		Keys:     i.Keys(),
+	}
+}
+
+// Mint returns a signed token for 'subject'. The "iss", "aud", "sub", "iat"
+// and "exp" claims are set from the issuer and can be overridden, or
+// removed with a nil value, through 'claims'.
+func (i *Issuer) Mint(subject string, claims Claims) (string, error) {
+	now := time.Now()
+	all := jwt.MapClaims{
+		"iss": i.Issuer,
+		"sub": subject,
+		"iat": now.Unix(),
+		"exp": now.Add(i.TTL).Unix(),
+	}
+	if i.Audience != "" {
+		all["aud"] = i.Audience
+	}
+	for name, value := range claims {
+		if value == nil {
+			delete(all, name)
+			continue
+		}
+		all[name] = value
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, all)
+	token.Header["kid"] = KeyID
+	return token.SignedString(i.key)
+}
+
+// ServeHTTP serves the key set of the issuer as a JWKS.
+func (i *Issuer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	jwk, err := auth.NewJWK(KeyID, &i.key.PublicKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string][]auth.JWK{"keys": {jwk}})
+}
@@ -0,0 +1,282 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultJWKSRefresh is the interval between fetches of a JWKS when none is
+// configured.
+const DefaultJWKSRefresh = time.Hour
+
+// jwksMinRefresh is the minimum interval between fetches of a JWKS triggered
+// by tokens signed with an unknown key, so that forged key IDs cannot make
+// every request hit the issuer.
+const jwksMinRefresh = time.Minute
+
+// ErrUnknownKey is returned by a KeySource that has no key with the
+// requested ID.
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// KeySource resolves the public keys verifying the signatures of tokens.
+type KeySource interface {
+	// Key returns the key with ID 'kid'. An empty ID selects the only key
+	// of sources holding a single key.
+	Key(ctx context.Context, kid string) (crypto.PublicKey, error)
+}
+
+// StaticKeys is a fixed set of public keys by key ID.
+type StaticKeys map[string]crypto.PublicKey
+
+// Key implements KeySource.
+func (k StaticKeys) Key(_ context.Context, kid string) (crypto.PublicKey, error) {
+	if key, ok := k[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(k) == 1 {
+		for _, key := range k {
+			return key, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// LoadStaticKeys reads PEM encoded public keys or certificates. Keys are
+// identified by the name of their file without its directory and extension.
+func LoadStaticKeys(paths []string) (StaticKeys, error) {
+	keys := StaticKeys{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ParsePublicKeyPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys[keyID(path)] = key
+	}
+	return keys, nil
+}
+
+// ParsePublicKeyPEM parses a PEM encoded public key or certificate.
+func ParsePublicKeyPEM(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block: %q", block.Type)
+}
+
+func keyID(path string) string {
+	name := filepath.Base(path)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// JWKS is a KeySource fetching the JSON Web Key Set of an issuer. Keys are
+// cached and fetched again every Refresh interval, or sooner when a token
+// is signed with a key the set does not hold.
+type JWKS struct {
+	URL     string
+	Client  *http.Client
+	Refresh time.Duration
+
+	mu        sync.Mutex
+	keys      StaticKeys
+	fetchedAt time.Time
+}
+
+// NewJWKS returns a KeySource fetching the key set at 'url'.
+func NewJWKS(url string, refresh time.Duration) *JWKS {
+	if refresh <= 0 {
+		refresh = DefaultJWKSRefresh
+	}
+	return &JWKS{
+		URL:     url,
+		Client:  &http.Client{Timeout: 10 * time.Second},
+		Refresh: refresh,
+	}
+}
+
+// Key implements KeySource.
+func (j *JWKS) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	age := time.Since(j.fetchedAt)
+	if j.keys == nil || age >= j.Refresh {
+		if err := j.fetch(ctx); err != nil {
+			return nil, err
+		}
+	} else if _, ok := j.keys[kid]; !ok && age >= jwksMinRefresh {
+		// The issuer may have rotated its keys
+		if err := j.fetch(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return j.keys.Key(ctx, kid)
+}
+
+// fetch replaces the cached keys with the current key set. Keys of
+// unsupported types are ignored.
+func (j *JWKS) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := j.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching JWKS: unexpected status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("decoding JWKS: %w", err)
+	}
+
+	keys := StaticKeys{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	j.keys = keys
+	j.fetchedAt = time.Now()
+	return nil
+}
+
+// JWK is a public JSON Web Key. Only RSA and elliptic curve keys are
+// supported.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Elliptic curve
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// NewJWK returns the JWK of an RSA or elliptic curve public key.
+func NewJWK(kid string, key crypto.PublicKey) (JWK, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			N:   encode(key.N.Bytes()),
+			E:   encode(big.NewInt(int64(key.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return JWK{
+			Kty: "EC",
+			Kid: kid,
+			Use: "sig",
+			Crv: key.Curve.Params().Name,
+			X:   encode(key.X.FillBytes(make([]byte, size))),
+			Y:   encode(key.Y.FillBytes(make([]byte, size))),
+		}, nil
+	}
+	return JWK{}, fmt.Errorf("unsupported key type: %T", key)
+}
+
+// PublicKey decodes the key.
+func (k *JWK) PublicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %q", k.Kty)
+}
@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// Default claims read by a JWTAuthenticator.
+const (
+	DefaultScopesClaim = "scope"
+	DefaultRolesClaim  = "roles"
+	DefaultTenantClaim = "tenant"
+)
+
+// jwtMethods are the accepted signing algorithms. Symmetric algorithms are
+// not accepted, so that holding the verification keys does not allow
+// minting tokens.
+var jwtMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// JWTOptions configures the validation of JWT bearer tokens and the mapping
+// of their claims to a principal.
+type JWTOptions struct {
+	// Issuer is the required "iss" claim.
+	Issuer string
+	// Audience, if set, must be one of the "aud" claim values.
+	Audience string
+	// Keys verifies the token signatures.
+	Keys KeySource
+	// ScopesClaim holds scopes granted as is, as a space-separated string
+	// or a list. It defaults to DefaultScopesClaim.
+	ScopesClaim string
+	// RolesClaim holds roles, as a string or a list, granted the scopes
+	// Roles maps them to. It defaults to DefaultRolesClaim.
+	RolesClaim string
+	// Roles maps roles to scopes. Roles are matched case-insensitively.
+	Roles map[string][]string
+	// TenantClaim holds the name of the tenant of the caller. It defaults
+	// to DefaultTenantClaim.
+	TenantClaim string
+	// DefaultTenant is the tenant of tokens without a tenant claim. If
+	// empty, such tokens are rejected.
+	DefaultTenant string
+	// Leeway is the clock skew tolerated on time-based claims.
+	Leeway time.Duration
+}
+
+// JWTAuthenticator authenticates requests carrying a JWT bearer token, such
+// as an OIDC access token. Bearer tokens starting with KeyPrefix are left to
+// the KeyAuthenticator.
+type JWTAuthenticator struct {
+	DB      database.Datastore
+	Options JWTOptions
+
+	roles map[string][]string
+}
+
+// NewJWTAuthenticator returns an authenticator of the tokens described by
+// 'opts'. Tenants are resolved by name from 'db'.
+func NewJWTAuthenticator(db database.Datastore, opts JWTOptions) (*JWTAuthenticator, error) {
+	if opts.Issuer == "" {
+		return nil, errors.New("missing JWT issuer")
+	}
+	if opts.Keys == nil {
+		return nil, errors.New("missing JWT keys")
+	}
+	if opts.ScopesClaim == "" {
+		opts.ScopesClaim = DefaultScopesClaim
+	}
+	if opts.RolesClaim == "" {
+		opts.RolesClaim = DefaultRolesClaim
+	}
+	if opts.TenantClaim == "" {
+		opts.TenantClaim = DefaultTenantClaim
+	}
+
+	roles := make(map[string][]string, len(opts.Roles))
+	for role, scopes := range opts.Roles {
+		for _, scope := range scopes {
+			if !validScope(scope) {
+				return nil, fmt.Errorf("role %q: unknown scope: %q", role, scope)
+			}
+		}
+		roles[strings.ToLower(role)] = scopes
+	}
+
+	return &JWTAuthenticator{DB: db, Options: opts, roles: roles}, nil
+}
+
+// Authenticate implements Authenticator.
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token := bearerToken(r)
+	if token == "" || strings.HasPrefix(token, KeyPrefix) || strings.Count(token, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+
+	// Validating token. Failures to fetch the keys are not the caller's
+	// fault and are reported as such.
+	var keysErr error
+	keyfunc := func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := a.Options.Keys.Key(r.Context(), kid)
+		if err != nil && !errors.Is(err, ErrUnknownKey) {
+			keysErr = err
+		}
+		return key, err
+	}
+	parserOpts := []jwt.ParserOption{
+		jwt.WithValidMethods(jwtMethods),
+		jwt.WithIssuer(a.Options.Issuer),
+		jwt.WithLeeway(a.Options.Leeway),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	}
+	if a.Options.Audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(a.Options.Audience))
+	}
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, keyfunc, parserOpts...); err != nil {
+		if keysErr != nil {
+			return nil, keysErr
+		}
+		return nil, &CredentialsError{Reason: fmt.Sprintf("invalid token: %v", err)}
+	}
+
+	subject, _ := claims.GetSubject()
+	if subject == "" {
+		return nil, &CredentialsError{Reason: "token has no subject"}
+	}
+
+	// Resolving tenant
+	tenantName := a.Options.DefaultTenant
+	if claim, ok := claims[a.Options.TenantClaim].(string); ok && claim != "" {
+		tenantName = claim
+	}
+	if tenantName == "" {
+		return nil, &CredentialsError{Reason: "token has no tenant"}
+	}
+	var tenant models.TenantRecord
+	if err := a.DB.Find(&tenant, "name = ?", tenantName); err != nil {
+		return nil, err
+	}
+	if tenant.ID == 0 {
+		return nil, &CredentialsError{Reason: fmt.Sprintf("unknown tenant: %q", tenantName)}
+	}
+
+	return &Principal{
+		Subject:  "jwt:" + subject,
+		TenantID: tenant.ID,
+		Scopes:   a.scopes(claims),
+	}, nil
+}
+
+// scopes returns the known scopes granted by the scopes and roles claims.
+func (a *JWTAuthenticator) scopes(claims jwt.MapClaims) []string {
+	seen := map[string]bool{}
+	scopes := []string{}
+	grant := func(scope string) {
+		if validScope(scope) && !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+
+	for _, scope := range claimValues(claims[a.Options.ScopesClaim]) {
+		grant(scope)
+	}
+	for _, role := range claimValues(claims[a.Options.RolesClaim]) {
+		for _, scope := range a.roles[strings.ToLower(role)] {
+			grant(scope)
+		}
+	}
+
+	return scopes
+}
+
+// claimValues returns the values of a claim holding a space-separated string
+// or a list of strings.
+func claimValues(claim interface{}) []string {
+	switch claim := claim.(type) {
+	case string:
+		return strings.Fields(claim)
+	case []interface{}:
+		values := make([]string, 0, len(claim))
+		for _, value := range claim {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package auth_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/auth"
+	"github.com/mick-io/duplo_go_cloud/internal/auth/authtest"
+	"github.com/mick-io/duplo_go_cloud/internal/database/dbtest"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// jwtFixture holds an issuer, an authenticator of its tokens and the two
+// tenants they may act for.
+type jwtFixture struct {
+	issuer        *authtest.Issuer
+	authenticator *auth.JWTAuthenticator
+	tenantA       *models.TenantRecord
+	tenantB       *models.TenantRecord
+}
+
+func newJWTFixture(t *testing.T, configure func(*auth.JWTOptions)) *jwtFixture {
+	t.Helper()
+
+	db := dbtest.NewDatastore(t)
+	_, tenantA := dbtest.CreateTenant(t, db, "a")
+	_, tenantB := dbtest.CreateTenant(t, db, "b")
+
+	issuer, err := authtest.NewIssuer("https://issuer.test", "duplo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := issuer.Options()
+	opts.DefaultTenant = "a"
+	if configure != nil {
+		configure(&opts)
+	}
+	authenticator, err := auth.NewJWTAuthenticator(db, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &jwtFixture{issuer: issuer, authenticator: authenticator, tenantA: tenantA, tenantB: tenantB}
+}
+
+func (f *jwtFixture) mint(t *testing.T, claims authtest.Claims) string {
+	t.Helper()
+
+	token, err := f.issuer.Mint("alice", claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func bearerRequest(token string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/locations", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	return req
+}
+
+// serve runs a request with 'token' through the Authenticate middleware and
+// returns the HTTP status of the outcome.
+func serve(authenticator auth.Authenticator, token string) int {
+	c := echo.New().NewContext(bearerRequest(token), httptest.NewRecorder())
+	handler := auth.Authenticate(authenticator)(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	var httpErr *echo.HTTPError
+	if err := handler(c); errors.As(err, &httpErr) {
+		return httpErr.Code
+	}
+	return c.Response().Status
+}
+
+func TestJWTScopes(t *testing.T) {
+	f := newJWTFixture(t, func(opts *auth.JWTOptions) {
+		opts.Roles = map[string][]string{
+			"Editor": {auth.ScopeLocationsRead, auth.ScopeLocationsWrite},
+			"ops":    {auth.ScopeForecastRefresh},
+		}
+	})
+
+	tests := []struct {
+		name   string
+		claims authtest.Claims
+		want   []string
+	}{
+		{"no scopes", nil, []string{}},
+		{"space-separated", authtest.Claims{"scope": "locations:read forecast:refresh"}, []string{auth.ScopeLocationsRead, auth.ScopeForecastRefresh}},
+		{"list", authtest.Claims{"scope": []string{"locations:write"}}, []string{auth.ScopeLocationsWrite}},
+		{"unknown scopes ignored", authtest.Claims{"scope": "openid locations:read email"}, []string{auth.ScopeLocationsRead}},
+		{"roles case-insensitive", authtest.Claims{"roles": []string{"editor", "OPS"}}, []string{auth.ScopeLocationsRead, auth.ScopeLocationsWrite, auth.ScopeForecastRefresh}},
+		{"role as string", authtest.Claims{"roles": "ops"}, []string{auth.ScopeForecastRefresh}},
+		{"unknown roles ignored", authtest.Claims{"roles": []string{"viewer"}}, []string{}},
+		{"scopes and roles deduplicated", authtest.Claims{"scope": "locations:read", "roles": "editor"}, []string{auth.ScopeLocationsRead, auth.ScopeLocationsWrite}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := f.authenticator.Authenticate(bearerRequest(f.mint(t, tt.claims)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(principal.Scopes, tt.want) {
+				t.Errorf("scopes = %v, want %v", principal.Scopes, tt.want)
+			}
+			if principal.Subject != "jwt:alice" {
+				t.Errorf("subject = %q, want %q", principal.Subject, "jwt:alice")
+			}
+		})
+	}
+}
+
+func TestJWTRolesRejectUnknownScopes(t *testing.T) {
+	issuer, err := authtest.NewIssuer("https://issuer.test", "duplo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := issuer.Options()
+	opts.Roles = map[string][]string{"editor": {"locations:delete"}}
+
+	if _, err := auth.NewJWTAuthenticator(dbtest.NewDatastore(t), opts); err == nil {
+		t.Error("NewJWTAuthenticator accepted a role granting an unknown scope")
+	}
+}
+
+func TestJWTTenant(t *testing.T) {
+	f := newJWTFixture(t, nil)
+
+	principal, err := f.authenticator.Authenticate(bearerRequest(f.mint(t, authtest.Claims{"tenant": "b"})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.TenantID != f.tenantB.ID {
+		t.Errorf("tenant = %d, want %d", principal.TenantID, f.tenantB.ID)
+	}
+
+	// Falling back to the default tenant
+	principal, err = f.authenticator.Authenticate(bearerRequest(f.mint(t, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.TenantID != f.tenantA.ID {
+		t.Errorf("tenant = %d, want default %d", principal.TenantID, f.tenantA.ID)
+	}
+
+	var credentialsErr *auth.CredentialsError
+	_, err = f.authenticator.Authenticate(bearerRequest(f.mint(t, authtest.Claims{"tenant": "c"})))
+	if !errors.As(err, &credentialsErr) {
+		t.Errorf("unknown tenant error = %v, want *auth.CredentialsError", err)
+	}
+
+	f.authenticator.Options.DefaultTenant = ""
+	_, err = f.authenticator.Authenticate(bearerRequest(f.mint(t, nil)))
+	if !errors.As(err, &credentialsErr) {
+		t.Errorf("missing tenant error = %v, want *auth.CredentialsError", err)
+	}
+}
+
+// signedWith returns a token with valid claims signed by 'method' with
+// 'key' under the key ID 'kid'.
+func signedWith(f *jwtFixture, method jwt.SigningMethod, key interface{}, kid string) (string, error) {
+	token := jwt.NewWithClaims(method, jwt.MapClaims{
+		"iss": f.issuer.Issuer,
+		"aud": f.issuer.Audience,
+		"sub": "mallory",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	return token.SignedString(key)
+}
+
+func TestJWTRejectsInvalidTokens(t *testing.T) {
+	f := newJWTFixture(t, nil)
+
+	// The public key as an HMAC secret, for algorithm confusion
+	publicKey, err := x509.MarshalPKIXPublicKey(f.issuer.Keys()[authtest.KeyID])
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})
+
+	// An issuer signing with another key under the same key ID
+	other, err := authtest.NewIssuer(f.issuer.Issuer, f.issuer.Audience)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attackerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token func() (string, error)
+	}{
+		{"expired", func() (string, error) {
+			return f.issuer.Mint("alice", authtest.Claims{"exp": time.Now().Add(-time.Minute).Unix()})
+		}},
+		{"without expiry", func() (string, error) {
+			return f.issuer.Mint("alice", authtest.Claims{"exp": nil})
+		}},
+		{"wrong audience", func() (string, error) {
+			return f.issuer.Mint("alice", authtest.Claims{"aud": "other"})
+		}},
+		{"wrong issuer", func() (string, error) {
+			return f.issuer.Mint("alice", authtest.Claims{"iss": "https://attacker.test"})
+		}},
+		{"without subject", func() (string, error) {
+			return f.issuer.Mint("alice", authtest.Claims{"sub": nil})
+		}},
+		{"HS256 signed with the public key", func() (string, error) {
+			return signedWith(f, jwt.SigningMethodHS256, publicPEM, authtest.KeyID)
+		}},
+		{"alg none", func() (string, error) {
+			return signedWith(f, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, authtest.KeyID)
+		}},
+		{"forged kid", func() (string, error) {
+			return other.Mint("alice", authtest.Claims{})
+		}},
+		{"unknown kid", func() (string, error) {
+			return signedWith(f, jwt.SigningMethodRS256, attackerKey, "attacker")
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := tt.token()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = f.authenticator.Authenticate(bearerRequest(token))
+			var credentialsErr *auth.CredentialsError
+			if !errors.As(err, &credentialsErr) {
+				t.Errorf("error = %v, want *auth.CredentialsError", err)
+			}
+			if got := serve(f.authenticator, token); got != http.StatusUnauthorized {
+				t.Errorf("status = %d, want %d", got, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+func TestJWTIgnoresOtherCredentials(t *testing.T) {
+	f := newJWTFixture(t, nil)
+
+	for _, token := range []string{"", auth.KeyPrefix + "abc.def.ghi", "opaque"} {
+		if _, err := f.authenticator.Authenticate(bearerRequest(token)); !errors.Is(err, auth.ErrNoCredentials) {
+			t.Errorf("Authenticate(%q) error = %v, want %v", token, err, auth.ErrNoCredentials)
+		}
+	}
+}
+
+// jwksServer serves the key set of an issuer, or 503 while 'down' is set,
+// and counts the requests it receives.
+type jwksServer struct {
+	*httptest.Server
+	down     atomic.Bool
+	requests atomic.Int32
+}
+
+func newJWKSServer(t *testing.T, issuer *authtest.Issuer) *jwksServer {
+	t.Helper()
+
+	s := &jwksServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		if s.down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		issuer.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestJWKSForgedKidDoesNotRefetch(t *testing.T) {
+	f := newJWTFixture(t, nil)
+	jwks := newJWKSServer(t, f.issuer)
+	f.authenticator.Options.Keys = auth.NewJWKS(jwks.URL, 0)
+
+	if got := serve(f.authenticator, f.mint(t, nil)); got != http.StatusOK {
+		t.Fatalf("status = %d, want %d", got, http.StatusOK)
+	}
+
+	// Tokens signed with key IDs the set does not hold are rejected without
+	// fetching the set again
+	attackerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		token, err := signedWith(f, jwt.SigningMethodRS256, attackerKey, fmt.Sprintf("forged-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := serve(f.authenticator, token); got != http.StatusUnauthorized {
+			t.Errorf("status = %d, want %d", got, http.StatusUnauthorized)
+		}
+	}
+	if got := jwks.requests.Load(); got != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", got)
+	}
+}
+
+func TestJWKSOutage(t *testing.T) {
+	f := newJWTFixture(t, nil)
+	jwks := newJWKSServer(t, f.issuer)
+	jwks.down.Store(true)
+	f.authenticator.Options.Keys = auth.NewJWKS(jwks.URL, 0)
+
+	token := f.mint(t, nil)
+	_, err := f.authenticator.Authenticate(bearerRequest(token))
+	var credentialsErr *auth.CredentialsError
+	if err == nil || errors.As(err, &credentialsErr) {
+		t.Errorf("error = %v, want a key source error", err)
+	}
+	if got := serve(f.authenticator, token); got != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", got, http.StatusInternalServerError)
+	}
+
+	// Recovering once the issuer is back
+	jwks.down.Store(false)
+	if got := serve(f.authenticator, token); got != http.StatusOK {
+		t.Errorf("status = %d, want %d", got, http.StatusOK)
+	}
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// KeyPrefix starts every API key, so that keys are recognizable in
+// configuration files and distinguishable from other bearer tokens.
+const KeyPrefix = "dgc_"
+
+// keyPrefixLength is the number of leading characters of a key stored in
+// clear, including KeyPrefix.
+const keyPrefixLength = 12
+
+// lastUsedInterval is the minimum interval between updates of the last use
+// of a key, to avoid a write per request.
+const lastUsedInterval = time.Minute
+
+// HeaderAPIKey is the header carrying an API key, as an alternative to a
+// bearer token.
+const HeaderAPIKey = "X-API-Key"
+
+// GenerateKey returns a new random API key.
+func GenerateKey() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return KeyPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// HashKey returns the hash an API key is stored as. Keys are long random
+// strings, so a fast unsalted hash does not make them guessable.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateKey generates and stores an API key granted 'scopes', returning the
+// stored record and the key, which cannot be recovered from the record. The
+// key belongs to the tenant 'db' is bound to.
+func CreateKey(db database.Datastore, name string, scopes []string, expiresAt *time.Time) (*models.APIKeyRecord, string, error) {
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return nil, "", fmt.Errorf("unknown scope: %q", scope)
+		}
+	}
+
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, "", err
+	}
+	record := &models.APIKeyRecord{
+		Name:      name,
+		Prefix:    key[:keyPrefixLength],
+		Hash:      HashKey(key),
+		Scopes:    strings.Join(scopes, ","),
+		ExpiresAt: expiresAt,
+	}
+	if err := db.Create(record); err != nil {
+		return nil, "", err
+	}
+	return record, key, nil
+}
+
+// KeyScopes returns the scopes granted to a stored key.
+func KeyScopes(record *models.APIKeyRecord) []string {
+	if record.Scopes == "" {
+		return []string{}
+	}
+	return strings.Split(record.Scopes, ",")
+}
+
+func validScope(scope string) bool {
+	for _, known := range Scopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyAuthenticator authenticates requests carrying an API key in the
+// X-API-Key header or as a bearer token.
+type KeyAuthenticator struct {
+	DB database.Datastore
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// NewKeyAuthenticator returns an authenticator of the keys stored in 'db'.
+func NewKeyAuthenticator(db database.Datastore) *KeyAuthenticator {
+	return &KeyAuthenticator{DB: db, Now: time.Now}
+}
+
+// Authenticate implements Authenticator.
+func (a *KeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(HeaderAPIKey)
+	if key == "" {
+		key = bearerToken(r)
+	}
+	if !strings.HasPrefix(key, KeyPrefix) {
+		return nil, ErrNoCredentials
+	}
+
+	var record models.APIKeyRecord
+	if err := a.DB.Find(&record, "hash = ?", HashKey(key)); err != nil {
+		return nil, err
+	}
+	now := a.Now()
+	switch {
+	case record.ID == 0:
+		return nil, &CredentialsError{Reason: "unknown API key"}
+	case record.RevokedAt != nil:
+		return nil, &CredentialsError{Reason: "revoked API key"}
+	case record.ExpiresAt != nil && !now.Before(*record.ExpiresAt):
+		return nil, &CredentialsError{Reason: "expired API key"}
+	}
+
+	// Recording the last use is best effort and does not fail the request
+	if record.LastUsedAt == nil || now.Sub(*record.LastUsedAt) >= lastUsedInterval {
+		record.LastUsedAt = &now
+		_ = a.DB.Save(&record)
+	}
+
+	return &Principal{
+		Subject:  fmt.Sprintf("key:%d", record.ID),
+		KeyID:    record.ID,
+		TenantID: record.TenantID,
+		Scopes:   KeyScopes(&record),
+	}, nil
+}
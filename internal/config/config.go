@@ -3,6 +3,7 @@ package config
 import (
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/go-playground/validator"
 	"github.com/spf13/viper"
@@ -16,14 +17,143 @@ type DatabaseConfig struct {
 	User     string `validate:"required"`
 }
 
+// AlertRule fires when a forecast variable rises above Above or falls below
+// Below, in the canonical units of the weather API.
+type AlertRule struct {
+	Name     string   `validate:"required"`
+	Variable string   `validate:"oneof=temperature_2m precipitation relative_humidity_2m wind_speed_10m surface_pressure"`
+	Above    *float64 `validate:"required_without=Below"`
+	Below    *float64
+}
+
+// RateLimitRule allows Requests requests per Window. Zero disables it.
+type RateLimitRule struct {
+	Requests int           `validate:"min=0"`
+	Window   time.Duration `validate:"min=0"`
+}
+
 type Config struct {
 	Database *DatabaseConfig
-	Server   struct {
-		Environment string `validate:"required"`
-		Port        int    `validate:"required,min=1024,max=65535"`
+	// Server configures the HTTP server. On SIGINT or SIGTERM, in-flight
+	// requests and jobs are given ShutdownTimeout to finish.
+	Server struct {
+		Environment     string        `validate:"required"`
+		Port            int           `validate:"required,min=1024,max=65535"`
+		ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout" validate:"min=0"`
 	}
 	API struct {
-		ForecastAPIBaseURL string `mapstructure:"forecast_api_base_url" validate:"required,url"`
+		ForecastAPIBaseURL         string `mapstructure:"forecast_api_base_url" validate:"required,url"`
+		GeocodingAPIBaseURL        string `mapstructure:"geocoding_api_base_url" validate:"required,url"`
+		ReverseGeocodingAPIBaseURL string `mapstructure:"reverse_geocoding_api_base_url" validate:"required,url"`
+		ArchiveAPIBaseURL          string `mapstructure:"archive_api_base_url" validate:"required,url"`
+	}
+	// Auth configures the bearer tokens accepted besides API keys. JWT
+	// authentication is enabled when an issuer is set, and verifies tokens
+	// with the keys of 'jwks_url' or else with the PEM files of
+	// 'static_keys'. Roles maps the values of the roles claim, lowercased,
+	// to scopes.
+	Auth struct {
+		JWT struct {
+			Issuer        string
+			Audience      string
+			JWKSURL       string        `mapstructure:"jwks_url" validate:"omitempty,url"`
+			JWKSRefresh   time.Duration `mapstructure:"jwks_refresh" validate:"min=0"`
+			StaticKeys    []string      `mapstructure:"static_keys"`
+			ScopesClaim   string        `mapstructure:"scopes_claim"`
+			RolesClaim    string        `mapstructure:"roles_claim"`
+			TenantClaim   string        `mapstructure:"tenant_claim"`
+			DefaultTenant string        `mapstructure:"default_tenant"`
+			Leeway        time.Duration `validate:"min=0"`
+			Roles         map[string][]string
+		}
+	}
+	// RateLimit limits the requests of each API key or token subject, and of
+	// each IP address for unauthenticated requests. Expensive applies on
+	// top of Default to the routes calling the weather API. IP limits every
+	// request of each IP address before authentication, so that floods of
+	// invalid credentials are limited too. Store is "memory", or
+	// "postgres" to share the counters between instances.
+	RateLimit struct {
+		Store     string `validate:"omitempty,oneof=memory postgres"`
+		IP        RateLimitRule
+		Default   RateLimitRule
+		Expensive RateLimitRule
+	} `mapstructure:"rate_limit"`
+	// Log configures the logs written to the standard error. Level is
+	// "debug", "info", "warn" or "error" and Format is "text" or "json".
+	Log struct {
+		Level  string `validate:"omitempty,oneof=debug info warn error"`
+		Format string `validate:"omitempty,oneof=text json"`
+	}
+	// Health configures the checks of /health and /readyz. The weather API
+	// is probed at most once per WeatherAPITTL.
+	Health struct {
+		DatabaseTimeout   time.Duration `mapstructure:"database_timeout" validate:"min=0"`
+		WeatherAPITimeout time.Duration `mapstructure:"weather_api_timeout" validate:"min=0"`
+		WeatherAPITTL     time.Duration `mapstructure:"weather_api_ttl" validate:"min=0"`
+	}
+	// Metrics configures the Prometheus metrics served on /metrics.
+	// Locations without a forecast stored within StaleAfter are counted as
+	// stale, here and by /health.
+	Metrics struct {
+		StaleAfter time.Duration `mapstructure:"stale_after" validate:"min=0"`
+	}
+	// Tracing configures the export of the OpenTelemetry spans. Exporter is
+	// "none", "stdout" or "otlp", in which case spans are sent to the
+	// OTLP/HTTP collector at Endpoint, or else at the
+	// OTEL_EXPORTER_OTLP_ENDPOINT environment variable.
+	Tracing struct {
+		Exporter    string  `validate:"omitempty,oneof=none stdout otlp"`
+		Endpoint    string  `validate:"omitempty,url"`
+		ServiceName string  `mapstructure:"service_name"`
+		SampleRatio float64 `mapstructure:"sample_ratio" validate:"min=0,max=1"`
+	}
+	Refresh struct {
+		Concurrency int           `validate:"min=0"`
+		Timeout     time.Duration `validate:"min=0"`
+	}
+	Stream struct {
+		Heartbeat   time.Duration `validate:"required"`
+		HistorySize int           `mapstructure:"history_size" validate:"min=0"`
+	}
+	// Alerts are checked against every refreshed forecast, and the ones
+	// crossed are published to the forecast stream.
+	Alerts   []AlertRule `validate:"dive"`
+	Backfill struct {
+		ChunkDays int `mapstructure:"chunk_days" validate:"min=0"`
+	}
+	// Enrichment configures the jobs enriching every location. Interval is
+	// the minimum interval between two locations, to stay within the rate
+	// limit of the reverse geocoding provider.
+	Enrichment struct {
+		Interval time.Duration `validate:"min=0"`
+	}
+	// Derived holds the base temperatures of degree days, in degrees
+	// Celsius.
+	Derived struct {
+		HeatingBase float64 `mapstructure:"heating_base"`
+		CoolingBase float64 `mapstructure:"cooling_base"`
+	}
+	// Units holds the unit system responses are rendered in when neither
+	// the request nor the location selects one.
+	Units struct {
+		Default string `validate:"required"`
+	}
+	// Tenants holds the quotas of the tenants without quotas of their own.
+	// Zero is unlimited.
+	Tenants struct {
+		MaxLocations  int `mapstructure:"max_locations" validate:"min=0"`
+		RefreshBudget int `mapstructure:"refresh_budget" validate:"min=0"`
+	}
+	Verification struct {
+		LeadTimes []int `mapstructure:"lead_times" validate:"dive,min=1"`
+	}
+	WebSocket struct {
+		MaxSubscriptions int           `mapstructure:"max_subscriptions" validate:"min=0"`
+		SendBuffer       int           `mapstructure:"send_buffer" validate:"min=0"`
+		ReadLimit        int64         `mapstructure:"read_limit" validate:"min=0"`
+		PingInterval     time.Duration `mapstructure:"ping_interval" validate:"min=0"`
+		WriteTimeout     time.Duration `mapstructure:"write_timeout" validate:"min=0"`
 	}
 }
 
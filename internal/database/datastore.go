@@ -1,10 +1,61 @@
 package database
 
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// ErrRecordNotFound is returned by First and Last when no record matches.
+var ErrRecordNotFound = gorm.ErrRecordNotFound
+
+// Page describes the ordering and size of a page of results.
+type Page struct {
+	Order string
+	Limit int
+}
+
+// Datastore reads and writes records. A Datastore bound to a context
+// carrying a tenant, see WithTenant, only sees and changes the rows of that
+// tenant.
 type Datastore interface {
+	WithContext(ctx context.Context) Datastore
 	Find(out interface{}, where ...interface{}) error
+	FindPage(out interface{}, page Page, where ...interface{}) error
+	FindInBatches(out interface{}, batchSize int, fn func(batch int) error) error
 	First(out interface{}, where ...interface{}) error
+	Last(out interface{}, where ...interface{}) error
+	Lock(out interface{}, where ...interface{}) error
+	Count(model interface{}, count *int64, where ...interface{}) error
 	Create(value interface{}) error
 	Save(value interface{}) error
 	Delete(value interface{}, where ...interface{}) error
+	Transaction(fn func(tx Datastore) error) error
 	HealthCheck() error
 }
+
+// CountStaleLocations counts the locations without a forecast stored after
+// 'since'.
+func CountStaleLocations(db Datastore, since time.Time) (int64, error) {
+	var count int64
+	err := db.Count(&models.LocationRecord{}, &count,
+		"id NOT IN (SELECT location_record_id FROM forecast_records WHERE created_at > ? AND deleted_at IS NULL)", since)
+	return count, err
+}
+
+// tenantKey is the context key of the tenant.
+type tenantKey struct{}
+
+// WithTenant returns a copy of 'ctx' carrying a tenant ID.
+func WithTenant(ctx context.Context, tenantID uint) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantID)
+}
+
+// TenantFrom returns the tenant ID carried by 'ctx', if any.
+func TenantFrom(ctx context.Context) (uint, bool) {
+	tenantID, ok := ctx.Value(tenantKey{}).(uint)
+	return tenantID, ok
+}
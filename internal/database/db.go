@@ -7,6 +7,7 @@ import (
 	"gorm.io/gorm"
 
 	"github.com/mick-io/duplo_go_cloud/internal/config"
+	"github.com/mick-io/duplo_go_cloud/internal/logging"
 	"github.com/mick-io/duplo_go_cloud/internal/models"
 )
 
@@ -17,15 +18,61 @@ func Initialize(dbCfg *config.DatabaseConfig) (*gorm.DB, error) {
 	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
 		dbCfg.Host, dbCfg.Port, dbCfg.User, dbCfg.Password, dbCfg.Name)
 
-	DB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	DB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logging.NewGormLogger()})
 	if err != nil {
 		return nil, err
 	}
 
-	DB.AutoMigrate(&models.LocationRecord{})
-	DB.AutoMigrate(&models.ForecastRecord{})
-	DB.AutoMigrate(&models.HourlyRecord{})
-	DB.AutoMigrate(&models.HourlyUnitsRecord{})
+	if err := Migrate(DB); err != nil {
+		return nil, err
+	}
 
 	return DB, nil
 }
+
+// Migrate creates or updates the tables of the records and assigns the rows
+// without a tenant to the default tenant.
+func Migrate(db *gorm.DB) error {
+	err := db.AutoMigrate(
+		&models.LocationRecord{},
+		&models.ForecastRecord{},
+		&models.HourlyRecord{},
+		&models.HourlyUnitsRecord{},
+		&models.JobRecord{},
+		&models.JobTaskRecord{},
+		&models.ObservationRecord{},
+		&models.VerificationRecord{},
+		&models.HistoryRecord{},
+		&models.HistoryUnitsRecord{},
+		&models.APIKeyRecord{},
+		&models.TenantRecord{},
+		&models.RateLimitRecord{},
+	)
+	if err != nil {
+		return err
+	}
+
+	return migrateDefaultTenant(db)
+}
+
+// DefaultTenant is the tenant owning the rows stored before tenants were
+// introduced.
+const DefaultTenant = "default"
+
+// migrateDefaultTenant assigns the rows without a tenant to the default
+// tenant, creating it if needed.
+func migrateDefaultTenant(db *gorm.DB) error {
+	tenant := models.TenantRecord{Name: DefaultTenant}
+	if err := db.Where("name = ?", tenant.Name).FirstOrCreate(&tenant).Error; err != nil {
+		return err
+	}
+
+	for _, model := range []interface{}{&models.LocationRecord{}, &models.JobRecord{}, &models.APIKeyRecord{}} {
+		err := db.Model(model).Unscoped().Where("tenant_id = 0").Update("tenant_id", tenant.ID).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+// Package dbtest opens in-memory SQLite databases with the schema of the
+// service, so that the datastore and the code built on it can be tested
+// without Postgres.
+//
+// For example:
+//
+//	func TestSomething(t *testing.T) {
+//		db := dbtest.NewDatastore(t)
+//		db.Create(&models.LocationRecord{Latitude: 1, Longitude: 2})
+//	}
+package dbtest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/datastore"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// Open returns a new empty database with every table migrated. It is closed
+// when the test ends.
+func Open(t testing.TB) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+
+	// An in-memory database lives as long as its connection, so the pool
+	// is limited to a single connection that is never recycled. This also
+	// serializes concurrent statements, which SQLite would reject.
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	sqlDB.SetConnMaxLifetime(0)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := database.Migrate(db); err != nil {
+		t.Fatalf("migrating database: %v", err)
+	}
+	return db
+}
+
+// NewDatastore returns a datastore over a new database, see Open.
+func NewDatastore(t testing.TB) database.Datastore {
+	t.Helper()
+	return datastore.NewGormDatastore(Open(t))
+}
+
+// CreateTenant stores a tenant named 'name' and returns a context carrying
+// it, see database.WithTenant.
+func CreateTenant(t testing.TB, db database.Datastore, name string) (context.Context, *models.TenantRecord) {
+	t.Helper()
+
+	tenant := &models.TenantRecord{Name: name}
+	if err := db.Create(tenant); err != nil {
+		t.Fatalf("creating tenant: %v", err)
+	}
+	return database.WithTenant(context.Background(), tenant.ID), tenant
+}
@@ -1,21 +1,43 @@
 package datastore
 
 import (
+	"context"
+
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/mick-io/duplo_go_cloud/internal/database"
 )
 
-// GormDatastore is an implementation of the Datastore interface using GORM.
+// GormDatastore is an implementation of the Datastore interface using GORM. Every method records
+// a span, as a child of the span of the context of the datastore, see WithContext.
 type GormDatastore struct {
 	db *gorm.DB
 }
 
-// NewGormDatastore creates a new GormDatastore with the given *gorm.DB instance.
+// NewGormDatastore creates a new GormDatastore with the given *gorm.DB instance. It registers the
+// callbacks that scope the queries of datastores bound to a tenant, see WithContext, and that
+// observe the duration of every statement.
 func NewGormDatastore(db *gorm.DB) database.Datastore {
+	registerTenantScopes(db)
+	registerMetrics(db)
 	return &GormDatastore{db: db}
 }
 
+// WithContext returns a datastore whose queries run with 'ctx'. If 'ctx' carries a tenant, see
+// database.WithTenant, queries on tenant-owned records only match the rows of that tenant and
+// created records are assigned to it.
+// For example:
+//
+//	ctx := database.WithTenant(context.Background(), 3)
+//	locations := []models.LocationRecord{}
+//	ds.WithContext(ctx).Find(&locations)
+//
+// This will find the locations of tenant 3.
+func (g *GormDatastore) WithContext(ctx context.Context) database.Datastore {
+	return &GormDatastore{db: g.db.WithContext(ctx)}
+}
+
 // Find retrieves records that match the given conditions and stores them in 'out'.
 // Examples:
 //
@@ -38,8 +60,63 @@ func NewGormDatastore(db *gorm.DB) database.Datastore {
 //
 //	users := []User{}
 //	ds.Find(&users, "name IN (?)", []string{"mick", "mick 2"})
-func (g *GormDatastore) Find(out interface{}, where ...interface{}) error {
-	result := g.db.Find(out, where...)
+func (g *GormDatastore) Find(out interface{}, where ...interface{}) (err error) {
+	db, span := g.startSpan("Find")
+	defer endSpan(span, &err)
+
+	result := db.Find(out, where...)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+// FindPage retrieves records that match the given conditions, ordered and limited as described by 'page',
+// and stores them in 'out'.
+// For example:
+//
+//	users := []User{}
+//	ds.FindPage(&users, database.Page{Order: "name ASC, id ASC", Limit: 10}, "name > ?", "mick")
+//
+// This will find the first 10 users whose name sorts after 'mick'.
+func (g *GormDatastore) FindPage(out interface{}, page database.Page, where ...interface{}) (err error) {
+	db, span := g.startSpan("FindPage")
+	defer endSpan(span, &err)
+
+	tx := db
+	if page.Order != "" {
+		tx = tx.Order(page.Order)
+	}
+	if page.Limit > 0 {
+		tx = tx.Limit(page.Limit)
+	}
+
+	result := tx.Find(out, where...)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+// FindInBatches retrieves all records of the type of 'out' in batches of
+// 'batchSize', ordered by primary key. 'out' is refilled before each call to
+// 'fn', so only one batch is held in memory at a time.
+// For example:
+//
+//	users := []User{}
+//	ds.FindInBatches(&users, 100, func(batch int) error {
+//		for _, user := range users {
+//			fmt.Println(user.Name)
+//		}
+//		return nil
+//	})
+func (g *GormDatastore) FindInBatches(out interface{}, batchSize int, fn func(batch int) error) (err error) {
+	db, span := g.startSpan("FindInBatches")
+	defer endSpan(span, &err)
+
+	result := db.FindInBatches(out, batchSize, func(tx *gorm.DB, batch int) error {
+		return fn(batch)
+	})
 	if result.Error != nil {
 		return result.Error
 	}
@@ -63,8 +140,81 @@ func (g *GormDatastore) Find(out interface{}, where ...interface{}) error {
 //
 //	user := User{}
 //	ds.First(&user, "name = ?", "mick")
-func (g *GormDatastore) First(out interface{}, where ...interface{}) error {
-	result := g.db.First(out, where...)
+func (g *GormDatastore) First(out interface{}, where ...interface{}) (err error) {
+	db, span := g.startSpan("First")
+	defer endSpan(span, &err)
+
+	result := db.First(out, where...)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+// Last retrieves the last record, ordered by primary key, that matches the given conditions and stores it in 'out'.
+// Examples:
+//
+// Using a struct:
+//
+//	user := User{}
+//	ds.Last(&user, &User{Name: "mick"})
+//
+// Using a string:
+//
+//	user := User{}
+//	ds.Last(&user, "name = ?", "mick")
+func (g *GormDatastore) Last(out interface{}, where ...interface{}) (err error) {
+	db, span := g.startSpan("Last")
+	defer endSpan(span, &err)
+
+	result := db.Last(out, where...)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+// Lock retrieves the first record, ordered by primary key, that matches the given conditions, stores it
+// in 'out' and locks its row until the end of the transaction, see Transaction. Concurrent transactions
+// locking the same row wait for it to be released.
+// For example:
+//
+//	ds.Transaction(func(tx database.Datastore) error {
+//		account := Account{}
+//		if err := tx.Lock(&account, 3); err != nil {
+//			return err
+//		}
+//		account.Balance -= 10
+//		return tx.Save(&account)
+//	})
+//
+// This will withdraw 10 from account 3 without losing concurrent withdrawals.
+func (g *GormDatastore) Lock(out interface{}, where ...interface{}) (err error) {
+	db, span := g.startSpan("Lock")
+	defer endSpan(span, &err)
+
+	result := db.Clauses(clause.Locking{Strength: "UPDATE"}).First(out, where...)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+// Count counts the records of the type of 'model' that match the given conditions.
+// For example:
+//
+//	var count int64
+//	ds.Count(&User{}, &count, "name = ?", "mick")
+func (g *GormDatastore) Count(model interface{}, count *int64, where ...interface{}) (err error) {
+	db, span := g.startSpan("Count")
+	defer endSpan(span, &err)
+
+	tx := db.Model(model)
+	if len(where) > 0 {
+		tx = tx.Where(where[0], where[1:]...)
+	}
+
+	result := tx.Count(count)
 	if result.Error != nil {
 		return result.Error
 	}
@@ -78,8 +228,11 @@ func (g *GormDatastore) First(out interface{}, where ...interface{}) error {
 //	ds.Create(&user)
 //
 // This will create a new user with the name 'mick'.
-func (g *GormDatastore) Create(value interface{}) error {
-	result := g.db.Create(value)
+func (g *GormDatastore) Create(value interface{}) (err error) {
+	db, span := g.startSpan("Create")
+	defer endSpan(span, &err)
+
+	result := db.Create(value)
 	if result.Error != nil {
 		return result.Error
 	}
@@ -95,8 +248,11 @@ func (g *GormDatastore) Create(value interface{}) error {
 //	ds.Save(&user)
 //
 // This will find the first user with the name 'mick', change its name to 'not mick', and save the change.
-func (g *GormDatastore) Save(value interface{}) error {
-	result := g.db.Save(value)
+func (g *GormDatastore) Save(value interface{}) (err error) {
+	db, span := g.startSpan("Save")
+	defer endSpan(span, &err)
+
+	result := db.Save(value)
 	if result.Error != nil {
 		return result.Error
 	}
@@ -118,22 +274,49 @@ func (g *GormDatastore) Save(value interface{}) error {
 // Using a string:
 //
 //	ds.Delete(&User{}, "name = ?", "mick")
-func (g *GormDatastore) Delete(value interface{}, where ...interface{}) error {
-	result := g.db.Delete(value, where...)
+func (g *GormDatastore) Delete(value interface{}, where ...interface{}) (err error) {
+	db, span := g.startSpan("Delete")
+	defer endSpan(span, &err)
+
+	result := db.Delete(value, where...)
 	if result.Error != nil {
 		return result.Error
 	}
 	return nil
 }
 
+// Transaction runs 'fn' in a database transaction. The transaction is committed if 'fn' returns nil and
+// rolled back otherwise.
+// For example:
+//
+//	ds.Transaction(func(tx database.Datastore) error {
+//		if err := tx.Create(&user); err != nil {
+//			return err
+//		}
+//		return tx.Create(&profile)
+//	})
+//
+// This will create both the user and profile, or neither.
+func (g *GormDatastore) Transaction(fn func(tx database.Datastore) error) (err error) {
+	db, span := g.startSpan("Transaction")
+	defer endSpan(span, &err)
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		return fn(&GormDatastore{db: tx})
+	})
+}
+
 // HealthCheck checks the health of the database connection.
-func (g *GormDatastore) HealthCheck() error {
-	sqlDB, err := g.db.DB()
+func (g *GormDatastore) HealthCheck() (err error) {
+	db, span := g.startSpan("HealthCheck")
+	defer endSpan(span, &err)
+
+	sqlDB, err := db.DB()
 	if err != nil {
 		return err
 	}
 
-	err = sqlDB.Ping()
+	err = sqlDB.PingContext(db.Statement.Context)
 	if err != nil {
 		return err
 	}
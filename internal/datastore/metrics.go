@@ -0,0 +1,64 @@
+package datastore
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/mick-io/duplo_go_cloud/internal/metrics"
+)
+
+// metricsStartKey is the key of the start time of a statement in its
+// instance settings.
+const metricsStartKey = "metrics:start"
+
+// registerMetrics registers the callbacks observing the duration of every
+// statement in metrics.DatastoreDuration. Registering them twice is
+// harmless.
+func registerMetrics(db *gorm.DB) {
+	if db.Callback().Query().Get("metrics:start") != nil {
+		return
+	}
+
+	_ = db.Callback().Query().Before("*").Register("metrics:start", startStatement)
+	_ = db.Callback().Query().After("*").Register("metrics:observe", observeStatement("query"))
+	_ = db.Callback().Row().Before("*").Register("metrics:start", startStatement)
+	_ = db.Callback().Row().After("*").Register("metrics:observe", observeStatement("row"))
+	_ = db.Callback().Raw().Before("*").Register("metrics:start", startStatement)
+	_ = db.Callback().Raw().After("*").Register("metrics:observe", observeStatement("raw"))
+	_ = db.Callback().Create().Before("*").Register("metrics:start", startStatement)
+	_ = db.Callback().Create().After("*").Register("metrics:observe", observeStatement("create"))
+	_ = db.Callback().Update().Before("*").Register("metrics:start", startStatement)
+	_ = db.Callback().Update().After("*").Register("metrics:observe", observeStatement("update"))
+	_ = db.Callback().Delete().Before("*").Register("metrics:start", startStatement)
+	_ = db.Callback().Delete().After("*").Register("metrics:observe", observeStatement("delete"))
+}
+
+func startStatement(db *gorm.DB) {
+	db.InstanceSet(metricsStartKey, time.Now())
+}
+
+func observeStatement(operation string) func(db *gorm.DB) {
+	return func(db *gorm.DB) {
+		value, ok := db.InstanceGet(metricsStartKey)
+		if !ok {
+			return
+		}
+		start, _ := value.(time.Time)
+
+		table := db.Statement.Table
+		if table == "" {
+			table = "none"
+		}
+		outcome := "ok"
+		switch {
+		case errors.Is(db.Error, gorm.ErrRecordNotFound):
+			outcome = "not_found"
+		case db.Error != nil:
+			outcome = "error"
+		}
+
+		metrics.DatastoreDuration.WithLabelValues(operation, table, outcome).Observe(time.Since(start).Seconds())
+	}
+}
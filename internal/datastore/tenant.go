@@ -0,0 +1,118 @@
+package datastore
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+)
+
+// tenantTables are the tables whose rows hold the ID of the tenant they
+// belong to.
+var tenantTables = map[string]bool{
+	"location_records": true,
+	"job_records":      true,
+	"api_key_records":  true,
+}
+
+// ownedTables maps the tables whose rows belong to a tenant through a parent
+// row to the column referencing the parent and the query selecting the IDs
+// of the parents of a tenant.
+var ownedTables = map[string]struct {
+	column  string
+	parents string
+}{
+	"forecast_records":      {"location_record_id", tenantLocations},
+	"observation_records":   {"location_record_id", tenantLocations},
+	"verification_records":  {"location_record_id", tenantLocations},
+	"history_records":       {"location_record_id", tenantLocations},
+	"history_units_records": {"location_record_id", tenantLocations},
+	"hourly_records":        {"forecast_record_id", tenantForecasts},
+	"hourly_units_records":  {"forecast_record_id", tenantForecasts},
+	"job_task_records":      {"job_record_id", "SELECT id FROM job_records WHERE tenant_id = ?"},
+}
+
+const (
+	tenantLocations = "SELECT id FROM location_records WHERE tenant_id = ?"
+	tenantForecasts = "SELECT id FROM forecast_records WHERE location_record_id IN (" + tenantLocations + ")"
+)
+
+// registerTenantScopes registers the callbacks scoping the statements run
+// with a context carrying a tenant. Registering them twice is harmless.
+func registerTenantScopes(db *gorm.DB) {
+	if db.Callback().Query().Get("tenant:scope") != nil {
+		return
+	}
+
+	_ = db.Callback().Query().Before("gorm:query").Register("tenant:scope", scopeTenant)
+	_ = db.Callback().Row().Before("gorm:row").Register("tenant:scope", scopeTenant)
+	_ = db.Callback().Update().Before("gorm:update").Register("tenant:scope", scopeTenantUpdate)
+	_ = db.Callback().Delete().Before("gorm:delete").Register("tenant:scope", scopeTenant)
+	_ = db.Callback().Create().Before("gorm:create").Register("tenant:assign", assignTenant)
+}
+
+// scopeTenant restricts a query, update or delete to the rows of the tenant.
+func scopeTenant(db *gorm.DB) {
+	stmt := db.Statement
+	tenantID, ok := database.TenantFrom(stmt.Context)
+	if !ok || stmt.Schema == nil {
+		return
+	}
+
+	table := stmt.Schema.Table
+	switch {
+	case table == "tenant_records":
+		stmt.AddClause(clause.Where{Exprs: []clause.Expression{
+			clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: "id"}, Value: tenantID},
+		}})
+	case tenantTables[table]:
+		stmt.AddClause(clause.Where{Exprs: []clause.Expression{
+			clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: "tenant_id"}, Value: tenantID},
+		}})
+	default:
+		owned, ok := ownedTables[table]
+		if !ok {
+			return
+		}
+		stmt.AddClause(clause.Where{Exprs: []clause.Expression{
+			clause.Expr{
+				SQL:  "? IN (" + owned.parents + ")",
+				Vars: []interface{}{clause.Column{Table: clause.CurrentTable, Name: owned.column}, tenantID},
+			},
+		}})
+	}
+}
+
+// scopeTenantUpdate restricts an update to the rows of the tenant and keeps
+// them from being moved to another tenant.
+func scopeTenantUpdate(db *gorm.DB) {
+	scopeTenant(db)
+	assignTenantID(db)
+}
+
+// assignTenant assigns created rows of tenant tables to the tenant. Upserts
+// are turned into plain inserts that ignore conflicts, so that saving a row
+// of another tenant cannot overwrite it.
+func assignTenant(db *gorm.DB) {
+	stmt := db.Statement
+	if _, ok := database.TenantFrom(stmt.Context); !ok {
+		return
+	}
+
+	assignTenantID(db)
+	if _, ok := stmt.Clauses["ON CONFLICT"]; ok {
+		stmt.AddClause(clause.OnConflict{DoNothing: true})
+	}
+}
+
+// assignTenantID sets the TenantID of the rows written to tenant tables.
+func assignTenantID(db *gorm.DB) {
+	stmt := db.Statement
+	tenantID, ok := database.TenantFrom(stmt.Context)
+	if !ok || stmt.Schema == nil || !tenantTables[stmt.Schema.Table] {
+		return
+	}
+	if stmt.Schema.LookUpField("TenantID") != nil && stmt.ReflectValue.IsValid() {
+		stmt.SetColumn("TenantID", tenantID, true)
+	}
+}
@@ -0,0 +1,210 @@
+package datastore_test
+
+import (
+	"errors"
+	"testing"
+
+	"gorm.io/gorm"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/database/dbtest"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// tenants holds a datastore scoped to each of two tenants, each owning a
+// location with a forecast, and the unscoped datastore.
+type tenants struct {
+	db       database.Datastore
+	a, b     database.Datastore
+	aID, bID uint
+	locA     models.LocationRecord
+	locB     models.LocationRecord
+	forecast models.ForecastRecord
+}
+
+func newTenants(t *testing.T) *tenants {
+	t.Helper()
+
+	db := dbtest.NewDatastore(t)
+	ctxA, tenantA := dbtest.CreateTenant(t, db, "a")
+	ctxB, tenantB := dbtest.CreateTenant(t, db, "b")
+	ts := &tenants{
+		db:  db,
+		a:   db.WithContext(ctxA),
+		b:   db.WithContext(ctxB),
+		aID: tenantA.ID,
+		bID: tenantB.ID,
+	}
+
+	ts.locA = models.LocationRecord{Name: "a", Latitude: 1, Longitude: 2}
+	if err := ts.a.Create(&ts.locA); err != nil {
+		t.Fatalf("creating location: %v", err)
+	}
+	ts.locB = models.LocationRecord{Name: "b", Latitude: 1, Longitude: 2}
+	if err := ts.b.Create(&ts.locB); err != nil {
+		t.Fatalf("creating location: %v", err)
+	}
+	ts.forecast = models.ForecastRecord{LocationRecordID: ts.locA.ID, Timezone: "UTC"}
+	if err := ts.a.Create(&ts.forecast); err != nil {
+		t.Fatalf("creating forecast: %v", err)
+	}
+	return ts
+}
+
+// location reads a location bypassing the tenant scopes.
+func (ts *tenants) location(t *testing.T, id uint) models.LocationRecord {
+	t.Helper()
+
+	record := models.LocationRecord{}
+	if err := ts.db.First(&record, id); err != nil {
+		t.Fatalf("reading location %d: %v", id, err)
+	}
+	return record
+}
+
+func TestCreateAssignsTenant(t *testing.T) {
+	ts := newTenants(t)
+
+	if ts.locA.TenantID != ts.aID || ts.locB.TenantID != ts.bID {
+		t.Fatalf("tenant IDs = %d, %d, want %d, %d", ts.locA.TenantID, ts.locB.TenantID, ts.aID, ts.bID)
+	}
+
+	// Claiming another tenant on create is overridden
+	loc := models.LocationRecord{TenantID: ts.aID, Latitude: 3, Longitude: 4}
+	if err := ts.b.Create(&loc); err != nil {
+		t.Fatal(err)
+	}
+	if got := ts.location(t, loc.ID).TenantID; got != ts.bID {
+		t.Errorf("tenant ID = %d, want %d", got, ts.bID)
+	}
+}
+
+func TestFindIsScopedToTenant(t *testing.T) {
+	ts := newTenants(t)
+
+	locations := []models.LocationRecord{}
+	if err := ts.b.Find(&locations); err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 1 || locations[0].ID != ts.locB.ID {
+		t.Errorf("Find returned %+v, want only location %d", locations, ts.locB.ID)
+	}
+
+	// Filtering by the coordinates both tenants share
+	locations = []models.LocationRecord{}
+	if err := ts.b.Find(&locations, &models.LocationRecord{Latitude: 1, Longitude: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 1 || locations[0].ID != ts.locB.ID {
+		t.Errorf("Find by coordinates returned %+v, want only location %d", locations, ts.locB.ID)
+	}
+
+	record := models.LocationRecord{}
+	if err := ts.b.Find(&record, ts.locA.ID); err != nil {
+		t.Fatal(err)
+	}
+	if record.ID != 0 {
+		t.Errorf("Find by ID returned location %d of another tenant", record.ID)
+	}
+
+	if err := ts.b.First(&models.LocationRecord{}, ts.locA.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("First error = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+	if err := ts.a.First(&models.LocationRecord{}, ts.locA.ID); err != nil {
+		t.Errorf("First by owner: %v", err)
+	}
+
+	var count int64
+	if err := ts.b.Count(&models.LocationRecord{}, &count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Count = %d, want 1", count)
+	}
+}
+
+func TestFindOwnedRowsIsScopedToTenant(t *testing.T) {
+	ts := newTenants(t)
+
+	forecasts := []models.ForecastRecord{}
+	if err := ts.b.Find(&forecasts); err != nil {
+		t.Fatal(err)
+	}
+	if len(forecasts) != 0 {
+		t.Errorf("Find returned %d forecasts of another tenant", len(forecasts))
+	}
+	if err := ts.b.First(&models.ForecastRecord{}, ts.forecast.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("First error = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+
+	forecasts = []models.ForecastRecord{}
+	if err := ts.a.Find(&forecasts); err != nil {
+		t.Fatal(err)
+	}
+	if len(forecasts) != 1 {
+		t.Errorf("Find by owner returned %d forecasts, want 1", len(forecasts))
+	}
+}
+
+func TestSaveCannotOverwriteOtherTenant(t *testing.T) {
+	ts := newTenants(t)
+
+	// Save updates by primary key and, when no row was updated, falls back
+	// to an upsert; both must leave the row of the other tenant untouched.
+	stolen := ts.locA
+	stolen.Name = "stolen"
+	if err := ts.b.Save(&stolen); err != nil {
+		t.Fatal(err)
+	}
+
+	got := ts.location(t, ts.locA.ID)
+	if got.Name != "a" || got.TenantID != ts.aID {
+		t.Errorf("location = %q of tenant %d, want %q of tenant %d", got.Name, got.TenantID, "a", ts.aID)
+	}
+
+	var count int64
+	if err := ts.db.Count(&models.LocationRecord{}, &count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("Count = %d, want 2", count)
+	}
+}
+
+func TestSaveKeepsTenant(t *testing.T) {
+	ts := newTenants(t)
+
+	moved := ts.locA
+	moved.Name = "renamed"
+	moved.TenantID = ts.bID
+	if err := ts.a.Save(&moved); err != nil {
+		t.Fatal(err)
+	}
+
+	got := ts.location(t, ts.locA.ID)
+	if got.Name != "renamed" || got.TenantID != ts.aID {
+		t.Errorf("location = %q of tenant %d, want %q of tenant %d", got.Name, got.TenantID, "renamed", ts.aID)
+	}
+}
+
+func TestDeleteIsScopedToTenant(t *testing.T) {
+	ts := newTenants(t)
+
+	if err := ts.b.Delete(&models.LocationRecord{}, ts.locA.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.b.Delete(&models.LocationRecord{}, "latitude = ? AND longitude = ?", 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.b.Delete(&models.ForecastRecord{}, ts.forecast.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.location(t, ts.locA.ID)
+	if err := ts.db.First(&models.ForecastRecord{}, ts.forecast.ID); err != nil {
+		t.Errorf("forecast of another tenant was deleted: %v", err)
+	}
+	if err := ts.db.First(&models.LocationRecord{}, ts.locB.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("First error = %v, want location of the tenant deleted", err)
+	}
+}
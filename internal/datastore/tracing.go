@@ -0,0 +1,32 @@
+package datastore
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+
+	"github.com/mick-io/duplo_go_cloud/internal/tracing"
+)
+
+// startSpan starts the span of the datastore method 'method' and returns the connection whose
+// statements run in it.
+func (g *GormDatastore) startSpan(method string) (*gorm.DB, trace.Span) {
+	ctx, span := tracing.Start(g.db.Statement.Context, "datastore."+method,
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.operation", method),
+	)
+	return g.db.WithContext(ctx), span
+}
+
+// endSpan ends a span started by startSpan. Records not found are expected by callers and are
+// not recorded as errors.
+func endSpan(span trace.Span, err *error) {
+	if errors.Is(*err, gorm.ErrRecordNotFound) {
+		span.SetAttributes(attribute.Bool("db.not_found", true))
+		span.End()
+		return
+	}
+	tracing.End(span, err)
+}
@@ -0,0 +1,109 @@
+package derived
+
+import "github.com/mick-io/duplo_go_cloud/internal/units"
+
+// Bases are the base temperatures of degree days, in degrees Celsius.
+type Bases struct {
+	Heating float64
+	Cooling float64
+}
+
+// Series is an hourly series in the units it is stored or rendered in.
+// Humidity and wind speed may be missing, in which case WindSpeedUnit is
+// empty and the metrics that need them are not computed.
+type Series struct {
+	Time               []string
+	Temperature2M      []float64
+	RelativeHumidity2M []float64
+	WindSpeed10M       []float64
+	TemperatureUnit    string
+	WindSpeedUnit      string
+}
+
+// Result holds the selected metrics of a series, in its temperature unit.
+// Metrics that were not selected or could not be computed are nil.
+type Result struct {
+	HeatIndex           []float64
+	WindChill           []float64
+	DewPoint            []float64
+	ApparentTemperature []float64
+	DegreeDays          []DegreeDay
+}
+
+// Compute computes the selected metrics of a series. The degree day bases
+// are in the temperature unit of the series.
+func Compute(series *Series, selected map[string]bool, heatingBase, coolingBase float64) (*Result, error) {
+	n := len(series.Time)
+	result := &Result{}
+
+	if selected[MetricDegreeDays] {
+		result.DegreeDays = DegreeDays(series.Time, series.Temperature2M, heatingBase, coolingBase)
+	}
+
+	hourly := selected[MetricHeatIndex] || selected[MetricWindChill] ||
+		selected[MetricDewPoint] || selected[MetricApparentTemperature]
+	if !hourly || series.WindSpeedUnit == "" {
+		return result, nil
+	}
+
+	if selected[MetricHeatIndex] {
+		result.HeatIndex = make([]float64, n)
+	}
+	if selected[MetricWindChill] {
+		result.WindChill = make([]float64, n)
+	}
+	if selected[MetricDewPoint] {
+		result.DewPoint = make([]float64, n)
+	}
+	if selected[MetricApparentTemperature] {
+		result.ApparentTemperature = make([]float64, n)
+	}
+
+	for i := 0; i < n; i++ {
+		tempC, err := toCelsius(series.Temperature2M[i], series.TemperatureUnit)
+		if err != nil {
+			return nil, err
+		}
+		wind, err := toMetersPerSecond(series.WindSpeed10M[i], series.WindSpeedUnit)
+		if err != nil {
+			return nil, err
+		}
+		humidity := series.RelativeHumidity2M[i]
+
+		if result.HeatIndex != nil {
+			result.HeatIndex[i] = fromCelsius(HeatIndex(tempC, humidity), series.TemperatureUnit)
+		}
+		if result.WindChill != nil {
+			result.WindChill[i] = fromCelsius(WindChill(tempC, wind), series.TemperatureUnit)
+		}
+		if result.DewPoint != nil {
+			result.DewPoint[i] = fromCelsius(DewPoint(tempC, humidity), series.TemperatureUnit)
+		}
+		if result.ApparentTemperature != nil {
+			result.ApparentTemperature[i] = fromCelsius(ApparentTemperature(tempC, humidity, wind), series.TemperatureUnit)
+		}
+	}
+
+	return result, nil
+}
+
+// ConvertBase converts a base temperature in degrees Celsius to 'unit'.
+func ConvertBase(c float64, unit string) float64 {
+	return fromCelsius(c, unit)
+}
+
+func toCelsius(value float64, unit string) (float64, error) {
+	return units.Convert(value, unit, units.Celsius)
+}
+
+func fromCelsius(c float64, unit string) float64 {
+	value, err := units.Convert(c, units.Celsius, unit)
+	if err != nil {
+		return c
+	}
+	return value
+}
+
+func toMetersPerSecond(value float64, unit string) (float64, error) {
+	return units.Convert(value, unit, units.MetersPerSecond)
+}
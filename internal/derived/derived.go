@@ -0,0 +1,188 @@
+// Package derived computes metrics derived from the stored hourly series:
+// heat index, wind chill, dew point, apparent temperature and heating and
+// cooling degree days. The formulas work in degrees Celsius and meters per
+// second; Compute converts from and to the units of the series.
+package derived
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Metric names accepted by Compute.
+const (
+	MetricHeatIndex           = "heat_index"
+	MetricWindChill           = "wind_chill"
+	MetricDewPoint            = "dew_point_2m"
+	MetricApparentTemperature = "apparent_temperature"
+	MetricDegreeDays          = "degree_days"
+)
+
+// Metrics lists every metric name in the order they are documented.
+var Metrics = []string{
+	MetricHeatIndex,
+	MetricWindChill,
+	MetricDewPoint,
+	MetricApparentTemperature,
+	MetricDegreeDays,
+}
+
+// ParseMetrics parses a comma-separated list of metric names. "all" selects
+// every metric.
+func ParseMetrics(param string) (map[string]bool, error) {
+	selected := map[string]bool{}
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		if name == "all" {
+			for _, metric := range Metrics {
+				selected[metric] = true
+			}
+			continue
+		}
+
+		known := false
+		for _, metric := range Metrics {
+			if name == metric {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown metric: %q", name)
+		}
+		selected[name] = true
+	}
+	return selected, nil
+}
+
+// CelsiusToFahrenheit converts a temperature in degrees Celsius to degrees
+// Fahrenheit.
+func CelsiusToFahrenheit(c float64) float64 {
+	return c*9/5 + 32
+}
+
+// FahrenheitToCelsius converts a temperature in degrees Fahrenheit to
+// degrees Celsius.
+func FahrenheitToCelsius(f float64) float64 {
+	return (f - 32) * 5 / 9
+}
+
+// metersPerSecondToMPH is the number of miles per hour in a meter per second.
+const metersPerSecondToMPH = 3600 / 1609.344
+
+// HeatIndex returns the heat index, in degrees Celsius, of a temperature in
+// degrees Celsius and a relative humidity in percent, following the US
+// National Weather Service algorithm: Steadman's simple formula, then the
+// Rothfusz regression with its adjustments for high temperatures.
+func HeatIndex(tempC, humidity float64) float64 {
+	t := CelsiusToFahrenheit(tempC)
+	rh := humidity
+
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + rh*0.094)
+	if (hi+t)/2 < 80 {
+		return FahrenheitToCelsius(hi)
+	}
+
+	hi = -42.379 + 2.04901523*t + 10.14333127*rh -
+		0.22475541*t*rh - 0.00683783*t*t - 0.05481717*rh*rh +
+		0.00122874*t*t*rh + 0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+
+	switch {
+	case rh < 13 && t >= 80 && t <= 112:
+		hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+	case rh > 85 && t >= 80 && t <= 87:
+		hi += (rh - 85) / 10 * (87 - t) / 5
+	}
+	return FahrenheitToCelsius(hi)
+}
+
+// WindChill returns the wind chill, in degrees Celsius, of a temperature in
+// degrees Celsius and a wind speed in meters per second at 10 meters, using
+// the 2001 North American formula. The temperature is returned unchanged
+// outside the formula's domain: above 10°C (50°F) or below 3 mph of wind.
+func WindChill(tempC, windSpeed float64) float64 {
+	t := CelsiusToFahrenheit(tempC)
+	v := windSpeed * metersPerSecondToMPH
+	if t > 50 || v < 3 {
+		return tempC
+	}
+
+	vp := math.Pow(v, 0.16)
+	return FahrenheitToCelsius(35.74 + 0.6215*t - 35.75*vp + 0.4275*t*vp)
+}
+
+// DewPoint returns the dew point, in degrees Celsius, of a temperature in
+// degrees Celsius and a relative humidity in percent, using the Magnus
+// formula with the Alduchov and Eskridge coefficients. The humidity is
+// clamped to [1, 100].
+func DewPoint(tempC, humidity float64) float64 {
+	const a, b = 17.625, 243.04
+	rh := math.Max(1, math.Min(100, humidity))
+	gamma := math.Log(rh/100) + a*tempC/(b+tempC)
+	return b * gamma / (a - gamma)
+}
+
+// ApparentTemperature returns the "feels like" temperature, in degrees
+// Celsius: the wind chill when it applies, the heat index from 80°F
+// (26.7°C), and the temperature otherwise.
+func ApparentTemperature(tempC, humidity, windSpeed float64) float64 {
+	t := CelsiusToFahrenheit(tempC)
+	switch {
+	case t <= 50 && windSpeed*metersPerSecondToMPH >= 3:
+		return WindChill(tempC, windSpeed)
+	case t >= 80:
+		return HeatIndex(tempC, humidity)
+	}
+	return tempC
+}
+
+// DegreeDay holds the heating and cooling degree days of a day. The mean
+// temperature is the average of the day's minimum and maximum.
+type DegreeDay struct {
+	Date string
+	Mean float64
+	HDD  float64
+	CDD  float64
+}
+
+// DegreeDays computes the degree days of every complete day (24 hours) of an
+// hourly series. Times are local ISO 8601 times; temperatures and bases share
+// the same unit, which is also the unit of the result.
+func DegreeDays(times []string, temps []float64, heatingBase, coolingBase float64) []DegreeDay {
+	type extremes struct {
+		min, max float64
+		hours    int
+	}
+
+	days := map[string]*extremes{}
+	var order []string
+	for i, t := range times {
+		date, _, _ := strings.Cut(t, "T")
+		day, ok := days[date]
+		if !ok {
+			day = &extremes{min: temps[i], max: temps[i]}
+			days[date] = day
+			order = append(order, date)
+		}
+		day.min = math.Min(day.min, temps[i])
+		day.max = math.Max(day.max, temps[i])
+		day.hours++
+	}
+
+	result := []DegreeDay{}
+	for _, date := range order {
+		day := days[date]
+		if day.hours < 24 {
+			continue
+		}
+		mean := (day.min + day.max) / 2
+		result = append(result, DegreeDay{
+			Date: date,
+			Mean: mean,
+			HDD:  math.Max(0, heatingBase-mean),
+			CDD:  math.Max(0, mean-coolingBase),
+		})
+	}
+	return result
+}
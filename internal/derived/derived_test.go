@@ -0,0 +1,209 @@
+package derived_test
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/mick-io/duplo_go_cloud/internal/derived"
+)
+
+// mphToMetersPerSecond is the number of meters per second in a mile per hour.
+const mphToMetersPerSecond = 1609.344 / 3600
+
+// rothfusz is the NWS heat index regression, in degrees Fahrenheit, without
+// its adjustments.
+func rothfusz(t, rh float64) float64 {
+	return -42.379 + 2.04901523*t + 10.14333127*rh -
+		0.22475541*t*rh - 0.00683783*t*t - 0.05481717*rh*rh +
+		0.00122874*t*t*rh + 0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+}
+
+func TestHeatIndex(t *testing.T) {
+	// Values of the NWS heat index chart, rounded to the degree
+	tests := []struct {
+		tempF, humidity, want float64
+	}{
+		{80, 40, 80},
+		{84, 90, 98},
+		{86, 90, 105},
+		{90, 50, 95},
+		{90, 70, 106},
+		{100, 40, 109},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v°F %v%%", tt.tempF, tt.humidity), func(t *testing.T) {
+			got := derived.CelsiusToFahrenheit(derived.HeatIndex(derived.FahrenheitToCelsius(tt.tempF), tt.humidity))
+			if math.Abs(got-tt.want) > 0.5 {
+				t.Errorf("HeatIndex = %.2f°F, want %v°F", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeatIndexSimpleFormula(t *testing.T) {
+	// Steadman's formula is used while its average with the temperature is
+	// below 80°F
+	tempF, humidity := 70.0, 50.0
+	want := 0.5 * (tempF + 61 + (tempF-68)*1.2 + humidity*0.094)
+
+	got := derived.CelsiusToFahrenheit(derived.HeatIndex(derived.FahrenheitToCelsius(tempF), humidity))
+	if math.Abs(got-want) > 1e-9 {
+		t.Errorf("HeatIndex = %v°F, want %v°F", got, want)
+	}
+}
+
+func TestHeatIndexAdjustments(t *testing.T) {
+	// Adjustments of the NWS algorithm to the Rothfusz regression
+	tests := []struct {
+		name            string
+		tempF, humidity float64
+		adjustment      float64
+	}{
+		{"dry, hot", 100, 10, -(13 - 10) / 4.0 * math.Sqrt((17-5)/17.0)},
+		{"dry, mild", 82, 5, -(13 - 5) / 4.0 * math.Sqrt((17-13)/17.0)},
+		{"dry, upper bound", 112, 12, -(13 - 12) / 4.0 * math.Sqrt((17-17)/17.0)},
+		{"dry, above range", 113, 10, 0},
+		{"dry, at 13%", 100, 13, 0},
+		{"humid", 82, 100, (100 - 85) / 10.0 * (87 - 82) / 5.0},
+		{"humid, lower bound", 80, 90, (90 - 85) / 10.0 * (87 - 80) / 5.0},
+		{"humid, above range", 88, 90, 0},
+		{"humid, at 85%", 84, 85, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := rothfusz(tt.tempF, tt.humidity) + tt.adjustment
+			got := derived.CelsiusToFahrenheit(derived.HeatIndex(derived.FahrenheitToCelsius(tt.tempF), tt.humidity))
+			if math.Abs(got-want) > 1e-9 {
+				t.Errorf("HeatIndex = %v°F, want %v°F", got, want)
+			}
+		})
+	}
+}
+
+func TestWindChill(t *testing.T) {
+	// Values of the NWS wind chill chart, rounded to the degree, and the
+	// cutoffs of the formula
+	tests := []struct {
+		tempF, windMPH, want float64
+	}{
+		{40, 5, 36},
+		{30, 10, 21},
+		{0, 15, -19},
+		{-10, 20, -35},
+		{5, 25, -17},
+		{50, 3, 49.68},
+		{51, 20, 51},
+		{20, 2.9, 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v°F %v mph", tt.tempF, tt.windMPH), func(t *testing.T) {
+			got := derived.CelsiusToFahrenheit(derived.WindChill(derived.FahrenheitToCelsius(tt.tempF), tt.windMPH*mphToMetersPerSecond))
+			if math.Abs(got-tt.want) > 0.5 {
+				t.Errorf("WindChill = %.2f°F, want %v°F", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindChillCutoffsReturnTemperature(t *testing.T) {
+	tests := []struct {
+		tempC, windSpeed float64
+	}{
+		{10.5, 10},
+		{-5, 3 * mphToMetersPerSecond * 0.99},
+		{-5, 0},
+	}
+
+	for _, tt := range tests {
+		if got := derived.WindChill(tt.tempC, tt.windSpeed); got != tt.tempC {
+			t.Errorf("WindChill(%v, %v) = %v, want the temperature", tt.tempC, tt.windSpeed, got)
+		}
+	}
+}
+
+func TestDewPoint(t *testing.T) {
+	// Values of the NWS dew point calculator, to a tenth of a degree
+	tests := []struct {
+		tempC, humidity, want float64
+	}{
+		{30, 50, 18.4},
+		{25, 60, 16.7},
+		{20, 100, 20},
+		{0, 50, -9.2},
+		{-10, 80, -12.8},
+		// Humidity is clamped to [1, 100]
+		{10, 0, -44.1},
+		{20, 120, 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v°C %v%%", tt.tempC, tt.humidity), func(t *testing.T) {
+			if got := derived.DewPoint(tt.tempC, tt.humidity); math.Abs(got-tt.want) > 0.05 {
+				t.Errorf("DewPoint = %.2f°C, want %v°C", got, tt.want)
+			}
+		})
+	}
+}
+
+// hours returns the hourly times of 'date' from 'from' to 'to', excluded.
+func hours(date string, from, to int) []string {
+	times := []string{}
+	for hour := from; hour < to; hour++ {
+		times = append(times, fmt.Sprintf("%sT%02d:00", date, hour))
+	}
+	return times
+}
+
+func TestDegreeDays(t *testing.T) {
+	tests := []struct {
+		name  string
+		times []string
+		temps func(i int) float64
+		want  []derived.DegreeDay
+	}{
+		{
+			// A cold day: max 50°F, min 30°F, mean 40°F, 25 HDD
+			name:  "heating",
+			times: hours("2024-01-01", 0, 24),
+			temps: func(i int) float64 { return 30 + float64(i%21) },
+			want:  []derived.DegreeDay{{Date: "2024-01-01", Mean: 40, HDD: 25, CDD: 0}},
+		},
+		{
+			// A hot day: max 95°F, min 75°F, mean 85°F, 20 CDD
+			name:  "cooling",
+			times: hours("2024-07-01", 0, 24),
+			temps: func(i int) float64 { return 75 + float64(i%21) },
+			want:  []derived.DegreeDay{{Date: "2024-07-01", Mean: 85, HDD: 0, CDD: 20}},
+		},
+		{
+			name:  "partial days are skipped",
+			times: append(append(hours("2024-01-01", 1, 24), hours("2024-01-02", 0, 24)...), hours("2024-01-03", 0, 12)...),
+			temps: func(i int) float64 { return 65 },
+			want:  []derived.DegreeDay{{Date: "2024-01-02", Mean: 65, HDD: 0, CDD: 0}},
+		},
+		{
+			name:  "no complete day",
+			times: hours("2024-01-01", 0, 23),
+			temps: func(i int) float64 { return 40 },
+			want:  []derived.DegreeDay{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			temps := make([]float64, len(tt.times))
+			for i := range temps {
+				temps[i] = tt.temps(i)
+			}
+
+			got := derived.DegreeDays(tt.times, temps, 65, 65)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("DegreeDays = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package enrichment
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mick-io/duplo_go_cloud/internal/api"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// Step enriches a location record in place.
+type Step interface {
+	Name() string
+	Enrich(loc *models.LocationRecord) error
+}
+
+// Pipeline runs a sequence of enrichment steps against a location record.
+type Pipeline struct {
+	steps []Step
+}
+
+// NewPipeline creates a new Pipeline that runs the given steps in order.
+func NewPipeline(steps ...Step) *Pipeline {
+	return &Pipeline{steps: steps}
+}
+
+// Run applies every step to the location. A failing step does not prevent
+// the remaining steps from running; all step errors are joined and returned.
+// EnrichedAt is only updated when every step succeeds.
+func (p *Pipeline) Run(loc *models.LocationRecord) error {
+	var errs []error
+	for _, step := range p.steps {
+		if err := step.Enrich(loc); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", step.Name(), err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	now := time.Now()
+	loc.EnrichedAt = &now
+	return nil
+}
+
+// ReverseGeocodeStep fills in the place name, country and country code of a
+// location from its coordinates. Names that are already set, e.g. from a
+// forward geocoding lookup, are preserved.
+type ReverseGeocodeStep struct {
+	Client api.ReverseGeocodingAPIClient
+}
+
+func (s *ReverseGeocodeStep) Name() string {
+	return "reverse geocode"
+}
+
+func (s *ReverseGeocodeStep) Enrich(loc *models.LocationRecord) error {
+	result := models.ReverseGeocoding{}
+	opts := api.ReverseGeocodeOptions{
+		Latitude:  strconv.FormatFloat(loc.Latitude, 'f', 6, 64),
+		Longitude: strconv.FormatFloat(loc.Longitude, 'f', 6, 64),
+	}
+	if err := s.Client.ReverseGeocode(opts, &result); err != nil {
+		return err
+	}
+
+	if loc.Name == "" {
+		loc.Name = result.PlaceName()
+	}
+	if loc.Country == "" {
+		loc.Country = result.Address.Country
+	}
+	if loc.AdminRegion == "" {
+		loc.AdminRegion = result.Address.State
+	}
+	if result.Address.CountryCode != "" {
+		loc.CountryCode = strings.ToUpper(result.Address.CountryCode)
+	}
+	return nil
+}
+
+// TimezoneStep sets the IANA timezone of a location from its coordinates.
+type TimezoneStep struct {
+	Client api.TimezoneAPIClient
+}
+
+func (s *TimezoneStep) Name() string {
+	return "timezone"
+}
+
+func (s *TimezoneStep) Enrich(loc *models.LocationRecord) error {
+	result := models.Timezone{}
+	opts := api.ForecastOptions{
+		Latitude:  strconv.FormatFloat(loc.Latitude, 'f', 6, 64),
+		Longitude: strconv.FormatFloat(loc.Longitude, 'f', 6, 64),
+	}
+	if err := s.Client.GetTimezone(opts, &result); err != nil {
+		return err
+	}
+	if result.Timezone == "" {
+		return errors.New("no timezone returned")
+	}
+
+	loc.Timezone = result.Timezone
+	return nil
+}
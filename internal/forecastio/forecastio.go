@@ -0,0 +1,215 @@
+// Package forecastio writes stored forecasts as flat rows, one row per
+// location, valid time and variable, in CSV, newline-delimited JSON or
+// Parquet.
+package forecastio
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+type Format string
+
+const (
+	FormatJSON    Format = "json"
+	FormatCSV     Format = "csv"
+	FormatNDJSON  Format = "ndjson"
+	FormatParquet Format = "parquet"
+	FormatGeoJSON Format = "geojson"
+)
+
+var csvHeader = []string{"location_id", "lat", "lon", "valid_time", "variable", "value", "unit"}
+
+var mediaTypes = map[string]Format{
+	"application/json":               FormatJSON,
+	"text/csv":                       FormatCSV,
+	"application/x-ndjson":           FormatNDJSON,
+	"application/vnd.apache.parquet": FormatParquet,
+	"application/x-parquet":          FormatParquet,
+	"application/geo+json":           FormatGeoJSON,
+}
+
+// ParseFormat parses a format name as used by the format query parameter.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case FormatJSON, FormatCSV, FormatNDJSON, FormatParquet, FormatGeoJSON:
+		return f, nil
+	}
+	return "", fmt.Errorf("unsupported format: %q", s)
+}
+
+// Negotiate picks a format from an Accept header. It returns FormatJSON when
+// none of the accepted media types are supported.
+func Negotiate(accept string) Format {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if format, ok := mediaTypes[mediaType]; ok {
+			return format
+		}
+	}
+	return FormatJSON
+}
+
+// ContentType returns the media type used when writing the format.
+func (f Format) ContentType() string {
+	switch f {
+	case FormatCSV:
+		return "text/csv"
+	case FormatNDJSON:
+		return "application/x-ndjson"
+	case FormatParquet:
+		return "application/vnd.apache.parquet"
+	case FormatGeoJSON:
+		return "application/geo+json"
+	}
+	return "application/json"
+}
+
+// Writer writes forecast rows. Rows may be buffered until Flush or Close is
+// called.
+type Writer interface {
+	Write(rows []models.ForecastRow) error
+	Flush() error
+	Close() error
+}
+
+// NewWriter creates a Writer for the given flat format. FormatJSON and
+// FormatGeoJSON are nested formats and are not supported.
+func NewWriter(format Format, w io.Writer) (Writer, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVWriter(w)
+	case FormatNDJSON:
+		return &ndjsonWriter{enc: json.NewEncoder(w)}, nil
+	case FormatParquet:
+		return &parquetWriter{w: parquet.NewGenericWriter[models.ForecastRow](w)}, nil
+	}
+	return nil, fmt.Errorf("unsupported format: %q", format)
+}
+
+// Rows flattens a stored forecast snapshot into rows.
+func Rows(loc *models.LocationRecord, forecast *models.ForecastRecord, units *models.HourlyUnitsRecord, hourly []models.HourlyRecord) ([]models.ForecastRow, error) {
+	rows := make([]models.ForecastRow, 0, 5*len(hourly))
+	for _, record := range hourly {
+		validTime, err := models.ParseHourlyTime(record.Time, forecast.UTCOffsetSeconds)
+		if err != nil {
+			return nil, err
+		}
+
+		row := models.ForecastRow{
+			LocationID: loc.ID,
+			Latitude:   loc.Latitude,
+			Longitude:  loc.Longitude,
+			ValidTime:  validTime,
+		}
+		row.Variable, row.Value, row.Unit = "temperature_2m", record.Temperature2M, units.Temperature2MUnit
+		rows = append(rows, row)
+		row.Variable, row.Value, row.Unit = "precipitation", record.Precipitation, units.PrecipitationUnit
+		rows = append(rows, row)
+		// Snapshots stored before humidity and wind were fetched have no
+		// units for them
+		if units.RelativeHumidity2MUnit != "" {
+			row.Variable, row.Value, row.Unit = "relative_humidity_2m", record.RelativeHumidity2M, units.RelativeHumidity2MUnit
+			rows = append(rows, row)
+			row.Variable, row.Value, row.Unit = "wind_speed_10m", record.WindSpeed10M, units.WindSpeed10MUnit
+			rows = append(rows, row)
+		}
+		if units.SurfacePressureUnit != "" {
+			row.Variable, row.Value, row.Unit = "surface_pressure", record.SurfacePressure, units.SurfacePressureUnit
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(w io.Writer) (*csvWriter, error) {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return nil, err
+	}
+	return &csvWriter{w: writer}, nil
+}
+
+func (c *csvWriter) Write(rows []models.ForecastRow) error {
+	for _, row := range rows {
+		err := c.w.Write([]string{
+			strconv.FormatUint(uint64(row.LocationID), 10),
+			strconv.FormatFloat(row.Latitude, 'f', -1, 64),
+			strconv.FormatFloat(row.Longitude, 'f', -1, 64),
+			row.ValidTime.Format(time.RFC3339),
+			row.Variable,
+			strconv.FormatFloat(row.Value, 'f', -1, 64),
+			row.Unit,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) Close() error {
+	return c.Flush()
+}
+
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func (n *ndjsonWriter) Write(rows []models.ForecastRow) error {
+	for _, row := range rows {
+		if err := n.enc.Encode(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *ndjsonWriter) Flush() error {
+	return nil
+}
+
+func (n *ndjsonWriter) Close() error {
+	return nil
+}
+
+// parquetWriter writes one row group per Flush, so memory use is bounded by
+// the rows written between flushes.
+type parquetWriter struct {
+	w *parquet.GenericWriter[models.ForecastRow]
+}
+
+func (p *parquetWriter) Write(rows []models.ForecastRow) error {
+	_, err := p.w.Write(rows)
+	return err
+}
+
+func (p *parquetWriter) Flush() error {
+	return p.w.Flush()
+}
+
+func (p *parquetWriter) Close() error {
+	return p.w.Close()
+}
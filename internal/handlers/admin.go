@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/enrichment"
+	"github.com/mick-io/duplo_go_cloud/internal/jobs"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+func EnrichLocationByID(db database.Datastore, enricher *enrichment.Pipeline) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		idParam := c.Param("id")
+		id, err := strconv.Atoi(idParam)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid id parameter: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		var record models.LocationRecord
+		if err := db.Find(&record, id); err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+		if record.ID == 0 {
+			msg := fmt.Sprintf("Location not found w/ID: %v", id)
+			return echo.NewHTTPError(http.StatusNotFound, msg)
+		}
+
+		resp, err := enrichLocation(db, enricher, &record)
+		if err != nil {
+			msg := fmt.Sprintf("Error storing location enrichment: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+// EnrichLocations submits a job enriching every location of the tenant.
+// Locations are enriched one at a time, within the rate limit of the
+// reverse geocoding provider, so the job is polled through /jobs/:id.
+func EnrichLocations(db database.Datastore, runner *jobs.Runner) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+		return submitLocationJob(c, db, runner, nil, jobs.TypeEnrichment, nil)
+	}
+}
+
+// enrichLocation runs the enrichment pipeline against the record and stores
+// whatever it resolved. Enrichment failures are reported in the response
+// rather than failing the request.
+func enrichLocation(db database.Datastore, enricher *enrichment.Pipeline, record *models.LocationRecord) (models.EnrichLocationResponseBody, error) {
+	resp := models.EnrichLocationResponseBody{}
+	if err := enricher.Run(record); err != nil {
+		resp.Error = err.Error()
+	}
+
+	if err := db.Save(record); err != nil {
+		return resp, err
+	}
+
+	resp.ID = record.ID
+	resp.Latitude = record.Latitude
+	resp.Longitude = record.Longitude
+	resp.Name = record.Name
+	resp.Country = record.Country
+	resp.AdminRegion = record.AdminRegion
+	resp.CountryCode = record.CountryCode
+	resp.Timezone = record.Timezone
+	resp.EnrichedAt = record.EnrichedAt
+	return resp, nil
+}
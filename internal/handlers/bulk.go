@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/jobs"
+	"github.com/mick-io/duplo_go_cloud/internal/locationio"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/tenancy"
+)
+
+const (
+	importStatusCreated   = "created"
+	importStatusDuplicate = "duplicate"
+	importStatusInvalid   = "invalid"
+	importStatusFailed    = "failed"
+)
+
+type coordinates struct {
+	latitude  float64
+	longitude float64
+}
+
+func ImportLocations(db database.Datastore, runner *jobs.Runner, enforcer *tenancy.Enforcer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		// Determining input format
+		var format locationio.Format
+		var err error
+		if param := c.QueryParam("format"); param != "" {
+			format, err = locationio.ParseFormat(param)
+		} else {
+			format, err = locationio.FormatFromContentType(c.Request().Header.Get(echo.HeaderContentType))
+		}
+		if err != nil {
+			msg := fmt.Sprintf("Invalid import format: %v", err)
+			return echo.NewHTTPError(http.StatusUnsupportedMediaType, msg)
+		}
+
+		fetchForecasts := c.QueryParam("fetch_forecasts") == "true"
+
+		rows, err := locationio.Decode(format, c.Request().Body)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to parse request body: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		// Validating and storing each row while the tenant is locked, so that
+		// concurrent imports cannot exceed the location quota or store the
+		// same coordinates twice
+		resp := models.ImportLocationsResponseBody{
+			Rows: make([]models.ImportLocationRowResult, len(rows)),
+		}
+		created := []models.LocationRecord{}
+		var quota *tenancy.Quota
+		err = enforcer.WithQuota(c.Request().Context(), db, func(tx database.Datastore, q *tenancy.Quota) error {
+			quota = q
+
+			// Loading existing locations for deduplication
+			existing := []models.LocationRecord{}
+			if err := tx.Find(&existing); err != nil {
+				return err
+			}
+			seen := make(map[coordinates]uint, len(existing))
+			for _, record := range existing {
+				seen[coordinates{record.Latitude, record.Longitude}] = record.ID
+			}
+
+			for i, row := range rows {
+				result := models.ImportLocationRowResult{
+					Row:       row.Index,
+					Latitude:  row.Location.Latitude,
+					Longitude: row.Location.Longitude,
+				}
+
+				body := row.Body()
+				if row.Err != nil {
+					result.Status = importStatusInvalid
+					result.Error = row.Err.Error()
+				} else if err := body.Validate(); err != nil {
+					result.Status = importStatusInvalid
+					result.Error = err.Error()
+				} else if id, ok := seen[coordinates{body.Latitude, body.Longitude}]; ok {
+					result.Status = importStatusDuplicate
+					result.ID = id
+				} else if err := quota.AllowLocations(1); err != nil {
+					result.Status = importStatusFailed
+					result.Error = err.Error()
+				} else {
+					// Storing the row in a nested transaction so that a failed
+					// row does not abort the others
+					record := row.Record()
+					err := tx.Transaction(func(tx database.Datastore) error {
+						return tx.Create(record)
+					})
+					if err != nil {
+						result.Status = importStatusFailed
+						result.Error = err.Error()
+					} else {
+						result.Status = importStatusCreated
+						result.ID = record.ID
+						quota.Locations++
+						seen[coordinates{record.Latitude, record.Longitude}] = record.ID
+						created = append(created, *record)
+					}
+				}
+
+				switch result.Status {
+				case importStatusCreated:
+					resp.Created++
+				case importStatusDuplicate:
+					resp.Duplicates++
+				case importStatusInvalid:
+					resp.Invalid++
+				case importStatusFailed:
+					resp.Failed++
+				}
+				resp.Rows[i] = result
+			}
+			return nil
+		})
+		if err != nil {
+			msg := fmt.Sprintf("Error importing locations: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+
+		// Fetching forecasts for new locations in a refresh job, if the
+		// refresh budget of the tenant allows for all of them. The job is
+		// drained on shutdown and resumed on the next start.
+		if fetchForecasts && len(created) > 0 {
+			if err := quota.AllowRefreshes(len(created)); err != nil {
+				resp.ForecastsError = err.Error()
+			} else {
+				job := &models.JobRecord{Type: jobs.TypeRefresh, TenantID: tenantOf(c)}
+				tasks := make([]models.JobTaskRecord, len(created))
+				for i, location := range created {
+					tasks[i] = models.JobTaskRecord{LocationRecordID: location.ID}
+				}
+				if err := runner.Submit(job, tasks); err != nil {
+					resp.ForecastsError = fmt.Sprintf("Error submitting job: %v", err)
+				} else {
+					resp.ForecastsPending = true
+					resp.ForecastsJobID = job.ID
+				}
+			}
+		}
+
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+func ExportLocations(db database.Datastore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		format := locationio.FormatJSON
+		if param := c.QueryParam("format"); param != "" {
+			var err error
+			if format, err = locationio.ParseFormat(param); err != nil {
+				msg := fmt.Sprintf("Invalid export format: %v", err)
+				return echo.NewHTTPError(http.StatusBadRequest, msg)
+			}
+		}
+
+		records := []models.LocationRecord{}
+		if err := db.Find(&records); err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, format.ContentType())
+		res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=locations.%s", format))
+		res.WriteHeader(http.StatusOK)
+		return locationio.Encode(format, res, records)
+	}
+}
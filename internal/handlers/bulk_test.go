@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mick-io/duplo_go_cloud/internal/jobs"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/tenancy"
+)
+
+func TestImportLocationsFetchesForecastsInJob(t *testing.T) {
+	f := newTenantFixture(t)
+
+	// The refresh outlives the request until the runner shuts down
+	started := make(chan struct{})
+	runner := jobs.NewRunner(f.db)
+	runner.Register(jobs.TypeRefresh, func(ctx context.Context, job *jobs.Progress) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	body := `[{"latitude": 10, "longitude": 20}, {"latitude": 1, "longitude": 2}, {"latitude": 30, "longitude": 40}]`
+	c, rec := newTenantContext(f.ctxB, http.MethodPost, "/locations/import?fetch_forecasts=true", body)
+	if err := ImportLocations(f.db, runner, tenancy.NewEnforcer(tenancy.Limits{}))(c); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := models.ImportLocationsResponseBody{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Created != 2 || resp.Duplicates != 1 || !resp.ForecastsPending || resp.ForecastsJobID == 0 {
+		t.Fatalf("response = %+v, want 2 created, 1 duplicate and a pending job", resp)
+	}
+
+	job := models.JobRecord{}
+	if err := f.db.WithContext(f.ctxB).First(&job, resp.ForecastsJobID); err != nil {
+		t.Fatalf("reading job of the tenant: %v", err)
+	}
+	if job.Type != jobs.TypeRefresh || job.Total != 2 {
+		t.Errorf("job = %s with %d tasks, want %s with 2", job.Type, job.Total, jobs.TypeRefresh)
+	}
+
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := runner.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown did not drain the refresh: %v", err)
+	}
+}
+
+func TestConcurrentImportsRespectLocationQuota(t *testing.T) {
+	f := newTenantFixture(t)
+	enforcer := tenancy.NewEnforcer(tenancy.Limits{MaxLocations: 4})
+	handler := ImportLocations(f.db, jobs.NewRunner(f.db), enforcer)
+
+	// Tenant b already stores one location, so three of the eight rows fit
+	var wg sync.WaitGroup
+	created := make([]int, 4)
+	for i := range created {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`[{"latitude": %d, "longitude": 0}, {"latitude": %d, "longitude": 1}]`, 10+i, 10+i)
+			c, rec := newTenantContext(f.ctxB, http.MethodPost, "/locations/import", body)
+			if err := handler(c); err != nil {
+				t.Error(err)
+				return
+			}
+			resp := models.ImportLocationsResponseBody{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Error(err)
+				return
+			}
+			created[i] = resp.Created
+		}(i)
+	}
+	wg.Wait()
+
+	var count int64
+	if err := f.db.WithContext(f.ctxB).Count(&models.LocationRecord{}, &count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 || created[0]+created[1]+created[2]+created[3] != 3 {
+		t.Errorf("tenant stores %d locations after creating %v, want 4 after creating 3", count, created)
+	}
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/derived"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// derivedOptions are the derived metrics requested through the 'derived'
+// query parameter, a comma-separated list of metric names or "all", and
+// the degree day bases optionally overridden through the 'heating_base' and
+// 'cooling_base' query parameters, in the unit of the rendered temperature.
+type derivedOptions struct {
+	metrics     map[string]bool
+	heatingBase *float64
+	coolingBase *float64
+}
+
+// parseDerivedOptions returns nil if no derived metric was requested.
+func parseDerivedOptions(c echo.Context) (*derivedOptions, error) {
+	param := c.QueryParam("derived")
+	if param == "" {
+		return nil, nil
+	}
+
+	metrics, err := derived.ParseMetrics(param)
+	if err != nil {
+		msg := fmt.Sprintf("Invalid derived parameter: %v", err)
+		return nil, echo.NewHTTPError(http.StatusBadRequest, msg)
+	}
+	opts := &derivedOptions{metrics: metrics}
+
+	for name, base := range map[string]**float64{"heating_base": &opts.heatingBase, "cooling_base": &opts.coolingBase} {
+		if value := c.QueryParam(name); value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				msg := fmt.Sprintf("Invalid %s parameter: %v", name, err)
+				return nil, echo.NewHTTPError(http.StatusBadRequest, msg)
+			}
+			*base = &parsed
+		}
+	}
+
+	return opts, nil
+}
+
+// addDerived computes the requested metrics from the hourly series of a
+// forecast response and attaches them to it.
+func addDerived(resp *models.ReadForecastResponseBody, opts *derivedOptions, bases derived.Bases) error {
+	unit := resp.HourlyUnits.Temperature2M
+
+	heatingBase := derived.ConvertBase(bases.Heating, unit)
+	if opts.heatingBase != nil {
+		heatingBase = *opts.heatingBase
+	}
+	coolingBase := derived.ConvertBase(bases.Cooling, unit)
+	if opts.coolingBase != nil {
+		coolingBase = *opts.coolingBase
+	}
+
+	series := derived.Series{
+		Time:               resp.Hourly.Time,
+		Temperature2M:      resp.Hourly.Temperature2M,
+		RelativeHumidity2M: resp.Hourly.RelativeHumidity2M,
+		WindSpeed10M:       resp.Hourly.WindSpeed10M,
+		TemperatureUnit:    unit,
+		WindSpeedUnit:      resp.HourlyUnits.WindSpeed10M,
+	}
+	result, err := derived.Compute(&series, opts.metrics, heatingBase, coolingBase)
+	if err != nil {
+		return err
+	}
+
+	body := &models.DerivedResponseBody{Unit: unit}
+	if result.HeatIndex != nil || result.WindChill != nil || result.DewPoint != nil || result.ApparentTemperature != nil {
+		body.Hourly = &models.DerivedHourly{
+			Time:                resp.Hourly.Time,
+			HeatIndex:           result.HeatIndex,
+			WindChill:           result.WindChill,
+			DewPoint2M:          result.DewPoint,
+			ApparentTemperature: result.ApparentTemperature,
+		}
+	}
+	if result.DegreeDays != nil {
+		body.HeatingBase = &heatingBase
+		body.CoolingBase = &coolingBase
+		body.Daily = make([]models.DegreeDayResponse, len(result.DegreeDays))
+		for i, day := range result.DegreeDays {
+			body.Daily[i] = models.DegreeDayResponse{
+				Date:              day.Date,
+				MeanTemperature2M: day.Mean,
+				HeatingDegreeDays: day.HDD,
+				CoolingDegreeDays: day.CDD,
+			}
+		}
+	}
+
+	resp.Derived = body
+	return nil
+}
@@ -1,178 +1,314 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
-	"sync"
 	"time"
 
 	"github.com/labstack/echo/v4"
 
-	"github.com/mick-io/duplo_go_cloud/internal/api"
 	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/derived"
+	"github.com/mick-io/duplo_go_cloud/internal/forecastio"
 	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/refresh"
+	"github.com/mick-io/duplo_go_cloud/internal/tenancy"
 )
 
-func ReadStoredForecast(db database.Datastore) echo.HandlerFunc {
+func ReadStoredForecast(db database.Datastore, bases derived.Bases) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		locations := []models.LocationRecord{}
+		db := db.WithContext(c.Request().Context())
 
-		if err := db.Find(&locations); err != nil {
+		format, err := forecastFormat(c)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid format parameter: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+		selection, err := selectUnits(c)
+		if err != nil {
+			return err
+		}
+		switch format {
+		case forecastio.FormatJSON:
+		case forecastio.FormatGeoJSON:
+			return streamForecastFeatures(c, db, selection)
+		default:
+			return streamForecasts(c, db, format, selection)
+		}
+
+		params, err := parseLocationPage(c)
+		if err != nil {
+			return err
+		}
+		derivedOpts, err := parseDerivedOptions(c)
+		if err != nil {
+			return err
+		}
+
+		locations := []models.LocationRecord{}
+		if err := db.FindPage(&locations, params.Page(), params.Where()...); err != nil {
 			msg := "Error querying database"
 			return echo.NewHTTPError(http.StatusInternalServerError, msg)
 		}
+		locations, next := trimLocationPage(&params, locations)
 
-		var wg sync.WaitGroup
-		wg.Add(len(locations))
-		forecasts := make(chan *models.ReadForecastResponseBody, len(locations))
-		errs := make(chan error, len(locations))
-
-		for _, location := range locations {
-			go func(location *models.LocationRecord) {
-				defer wg.Done()
+		snapshots, err := latestForecasts(db, locations)
+		if err != nil {
+			msg := "Error querying database"
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
 
-				forecastRecord := models.ForecastRecord{}
-				err := db.Find(&forecastRecord, &models.ForecastRecord{LocationRecordID: location.ID})
-				if err != nil {
-					errs <- err
-					return
+		forecasts := make([]*models.ReadForecastResponseBody, 0, len(locations))
+		for i := range locations {
+			snapshot, ok := snapshots[locations[i].ID]
+			if !ok {
+				continue
+			}
+			if err := convertSnapshot(snapshot, selection.For(&locations[i])); err != nil {
+				msg := fmt.Sprintf("Error converting units: %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, msg)
+			}
+			resp := newForecastResponse(&locations[i], snapshot)
+			if derivedOpts != nil {
+				if err := addDerived(resp, derivedOpts, bases); err != nil {
+					msg := fmt.Sprintf("Error computing derived metrics: %v", err)
+					return echo.NewHTTPError(http.StatusInternalServerError, msg)
 				}
+			}
+			forecasts = append(forecasts, resp)
+		}
 
-				hourlyUnitsRecord := models.HourlyUnitsRecord{}
-				err = db.Find(&hourlyUnitsRecord, &models.HourlyUnitsRecord{ForecastRecordID: forecastRecord.ID})
-				if err != nil {
-					errs <- err
-					return
-				}
+		return writePage(c, &params, forecasts, next)
+	}
+}
 
-				hourlyRecords := []models.HourlyRecord{}
-				err = db.Find(&hourlyRecords, &models.HourlyRecord{ForecastRecordID: forecastRecord.ID})
-				if err != nil {
-					errs <- err
-					return
-				}
+func ReadLatestForecast(db database.Datastore, engine *refresh.Engine, enforcer *tenancy.Enforcer, timeout time.Duration) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
 
-				forecast := models.ReadForecastResponseBody{
-					Latitude:             location.Latitude,
-					Longitude:            location.Longitude,
-					GenerationtimeMS:     forecastRecord.GenerationtimeMS,
-					UTCOffsetSeconds:     forecastRecord.UTCOffsetSeconds,
-					Timezone:             forecastRecord.Timezone,
-					TimezoneAbbreviation: forecastRecord.TimezoneAbbreviation,
-					Elevation:            forecastRecord.Elevation,
-					HourlyUnits: models.HourlyUnits{
-						Temperature2M: hourlyUnitsRecord.Temperature2MUnit,
-						Time:          hourlyUnitsRecord.TimeUnit,
-					},
-					Hourly: models.Hourly{
-						Time:          make([]string, len(hourlyRecords)),
-						Temperature2M: make([]float64, len(hourlyRecords)),
-					},
-				}
+		locations := []models.LocationRecord{}
+		if err := db.Find(&locations); err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
 
-				for i, record := range hourlyRecords {
-					forecast.Hourly.Time[i] = record.Time
-					forecast.Hourly.Temperature2M[i] = record.Temperature2M
-				}
+		ctx := c.Request().Context()
+		if err := enforcer.AllowRefreshes(ctx, db, len(locations)); err != nil {
+			return quotaError(err)
+		}
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
 
-				forecasts <- &forecast
+		results := engine.Run(ctx, locations, nil)
+		return c.JSON(http.StatusOK, newRefreshResponse(results))
+	}
+}
 
-			}(&location)
+func ReadLocationForecast(db database.Datastore, bases derived.Bases) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		idParam := c.Param("id")
+		id, err := strconv.Atoi(idParam)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid id parameter: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+		derivedOpts, err := parseDerivedOptions(c)
+		if err != nil {
+			return err
+		}
+		selection, err := selectUnits(c)
+		if err != nil {
+			return err
 		}
 
-		go func() {
-			wg.Wait()
-			close(errs)
-			close(forecasts)
-		}()
+		var location models.LocationRecord
+		if err := db.Find(&location, id); err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+		if location.ID == 0 {
+			msg := fmt.Sprintf("Location not found w/ID: %v", id)
+			return echo.NewHTTPError(http.StatusNotFound, msg)
+		}
 
-		select {
-		case err := <-errs:
-			if err != nil {
-				msg := "Error querying database"
-				return echo.NewHTTPError(http.StatusInternalServerError, msg)
-			}
-		case <-time.After(time.Second * 10):
-			msg := "Timeout waiting for goroutines to finish"
+		snapshots, err := latestForecasts(db, []models.LocationRecord{location})
+		if err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+		snapshot, ok := snapshots[location.ID]
+		if !ok {
+			msg := fmt.Sprintf("No forecast stored for location w/ID: %v", id)
+			return echo.NewHTTPError(http.StatusNotFound, msg)
+		}
+		if err := convertSnapshot(snapshot, selection.For(&location)); err != nil {
+			msg := fmt.Sprintf("Error converting units: %v", err)
 			return echo.NewHTTPError(http.StatusInternalServerError, msg)
 		}
 
-		resp := make([]*models.ReadForecastResponseBody, 0)
-		for forecast := range forecasts {
-			resp = append(resp, forecast)
+		resp := newForecastResponse(&location, snapshot)
+		if derivedOpts != nil {
+			if err := addDerived(resp, derivedOpts, bases); err != nil {
+				msg := fmt.Sprintf("Error computing derived metrics: %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, msg)
+			}
 		}
 
-		return c.JSON(http.StatusOK, &resp)
+		return c.JSON(http.StatusOK, resp)
 	}
 }
 
-func ReadLatestForecast(db database.Datastore, WeatherAPIClient api.WeatherAPIClient) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		locations := []models.LocationRecord{}
-		if err := db.Find(&locations); err != nil {
-			msg := fmt.Sprintf("Error querying database: %v", err)
-			return echo.NewHTTPError(http.StatusInternalServerError, msg)
-		}
+// forecastSnapshot is a stored forecast together with its hourly series.
+type forecastSnapshot struct {
+	Forecast models.ForecastRecord
+	Units    models.HourlyUnitsRecord
+	Hourly   []models.HourlyRecord
+}
 
-		var wg sync.WaitGroup
-		wg.Add(len(locations))
-		errs := make(chan error, len(locations))
+// latestForecasts loads the most recent forecast snapshot of each location,
+// keyed by location ID. Locations without a stored forecast are omitted.
+// The snapshots are loaded with three set-based queries regardless of the
+// number of locations.
+func latestForecasts(db database.Datastore, locations []models.LocationRecord) (map[uint]*forecastSnapshot, error) {
+	snapshots := make(map[uint]*forecastSnapshot, len(locations))
+	if len(locations) == 0 {
+		return snapshots, nil
+	}
 
-		for _, location := range locations {
-			go func(location models.LocationRecord) {
-				// Fetching forecast data
-				resp := models.Forecast{}
-				opts := api.ForecastOptions{
-					Latitude:  strconv.FormatFloat(location.Latitude, 'f', 6, 64),
-					Longitude: strconv.FormatFloat(location.Longitude, 'f', 6, 64),
-				}
-				if err := WeatherAPIClient.GetForecast(opts, &resp); err != nil {
-					msg := fmt.Sprintf("Error getting forecast: %v", err)
-					errs <- echo.NewHTTPError(http.StatusBadGateway, msg)
-				}
+	locationIDs := make([]uint, len(locations))
+	for i, location := range locations {
+		locationIDs[i] = location.ID
+	}
 
-				// Validating forecast data
-				if err := models.ValidateForecast(resp); err != nil {
-					msg := fmt.Sprintf("Error validating forecast: %v", err)
-					errs <- echo.NewHTTPError(http.StatusBadGateway, msg)
-				}
+	forecasts := []models.ForecastRecord{}
+	err := db.Find(&forecasts, `id IN (
+		SELECT MAX(id) FROM forecast_records
+		WHERE location_record_id IN ? AND deleted_at IS NULL
+		GROUP BY location_record_id
+	)`, locationIDs)
+	if err != nil {
+		return nil, err
+	}
+	if len(forecasts) == 0 {
+		return snapshots, nil
+	}
 
-				// Storing forecast data
-				forecast := models.NewForecastRecords(location.ID, &resp)
-				if err := db.Save(forecast); err != nil {
-					msg := fmt.Sprintf("Error storing forecast: %v", err)
-					errs <- echo.NewHTTPError(http.StatusInternalServerError, msg)
-				}
-				hourly := models.NewHourlyRecord(forecast.Model.ID, &resp.Hourly)
-				if err := db.Create(&hourly); err != nil {
-					msg := fmt.Sprintf("Error storing hourly records: %v", err)
-					errs <- echo.NewHTTPError(http.StatusInternalServerError, msg)
-				}
-				units := models.NewHourlyUnitsRecord(forecast.Model.ID, &resp.HourlyUnits)
-				if err := db.Save(units); err != nil {
-					msg := fmt.Sprintf("Error storing unit records: %v", err)
-					errs <- echo.NewHTTPError(http.StatusInternalServerError, msg)
-				}
+	byForecastID := make(map[uint]*forecastSnapshot, len(forecasts))
+	forecastIDs := make([]uint, len(forecasts))
+	for i, forecast := range forecasts {
+		snapshot := &forecastSnapshot{Forecast: forecast}
+		snapshots[forecast.LocationRecordID] = snapshot
+		byForecastID[forecast.ID] = snapshot
+		forecastIDs[i] = forecast.ID
+	}
 
-			}(location)
-		}
+	units := []models.HourlyUnitsRecord{}
+	if err := db.Find(&units, "forecast_record_id IN ?", forecastIDs); err != nil {
+		return nil, err
+	}
+	for _, record := range units {
+		byForecastID[record.ForecastRecordID].Units = record
+	}
 
-		go func() {
-			wg.Wait()
-			close(errs)
-		}()
+	hourly := []models.HourlyRecord{}
+	if err := db.FindPage(&hourly, database.Page{Order: "forecast_record_id, id"}, "forecast_record_id IN ?", forecastIDs); err != nil {
+		return nil, err
+	}
+	for _, record := range hourly {
+		snapshot := byForecastID[record.ForecastRecordID]
+		snapshot.Hourly = append(snapshot.Hourly, record)
+	}
 
-		select {
-		case err := <-errs:
-			if err != nil {
-				return err
-			}
-		case <-time.After(time.Second * 10):
-			msg := "Timeout waiting for goroutines to finish"
-			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+	return snapshots, nil
+}
+
+func newForecastResponse(loc *models.LocationRecord, snapshot *forecastSnapshot) *models.ReadForecastResponseBody {
+	forecast, units, hourly := &snapshot.Forecast, &snapshot.Units, snapshot.Hourly
+	resp := models.ReadForecastResponseBody{
+		LocationID:           loc.ID,
+		Latitude:             loc.Latitude,
+		Longitude:            loc.Longitude,
+		GenerationtimeMS:     forecast.GenerationtimeMS,
+		UTCOffsetSeconds:     forecast.UTCOffsetSeconds,
+		Timezone:             forecast.Timezone,
+		TimezoneAbbreviation: forecast.TimezoneAbbreviation,
+		Elevation:            forecast.Elevation,
+		HourlyUnits: models.HourlyUnits{
+			Temperature2M:      units.Temperature2MUnit,
+			Precipitation:      units.PrecipitationUnit,
+			RelativeHumidity2M: units.RelativeHumidity2MUnit,
+			WindSpeed10M:       units.WindSpeed10MUnit,
+			SurfacePressure:    units.SurfacePressureUnit,
+			Time:               units.TimeUnit,
+		},
+		Hourly: models.Hourly{
+			Time:               make([]string, len(hourly)),
+			Temperature2M:      make([]float64, len(hourly)),
+			Precipitation:      make([]float64, len(hourly)),
+			RelativeHumidity2M: make([]float64, len(hourly)),
+			WindSpeed10M:       make([]float64, len(hourly)),
+			SurfacePressure:    make([]float64, len(hourly)),
+		},
+	}
+
+	for i, record := range hourly {
+		resp.Hourly.Time[i] = record.Time
+		resp.Hourly.Temperature2M[i] = record.Temperature2M
+		resp.Hourly.Precipitation[i] = record.Precipitation
+		resp.Hourly.RelativeHumidity2M[i] = record.RelativeHumidity2M
+		resp.Hourly.WindSpeed10M[i] = record.WindSpeed10M
+		resp.Hourly.SurfacePressure[i] = record.SurfacePressure
+	}
+
+	return &resp
+}
+
+// refreshError converts an error returned by refresh.Engine.Refresh into an
+// *echo.HTTPError, blaming the weather API for fetch and validation failures.
+func refreshError(err error) error {
+	var refreshErr *refresh.Error
+	if errors.As(err, &refreshErr) && refreshErr.Upstream() {
+		msg := fmt.Sprintf("Error getting forecast: %v", err)
+		return echo.NewHTTPError(http.StatusBadGateway, msg)
+	}
+
+	msg := fmt.Sprintf("Error storing forecast: %v", err)
+	return echo.NewHTTPError(http.StatusInternalServerError, msg)
+}
+
+func newRefreshResponse(results []refresh.Result) models.RefreshResponseBody {
+	resp := models.RefreshResponseBody{
+		Succeeded: []models.RefreshResult{},
+		Failed:    []models.RefreshResult{},
+		Skipped:   []models.RefreshResult{},
+	}
+
+	for _, result := range results {
+		item := models.RefreshResult{
+			LocationID: result.LocationID,
+			ForecastID: result.ForecastID,
+		}
+		if result.Err != nil {
+			item.Error = result.Err.Error()
 		}
 
-		return ReadStoredForecast(db)(c)
+		switch result.Status {
+		case refresh.StatusSucceeded:
+			resp.Succeeded = append(resp.Succeeded, item)
+		case refresh.StatusFailed:
+			resp.Failed = append(resp.Failed, item)
+		case refresh.StatusSkipped:
+			resp.Skipped = append(resp.Skipped, item)
+		}
 	}
+
+	return resp
 }
@@ -0,0 +1,383 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// ReadForecastDiff compares two stored forecast snapshots of a location,
+// aligning their hourly series by valid time. The 'from' and 'to' query
+// parameters select a snapshot by forecast ID, by RFC 3339 timestamp (the
+// latest snapshot stored at or before it) or with "latest". 'to' defaults to
+// the latest snapshot and 'from' to the snapshot stored before 'to'; a
+// 'from' newer than 'to' is rejected. The 'format' query parameter selects
+// JSON (default) or a compact text report. Values and changes are rendered
+// in the selected unit system.
+func ReadForecastDiff(db database.Datastore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		// Validating input
+		idParam := c.Param("id")
+		id, err := strconv.Atoi(idParam)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid id parameter: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		format := c.QueryParam("format")
+		if format == "" {
+			format = "json"
+		}
+		if format != "json" && format != "text" {
+			msg := fmt.Sprintf("Invalid format parameter: %q", format)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		selection, err := selectUnits(c)
+		if err != nil {
+			return err
+		}
+
+		var location models.LocationRecord
+		if err := db.Find(&location, id); err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+		if location.ID == 0 {
+			msg := fmt.Sprintf("Location not found w/ID: %v", id)
+			return echo.NewHTTPError(http.StatusNotFound, msg)
+		}
+
+		// Resolving snapshots
+		toParam := c.QueryParam("to")
+		if toParam == "" {
+			toParam = "latest"
+		}
+		to, err := findSnapshot(db, location.ID, toParam)
+		if err != nil {
+			return snapshotError("to", toParam, err)
+		}
+
+		var from *models.ForecastRecord
+		if fromParam := c.QueryParam("from"); fromParam != "" {
+			if from, err = findSnapshot(db, location.ID, fromParam); err != nil {
+				return snapshotError("from", fromParam, err)
+			}
+			if from.ID > to.ID {
+				msg := fmt.Sprintf("Invalid from parameter: forecast %d is newer than forecast %d selected by to", from.ID, to.ID)
+				return echo.NewHTTPError(http.StatusBadRequest, msg)
+			}
+		} else {
+			from = &models.ForecastRecord{}
+			err := db.Last(from, "location_record_id = ? AND id < ?", location.ID, to.ID)
+			if err != nil {
+				return snapshotError("from", "previous", err)
+			}
+		}
+
+		// Loading hourly series
+		fromSnapshot, err := loadSnapshot(db, from)
+		if err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+		toSnapshot, err := loadSnapshot(db, to)
+		if err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+
+		// Converting both snapshots to the same units, since they may have
+		// been stored in different ones
+		system := selection.For(&location)
+		for _, snapshot := range []*forecastSnapshot{fromSnapshot, toSnapshot} {
+			if err := convertSnapshot(snapshot, system); err != nil {
+				msg := fmt.Sprintf("Error converting units: %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, msg)
+			}
+		}
+
+		diff, err := diffForecasts(&location, fromSnapshot, toSnapshot)
+		if err != nil {
+			msg := fmt.Sprintf("Error comparing forecasts: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+
+		if format == "text" {
+			return c.String(http.StatusOK, formatForecastDiff(diff))
+		}
+		return c.JSON(http.StatusOK, diff)
+	}
+}
+
+// errInvalidSnapshot is returned by findSnapshot for unparsable parameters.
+var errInvalidSnapshot = errors.New(`expected a forecast ID, an RFC 3339 timestamp or "latest"`)
+
+// findSnapshot resolves a 'from' or 'to' parameter to a forecast of the
+// location.
+func findSnapshot(db database.Datastore, locationID uint, param string) (*models.ForecastRecord, error) {
+	forecast := &models.ForecastRecord{}
+
+	if param == "latest" {
+		return forecast, db.Last(forecast, "location_record_id = ?", locationID)
+	}
+	if id, err := strconv.ParseUint(param, 10, 64); err == nil {
+		return forecast, db.First(forecast, "location_record_id = ? AND id = ?", locationID, id)
+	}
+	at, err := time.Parse(time.RFC3339, param)
+	if err != nil {
+		return nil, errInvalidSnapshot
+	}
+	return forecast, db.Last(forecast, "location_record_id = ? AND created_at <= ?", locationID, at)
+}
+
+func snapshotError(name, param string, err error) error {
+	if errors.Is(err, database.ErrRecordNotFound) {
+		msg := fmt.Sprintf("No forecast snapshot found for %s=%s", name, param)
+		return echo.NewHTTPError(http.StatusNotFound, msg)
+	}
+	if errors.Is(err, errInvalidSnapshot) {
+		msg := fmt.Sprintf("Invalid %s parameter: %v", name, err)
+		return echo.NewHTTPError(http.StatusBadRequest, msg)
+	}
+	msg := fmt.Sprintf("Error querying database: %v", err)
+	return echo.NewHTTPError(http.StatusInternalServerError, msg)
+}
+
+// loadSnapshot loads the units and hourly series of a stored forecast.
+func loadSnapshot(db database.Datastore, forecast *models.ForecastRecord) (*forecastSnapshot, error) {
+	snapshot := &forecastSnapshot{Forecast: *forecast}
+	if err := db.Find(&snapshot.Units, "forecast_record_id = ?", forecast.ID); err != nil {
+		return nil, err
+	}
+	err := db.FindPage(&snapshot.Hourly, database.Page{Order: "id"}, "forecast_record_id = ?", forecast.ID)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// diffForecasts aligns the hourly series of two snapshots by valid time and
+// computes the per-hour deltas and their summary. Precipitation is left out
+// of the snapshots stored before it was fetched, which have no precipitation
+// unit, and is only compared when both snapshots have it.
+func diffForecasts(loc *models.LocationRecord, from, to *forecastSnapshot) (*models.ForecastDiffResponseBody, error) {
+	type pair struct {
+		time     string
+		from, to *models.HourlyRecord
+	}
+
+	hours := map[int64]*pair{}
+	for i := range from.Hourly {
+		record := &from.Hourly[i]
+		validTime, err := models.ParseHourlyTime(record.Time, from.Forecast.UTCOffsetSeconds)
+		if err != nil {
+			return nil, err
+		}
+		hours[validTime.Unix()] = &pair{time: record.Time, from: record}
+	}
+	for i := range to.Hourly {
+		record := &to.Hourly[i]
+		validTime, err := models.ParseHourlyTime(record.Time, to.Forecast.UTCOffsetSeconds)
+		if err != nil {
+			return nil, err
+		}
+		// Times are reported in the local time of the newer snapshot
+		if p, ok := hours[validTime.Unix()]; ok {
+			p.time, p.to = record.Time, record
+		} else {
+			hours[validTime.Unix()] = &pair{time: record.Time, to: record}
+		}
+	}
+
+	keys := make([]int64, 0, len(hours))
+	for key := range hours {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	resp := models.ForecastDiffResponseBody{
+		LocationID: loc.ID,
+		From:       newSnapshotRef(&from.Forecast),
+		To:         newSnapshotRef(&to.Forecast),
+		HourlyUnits: models.HourlyUnits{
+			Time:          to.Units.TimeUnit,
+			Temperature2M: to.Units.Temperature2MUnit,
+			Precipitation: to.Units.PrecipitationUnit,
+		},
+		Hours: make([]models.ForecastHourDiff, 0, len(keys)),
+		Days:  []models.ForecastDayDiff{},
+	}
+	summary := &resp.Summary
+	fromPrecipitation := from.Units.PrecipitationUnit != ""
+	toPrecipitation := to.Units.PrecipitationUnit != ""
+	comparePrecipitation := fromPrecipitation && toPrecipitation
+
+	// Daily extremes are computed over the hours covered by both snapshots
+	// so that hours dropping out of the window do not skew them.
+	type extremes struct {
+		fromHigh, fromLow, toHigh, toLow float64
+	}
+	days := map[string]*extremes{}
+	var dayOrder []string
+
+	var temperatureSum float64
+	for _, key := range keys {
+		p := hours[key]
+		hour := models.ForecastHourDiff{Time: p.time}
+
+		if p.from != nil {
+			hour.Temperature2MFrom = float64Ptr(p.from.Temperature2M)
+			if fromPrecipitation {
+				hour.PrecipitationFrom = float64Ptr(p.from.Precipitation)
+			}
+		}
+		if p.to != nil {
+			hour.Temperature2MTo = float64Ptr(p.to.Temperature2M)
+			if toPrecipitation {
+				hour.PrecipitationTo = float64Ptr(p.to.Precipitation)
+			}
+		}
+
+		switch {
+		case p.from == nil:
+			summary.HoursAdded++
+		case p.to == nil:
+			summary.HoursRemoved++
+		default:
+			summary.HoursCompared++
+			temperatureDelta := p.to.Temperature2M - p.from.Temperature2M
+			hour.Temperature2MDelta = float64Ptr(temperatureDelta)
+			var precipitationDelta float64
+			if comparePrecipitation {
+				precipitationDelta = p.to.Precipitation - p.from.Precipitation
+				hour.PrecipitationDelta = float64Ptr(precipitationDelta)
+			}
+
+			if temperatureDelta != 0 || precipitationDelta != 0 {
+				summary.HoursChanged++
+			}
+			temperatureSum += temperatureDelta
+			if summary.MaxTemperatureChange == nil || math.Abs(temperatureDelta) > math.Abs(summary.MaxTemperatureChange.Delta) {
+				summary.MaxTemperatureChange = &models.HourChange{Time: p.time, Delta: temperatureDelta}
+			}
+
+			if comparePrecipitation {
+				if summary.MaxPrecipitationChange == nil || math.Abs(precipitationDelta) > math.Abs(summary.MaxPrecipitationChange.Delta) {
+					summary.MaxPrecipitationChange = &models.HourChange{Time: p.time, Delta: precipitationDelta}
+				}
+				if summary.RainAppeared == nil && p.from.Precipitation == 0 && p.to.Precipitation > 0 {
+					summary.RainAppeared = stringPtr(p.time)
+				}
+				if summary.RainDisappeared == nil && p.from.Precipitation > 0 && p.to.Precipitation == 0 {
+					summary.RainDisappeared = stringPtr(p.time)
+				}
+			}
+
+			day, _, _ := strings.Cut(p.time, "T")
+			ext, ok := days[day]
+			if !ok {
+				ext = &extremes{
+					fromHigh: p.from.Temperature2M, fromLow: p.from.Temperature2M,
+					toHigh: p.to.Temperature2M, toLow: p.to.Temperature2M,
+				}
+				days[day] = ext
+				dayOrder = append(dayOrder, day)
+			}
+			ext.fromHigh = math.Max(ext.fromHigh, p.from.Temperature2M)
+			ext.fromLow = math.Min(ext.fromLow, p.from.Temperature2M)
+			ext.toHigh = math.Max(ext.toHigh, p.to.Temperature2M)
+			ext.toLow = math.Min(ext.toLow, p.to.Temperature2M)
+		}
+
+		resp.Hours = append(resp.Hours, hour)
+	}
+	if summary.HoursCompared > 0 {
+		summary.MeanTemperatureChange = temperatureSum / float64(summary.HoursCompared)
+	}
+
+	for _, day := range dayOrder {
+		ext := days[day]
+		resp.Days = append(resp.Days, models.ForecastDayDiff{
+			Date:      day,
+			HighFrom:  ext.fromHigh,
+			HighTo:    ext.toHigh,
+			HighDelta: ext.toHigh - ext.fromHigh,
+			LowFrom:   ext.fromLow,
+			LowTo:     ext.toLow,
+			LowDelta:  ext.toLow - ext.fromLow,
+		})
+	}
+
+	return &resp, nil
+}
+
+func newSnapshotRef(forecast *models.ForecastRecord) models.ForecastSnapshotRef {
+	return models.ForecastSnapshotRef{ForecastID: forecast.ID, CreatedAt: forecast.CreatedAt}
+}
+
+// formatForecastDiff renders a diff as a compact text report listing the
+// summary, the daily extremes and the hours that changed.
+func formatForecastDiff(diff *models.ForecastDiffResponseBody) string {
+	var b strings.Builder
+	tUnit, pUnit := diff.HourlyUnits.Temperature2M, diff.HourlyUnits.Precipitation
+	s := &diff.Summary
+
+	fmt.Fprintf(&b, "location %d: forecast %d (%s) -> %d (%s)\n",
+		diff.LocationID,
+		diff.From.ForecastID, diff.From.CreatedAt.UTC().Format(time.RFC3339),
+		diff.To.ForecastID, diff.To.CreatedAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "hours: %d compared, %d changed, %d added, %d removed\n",
+		s.HoursCompared, s.HoursChanged, s.HoursAdded, s.HoursRemoved)
+	if s.MaxTemperatureChange != nil {
+		fmt.Fprintf(&b, "max temperature change: %+.1f%s at %s (mean %+.1f%s)\n",
+			s.MaxTemperatureChange.Delta, tUnit, s.MaxTemperatureChange.Time, s.MeanTemperatureChange, tUnit)
+	}
+	if s.MaxPrecipitationChange != nil {
+		fmt.Fprintf(&b, "max precipitation change: %+.1f%s at %s\n",
+			s.MaxPrecipitationChange.Delta, pUnit, s.MaxPrecipitationChange.Time)
+	}
+	if s.RainAppeared != nil {
+		fmt.Fprintf(&b, "rain appeared: %s\n", *s.RainAppeared)
+	}
+	if s.RainDisappeared != nil {
+		fmt.Fprintf(&b, "rain disappeared: %s\n", *s.RainDisappeared)
+	}
+
+	for _, day := range diff.Days {
+		fmt.Fprintf(&b, "%s high %.1f -> %.1f (%+.1f) low %.1f -> %.1f (%+.1f)\n",
+			day.Date, day.HighFrom, day.HighTo, day.HighDelta, day.LowFrom, day.LowTo, day.LowDelta)
+	}
+
+	for _, hour := range diff.Hours {
+		if hour.Temperature2MDelta == nil || (*hour.Temperature2MDelta == 0 && *hour.PrecipitationDelta == 0) {
+			continue
+		}
+		fmt.Fprintf(&b, "%s %.1f -> %.1f%s (%+.1f) precip %.1f -> %.1f%s (%+.1f)\n",
+			hour.Time,
+			*hour.Temperature2MFrom, *hour.Temperature2MTo, tUnit, *hour.Temperature2MDelta,
+			*hour.PrecipitationFrom, *hour.PrecipitationTo, pUnit, *hour.PrecipitationDelta)
+	}
+
+	return b.String()
+}
+
+func float64Ptr(v float64) *float64 {
+	return &v
+}
+
+func stringPtr(v string) *string {
+	return &v
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database/dbtest"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/units"
+)
+
+func TestDiffForecastsSkipsPrecipitationWithoutUnit(t *testing.T) {
+	// The older snapshot was stored before precipitation was fetched
+	from := &forecastSnapshot{
+		Units:  models.HourlyUnitsRecord{Temperature2MUnit: units.Celsius},
+		Hourly: []models.HourlyRecord{{Time: "2024-01-01T00:00", Temperature2M: 10}},
+	}
+	to := &forecastSnapshot{
+		Units:  models.HourlyUnitsRecord{Temperature2MUnit: units.Celsius, PrecipitationUnit: units.Millimeters},
+		Hourly: []models.HourlyRecord{{Time: "2024-01-01T00:00", Temperature2M: 10, Precipitation: 2}},
+	}
+
+	diff, err := diffForecasts(&models.LocationRecord{}, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hour := diff.Hours[0]
+	if hour.PrecipitationFrom != nil || hour.PrecipitationDelta != nil || hour.PrecipitationTo == nil || *hour.PrecipitationTo != 2 {
+		t.Errorf("hour = %+v, want only the precipitation of the newer snapshot", hour)
+	}
+	s := diff.Summary
+	if s.HoursChanged != 0 || s.MaxPrecipitationChange != nil || s.RainAppeared != nil {
+		t.Errorf("summary = %+v, want no precipitation change", s)
+	}
+}
+
+func TestReadForecastDiffRejectsFromNewerThanTo(t *testing.T) {
+	db := dbtest.NewDatastore(t)
+	location := models.LocationRecord{Latitude: 1, Longitude: 2}
+	if err := db.Create(&location); err != nil {
+		t.Fatal(err)
+	}
+	forecasts := []models.ForecastRecord{{LocationRecordID: location.ID}, {LocationRecordID: location.ID}}
+	if err := db.Create(&forecasts); err != nil {
+		t.Fatal(err)
+	}
+
+	target := fmt.Sprintf("/locations/%d/forecast/diff?from=%d&to=%d", location.ID, forecasts[1].ID, forecasts[0].ID)
+	c, _ := newTenantContext(context.Background(), http.MethodGet, target, "")
+	c.SetParamNames("id")
+	c.SetParamValues(fmt.Sprint(location.ID))
+	wantHTTPError(t, ReadForecastDiff(db)(c), http.StatusBadRequest)
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/forecastio"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// exportBatchSize is the number of locations written between flushes.
+const exportBatchSize = 100
+
+// forecastFormat resolves the output format of a forecast request from the
+// format query parameter, falling back to the Accept header.
+func forecastFormat(c echo.Context) (forecastio.Format, error) {
+	if param := c.QueryParam("format"); param != "" {
+		return forecastio.ParseFormat(param)
+	}
+	return forecastio.Negotiate(c.Request().Header.Get(echo.HeaderAccept)), nil
+}
+
+// streamForecasts writes the latest stored forecast of every location as
+// flat rows. Locations are loaded in batches and each batch is flushed to
+// the client before the next is read. Values are converted to the unit
+// system selected for each location.
+func streamForecasts(c echo.Context, db database.Datastore, format forecastio.Format, selection *unitSelection) error {
+	res := c.Response()
+	writer, err := forecastio.NewWriter(format, res)
+	if err != nil {
+		msg := fmt.Sprintf("Invalid export format: %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest, msg)
+	}
+
+	res.Header().Set(echo.HeaderContentType, format.ContentType())
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=forecast.%s", format))
+	res.WriteHeader(http.StatusOK)
+
+	locations := []models.LocationRecord{}
+	err = db.FindInBatches(&locations, exportBatchSize, func(batch int) error {
+		snapshots, err := latestForecasts(db, locations)
+		if err != nil {
+			return err
+		}
+
+		for i := range locations {
+			snapshot, ok := snapshots[locations[i].ID]
+			if !ok {
+				continue
+			}
+			if err := convertSnapshot(snapshot, selection.For(&locations[i])); err != nil {
+				return err
+			}
+			rows, err := forecastio.Rows(&locations[i], &snapshot.Forecast, &snapshot.Units, snapshot.Hourly)
+			if err != nil {
+				return err
+			}
+			if err := writer.Write(rows); err != nil {
+				return err
+			}
+		}
+
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		res.Flush()
+		return nil
+	})
+	if err != nil {
+		// The status line has already been sent, so the error can only be
+		// surfaced by aborting the body.
+		return err
+	}
+
+	return writer.Close()
+}
@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/api"
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+const (
+	// maxGridCells caps the number of cells in a gridded forecast request.
+	maxGridCells = 1000
+	// gridChunkSize is the number of coordinates sent per upstream request.
+	gridChunkSize = 100
+	// defaultGridStep is the default cell size in degrees.
+	defaultGridStep = 0.5
+	// minGridStep is the smallest cell size in degrees, about a kilometer,
+	// below the resolution of the weather models.
+	minGridStep = 0.01
+)
+
+// streamForecastFeatures writes the latest stored forecast of every location
+// as a GeoJSON FeatureCollection with one Point feature per location.
+// Features are written as each batch of locations is loaded.
+func streamForecastFeatures(c echo.Context, db database.Datastore, selection *unitSelection) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/geo+json")
+	res.WriteHeader(http.StatusOK)
+
+	if _, err := res.Write([]byte(`{"type":"FeatureCollection","features":[`)); err != nil {
+		return err
+	}
+
+	baseURL := c.Scheme() + "://" + c.Request().Host
+	now := time.Now()
+	first := true
+	locations := []models.LocationRecord{}
+	err := db.FindInBatches(&locations, exportBatchSize, func(batch int) error {
+		snapshots, err := latestForecasts(db, locations)
+		if err != nil {
+			return err
+		}
+
+		for i := range locations {
+			loc := &locations[i]
+
+			properties := map[string]interface{}{
+				"id":           loc.ID,
+				"name":         loc.Name,
+				"forecast_url": fmt.Sprintf("%s/locations/%d/forecast", baseURL, loc.ID),
+			}
+			if snapshot, ok := snapshots[loc.ID]; ok {
+				if err := convertSnapshot(snapshot, selection.For(loc)); err != nil {
+					return err
+				}
+				current, next24h := summarizeForecast(&snapshot.Forecast, &snapshot.Units, snapshot.Hourly, now)
+				properties["current"] = current
+				properties["next_24h"] = next24h
+			}
+
+			feature, err := json.Marshal(models.NewPointFeature(loc.ID, loc.Latitude, loc.Longitude, properties))
+			if err != nil {
+				return err
+			}
+			if !first {
+				feature = append([]byte(","), feature...)
+			}
+			first = false
+			if _, err := res.Write(feature); err != nil {
+				return err
+			}
+		}
+
+		res.Flush()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = res.Write([]byte("]}"))
+	return err
+}
+
+// summarizeForecast returns the conditions for the hour containing 'now' and
+// summary statistics over the following 24 hours. Either may be nil if the
+// forecast does not cover that period.
+func summarizeForecast(forecast *models.ForecastRecord, units *models.HourlyUnitsRecord, hourly []models.HourlyRecord, now time.Time) (*models.CurrentConditions, *models.SummaryStatistics) {
+	var current *models.CurrentConditions
+	var next24h *models.SummaryStatistics
+	end := now.Add(24 * time.Hour)
+
+	for _, record := range hourly {
+		validTime, err := models.ParseHourlyTime(record.Time, forecast.UTCOffsetSeconds)
+		if err != nil {
+			continue
+		}
+
+		if !validTime.After(now) && validTime.Add(time.Hour).After(now) {
+			current = &models.CurrentConditions{
+				Time:          record.Time,
+				Temperature2M: record.Temperature2M,
+				Unit:          units.Temperature2MUnit,
+			}
+		}
+
+		if validTime.After(now) && !validTime.After(end) {
+			if next24h == nil {
+				next24h = &models.SummaryStatistics{
+					Min:  math.Inf(1),
+					Max:  math.Inf(-1),
+					Unit: units.Temperature2MUnit,
+				}
+			}
+			next24h.Min = math.Min(next24h.Min, record.Temperature2M)
+			next24h.Max = math.Max(next24h.Max, record.Temperature2M)
+			next24h.Mean += record.Temperature2M
+			next24h.Count++
+		}
+	}
+
+	if next24h != nil {
+		next24h.Mean /= float64(next24h.Count)
+	}
+	return current, next24h
+}
+
+// ReadForecastGrid returns current conditions for a grid of cells covering a
+// bounding box, as a GeoJSON FeatureCollection of Polygon cells. It is meant
+// for drawing heatmaps and queries the weather API directly.
+func ReadForecastGrid(WeatherAPIClient api.WeatherAPIClient) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// Validating input
+		bbox, err := parseBBox(c.QueryParam("bbox"))
+		if err != nil {
+			msg := fmt.Sprintf("Invalid bbox parameter: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		step := defaultGridStep
+		if param := c.QueryParam("step"); param != "" {
+			step, err = strconv.ParseFloat(param, 64)
+			if err != nil || math.IsNaN(step) || math.IsInf(step, 0) || step < minGridStep {
+				msg := fmt.Sprintf("Invalid step parameter: %v, the minimum is %v", param, minGridStep)
+				return echo.NewHTTPError(http.StatusBadRequest, msg)
+			}
+		}
+
+		variable := c.QueryParam("variable")
+		switch variable {
+		case "":
+			variable = "temperature_2m"
+		case "temperature_2m", "precipitation":
+		default:
+			msg := fmt.Sprintf("Invalid variable parameter: %v", variable)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		selection, err := selectUnits(c)
+		if err != nil {
+			return err
+		}
+		system := selection.For(nil)
+
+		// Counting cells in floating point, since the product of the
+		// column and row counts may overflow an int
+		columnCount := math.Ceil((bbox[2] - bbox[0]) / step)
+		rowCount := math.Ceil((bbox[3] - bbox[1]) / step)
+		if cellCount := columnCount * rowCount; cellCount > maxGridCells {
+			msg := fmt.Sprintf("Grid has %.0f cells, the maximum is %d; use a larger step or smaller bbox", cellCount, maxGridCells)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+		columns, rows := int(columnCount), int(rowCount)
+
+		// Building cells
+		type cell struct {
+			minLon, minLat, maxLon, maxLat float64
+		}
+		cells := make([]cell, 0, columns*rows)
+		opts := make([]api.ForecastOptions, 0, columns*rows)
+		for row := 0; row < rows; row++ {
+			for col := 0; col < columns; col++ {
+				cl := cell{
+					minLon: bbox[0] + float64(col)*step,
+					minLat: bbox[1] + float64(row)*step,
+				}
+				cl.maxLon = math.Min(cl.minLon+step, bbox[2])
+				cl.maxLat = math.Min(cl.minLat+step, bbox[3])
+				cells = append(cells, cl)
+				opts = append(opts, api.ForecastOptions{
+					Latitude:  strconv.FormatFloat((cl.minLat+cl.maxLat)/2, 'f', 4, 64),
+					Longitude: strconv.FormatFloat((cl.minLon+cl.maxLon)/2, 'f', 4, 64),
+				})
+			}
+		}
+
+		// Fetching current conditions
+		results := make([]models.CurrentForecast, 0, len(opts))
+		for start := 0; start < len(opts); start += gridChunkSize {
+			end := start + gridChunkSize
+			if end > len(opts) {
+				end = len(opts)
+			}
+
+			chunk := []models.CurrentForecast{}
+			if err := WeatherAPIClient.GetCurrent(c.Request().Context(), opts[start:end], &chunk); err != nil {
+				msg := fmt.Sprintf("Error getting forecast: %v", err)
+				return echo.NewHTTPError(http.StatusBadGateway, msg)
+			}
+			if len(chunk) != end-start {
+				msg := fmt.Sprintf("Error getting forecast: expected %d results, got %d", end-start, len(chunk))
+				return echo.NewHTTPError(http.StatusBadGateway, msg)
+			}
+			results = append(results, chunk...)
+		}
+
+		// Building features
+		features := make([]models.Feature, len(cells))
+		for i, cl := range cells {
+			result := results[i]
+			value, unit, to := result.Current.Temperature2M, result.CurrentUnits.Temperature2M, system.Temperature
+			if variable == "precipitation" {
+				value, unit, to = result.Current.Precipitation, result.CurrentUnits.Precipitation, system.Precipitation
+			}
+			value, err := convertValue(value, unit, to)
+			if err != nil {
+				msg := fmt.Sprintf("Error converting units: %v", err)
+				return echo.NewHTTPError(http.StatusBadGateway, msg)
+			}
+
+			ring := [][2]float64{
+				{cl.minLat, cl.minLon},
+				{cl.minLat, cl.maxLon},
+				{cl.maxLat, cl.maxLon},
+				{cl.maxLat, cl.minLon},
+			}
+			features[i] = models.NewPolygonFeature(i, ring, map[string]interface{}{
+				"variable": variable,
+				"value":    value,
+				"unit":     to,
+				"time":     result.Current.Time,
+			})
+		}
+
+		collection := models.NewFeatureCollection(features)
+		collection.BBox = bbox[:]
+		c.Response().Header().Set(echo.HeaderContentType, "application/geo+json")
+		return c.JSON(http.StatusOK, collection)
+	}
+}
+
+// parseBBox parses a "minLon,minLat,maxLon,maxLat" bounding box.
+func parseBBox(param string) ([4]float64, error) {
+	var bbox [4]float64
+	parts := strings.Split(param, ",")
+	if len(parts) != 4 {
+		return bbox, fmt.Errorf("expected minLon,minLat,maxLon,maxLat, got %q", param)
+	}
+
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return bbox, err
+		}
+		if math.IsNaN(value) {
+			return bbox, fmt.Errorf("coordinate is not a number: %q", part)
+		}
+		bbox[i] = value
+	}
+
+	if bbox[0] < -180 || bbox[2] > 180 || bbox[1] < -90 || bbox[3] > 90 {
+		return bbox, fmt.Errorf("coordinates out of range: %q", param)
+	}
+	if bbox[0] >= bbox[2] || bbox[1] >= bbox[3] {
+		return bbox, fmt.Errorf("min must be less than max: %q", param)
+	}
+	return bbox, nil
+}
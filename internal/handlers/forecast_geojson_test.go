@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/api"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// currentClient answers GetCurrent with the same conditions for every
+// coordinate.
+type currentClient struct {
+	api.WeatherAPIClient
+	calls int
+}
+
+func (f *currentClient) GetCurrent(_ context.Context, opts []api.ForecastOptions, result *[]models.CurrentForecast) error {
+	f.calls++
+	*result = make([]models.CurrentForecast, len(opts))
+	for i := range opts {
+		(*result)[i].Current.Temperature2M = 20
+		(*result)[i].CurrentUnits.Temperature2M = "°C"
+	}
+	return nil
+}
+
+func TestReadForecastGridRejectsOversizedGrids(t *testing.T) {
+	tests := []struct {
+		name  string
+		query url.Values
+	}{
+		// 4294967296 × 2147483648 cells overflow int64 to MinInt64
+		{"overflowing cell count", url.Values{"bbox": {"-180,-90,180,90"}, "step": {"8.381903171539307e-08"}}},
+		{"step below minimum", url.Values{"bbox": {"0,0,0.001,0.001"}, "step": {"0.0001"}}},
+		{"too many cells", url.Values{"bbox": {"-180,-90,180,90"}, "step": {"1"}}},
+		{"NaN step", url.Values{"bbox": {"0,0,1,1"}, "step": {"NaN"}}},
+		{"infinite step", url.Values{"bbox": {"0,0,1,1"}, "step": {"Inf"}}},
+		{"negative step", url.Values{"bbox": {"0,0,1,1"}, "step": {"-1"}}},
+		{"NaN bbox", url.Values{"bbox": {"NaN,0,1,1"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &currentClient{}
+			req := httptest.NewRequest(http.MethodGet, "/forecast/grid?"+tt.query.Encode(), nil)
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+
+			err := ReadForecastGrid(client)(c)
+			httpErr, ok := err.(*echo.HTTPError)
+			if !ok || httpErr.Code != http.StatusBadRequest {
+				t.Fatalf("error = %v, want 400 Bad Request", err)
+			}
+			if client.calls != 0 {
+				t.Errorf("weather API called %d times", client.calls)
+			}
+		})
+	}
+}
+
+func TestReadForecastGrid(t *testing.T) {
+	client := &currentClient{}
+	query := url.Values{"bbox": {"0,0,1,0.5"}, "step": {"0.25"}, "units": {"metric"}}
+	req := httptest.NewRequest(http.MethodGet, "/forecast/grid?"+query.Encode(), nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if err := ReadForecastGrid(client)(c); err != nil {
+		t.Fatalf("ReadForecastGrid: %v", err)
+	}
+
+	var body struct {
+		Features []json.RawMessage `json:"features"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if len(body.Features) != 8 {
+		t.Errorf("got %d features, want 8", len(body.Features))
+	}
+}
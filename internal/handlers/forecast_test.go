@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"gorm.io/gorm"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/database/dbtest"
+	"github.com/mick-io/duplo_go_cloud/internal/datastore"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// benchmarkHours is the number of hourly rows stored per forecast.
+const benchmarkHours = 24
+
+// seedForecasts stores 'n' locations with two forecast snapshots each, so
+// that loading the latest one has to skip the older. The returned counter is
+// incremented by every query run afterwards.
+func seedForecasts(tb testing.TB, n int) (database.Datastore, []models.LocationRecord, *atomic.Int64) {
+	tb.Helper()
+
+	db := dbtest.Open(tb)
+	locations := make([]models.LocationRecord, n)
+	for i := range locations {
+		locations[i] = models.LocationRecord{Latitude: float64(i%180) - 90, Longitude: float64(i % 360)}
+	}
+	if err := db.CreateInBatches(&locations, 500).Error; err != nil {
+		tb.Fatalf("creating locations: %v", err)
+	}
+
+	for snapshot := 0; snapshot < 2; snapshot++ {
+		forecasts := make([]models.ForecastRecord, n)
+		for i, location := range locations {
+			forecasts[i] = models.ForecastRecord{LocationRecordID: location.ID, Timezone: "UTC"}
+		}
+		if err := db.CreateInBatches(&forecasts, 500).Error; err != nil {
+			tb.Fatalf("creating forecasts: %v", err)
+		}
+
+		units := make([]models.HourlyUnitsRecord, n)
+		hourly := make([]models.HourlyRecord, 0, n*benchmarkHours)
+		for i, forecast := range forecasts {
+			units[i] = models.HourlyUnitsRecord{ForecastRecordID: forecast.ID, Temperature2MUnit: "°C"}
+			for hour := 0; hour < benchmarkHours; hour++ {
+				hourly = append(hourly, models.HourlyRecord{
+					ForecastRecordID: forecast.ID,
+					Time:             fmt.Sprintf("2024-01-01T%02d:00", hour),
+					Temperature2M:    float64(hour),
+				})
+			}
+		}
+		if err := db.CreateInBatches(&units, 500).Error; err != nil {
+			tb.Fatalf("creating units: %v", err)
+		}
+		if err := db.CreateInBatches(&hourly, 500).Error; err != nil {
+			tb.Fatalf("creating hourly records: %v", err)
+		}
+	}
+
+	queries := &atomic.Int64{}
+	err := db.Callback().Query().After("gorm:query").Register("test:count", func(*gorm.DB) {
+		queries.Add(1)
+	})
+	if err != nil {
+		tb.Fatalf("registering callback: %v", err)
+	}
+	return datastore.NewGormDatastore(db), locations, queries
+}
+
+// perLocationForecasts loads the latest snapshot of each location with three
+// queries per location, as the forecast handlers did before latestForecasts.
+func perLocationForecasts(db database.Datastore, locations []models.LocationRecord) (map[uint]*forecastSnapshot, error) {
+	snapshots := make(map[uint]*forecastSnapshot, len(locations))
+	for _, location := range locations {
+		snapshot := &forecastSnapshot{}
+		err := db.Last(&snapshot.Forecast, &models.ForecastRecord{LocationRecordID: location.ID})
+		if errors.Is(err, database.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := db.Find(&snapshot.Units, &models.HourlyUnitsRecord{ForecastRecordID: snapshot.Forecast.ID}); err != nil {
+			return nil, err
+		}
+		if err := db.Find(&snapshot.Hourly, &models.HourlyRecord{ForecastRecordID: snapshot.Forecast.ID}); err != nil {
+			return nil, err
+		}
+		snapshots[location.ID] = snapshot
+	}
+	return snapshots, nil
+}
+
+func TestLatestForecasts(t *testing.T) {
+	db, locations, _ := seedForecasts(t, 10)
+
+	got, err := latestForecasts(db, locations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := perLocationForecasts(db, locations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(locations) {
+		t.Fatalf("loaded %d snapshots, want %d", len(got), len(locations))
+	}
+	for id, snapshot := range want {
+		if got[id].Forecast.ID != snapshot.Forecast.ID || got[id].Units.ID != snapshot.Units.ID || len(got[id].Hourly) != benchmarkHours {
+			t.Errorf("snapshot of location %d = forecast %d with %d hours, want forecast %d with %d hours",
+				id, got[id].Forecast.ID, len(got[id].Hourly), snapshot.Forecast.ID, benchmarkHours)
+		}
+	}
+}
+
+// BenchmarkReadStoredForecast compares loading the latest snapshots of a page
+// of locations with latestForecasts and with a query per location. In-memory
+// SQLite has no round trips, so the number of queries is reported as well:
+// each costs a round trip to Postgres.
+func BenchmarkReadStoredForecast(b *testing.B) {
+	loaders := []struct {
+		name string
+		load func(database.Datastore, []models.LocationRecord) (map[uint]*forecastSnapshot, error)
+	}{
+		{"set-based", latestForecasts},
+		{"per-location", perLocationForecasts},
+	}
+
+	for _, n := range []int{1000, 10000} {
+		b.Run(fmt.Sprintf("locations=%d", n), func(b *testing.B) {
+			db, locations, queries := seedForecasts(b, n)
+			for _, loader := range loaders {
+				b.Run(loader.name, func(b *testing.B) {
+					queries.Store(0)
+					for i := 0; i < b.N; i++ {
+						if _, err := loader.load(db, locations); err != nil {
+							b.Fatal(err)
+						}
+					}
+					b.ReportMetric(float64(queries.Load())/float64(b.N), "queries/op")
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"strings"
+
+	"github.com/mick-io/duplo_go_cloud/internal/api"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// usStates maps US state abbreviations to the admin1 names returned by the
+// geocoding API so that queries like "Denver, CO" resolve as expected.
+var usStates = map[string]string{
+	"AL": "Alabama", "AK": "Alaska", "AZ": "Arizona", "AR": "Arkansas",
+	"CA": "California", "CO": "Colorado", "CT": "Connecticut", "DE": "Delaware",
+	"DC": "District of Columbia", "FL": "Florida", "GA": "Georgia", "HI": "Hawaii",
+	"ID": "Idaho", "IL": "Illinois", "IN": "Indiana", "IA": "Iowa",
+	"KS": "Kansas", "KY": "Kentucky", "LA": "Louisiana", "ME": "Maine",
+	"MD": "Maryland", "MA": "Massachusetts", "MI": "Michigan", "MN": "Minnesota",
+	"MS": "Mississippi", "MO": "Missouri", "MT": "Montana", "NE": "Nebraska",
+	"NV": "Nevada", "NH": "New Hampshire", "NJ": "New Jersey", "NM": "New Mexico",
+	"NY": "New York", "NC": "North Carolina", "ND": "North Dakota", "OH": "Ohio",
+	"OK": "Oklahoma", "OR": "Oregon", "PA": "Pennsylvania", "RI": "Rhode Island",
+	"SC": "South Carolina", "SD": "South Dakota", "TN": "Tennessee", "TX": "Texas",
+	"UT": "Utah", "VT": "Vermont", "VA": "Virginia", "WA": "Washington",
+	"WV": "West Virginia", "WI": "Wisconsin", "WY": "Wyoming",
+}
+
+// geocode resolves a free-form query such as "Denver, CO" or "80202" into
+// candidate places. The first comma-separated part is sent to the geocoding
+// API, and any remaining parts are used to narrow down the results by admin
+// region or country.
+func geocode(client api.GeocodingAPIClient, query string) ([]models.GeocodingResult, error) {
+	parts := strings.Split(query, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+
+	resp := models.Geocoding{}
+	if err := client.Search(api.GeocodeOptions{Name: parts[0]}, &resp); err != nil {
+		return nil, err
+	}
+
+	candidates := make([]models.GeocodingResult, 0, len(resp.Results))
+	for _, result := range resp.Results {
+		if matchesQualifiers(result, parts[1:]) {
+			candidates = append(candidates, result)
+		}
+	}
+
+	return candidates, nil
+}
+
+func matchesQualifiers(result models.GeocodingResult, qualifiers []string) bool {
+	for _, q := range qualifiers {
+		if q == "" {
+			continue
+		}
+		if state, ok := usStates[strings.ToUpper(q)]; ok && result.CountryCode == "US" {
+			q = state
+		}
+
+		matched := false
+		for _, field := range []string{result.CountryCode, result.Country, result.Admin1, result.Admin2} {
+			if strings.EqualFold(field, q) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
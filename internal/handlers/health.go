@@ -1,29 +1,46 @@
 package handlers
 
 import (
+	"fmt"
 	"net/http"
 
 	"github.com/labstack/echo/v4"
 
-	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/health"
 	"github.com/mick-io/duplo_go_cloud/internal/models"
 )
 
-func HealthCheckHandler(db database.Datastore) echo.HandlerFunc {
+// HealthCheckHandler reports the health of every component the service
+// depends on. It answers with 503 Service Unavailable when the service is in
+// error, and with 200 OK when it is healthy or degraded.
+func HealthCheckHandler(checker *health.Checker) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		status := models.HealthStatusResponseBody{
-			Status:     "OK",
-			Database:   "OK",
-			WeatherAPI: "OK",
-		}
+		status := checker.Check(c.Request().Context())
 
-		if err := db.HealthCheck(); err != nil {
-			status.Database = "ERROR"
+		if status.Status == health.StatusError {
+			return c.JSON(http.StatusServiceUnavailable, status)
 		}
+		return c.JSON(http.StatusOK, status)
+	}
+}
 
-		if status.Status != "ERROR" {
-			return c.JSON(http.StatusServiceUnavailable, status)
+// Livez reports that the process is up and serving requests. It checks no
+// dependency, so that a dependency outage does not get the service
+// restarted.
+func Livez() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, models.ProbeResponseBody{Status: health.StatusOK})
+	}
+}
+
+// Readyz reports whether the service can serve requests, see
+// health.Checker.Ready.
+func Readyz(checker *health.Checker) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := checker.Ready(c.Request().Context()); err != nil {
+			msg := fmt.Sprintf("Not ready: %v", err)
+			return echo.NewHTTPError(http.StatusServiceUnavailable, msg)
 		}
-		return c.JSON(200, status)
+		return c.JSON(http.StatusOK, models.ProbeResponseBody{Status: health.StatusOK})
 	}
 }
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/history"
+	"github.com/mick-io/duplo_go_cloud/internal/jobs"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// maxHistoryDays is the longest date range returned by ReadHistory.
+const maxHistoryDays = 366
+
+// CreateBackfill submits a job backfilling the history of a location between
+// the 'start' and 'end' dates (YYYY-MM-DD, inclusive, UTC), with a task per
+// chunk of dates. Chunks already backfilled by a previous job are skipped
+// unless 'force' is true, so a partially failed backfill is resumed by
+// submitting it again.
+func CreateBackfill(db database.Datastore, runner *jobs.Runner, chunkDays int) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		// Validating input
+		idParam := c.Param("id")
+		id, err := strconv.Atoi(idParam)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid id parameter: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		start, end, err := parseDateRange(c.QueryParam("start"), c.QueryParam("end"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if end.After(time.Now().UTC()) {
+			msg := "The end date is in the future"
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		force := false
+		if param := c.QueryParam("force"); param != "" {
+			if force, err = strconv.ParseBool(param); err != nil {
+				msg := fmt.Sprintf("Invalid force parameter: %v", err)
+				return echo.NewHTTPError(http.StatusBadRequest, msg)
+			}
+		}
+
+		var location models.LocationRecord
+		if err := db.Find(&location, id); err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+		if location.ID == 0 {
+			msg := fmt.Sprintf("Location not found w/ID: %v", id)
+			return echo.NewHTTPError(http.StatusNotFound, msg)
+		}
+
+		// Skipping chunks that were already backfilled
+		done := []models.JobTaskRecord{}
+		if !force {
+			err := db.Find(&done, `location_record_id = ? AND status = ? AND job_record_id IN (
+				SELECT id FROM job_records WHERE type = ? AND deleted_at IS NULL
+			)`, location.ID, jobs.TaskSucceeded, jobs.TypeBackfill)
+			if err != nil {
+				msg := fmt.Sprintf("Error querying database: %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, msg)
+			}
+		}
+
+		tasks := []models.JobTaskRecord{}
+		for _, window := range history.Chunks(start, end, chunkDays) {
+			if backfilled(done, window) {
+				continue
+			}
+			window := window
+			tasks = append(tasks, models.JobTaskRecord{
+				LocationRecordID: location.ID,
+				WindowStart:      &window.Start,
+				WindowEnd:        &window.End,
+			})
+		}
+
+		// Submitting job
+		job := &models.JobRecord{Type: jobs.TypeBackfill, TenantID: tenantOf(c)}
+		if err := runner.Submit(job, tasks); err != nil {
+			msg := fmt.Sprintf("Error submitting job: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+
+		c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/jobs/%d", job.ID))
+		return c.JSON(http.StatusAccepted, newJobResponse(job, nil))
+	}
+}
+
+// backfilled reports whether one of the finished tasks covers the window.
+func backfilled(done []models.JobTaskRecord, window history.Window) bool {
+	for _, task := range done {
+		if task.WindowStart == nil || task.WindowEnd == nil {
+			continue
+		}
+		if !task.WindowStart.After(window.Start) && !task.WindowEnd.Before(window.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadHistory returns the backfilled hours of a location between the 'start'
+// and 'end' dates (YYYY-MM-DD, inclusive, UTC), in the selected unit system.
+func ReadHistory(db database.Datastore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		// Validating input
+		idParam := c.Param("id")
+		id, err := strconv.Atoi(idParam)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid id parameter: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		start, end, err := parseDateRange(c.QueryParam("start"), c.QueryParam("end"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if end.Sub(start) >= maxHistoryDays*24*time.Hour {
+			msg := fmt.Sprintf("Date range exceeds %d days", maxHistoryDays)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+		selection, err := selectUnits(c)
+		if err != nil {
+			return err
+		}
+
+		var location models.LocationRecord
+		if err := db.Find(&location, id); err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+		if location.ID == 0 {
+			msg := fmt.Sprintf("Location not found w/ID: %v", id)
+			return echo.NewHTTPError(http.StatusNotFound, msg)
+		}
+
+		// Loading history
+		units := models.HistoryUnitsRecord{}
+		if err := db.Find(&units, "location_record_id = ?", location.ID); err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+
+		records := []models.HistoryRecord{}
+		err = db.FindPage(&records, database.Page{Order: "time"},
+			"location_record_id = ? AND time >= ? AND time < ?", location.ID, start, end.AddDate(0, 0, 1))
+		if err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+
+		// Converting to the selected units. Locations without history have
+		// no units and an empty series.
+		system := selection.For(&location)
+		temperatureUnit, precipitationUnit := units.Temperature2MUnit, units.PrecipitationUnit
+		if units.ID != 0 {
+			temperatureUnit, precipitationUnit = system.Temperature, system.Precipitation
+		}
+
+		resp := models.ReadHistoryResponseBody{
+			LocationID: location.ID,
+			Latitude:   location.Latitude,
+			Longitude:  location.Longitude,
+			Timezone:   "GMT",
+			HourlyUnits: models.HourlyUnits{
+				Time:          units.TimeUnit,
+				Temperature2M: temperatureUnit,
+				Precipitation: precipitationUnit,
+			},
+			Hourly: models.ArchiveHourly{
+				Time:          make([]string, len(records)),
+				Temperature2M: make([]*float64, len(records)),
+				Precipitation: make([]*float64, len(records)),
+			},
+		}
+		for i, record := range records {
+			resp.Hourly.Time[i] = record.Time.UTC().Format("2006-01-02T15:04")
+			resp.Hourly.Temperature2M[i], err = convertOptional(record.Temperature2M, units.Temperature2MUnit, temperatureUnit)
+			if err != nil {
+				msg := fmt.Sprintf("Error converting units: %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, msg)
+			}
+			resp.Hourly.Precipitation[i], err = convertOptional(record.Precipitation, units.PrecipitationUnit, precipitationUnit)
+			if err != nil {
+				msg := fmt.Sprintf("Error converting units: %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, msg)
+			}
+		}
+
+		return c.JSON(http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/jobs"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/tenancy"
+)
+
+func CreateRefreshJob(db database.Datastore, runner *jobs.Runner, enforcer *tenancy.Enforcer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		var body models.CreateRefreshJobRequestBody
+		if c.Request().ContentLength != 0 {
+			if err := c.Bind(&body); err != nil {
+				msg := fmt.Sprintf("Failed to parse request body: %v", err)
+				return echo.NewHTTPError(http.StatusBadRequest, msg)
+			}
+		}
+
+		return submitLocationJob(c, db, runner, enforcer, jobs.TypeRefresh, body.LocationIDs)
+	}
+}
+
+// submitLocationJob submits a job of the given type with a task for each
+// location in 'locationIDs', or for every location if it is empty. IDs given
+// more than once get a single task. If 'enforcer' is not nil, each task
+// counts against the refresh budget of the tenant.
+func submitLocationJob(c echo.Context, db database.Datastore, runner *jobs.Runner, enforcer *tenancy.Enforcer, jobType string, locationIDs []uint) error {
+	// Selecting locations
+	locationIDs = dedupeIDs(locationIDs)
+	locations := []models.LocationRecord{}
+	var err error
+	if len(locationIDs) > 0 {
+		err = db.Find(&locations, locationIDs)
+	} else {
+		err = db.Find(&locations)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Error querying database: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, msg)
+	}
+	if len(locationIDs) > 0 && len(locations) != len(locationIDs) {
+		msg := "One or more locations were not found"
+		return echo.NewHTTPError(http.StatusNotFound, msg)
+	}
+	if enforcer != nil {
+		if err := enforcer.AllowRefreshes(c.Request().Context(), db, len(locations)); err != nil {
+			return quotaError(err)
+		}
+	}
+
+	// Submitting job
+	job := &models.JobRecord{Type: jobType, TenantID: tenantOf(c)}
+	tasks := make([]models.JobTaskRecord, len(locations))
+	for i, location := range locations {
+		tasks[i] = models.JobTaskRecord{LocationRecordID: location.ID}
+	}
+	if err := runner.Submit(job, tasks); err != nil {
+		msg := fmt.Sprintf("Error submitting job: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, msg)
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/jobs/%d", job.ID))
+	return c.JSON(http.StatusAccepted, newJobResponse(job, nil))
+}
+
+// dedupeIDs returns 'ids' without duplicates, in the order they first
+// appear.
+func dedupeIDs(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	deduped := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			deduped = append(deduped, id)
+		}
+	}
+	return deduped
+}
+
+func ReadJob(db database.Datastore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		idParam := c.Param("id")
+		id, err := strconv.Atoi(idParam)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid id parameter: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		job := models.JobRecord{}
+		if err := db.Find(&job, id); err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+		if job.ID == 0 {
+			msg := fmt.Sprintf("Job not found w/ID: %v", id)
+			return echo.NewHTTPError(http.StatusNotFound, msg)
+		}
+
+		tasks := []models.JobTaskRecord{}
+		if err := db.FindPage(&tasks, database.Page{Order: "id"}, &models.JobTaskRecord{JobRecordID: job.ID}); err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+
+		return c.JSON(http.StatusOK, newJobResponse(&job, tasks))
+	}
+}
+
+func CancelJob(db database.Datastore, runner *jobs.Runner) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		idParam := c.Param("id")
+		id, err := strconv.Atoi(idParam)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid id parameter: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		// Ensuring the job belongs to the tenant, as the runner is not scoped
+		job := models.JobRecord{}
+		if err := db.Find(&job, id); err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+		if job.ID == 0 {
+			msg := fmt.Sprintf("Job not found w/ID: %v", id)
+			return echo.NewHTTPError(http.StatusNotFound, msg)
+		}
+
+		err = runner.Cancel(uint(id))
+		switch {
+		case errors.Is(err, jobs.ErrNotFound):
+			msg := fmt.Sprintf("Job not found w/ID: %v", id)
+			return echo.NewHTTPError(http.StatusNotFound, msg)
+		case errors.Is(err, jobs.ErrFinished):
+			msg := fmt.Sprintf("Job w/ID: %v has already finished", id)
+			return echo.NewHTTPError(http.StatusConflict, msg)
+		case err != nil:
+			msg := fmt.Sprintf("Error cancelling job: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+
+		return c.NoContent(http.StatusAccepted)
+	}
+}
+
+func newJobResponse(job *models.JobRecord, tasks []models.JobTaskRecord) models.JobResponseBody {
+	resp := models.JobResponseBody{
+		ID:         job.ID,
+		Type:       job.Type,
+		Status:     job.Status,
+		Total:      job.Total,
+		Succeeded:  job.Succeeded,
+		Failed:     job.Failed,
+		Skipped:    job.Skipped,
+		Error:      job.Error,
+		CreatedAt:  job.CreatedAt,
+		StartedAt:  job.StartedAt,
+		FinishedAt: job.FinishedAt,
+	}
+
+	if tasks != nil {
+		resp.Tasks = make([]models.JobTaskResponseBody, len(tasks))
+		for i, task := range tasks {
+			resp.Tasks[i] = models.JobTaskResponseBody{
+				LocationID:  task.LocationRecordID,
+				Status:      task.Status,
+				ForecastID:  task.ForecastRecordID,
+				WindowStart: task.WindowStart,
+				WindowEnd:   task.WindowEnd,
+				Error:       task.Error,
+				FinishedAt:  task.FinishedAt,
+			}
+		}
+	}
+
+	return resp
+}
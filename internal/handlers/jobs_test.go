@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/mick-io/duplo_go_cloud/internal/jobs"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+func TestCreateRefreshJobDedupesLocations(t *testing.T) {
+	f := newTenantFixture(t)
+	runner := jobs.NewRunner(f.db)
+	runner.Register(jobs.TypeRefresh, func(ctx context.Context, job *jobs.Progress) error { return nil })
+	t.Cleanup(func() { runner.Shutdown(context.Background()) })
+
+	body := fmt.Sprintf(`{"location_ids":[%d,%d,%d]}`, f.locA.ID, f.locA.ID, f.locA.ID)
+	c, rec := newTenantContext(f.ctxA, http.MethodPost, "/jobs/refresh", body)
+	if err := CreateRefreshJob(f.db, runner, nil)(c); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := models.JobResponseBody{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusAccepted || resp.Total != 1 {
+		t.Errorf("status = %d with %d tasks, want %d with 1", rec.Code, resp.Total, http.StatusAccepted)
+	}
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/auth"
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// CreateAPIKey creates an API key. The key is only returned in this
+// response; only its hash is stored.
+func CreateAPIKey(db database.Datastore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		// Validating input
+		var body models.CreateAPIKeyRequestBody
+		if err := c.Bind(&body); err != nil {
+			msg := fmt.Sprintf("Failed to parse request body: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+		if err := body.Validate(); err != nil {
+			msg := fmt.Sprintf("Invalid request body: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+		if body.ExpiresAt != nil && !body.ExpiresAt.After(time.Now()) {
+			msg := "The expiry date is in the past"
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		// Storing key
+		record, key, err := auth.CreateKey(db, body.Name, body.Scopes, body.ExpiresAt)
+		if err != nil {
+			msg := fmt.Sprintf("Error storing API key: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+
+		return c.JSON(http.StatusCreated, models.CreateAPIKeyResponseBody{
+			APIKeyResponseBody: newAPIKeyResponse(record),
+			Key:                key,
+		})
+	}
+}
+
+// ReadAPIKeys lists the API keys, revoked and expired ones included.
+func ReadAPIKeys(db database.Datastore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		records := []models.APIKeyRecord{}
+		if err := db.FindPage(&records, database.Page{Order: "id"}); err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+
+		resp := make([]models.APIKeyResponseBody, len(records))
+		for i := range records {
+			resp[i] = newAPIKeyResponse(&records[i])
+		}
+
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+// RevokeAPIKey revokes an API key. Revoked keys are kept so that they can
+// still be listed.
+func RevokeAPIKey(db database.Datastore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		idParam := c.Param("id")
+		id, err := strconv.Atoi(idParam)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid id parameter: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		var record models.APIKeyRecord
+		if err := db.Find(&record, id); err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+		if record.ID == 0 {
+			msg := fmt.Sprintf("API key not found w/ID: %v", id)
+			return echo.NewHTTPError(http.StatusNotFound, msg)
+		}
+
+		if record.RevokedAt == nil {
+			now := time.Now()
+			record.RevokedAt = &now
+			if err := db.Save(&record); err != nil {
+				msg := fmt.Sprintf("Error storing API key: %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, msg)
+			}
+		}
+
+		return c.JSON(http.StatusOK, newAPIKeyResponse(&record))
+	}
+}
+
+func newAPIKeyResponse(record *models.APIKeyRecord) models.APIKeyResponseBody {
+	return models.APIKeyResponseBody{
+		ID:         record.ID,
+		Name:       record.Name,
+		Prefix:     record.Prefix,
+		Scopes:     auth.KeyScopes(record),
+		CreatedAt:  record.CreatedAt,
+		ExpiresAt:  record.ExpiresAt,
+		RevokedAt:  record.RevokedAt,
+		LastUsedAt: record.LastUsedAt,
+	}
+}
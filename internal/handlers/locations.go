@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
 
@@ -9,11 +10,17 @@ import (
 
 	"github.com/mick-io/duplo_go_cloud/internal/api"
 	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/enrichment"
 	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/refresh"
+	"github.com/mick-io/duplo_go_cloud/internal/tenancy"
+	"github.com/mick-io/duplo_go_cloud/internal/units"
 )
 
-func CreateLocation(db database.Datastore, WeatherAPIClient api.WeatherAPIClient) echo.HandlerFunc {
+func CreateLocation(db database.Datastore, engine *refresh.Engine, GeocodingAPIClient api.GeocodingAPIClient, enricher *enrichment.Pipeline, enforcer *tenancy.Enforcer) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
 		// Location data validation
 		var body models.CreateLocationRequestBody
 		if err := c.Bind(&body); err != nil {
@@ -25,95 +32,290 @@ func CreateLocation(db database.Datastore, WeatherAPIClient api.WeatherAPIClient
 			msg := fmt.Sprintf("Failed to validate location data: %v", err)
 			return echo.NewHTTPError(http.StatusBadRequest, msg)
 		}
+		defaultUnits, err := parseLocationUnits(body.Units)
+		if err != nil {
+			return err
+		}
+
+		// Resolving place name or postal code
+		loc := &models.LocationRecord{
+			Latitude:  body.Latitude,
+			Longitude: body.Longitude,
+		}
+		if body.Query != "" || body.GeocodingID != 0 {
+			var place models.GeocodingResult
+			if body.GeocodingID != 0 {
+				if err := GeocodingAPIClient.Get(body.GeocodingID, &place); err != nil {
+					msg := fmt.Sprintf("Error geocoding location: %v", err)
+					return echo.NewHTTPError(http.StatusBadGateway, msg)
+				}
+			} else {
+				candidates, err := geocode(GeocodingAPIClient, body.Query)
+				if err != nil {
+					msg := fmt.Sprintf("Error geocoding location: %v", err)
+					return echo.NewHTTPError(http.StatusBadGateway, msg)
+				}
+				if len(candidates) == 0 {
+					msg := fmt.Sprintf("No locations found matching query: %v", body.Query)
+					return echo.NewHTTPError(http.StatusNotFound, msg)
+				}
+				if len(candidates) > 1 {
+					return c.JSON(http.StatusMultipleChoices, models.GeocodingCandidatesResponseBody{
+						Message:    "Query matched multiple locations, resubmit with a geocoding_id",
+						Candidates: candidates,
+					})
+				}
+				place = candidates[0]
+			}
+			loc = models.NewGeocodedLocationRecord(&place)
+		}
+		loc.Units = defaultUnits
+		loc.Tags = models.NormalizeTags(body.Tags)
 
 		// Checking for conflicting location
 		record := models.LocationRecord{}
-		if err := db.Find(&record, &models.LocationRecord{Latitude: body.Latitude, Longitude: body.Longitude}); err != nil {
+		if err := db.Find(&record, &models.LocationRecord{Latitude: loc.Latitude, Longitude: loc.Longitude}); err != nil {
 			msg := fmt.Sprintf("Error querying database: %v", err)
 			return echo.NewHTTPError(http.StatusInternalServerError, msg)
 		}
 		if record.ID != 0 {
 			return echo.NewHTTPError(http.StatusConflict, models.CreateLocationResponseBody{
-				ID:        record.ID,
-				Latitude:  record.Latitude,
-				Longitude: record.Longitude,
+				ID:          record.ID,
+				Latitude:    record.Latitude,
+				Longitude:   record.Longitude,
+				Name:        record.Name,
+				Country:     record.Country,
+				AdminRegion: record.AdminRegion,
+				CountryCode: record.CountryCode,
+				Timezone:    record.Timezone,
+				Elevation:   record.Elevation,
+				Units:       record.Units,
+				Tags:        record.TagList(),
 			})
 		}
 
-		// Storing location
-		loc := &models.LocationRecord{
-			Latitude:  body.Latitude,
-			Longitude: body.Longitude,
-		}
-		if err := db.Create(&loc); err != nil {
-			msg := fmt.Sprintf("Error storing location: %v", err)
+		// Checking tenant quotas and storing location while the tenant is
+		// locked, so that concurrent requests cannot exceed the location
+		// quota. The new location is refreshed right away.
+		var storeErr error
+		err = enforcer.WithQuota(c.Request().Context(), db, func(tx database.Datastore, quota *tenancy.Quota) error {
+			if err := quota.AllowLocations(1); err != nil {
+				return err
+			}
+			if err := quota.AllowRefreshes(1); err != nil {
+				return err
+			}
+			storeErr = tx.Create(&loc)
+			return storeErr
+		})
+		if storeErr != nil {
+			msg := fmt.Sprintf("Error storing location: %v", storeErr)
 			return echo.NewHTTPError(http.StatusInternalServerError, msg)
 		}
-
-		// Fetching forecast data
-		resp := models.Forecast{}
-		opts := api.ForecastOptions{
-			Latitude:  strconv.FormatFloat(body.Latitude, 'f', 6, 64),
-			Longitude: strconv.FormatFloat(body.Longitude, 'f', 6, 64),
-		}
-		if err := WeatherAPIClient.GetForecast(opts, &resp); err != nil {
-			msg := fmt.Sprintf("Error getting forecast: %v", err)
-			return echo.NewHTTPError(http.StatusBadGateway, msg)
+		if err != nil {
+			return quotaError(err)
 		}
 
-		// Validating forecast data
-		if err := models.ValidateForecast(resp); err != nil {
-			msg := fmt.Sprintf("Error validating forecast: %v", err)
-			return echo.NewHTTPError(http.StatusBadGateway, msg)
+		// Enriching location created from raw coordinates. Enrichment is best
+		// effort, partial results are kept and it can be re-run through the
+		// admin endpoints.
+		if body.Query == "" && body.GeocodingID == 0 {
+			if err := enricher.Run(loc); err != nil {
+				slog.WarnContext(c.Request().Context(), "Error enriching location", "location_id", loc.ID, "error", err)
+			}
+			if err := db.Save(loc); err != nil {
+				msg := fmt.Sprintf("Error storing location enrichment: %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError, msg)
+			}
 		}
 
-		// Storing forecast data
-		forecast := models.NewForecastRecords(loc.ID, &resp)
-		if err := db.Save(forecast); err != nil {
-			msg := fmt.Sprintf("Error storing forecast: %v", err)
-			return echo.NewHTTPError(http.StatusInternalServerError, msg)
-		}
-		hourly := models.NewHourlyRecord(forecast.Model.ID, &resp.Hourly)
-		if err := db.Create(&hourly); err != nil {
-			msg := fmt.Sprintf("Error storing hourly records: %v", err)
-			return echo.NewHTTPError(http.StatusInternalServerError, msg)
-		}
-		units := models.NewHourlyUnitsRecord(forecast.Model.ID, &resp.HourlyUnits)
-		if err := db.Save(units); err != nil {
-			msg := fmt.Sprintf("Error storing unit records: %v", err)
-			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		// Fetching and storing forecast data
+		if _, err := engine.Refresh(c.Request().Context(), loc); err != nil {
+			return refreshError(err)
 		}
 
 		// Responding with location data
 		return c.JSON(http.StatusOK, models.CreateLocationResponseBody{
-			ID:        loc.ID,
-			Latitude:  loc.Latitude,
-			Longitude: loc.Longitude,
+			ID:          loc.ID,
+			Latitude:    loc.Latitude,
+			Longitude:   loc.Longitude,
+			Name:        loc.Name,
+			Country:     loc.Country,
+			AdminRegion: loc.AdminRegion,
+			CountryCode: loc.CountryCode,
+			Timezone:    loc.Timezone,
+			Elevation:   loc.Elevation,
+			Units:       loc.Units,
+			Tags:        loc.TagList(),
 		})
 	}
 }
 
 func ReadLocations(db database.Datastore) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		params, err := parseLocationPage(c)
+		if err != nil {
+			return err
+		}
+
 		records := []models.LocationRecord{}
-		if err := db.Find(&records); err != nil {
+		if err := db.FindPage(&records, params.Page(), params.Where()...); err != nil {
 			msg := fmt.Sprintf("Error querying database: %v", err)
 			return echo.NewHTTPError(http.StatusInternalServerError, msg)
 		}
+		records, next := trimLocationPage(&params, records)
 
 		resp := make([]models.ReadLocationResponseBody, len(records))
 		for i, record := range records {
 			resp[i] = models.ReadLocationResponseBody{
-				ID:        record.ID,
-				Latitude:  record.Latitude,
-				Longitude: record.Longitude,
+				ID:          record.ID,
+				Latitude:    record.Latitude,
+				Longitude:   record.Longitude,
+				Name:        record.Name,
+				Country:     record.Country,
+				AdminRegion: record.AdminRegion,
+				CountryCode: record.CountryCode,
+				Timezone:    record.Timezone,
+				Elevation:   record.Elevation,
+				Units:       record.Units,
+				Tags:        record.TagList(),
 			}
 		}
 
-		return c.JSON(http.StatusOK, resp)
+		return writePage(c, &params, resp, next)
 	}
 }
 
+// UpdateLocationUnits sets the unit system the forecasts of a location are
+// rendered in when a request does not select one.
+func UpdateLocationUnits(db database.Datastore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		// Validating input
+		idParam := c.Param("id")
+		id, err := strconv.Atoi(idParam)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid id parameter: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		var body models.UpdateLocationUnitsRequestBody
+		if err := c.Bind(&body); err != nil {
+			msg := fmt.Sprintf("Failed to parse request body: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+		defaultUnits, err := parseLocationUnits(body.Units)
+		if err != nil {
+			return err
+		}
+
+		var location models.LocationRecord
+		if err := db.Find(&location, id); err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+		if location.ID == 0 {
+			msg := fmt.Sprintf("Location not found w/ID: %v", id)
+			return echo.NewHTTPError(http.StatusNotFound, msg)
+		}
+
+		// Storing units
+		location.Units = defaultUnits
+		if err := db.Save(&location); err != nil {
+			msg := fmt.Sprintf("Error storing location: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+
+		return c.JSON(http.StatusOK, models.ReadLocationResponseBody{
+			ID:          location.ID,
+			Latitude:    location.Latitude,
+			Longitude:   location.Longitude,
+			Name:        location.Name,
+			Country:     location.Country,
+			AdminRegion: location.AdminRegion,
+			CountryCode: location.CountryCode,
+			Timezone:    location.Timezone,
+			Elevation:   location.Elevation,
+			Units:       location.Units,
+			Tags:        location.TagList(),
+		})
+	}
+}
+
+// UpdateLocationTags replaces the tags of a location, which the forecast
+// stream can be filtered by.
+func UpdateLocationTags(db database.Datastore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		// Validating input
+		idParam := c.Param("id")
+		id, err := strconv.Atoi(idParam)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid id parameter: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		var body models.UpdateLocationTagsRequestBody
+		if err := c.Bind(&body); err != nil {
+			msg := fmt.Sprintf("Failed to parse request body: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+		if err := body.Validate(); err != nil {
+			msg := fmt.Sprintf("Failed to validate tags: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		var location models.LocationRecord
+		if err := db.Find(&location, id); err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+		if location.ID == 0 {
+			msg := fmt.Sprintf("Location not found w/ID: %v", id)
+			return echo.NewHTTPError(http.StatusNotFound, msg)
+		}
+
+		// Storing tags
+		location.Tags = models.NormalizeTags(body.Tags)
+		if err := db.Save(&location); err != nil {
+			msg := fmt.Sprintf("Error storing location: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+
+		return c.JSON(http.StatusOK, models.ReadLocationResponseBody{
+			ID:          location.ID,
+			Latitude:    location.Latitude,
+			Longitude:   location.Longitude,
+			Name:        location.Name,
+			Country:     location.Country,
+			AdminRegion: location.AdminRegion,
+			CountryCode: location.CountryCode,
+			Timezone:    location.Timezone,
+			Elevation:   location.Elevation,
+			Units:       location.Units,
+			Tags:        location.TagList(),
+		})
+	}
+}
+
+// parseLocationUnits validates the default unit system of a location and
+// returns its normalized specification. An empty system is kept empty.
+func parseLocationUnits(spec string) (string, error) {
+	if spec == "" {
+		return "", nil
+	}
+	system, err := units.Parse(spec)
+	if err != nil {
+		msg := fmt.Sprintf("Invalid units: %v", err)
+		return "", echo.NewHTTPError(http.StatusBadRequest, msg)
+	}
+	return system.String(), nil
+}
+
 // func UpdateLocation(db database.Datastore) echo.HandlerFunc {
 // 	return func(c echo.Context) error {
 // 		var body models.UpdateLocationRequestBody
@@ -161,6 +363,8 @@ func ReadLocations(db database.Datastore) echo.HandlerFunc {
 
 func DeleteLocationByID(db database.Datastore) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
 		idParam := c.Param("id")
 		id, err := strconv.Atoi(idParam)
 		if err != nil {
@@ -185,15 +389,23 @@ func DeleteLocationByID(db database.Datastore) echo.HandlerFunc {
 		}
 
 		return c.JSON(http.StatusNoContent, models.DeleteLocationResponseBody{
-			ID:        record.ID,
-			Latitude:  record.Latitude,
-			Longitude: record.Longitude,
+			ID:          record.ID,
+			Latitude:    record.Latitude,
+			Longitude:   record.Longitude,
+			Name:        record.Name,
+			Country:     record.Country,
+			AdminRegion: record.AdminRegion,
+			CountryCode: record.CountryCode,
+			Timezone:    record.Timezone,
+			Elevation:   record.Elevation,
 		})
 	}
 }
 
 func DeleteLocationByLatLong(db database.Datastore) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
 		// Validating input
 		latitudeParam := c.QueryParam("latitude")
 		longitudeParam := c.QueryParam("longitude")
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/api"
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/units"
+	"github.com/mick-io/duplo_go_cloud/internal/verification"
+)
+
+// maxArchiveDays is the longest date range imported from the archive API in
+// a single request.
+const maxArchiveDays = 92
+
+// archiveDateLayout is the layout of the dates of archive requests.
+const archiveDateLayout = "2006-01-02"
+
+// CreateObservations stores observations pushed by sensors for a location.
+// Values are in the unit system selected by the request and stored in
+// ObservationUnits. Observation times are truncated to the hour;
+// observations already stored for the same hour and variable are replaced.
+func CreateObservations(db database.Datastore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		// Validating input
+		idParam := c.Param("id")
+		id, err := strconv.Atoi(idParam)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid id parameter: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		var body models.CreateObservationsRequestBody
+		if err := c.Bind(&body); err != nil {
+			msg := fmt.Sprintf("Failed to parse request body: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+		if err := body.Validate(); err != nil {
+			msg := fmt.Sprintf("Invalid request body: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+		selection, err := selectUnits(c)
+		if err != nil {
+			return err
+		}
+
+		var location models.LocationRecord
+		if err := db.Find(&location, id); err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+		if location.ID == 0 {
+			msg := fmt.Sprintf("Location not found w/ID: %v", id)
+			return echo.NewHTTPError(http.StatusNotFound, msg)
+		}
+
+		// Converting observations
+		system := selection.For(&location)
+		now := time.Now()
+		records := []models.ObservationRecord{}
+		for i, observation := range body.Observations {
+			if observation.Time.After(now) {
+				msg := fmt.Sprintf("Observation %d is in the future", i)
+				return echo.NewHTTPError(http.StatusBadRequest, msg)
+			}
+
+			t := observation.Time.UTC().Truncate(time.Hour)
+			values := []struct {
+				variable string
+				value    *float64
+				from, to string
+			}{
+				{models.VariableTemperature2M, observation.Temperature2M, system.Temperature, models.ObservationUnits.Temperature2M},
+				{models.VariablePrecipitation, observation.Precipitation, system.Precipitation, models.ObservationUnits.Precipitation},
+			}
+			for _, v := range values {
+				if v.value == nil {
+					continue
+				}
+				value, err := units.Convert(*v.value, v.from, v.to)
+				if err != nil {
+					msg := fmt.Sprintf("Error converting units: %v", err)
+					return echo.NewHTTPError(http.StatusInternalServerError, msg)
+				}
+				records = append(records, models.ObservationRecord{
+					LocationRecordID: location.ID,
+					Time:             t,
+					Variable:         v.variable,
+					Value:            value,
+					Unit:             v.to,
+					Source:           models.ObservationSourceSensor,
+				})
+			}
+		}
+
+		return storeObservations(c, db, location.ID, records)
+	}
+}
+
+// ImportObservations imports the observations of a location between the
+// 'start' and 'end' dates (YYYY-MM-DD, inclusive, UTC) from the archive API.
+func ImportObservations(db database.Datastore, archive api.ArchiveAPIClient) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		// Validating input
+		idParam := c.Param("id")
+		id, err := strconv.Atoi(idParam)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid id parameter: %v", err)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		start, end, err := parseDateRange(c.QueryParam("start"), c.QueryParam("end"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if end.Sub(start) >= maxArchiveDays*24*time.Hour {
+			msg := fmt.Sprintf("Date range exceeds %d days", maxArchiveDays)
+			return echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+
+		var location models.LocationRecord
+		if err := db.Find(&location, id); err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+		if location.ID == 0 {
+			msg := fmt.Sprintf("Location not found w/ID: %v", id)
+			return echo.NewHTTPError(http.StatusNotFound, msg)
+		}
+
+		// Fetching observations
+		opts := api.ArchiveOptions{
+			Latitude:  strconv.FormatFloat(location.Latitude, 'f', -1, 64),
+			Longitude: strconv.FormatFloat(location.Longitude, 'f', -1, 64),
+			StartDate: start.Format(archiveDateLayout),
+			EndDate:   end.Format(archiveDateLayout),
+		}
+		var resp models.Archive
+		if err := archive.GetArchive(c.Request().Context(), opts, &resp); err != nil {
+			slog.ErrorContext(c.Request().Context(), "Error fetching observations", "location_id", location.ID, "error", err)
+			msg := fmt.Sprintf("Error getting observations: %v", err)
+			return echo.NewHTTPError(http.StatusBadGateway, msg)
+		}
+
+		records, err := models.NewObservationRecords(location.ID, &resp)
+		if err != nil {
+			msg := fmt.Sprintf("Error parsing observations: %v", err)
+			return echo.NewHTTPError(http.StatusBadGateway, msg)
+		}
+
+		return storeObservations(c, db, location.ID, records)
+	}
+}
+
+func storeObservations(c echo.Context, db database.Datastore, locationID uint, records []models.ObservationRecord) error {
+	stored, err := verification.StoreObservations(db, locationID, records)
+	if err != nil {
+		msg := fmt.Sprintf("Error storing observations: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, msg)
+	}
+
+	resp := models.CreateObservationsResponseBody{
+		LocationID: locationID,
+		Stored:     stored,
+	}
+	for i, record := range records {
+		if i == 0 || record.Time.Before(resp.From) {
+			resp.From = record.Time
+		}
+		if i == 0 || record.Time.After(resp.To) {
+			resp.To = record.Time
+		}
+	}
+
+	return c.JSON(http.StatusCreated, resp)
+}
+
+// parseDateRange parses the required 'start' and 'end' YYYY-MM-DD dates of
+// an inclusive range.
+func parseDateRange(startParam, endParam string) (time.Time, time.Time, error) {
+	if startParam == "" || endParam == "" {
+		return time.Time{}, time.Time{}, errors.New("The start and end parameters are required")
+	}
+
+	start, err := time.Parse(archiveDateLayout, startParam)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("Invalid start parameter: %v", err)
+	}
+	end, err := time.Parse(archiveDateLayout, endParam)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("Invalid end parameter: %v", err)
+	}
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, errors.New("The end date is before the start date")
+	}
+
+	return start, end, nil
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/pagination"
+)
+
+// locationSortColumns maps the sort names accepted by location list
+// endpoints to their columns.
+var locationSortColumns = map[string]string{
+	"id":         "id",
+	"latitude":   "latitude",
+	"longitude":  "longitude",
+	"name":       "name",
+	"created_at": "created_at",
+}
+
+func locationSortValue(record *models.LocationRecord, sort string) interface{} {
+	switch sort {
+	case "latitude":
+		return record.Latitude
+	case "longitude":
+		return record.Longitude
+	case "name":
+		return record.Name
+	case "created_at":
+		return record.CreatedAt
+	}
+	return record.ID
+}
+
+// parseLocationPage parses the pagination parameters of a location list
+// request.
+func parseLocationPage(c echo.Context) (pagination.Params, error) {
+	params, err := pagination.Parse(c.QueryParams(), locationSortColumns, "id")
+	if err != nil {
+		msg := fmt.Sprintf("Invalid pagination parameters: %v", err)
+		return params, echo.NewHTTPError(http.StatusBadRequest, msg)
+	}
+	return params, nil
+}
+
+// trimLocationPage drops the extra record fetched to detect another page and
+// returns the cursor of the next page, or nil if this is the last one.
+func trimLocationPage(params *pagination.Params, records []models.LocationRecord) ([]models.LocationRecord, *string) {
+	if !params.HasMore(len(records)) {
+		return records, nil
+	}
+
+	records = records[:params.Limit]
+	last := &records[len(records)-1]
+	next := params.NextCursor(locationSortValue(last, params.Sort), last.ID)
+	return records, &next
+}
+
+// writePage responds with a page of items, applying the requested sparse
+// fieldset and linking to the next page.
+func writePage[T any](c echo.Context, params *pagination.Params, items []T, next *string) error {
+	data, err := pagination.SelectFields(items, params.Fields)
+	if err != nil {
+		msg := fmt.Sprintf("Error selecting fields: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, msg)
+	}
+
+	if next != nil {
+		link := pagination.NextLink(c.Request().URL, *next)
+		c.Response().Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, link))
+	}
+
+	return c.JSON(http.StatusOK, models.PageResponseBody{
+		Data:       data,
+		NextCursor: next,
+	})
+}
@@ -0,0 +1,522 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/auth"
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/pubsub"
+	"github.com/mick-io/duplo_go_cloud/internal/ratelimit"
+	"github.com/mick-io/duplo_go_cloud/internal/refresh"
+	"github.com/mick-io/duplo_go_cloud/internal/tenancy"
+)
+
+// Message types exchanged over the forecast WebSocket.
+const (
+	socketSubscribe   = "subscribe"
+	socketUnsubscribe = "unsubscribe"
+	socketRefresh     = "refresh"
+
+	socketSubscribed   = "subscribed"
+	socketUnsubscribed = "unsubscribed"
+	socketRefreshed    = "refreshed"
+	socketDelta        = "forecast.delta"
+	socketError        = "error"
+)
+
+// SocketOptions limits the resources used by each forecast WebSocket
+// connection. Zero values select the defaults.
+type SocketOptions struct {
+	// MaxSubscriptions is the maximum number of locations a connection can
+	// subscribe to, and the maximum number refreshed by a single request.
+	MaxSubscriptions int
+	// SendBuffer is the number of outgoing messages queued per connection.
+	// A client that does not read fast enough to keep the queue from
+	// filling up is disconnected.
+	SendBuffer int
+	// ReadLimit is the maximum size in bytes of a client message.
+	ReadLimit int64
+	// PingInterval is the interval between keepalive pings. A client that
+	// sends nothing, pongs included, for two intervals is disconnected.
+	PingInterval time.Duration
+	// WriteTimeout bounds the time spent writing a single message.
+	WriteTimeout time.Duration
+	// Limiter counts every refresh message against RefreshLimit, per
+	// client, like the requests of the routes calling the weather API.
+	// Refreshes are not rate limited without a Limiter.
+	Limiter      *ratelimit.Limiter
+	RefreshLimit ratelimit.Rule
+}
+
+func (o SocketOptions) withDefaults() SocketOptions {
+	if o.MaxSubscriptions <= 0 {
+		o.MaxSubscriptions = 100
+	}
+	if o.SendBuffer <= 0 {
+		o.SendBuffer = 32
+	}
+	if o.ReadLimit <= 0 {
+		o.ReadLimit = 4096
+	}
+	if o.PingInterval <= 0 {
+		o.PingInterval = 30 * time.Second
+	}
+	if o.WriteTimeout <= 0 {
+		o.WriteTimeout = 10 * time.Second
+	}
+	return o
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// ForecastSocket serves a bidirectional forecast WebSocket. Clients send
+// SocketRequestBody messages to subscribe to, unsubscribe from or refresh
+// locations, and receive a SocketMessage delta holding only the changed
+// hours whenever a subscribed location gets a new forecast. Refreshes count
+// against the refresh budget of the tenant.
+func ForecastSocket(db database.Datastore, engine *refresh.Engine, enforcer *tenancy.Enforcer, hub *pubsub.Hub, opts SocketOptions) echo.HandlerFunc {
+	opts = opts.withDefaults()
+
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		selection, err := selectUnits(c)
+		if err != nil {
+			return err
+		}
+
+		ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+		if err != nil {
+			// The upgrader has already replied with an HTTP error
+			return nil
+		}
+
+		sub, _ := hub.Subscribe(pubsub.Filter{
+			TenantID: tenantOf(c),
+			Types:    []string{pubsub.EventForecastRefreshed},
+		}, 0)
+		defer sub.Cancel()
+
+		conn := newSocketConn(c.Request().Context(), ws, db, engine, enforcer, selection, opts)
+		if principal := auth.PrincipalFrom(c); principal != nil {
+			conn.canRefresh = principal.HasScope(auth.ScopeForecastRefresh)
+		}
+		if opts.Limiter != nil {
+			conn.client = opts.Limiter.Key(c)
+		}
+		go conn.writeLoop()
+		go conn.eventLoop(sub)
+		conn.readLoop()
+
+		conn.close(websocket.CloseNormalClosure, "")
+		<-conn.done
+		return nil
+	}
+}
+
+// locationState is the forecast last sent to a client for a location.
+type locationState struct {
+	forecastID uint
+	hours      map[string]models.ForecastHour
+}
+
+// socketConn is a single forecast WebSocket connection. Reads happen on the
+// handler goroutine, writes on writeLoop, and hub events are turned into
+// deltas on eventLoop.
+type socketConn struct {
+	ws       *websocket.Conn
+	db       database.Datastore
+	engine   *refresh.Engine
+	enforcer *tenancy.Enforcer
+	units    *unitSelection
+	opts     SocketOptions
+
+	// canRefresh is whether the client was granted the forecast:refresh
+	// scope, which refresh messages require.
+	canRefresh bool
+	// client is the client refresh messages are rate limited against.
+	client string
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	closeMsg  []byte
+	out       chan models.SocketMessage
+	done      chan struct{}
+
+	refreshing atomic.Bool
+
+	// mu guards subs, and is held while queueing deltas so that the deltas
+	// of a location are queued in the order they were computed.
+	mu   sync.Mutex
+	subs map[uint]*locationState
+}
+
+// newSocketConn creates a connection whose context keeps the values of the
+// request context, the tenant included, but not its cancellation.
+func newSocketConn(parent context.Context, ws *websocket.Conn, db database.Datastore, engine *refresh.Engine, enforcer *tenancy.Enforcer, units *unitSelection, opts SocketOptions) *socketConn {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(parent))
+	return &socketConn{
+		ws:       ws,
+		db:       db,
+		engine:   engine,
+		enforcer: enforcer,
+		units:    units,
+		opts:     opts,
+		ctx:      ctx,
+		cancel:   cancel,
+		out:      make(chan models.SocketMessage, opts.SendBuffer),
+		done:     make(chan struct{}),
+		subs:     map[uint]*locationState{},
+	}
+}
+
+// close ends the connection with the given close code. Only the first call
+// has an effect.
+func (c *socketConn) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeMsg = websocket.FormatCloseMessage(code, reason)
+		c.cancel()
+	})
+}
+
+// send queues a message without blocking, disconnecting the client if its
+// queue is full.
+func (c *socketConn) send(msg models.SocketMessage) {
+	select {
+	case c.out <- msg:
+	default:
+		c.close(websocket.ClosePolicyViolation, "send buffer full")
+	}
+}
+
+func (c *socketConn) sendError(locationID uint, format string, args ...interface{}) {
+	c.send(models.SocketMessage{
+		Type:       socketError,
+		LocationID: locationID,
+		Error:      fmt.Sprintf(format, args...),
+	})
+}
+
+func (c *socketConn) writeLoop() {
+	defer close(c.done)
+	defer c.ws.Close()
+
+	ticker := time.NewTicker(c.opts.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			deadline := time.Now().Add(c.opts.WriteTimeout)
+			_ = c.ws.WriteControl(websocket.CloseMessage, c.closeMsg, deadline)
+			return
+		case msg := <-c.out:
+			_ = c.ws.SetWriteDeadline(time.Now().Add(c.opts.WriteTimeout))
+			if err := c.ws.WriteJSON(msg); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ticker.C:
+			deadline := time.Now().Add(c.opts.WriteTimeout)
+			if err := c.ws.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		}
+	}
+}
+
+func (c *socketConn) readLoop() {
+	extendDeadline := func() error {
+		return c.ws.SetReadDeadline(time.Now().Add(2 * c.opts.PingInterval))
+	}
+
+	c.ws.SetReadLimit(c.opts.ReadLimit)
+	_ = extendDeadline()
+	c.ws.SetPongHandler(func(string) error { return extendDeadline() })
+
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		_ = extendDeadline()
+
+		var req models.SocketRequestBody
+		if err := json.Unmarshal(data, &req); err != nil {
+			c.sendError(0, "Invalid message: %v", err)
+			continue
+		}
+		if err := req.Validate(); err != nil {
+			c.sendError(0, "Invalid message: %v", err)
+			continue
+		}
+		if len(req.LocationIDs) > c.opts.MaxSubscriptions {
+			c.sendError(0, "Too many locations: at most %d per message", c.opts.MaxSubscriptions)
+			continue
+		}
+
+		switch req.Type {
+		case socketSubscribe:
+			c.subscribe(req.LocationIDs)
+		case socketUnsubscribe:
+			c.unsubscribe(req.LocationIDs)
+		case socketRefresh:
+			if !c.canRefresh {
+				c.sendError(0, "Missing scope: %s", auth.ScopeForecastRefresh)
+				continue
+			}
+			c.refresh(req.LocationIDs)
+		}
+	}
+}
+
+// eventLoop turns refresh events of subscribed locations into deltas.
+func (c *socketConn) eventLoop(sub *pubsub.Subscription) {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case event, ok := <-sub.C:
+			if !ok {
+				if !sub.Lagged() {
+					c.close(websocket.CloseGoingAway, "server shutting down")
+					return
+				}
+				// The hub dropped us for lagging; the client resubscribes
+				// and receives full snapshots again.
+				c.close(websocket.CloseTryAgainLater, "event stream lagged")
+				return
+			}
+			if !c.subscribed(event.LocationID) {
+				continue
+			}
+
+			locations := []models.LocationRecord{}
+			if err := c.db.Find(&locations, "id = ?", event.LocationID); err != nil {
+				c.sendError(event.LocationID, "Error querying database")
+				continue
+			}
+			c.sendDeltas(locations)
+		}
+	}
+}
+
+func (c *socketConn) subscribed(locationID uint) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.subs[locationID]
+	return ok
+}
+
+// findLocations loads the locations with the given IDs, reporting the IDs
+// that do not exist to the client.
+func (c *socketConn) findLocations(ids []uint) ([]models.LocationRecord, bool) {
+	locations := []models.LocationRecord{}
+	if err := c.db.Find(&locations, "id IN ?", ids); err != nil {
+		c.sendError(0, "Error querying database")
+		return nil, false
+	}
+
+	found := make(map[uint]bool, len(locations))
+	for _, location := range locations {
+		found[location.ID] = true
+	}
+	for _, id := range ids {
+		if !found[id] {
+			c.sendError(id, "Location not found w/ID: %v", id)
+		}
+	}
+
+	return locations, true
+}
+
+func (c *socketConn) subscribe(ids []uint) {
+	c.mu.Lock()
+	added := 0
+	for _, id := range ids {
+		if _, ok := c.subs[id]; !ok {
+			added++
+		}
+	}
+	total := len(c.subs) + added
+	c.mu.Unlock()
+
+	if total > c.opts.MaxSubscriptions {
+		c.sendError(0, "Too many subscriptions: at most %d per connection", c.opts.MaxSubscriptions)
+		return
+	}
+
+	locations, ok := c.findLocations(ids)
+	if !ok || len(locations) == 0 {
+		return
+	}
+
+	subscribed := make([]uint, len(locations))
+	c.mu.Lock()
+	for i, location := range locations {
+		if _, ok := c.subs[location.ID]; !ok {
+			c.subs[location.ID] = &locationState{}
+		}
+		subscribed[i] = location.ID
+	}
+	c.send(models.SocketMessage{Type: socketSubscribed, LocationIDs: subscribed})
+	c.mu.Unlock()
+
+	c.sendDeltas(locations)
+}
+
+func (c *socketConn) unsubscribe(ids []uint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, id := range ids {
+		delete(c.subs, id)
+	}
+	c.send(models.SocketMessage{Type: socketUnsubscribed, LocationIDs: ids})
+}
+
+// refresh fetches new forecasts for the given locations in the background.
+// Subscribed locations receive their deltas through the hub once stored.
+// A connection can only have one refresh in flight, and every refresh
+// message counts against the refresh rate limit of the client.
+func (c *socketConn) refresh(ids []uint) {
+	if c.opts.Limiter != nil {
+		if err := c.opts.Limiter.Allow(c.ctx, c.opts.RefreshLimit, c.client); err != nil {
+			c.sendError(0, "Error refreshing forecasts: %v", err)
+			return
+		}
+	}
+	if !c.refreshing.CompareAndSwap(false, true) {
+		c.sendError(0, "A refresh is already in progress")
+		return
+	}
+
+	locations, ok := c.findLocations(ids)
+	if !ok {
+		c.refreshing.Store(false)
+		return
+	}
+	if err := c.enforcer.AllowRefreshes(c.ctx, c.db, len(locations)); err != nil {
+		c.sendError(0, "Error refreshing forecasts: %v", err)
+		c.refreshing.Store(false)
+		return
+	}
+
+	go func() {
+		defer c.refreshing.Store(false)
+
+		for i := range locations {
+			location := &locations[i]
+			forecastID, err := c.engine.Refresh(c.ctx, location)
+			if c.ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				slog.ErrorContext(c.ctx, "Error refreshing forecast", "location_id", location.ID, "error", err)
+				c.sendError(location.ID, "Error refreshing forecast: %v", err)
+				continue
+			}
+			c.send(models.SocketMessage{
+				Type:       socketRefreshed,
+				LocationID: location.ID,
+				ForecastID: forecastID,
+			})
+		}
+	}()
+}
+
+// sendDeltas queues a delta for each subscribed location whose latest stored
+// forecast differs from the one last sent.
+func (c *socketConn) sendDeltas(locations []models.LocationRecord) {
+	snapshots, err := latestForecasts(c.db, locations)
+	if err != nil {
+		c.sendError(0, "Error querying database")
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, location := range locations {
+		snapshot, ok := snapshots[location.ID]
+		state, subscribed := c.subs[location.ID]
+		if !ok || !subscribed || snapshot.Forecast.ID <= state.forecastID {
+			continue
+		}
+		if err := convertSnapshot(snapshot, c.units.For(&location)); err != nil {
+			c.sendError(location.ID, "Error converting units: %v", err)
+			continue
+		}
+
+		hours, changed, removed := diffHours(state.hours, snapshot.Hourly)
+		state.forecastID = snapshot.Forecast.ID
+		state.hours = hours
+		if len(changed) == 0 && len(removed) == 0 {
+			continue
+		}
+
+		c.send(models.SocketMessage{
+			Type:       socketDelta,
+			LocationID: location.ID,
+			ForecastID: snapshot.Forecast.ID,
+			HourlyUnits: &models.HourlyUnits{
+				Time:               snapshot.Units.TimeUnit,
+				Temperature2M:      snapshot.Units.Temperature2MUnit,
+				Precipitation:      snapshot.Units.PrecipitationUnit,
+				RelativeHumidity2M: snapshot.Units.RelativeHumidity2MUnit,
+				WindSpeed10M:       snapshot.Units.WindSpeed10MUnit,
+				SurfacePressure:    snapshot.Units.SurfacePressureUnit,
+			},
+			Changed: changed,
+			Removed: removed,
+		})
+	}
+}
+
+// diffHours compares an hourly series with the hours previously sent,
+// returning the new hours keyed by time, the hours that are new or changed,
+// and the times that are no longer part of the series.
+func diffHours(previous map[string]models.ForecastHour, hourly []models.HourlyRecord) (map[string]models.ForecastHour, []models.ForecastHour, []string) {
+	hours := make(map[string]models.ForecastHour, len(hourly))
+	changed := []models.ForecastHour{}
+	for _, record := range hourly {
+		hour := models.ForecastHour{
+			Time:               record.Time,
+			Temperature2M:      record.Temperature2M,
+			Precipitation:      record.Precipitation,
+			RelativeHumidity2M: record.RelativeHumidity2M,
+			WindSpeed10M:       record.WindSpeed10M,
+			SurfacePressure:    record.SurfacePressure,
+		}
+		hours[hour.Time] = hour
+		if old, ok := previous[hour.Time]; !ok || old != hour {
+			changed = append(changed, hour)
+		}
+	}
+
+	removed := []string{}
+	for t := range previous {
+		if _, ok := hours[t]; !ok {
+			removed = append(removed, t)
+		}
+	}
+	sort.Strings(removed)
+
+	return hours, changed, removed
+}
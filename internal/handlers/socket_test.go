@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/auth"
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/pubsub"
+	"github.com/mick-io/duplo_go_cloud/internal/ratelimit"
+	"github.com/mick-io/duplo_go_cloud/internal/tenancy"
+)
+
+// principalAuthenticator authenticates every request as its principal.
+type principalAuthenticator struct {
+	principal *auth.Principal
+}
+
+func (a principalAuthenticator) Authenticate(*http.Request) (*auth.Principal, error) {
+	return a.principal, nil
+}
+
+func TestSocketRefreshesAreRateLimited(t *testing.T) {
+	f := newTenantFixture(t)
+	tenantID, _ := database.TenantFrom(f.ctxB)
+	principal := &auth.Principal{Subject: "key:1", TenantID: tenantID, Scopes: []string{auth.ScopeForecastRefresh}}
+
+	limiter := ratelimit.NewLimiter(ratelimit.NewMemoryStore())
+	opts := SocketOptions{
+		Limiter:      limiter,
+		RefreshLimit: ratelimit.Rule{Name: "expensive", Requests: 2, Window: time.Hour},
+	}
+	e := echo.New()
+	e.Use(auth.Authenticate(principalAuthenticator{principal}))
+	e.GET("/forecast/ws", ForecastSocket(f.db, nil, tenancy.NewEnforcer(tenancy.Limits{}), pubsub.NewHub(10), opts))
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	// The client already made an expensive request over HTTP
+	if err := limiter.Allow(f.ctxB, opts.RefreshLimit, principal.Subject); err != nil {
+		t.Fatal(err)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/forecast/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// Refreshing a location of the other tenant, which counts against the
+	// limit although it is not found
+	refresh := models.SocketRequestBody{Type: socketRefresh, LocationIDs: []uint{f.locA.ID}}
+	for _, want := range []string{"Location not found", "Rate limit of 2 requests per 1h0m0s exceeded"} {
+		if err := ws.WriteJSON(refresh); err != nil {
+			t.Fatal(err)
+		}
+		msg := models.SocketMessage{}
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != socketError || !strings.Contains(msg.Error, want) {
+			t.Fatalf("message = %+v, want an error containing %q", msg, want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/pubsub"
+)
+
+// sseRetry is the reconnection delay suggested to clients, in milliseconds.
+const sseRetry = 5000
+
+// StreamForecast streams forecast events as Server-Sent Events: a
+// forecast.refreshed event for every stored snapshot and an alert.fired
+// event for every alert rule it crosses. Events can be filtered with the
+// comma-separated 'location_ids', 'types' and 'tags' query parameters; the
+// events of the locations with any of the tags match. Clients resume from
+// the Last-Event-ID header, or the 'last_event_id' query parameter for
+// clients that cannot set headers. Only the events of the locations of the
+// caller's tenant are streamed.
+func StreamForecast(hub *pubsub.Hub, heartbeat time.Duration) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// Validating input
+		filter := pubsub.Filter{TenantID: tenantOf(c)}
+		if param := c.QueryParam("location_ids"); param != "" {
+			for _, part := range strings.Split(param, ",") {
+				id, err := strconv.ParseUint(strings.TrimSpace(part), 10, 64)
+				if err != nil {
+					msg := fmt.Sprintf("Invalid location_ids parameter: %v", err)
+					return echo.NewHTTPError(http.StatusBadRequest, msg)
+				}
+				filter.LocationIDs = append(filter.LocationIDs, uint(id))
+			}
+		}
+		if param := c.QueryParam("types"); param != "" {
+			filter.Types = strings.Split(param, ",")
+		}
+		if tags := models.NormalizeTags(strings.Split(c.QueryParam("tags"), ",")); tags != "" {
+			filter.Tags = strings.Split(tags, ",")
+		}
+
+		lastEventIDParam := c.Request().Header.Get("Last-Event-ID")
+		if lastEventIDParam == "" {
+			lastEventIDParam = c.QueryParam("last_event_id")
+		}
+		var lastEventID uint64
+		if lastEventIDParam != "" {
+			var err error
+			if lastEventID, err = strconv.ParseUint(lastEventIDParam, 10, 64); err != nil {
+				msg := fmt.Sprintf("Invalid Last-Event-ID: %v", err)
+				return echo.NewHTTPError(http.StatusBadRequest, msg)
+			}
+		}
+
+		// Subscribing before writing the headers so that no event published
+		// in between is missed
+		sub, replay := hub.Subscribe(filter, lastEventID)
+		defer sub.Cancel()
+
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, "text/event-stream")
+		res.Header().Set(echo.HeaderCacheControl, "no-cache")
+		res.Header().Set(echo.HeaderConnection, "keep-alive")
+		res.Header().Set("X-Accel-Buffering", "no")
+		res.WriteHeader(http.StatusOK)
+
+		if _, err := fmt.Fprintf(res, "retry: %d\n\n", sseRetry); err != nil {
+			return nil
+		}
+		for _, event := range replay {
+			if err := writeEvent(res, &event); err != nil {
+				return nil
+			}
+		}
+		res.Flush()
+
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.Request().Context().Done():
+				return nil
+			case <-ticker.C:
+				if _, err := fmt.Fprint(res, ": heartbeat\n\n"); err != nil {
+					return nil
+				}
+				res.Flush()
+			case event, ok := <-sub.C:
+				if !ok {
+					// The subscriber fell behind, or the server is shutting
+					// down; the client reconnects and resumes from its last
+					// event ID.
+					return nil
+				}
+				if err := writeEvent(res, &event); err != nil {
+					return nil
+				}
+				res.Flush()
+			}
+		}
+	}
+}
+
+func writeEvent(res *echo.Response, event *pubsub.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(res, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/tenancy"
+)
+
+// ReadTenant describes the quotas of the caller's tenant and its usage.
+func ReadTenant(db database.Datastore, enforcer *tenancy.Enforcer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		quota, err := enforcer.Quota(ctx, db.WithContext(ctx))
+		if err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+
+		return c.JSON(http.StatusOK, models.TenantResponseBody{
+			ID:            quota.TenantID,
+			Name:          quota.Name,
+			MaxLocations:  quota.Limits.MaxLocations,
+			Locations:     quota.Locations,
+			RefreshBudget: quota.Limits.RefreshBudget,
+			Refreshes:     quota.Refreshes,
+		})
+	}
+}
+
+// tenantOf returns the ID of the tenant of a request, or zero if it has
+// none. Records stored through an unscoped datastore, such as jobs, are
+// assigned to it explicitly.
+func tenantOf(c echo.Context) uint {
+	tenantID, _ := database.TenantFrom(c.Request().Context())
+	return tenantID
+}
+
+// quotaError maps an error of a tenant quota check to an HTTP error. An
+// exceeded location quota is reported as 403 Forbidden and an exhausted
+// refresh budget as 429 Too Many Requests.
+func quotaError(err error) error {
+	var quotaErr *tenancy.QuotaError
+	if errors.As(err, &quotaErr) {
+		msg := fmt.Sprintf("Tenant %v", quotaErr)
+		if quotaErr.Quota == tenancy.QuotaRefreshBudget {
+			return echo.NewHTTPError(http.StatusTooManyRequests, msg)
+		}
+		return echo.NewHTTPError(http.StatusForbidden, msg)
+	}
+
+	msg := fmt.Sprintf("Error checking tenant quota: %v", err)
+	return echo.NewHTTPError(http.StatusInternalServerError, msg)
+}
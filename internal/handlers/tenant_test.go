@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/database/dbtest"
+	"github.com/mick-io/duplo_go_cloud/internal/jobs"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/pubsub"
+)
+
+// tenantFixture holds two tenants, each owning a location at the same
+// coordinates and a job.
+type tenantFixture struct {
+	db         database.Datastore
+	ctxA, ctxB context.Context
+	locA, locB models.LocationRecord
+	jobA       models.JobRecord
+}
+
+func newTenantFixture(t *testing.T) *tenantFixture {
+	t.Helper()
+
+	db := dbtest.NewDatastore(t)
+	ctxA, tenantA := dbtest.CreateTenant(t, db, "a")
+	ctxB, _ := dbtest.CreateTenant(t, db, "b")
+	f := &tenantFixture{db: db, ctxA: ctxA, ctxB: ctxB}
+
+	f.locA = models.LocationRecord{Latitude: 1, Longitude: 2}
+	f.locB = models.LocationRecord{Latitude: 1, Longitude: 2}
+	f.jobA = models.JobRecord{Type: jobs.TypeRefresh, Status: jobs.StatusQueued, TenantID: tenantA.ID}
+	for _, create := range []func() error{
+		func() error { return db.WithContext(ctxA).Create(&f.locA) },
+		func() error { return db.WithContext(ctxB).Create(&f.locB) },
+		func() error { return db.Create(&f.jobA) },
+	} {
+		if err := create(); err != nil {
+			t.Fatalf("creating fixture: %v", err)
+		}
+	}
+	return f
+}
+
+// newTenantContext returns an echo context for a request made by the tenant
+// of 'ctx', as set by auth.Authenticate.
+func newTenantContext(ctx context.Context, method, target, body string) (echo.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(method, target, strings.NewReader(body)).WithContext(ctx)
+	if body != "" {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	rec := httptest.NewRecorder()
+	return echo.New().NewContext(req, rec), rec
+}
+
+func TestDeleteLocationByLatLongIsScopedToTenant(t *testing.T) {
+	f := newTenantFixture(t)
+
+	// Served through echo, since the handler writes a body with its 204
+	// that the recorder rejects
+	e := echo.New()
+	e.DELETE("/locations", DeleteLocationByLatLong(f.db))
+	req := httptest.NewRequest(http.MethodDelete, "/locations?latitude=1&longitude=2", nil).WithContext(f.ctxB)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	if err := f.db.First(&models.LocationRecord{}, f.locA.ID); err != nil {
+		t.Errorf("location of the other tenant was deleted: %v", err)
+	}
+	if err := f.db.First(&models.LocationRecord{}, f.locB.ID); err == nil {
+		t.Error("location of the tenant was not deleted")
+	}
+
+	// Nothing is left for the tenant at those coordinates
+	c, _ := newTenantContext(f.ctxB, http.MethodDelete, "/locations?latitude=1&longitude=2", "")
+	wantHTTPError(t, DeleteLocationByLatLong(f.db)(c), http.StatusNotFound)
+}
+
+func TestJobsAreScopedToTenant(t *testing.T) {
+	f := newTenantFixture(t)
+	runner := jobs.NewRunner(f.db)
+	path := fmt.Sprintf("/jobs/%d", f.jobA.ID)
+	id := fmt.Sprint(f.jobA.ID)
+
+	c, _ := newTenantContext(f.ctxB, http.MethodGet, path, "")
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+	wantHTTPError(t, ReadJob(f.db)(c), http.StatusNotFound)
+
+	c, _ = newTenantContext(f.ctxB, http.MethodDelete, path, "")
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+	wantHTTPError(t, CancelJob(f.db, runner)(c), http.StatusNotFound)
+
+	job := models.JobRecord{}
+	if err := f.db.First(&job, f.jobA.ID); err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != jobs.StatusQueued {
+		t.Errorf("status = %q, want job of the other tenant left %q", job.Status, jobs.StatusQueued)
+	}
+
+	c, rec := newTenantContext(f.ctxA, http.MethodGet, path, "")
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+	if err := ReadJob(f.db)(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestCreateRefreshJobRejectsLocationsOfOtherTenant(t *testing.T) {
+	f := newTenantFixture(t)
+	runner := jobs.NewRunner(f.db)
+	runner.Register(jobs.TypeRefresh, func(ctx context.Context, job *jobs.Progress) error { return nil })
+	t.Cleanup(func() { runner.Shutdown(context.Background()) })
+
+	body := fmt.Sprintf(`{"location_ids":[%d,%d]}`, f.locA.ID, f.locB.ID)
+	c, _ := newTenantContext(f.ctxB, http.MethodPost, "/jobs/refresh", body)
+	wantHTTPError(t, CreateRefreshJob(f.db, runner, nil)(c), http.StatusNotFound)
+
+	// Without IDs, only the locations of the tenant are refreshed
+	c, rec := newTenantContext(f.ctxB, http.MethodPost, "/jobs/refresh", "")
+	if err := CreateRefreshJob(f.db, runner, nil)(c); err != nil {
+		t.Fatal(err)
+	}
+	resp := models.JobResponseBody{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Total != 1 {
+		t.Errorf("total = %d, want 1", resp.Total)
+	}
+}
+
+func TestStreamForecastIsScopedToTenant(t *testing.T) {
+	f := newTenantFixture(t)
+	hub := pubsub.NewHub(0)
+	tenantA, _ := database.TenantFrom(f.ctxA)
+	tenantB, _ := database.TenantFrom(f.ctxB)
+
+	first := hub.Publish(pubsub.EventForecastRefreshed, tenantA, f.locA.ID, nil, nil)
+	hub.Publish(pubsub.EventForecastRefreshed, tenantB, f.locB.ID, nil, nil)
+	hub.Publish(pubsub.EventForecastRefreshed, tenantA, f.locA.ID, nil, nil)
+
+	// A cancelled request ends the stream once the replay is written
+	ctx, cancel := context.WithCancel(f.ctxB)
+	cancel()
+
+	target := fmt.Sprintf("/stream?last_event_id=%d", first.ID-1)
+	c, rec := newTenantContext(ctx, http.MethodGet, target, "")
+	if err := StreamForecast(hub, time.Minute)(c); err != nil {
+		t.Fatal(err)
+	}
+
+	events := []pubsub.Event{}
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		event := pubsub.Event{}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 1 || events[0].LocationID != f.locB.ID {
+		t.Errorf("streamed %+v, want only the event of location %d", events, f.locB.ID)
+	}
+}
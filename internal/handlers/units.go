@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/units"
+)
+
+// defaultUnitsKey is the context key of the server default unit system.
+const defaultUnitsKey = "default_units"
+
+// unitsPrecision is the number of decimals converted values are rounded to.
+const unitsPrecision = 3
+
+// DefaultUnits sets the unit system responses are rendered in when neither
+// the request nor the location selects one.
+func DefaultUnits(system units.System) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(defaultUnitsKey, system)
+			return next(c)
+		}
+	}
+}
+
+// unitSelection resolves the unit system of a response, by order of
+// precedence: the 'units' query parameter, the Accept-Units header, the
+// default of the location and the server default.
+type unitSelection struct {
+	requested *units.System
+	fallback  units.System
+}
+
+// selectUnits parses the unit system selected by a request. The 'units'
+// query parameter takes "metric", "imperial" or "custom", and the units of
+// a custom system are set with the 'temperature_unit', 'wind_speed_unit',
+// 'precipitation_unit' and 'pressure_unit' parameters. The Accept-Units
+// header takes a specification accepted by units.Parse.
+func selectUnits(c echo.Context) (*unitSelection, error) {
+	selection := &unitSelection{fallback: units.Imperial}
+	if system, ok := c.Get(defaultUnitsKey).(units.System); ok {
+		selection.fallback = system
+	}
+
+	param := c.QueryParam("units")
+	overrides := map[string]string{}
+	for _, quantity := range units.Quantities {
+		if value := c.QueryParam(quantity + "_unit"); value != "" {
+			overrides[quantity] = value
+		}
+	}
+
+	switch {
+	case param != "" || len(overrides) > 0:
+		if param == "" {
+			param = units.NameCustom
+		}
+		system, err := units.Parse(param)
+		if err != nil {
+			msg := fmt.Sprintf("Invalid units parameter: %v", err)
+			return nil, echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+		if len(overrides) > 0 && system.Name != units.NameCustom {
+			msg := fmt.Sprintf("Unit parameters require units=%s", units.NameCustom)
+			return nil, echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+		for quantity, value := range overrides {
+			if err := system.Set(quantity, value); err != nil {
+				msg := fmt.Sprintf("Invalid %s_unit parameter: %v", quantity, err)
+				return nil, echo.NewHTTPError(http.StatusBadRequest, msg)
+			}
+		}
+		selection.requested = &system
+	case c.Request().Header.Get("Accept-Units") != "":
+		system, err := units.Parse(c.Request().Header.Get("Accept-Units"))
+		if err != nil {
+			msg := fmt.Sprintf("Invalid Accept-Units header: %v", err)
+			return nil, echo.NewHTTPError(http.StatusBadRequest, msg)
+		}
+		selection.requested = &system
+	}
+
+	return selection, nil
+}
+
+// For returns the unit system of a location. A nil location selects the
+// system of the request or the server default.
+func (s *unitSelection) For(loc *models.LocationRecord) units.System {
+	if s.requested != nil {
+		return *s.requested
+	}
+	if loc != nil && loc.Units != "" {
+		if system, err := units.Parse(loc.Units); err == nil {
+			return system
+		}
+	}
+	return s.fallback
+}
+
+// convertSnapshot converts the hourly series of a snapshot to 'system' in
+// place and updates its units. Variables stored before they were fetched
+// have no unit and are left as they are.
+func convertSnapshot(snapshot *forecastSnapshot, system units.System) error {
+	u := &snapshot.Units
+	conversions := []struct {
+		unit  *string
+		to    string
+		value func(*models.HourlyRecord) *float64
+	}{
+		{&u.Temperature2MUnit, system.Temperature, func(r *models.HourlyRecord) *float64 { return &r.Temperature2M }},
+		{&u.PrecipitationUnit, system.Precipitation, func(r *models.HourlyRecord) *float64 { return &r.Precipitation }},
+		{&u.WindSpeed10MUnit, system.WindSpeed, func(r *models.HourlyRecord) *float64 { return &r.WindSpeed10M }},
+		{&u.SurfacePressureUnit, system.Pressure, func(r *models.HourlyRecord) *float64 { return &r.SurfacePressure }},
+	}
+
+	for _, conversion := range conversions {
+		if *conversion.unit == "" || *conversion.unit == conversion.to {
+			continue
+		}
+		for i := range snapshot.Hourly {
+			value := conversion.value(&snapshot.Hourly[i])
+			converted, err := convertValue(*value, *conversion.unit, conversion.to)
+			if err != nil {
+				return err
+			}
+			*value = converted
+		}
+		*conversion.unit = conversion.to
+	}
+
+	return nil
+}
+
+// convertValue converts a value and rounds it to unitsPrecision decimals.
+func convertValue(value float64, from, to string) (float64, error) {
+	if from == to {
+		return value, nil
+	}
+	converted, err := units.Convert(value, from, to)
+	if err != nil {
+		return 0, err
+	}
+	scale := math.Pow10(unitsPrecision)
+	return math.Round(converted*scale) / scale, nil
+}
+
+// convertOptional converts a value that may be missing.
+func convertOptional(value *float64, from, to string) (*float64, error) {
+	if value == nil {
+		return nil, nil
+	}
+	converted, err := convertValue(*value, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &converted, nil
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/units"
+)
+
+func TestSelectUnitsPrecedence(t *testing.T) {
+	knots := units.Metric
+	knots.Name = units.NameCustom
+	knots.WindSpeed = units.Knots
+	inches := units.Metric
+	inches.Name = units.NameCustom
+	inches.Precipitation = units.Inches
+
+	tests := []struct {
+		name          string
+		target        string
+		header        string
+		locationUnits string
+		serverDefault *units.System
+		want          units.System
+	}{
+		{
+			name:   "built-in default",
+			target: "/forecast",
+			want:   units.Imperial,
+		},
+		{
+			name:          "server default",
+			target:        "/forecast",
+			serverDefault: &units.Metric,
+			want:          units.Metric,
+		},
+		{
+			name:          "location over server default",
+			target:        "/forecast",
+			locationUnits: "custom; wind_speed=kn",
+			serverDefault: &units.Metric,
+			want:          knots,
+		},
+		{
+			name:          "invalid location units fall back to the server default",
+			target:        "/forecast",
+			locationUnits: "nautical",
+			serverDefault: &units.Metric,
+			want:          units.Metric,
+		},
+		{
+			name:          "header over location",
+			target:        "/forecast",
+			header:        "imperial",
+			locationUnits: "metric",
+			serverDefault: &units.Metric,
+			want:          units.Imperial,
+		},
+		{
+			name:          "query over header",
+			target:        "/forecast?units=metric",
+			header:        "imperial",
+			locationUnits: "imperial",
+			want:          units.Metric,
+		},
+		{
+			name:   "unit parameters select a custom system",
+			target: "/forecast?precipitation_unit=inch",
+			header: "imperial",
+			want:   inches,
+		},
+		{
+			name:   "unit parameters override a custom system",
+			target: "/forecast?units=custom;wind_speed=ms&wind_speed_unit=kn",
+			want:   knots,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set("Accept-Units", tt.header)
+			}
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+			if tt.serverDefault != nil {
+				c.Set(defaultUnitsKey, *tt.serverDefault)
+			}
+
+			selection, err := selectUnits(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := selection.For(&models.LocationRecord{Units: tt.locationUnits})
+			if got != tt.want {
+				t.Errorf("units = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func wantHTTPError(t *testing.T, err error, code int) {
+	t.Helper()
+	if httpErr, ok := err.(*echo.HTTPError); !ok || httpErr.Code != code {
+		t.Fatalf("error = %v, want %d %s", err, code, http.StatusText(code))
+	}
+}
+
+func TestSelectUnitsRejectsInvalidSelections(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		header string
+	}{
+		{"unknown system", "/forecast?units=nautical", ""},
+		{"unit parameters of a built-in system", "/forecast?units=metric&temperature_unit=fahrenheit", ""},
+		{"unknown unit", "/forecast?temperature_unit=kelvin", ""},
+		{"invalid header", "/forecast", "custom; altitude=feet"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set("Accept-Units", tt.header)
+			}
+			_, err := selectUnits(echo.New().NewContext(req, httptest.NewRecorder()))
+			wantHTTPError(t, err, http.StatusBadRequest)
+		})
+	}
+}
+
+func TestConvertSnapshot(t *testing.T) {
+	snapshot := &forecastSnapshot{
+		Units: models.HourlyUnitsRecord{
+			Temperature2MUnit:   units.Celsius,
+			PrecipitationUnit:   units.Millimeters,
+			WindSpeed10MUnit:    units.MetersPerSecond,
+			SurfacePressureUnit: "",
+		},
+		Hourly: []models.HourlyRecord{
+			{Temperature2M: 20, Precipitation: 2.54, WindSpeed10M: 10, SurfacePressure: 1013},
+		},
+	}
+
+	if err := convertSnapshot(snapshot, units.Imperial); err != nil {
+		t.Fatal(err)
+	}
+
+	hour := snapshot.Hourly[0]
+	if hour.Temperature2M != 68 || hour.Precipitation != 0.1 || hour.WindSpeed10M != 22.369 {
+		t.Errorf("hour = %+v, want 68°F, 0.1 inch and 22.369 mp/h", hour)
+	}
+	// Pressure was stored before it was fetched and has no unit
+	if hour.SurfacePressure != 1013 || snapshot.Units.SurfacePressureUnit != "" {
+		t.Errorf("pressure = %v %q, want it left as it is", hour.SurfacePressure, snapshot.Units.SurfacePressureUnit)
+	}
+	if snapshot.Units.Temperature2MUnit != units.Fahrenheit || snapshot.Units.WindSpeed10MUnit != units.MilesPerHour {
+		t.Errorf("units = %+v, want imperial", snapshot.Units)
+	}
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/jobs"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/units"
+	"github.com/mick-io/duplo_go_cloud/internal/verification"
+)
+
+func CreateVerificationJob(db database.Datastore, runner *jobs.Runner) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		var body models.CreateVerificationJobRequestBody
+		if c.Request().ContentLength != 0 {
+			if err := c.Bind(&body); err != nil {
+				msg := fmt.Sprintf("Failed to parse request body: %v", err)
+				return echo.NewHTTPError(http.StatusBadRequest, msg)
+			}
+		}
+
+		return submitLocationJob(c, db, runner, nil, jobs.TypeVerification, body.LocationIDs)
+	}
+}
+
+// ReadVerification returns the latest verification results, optionally
+// filtered by the comma-separated 'location_ids' and by 'variable'. Errors
+// are rendered in the unit system selected by the request or the server
+// default.
+func ReadVerification(db database.Datastore) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		db := db.WithContext(c.Request().Context())
+
+		// Validating input
+		selection, err := selectUnits(c)
+		if err != nil {
+			return err
+		}
+
+		conditions := []string{}
+		args := []interface{}{}
+		if param := c.QueryParam("location_ids"); param != "" {
+			ids := []uint{}
+			for _, part := range strings.Split(param, ",") {
+				id, err := strconv.ParseUint(strings.TrimSpace(part), 10, 64)
+				if err != nil {
+					msg := fmt.Sprintf("Invalid location_ids parameter: %v", err)
+					return echo.NewHTTPError(http.StatusBadRequest, msg)
+				}
+				ids = append(ids, uint(id))
+			}
+			conditions = append(conditions, "location_record_id IN ?")
+			args = append(args, ids)
+		}
+		if variable := c.QueryParam("variable"); variable != "" {
+			conditions = append(conditions, "variable = ?")
+			args = append(args, variable)
+		}
+
+		records := []models.VerificationRecord{}
+		if len(conditions) > 0 {
+			where := append([]interface{}{strings.Join(conditions, " AND ")}, args...)
+			err = db.FindPage(&records, database.Page{Order: "location_record_id, variable, lead_hours"}, where...)
+		} else {
+			err = db.FindPage(&records, database.Page{Order: "location_record_id, variable, lead_hours"})
+		}
+		if err != nil {
+			msg := fmt.Sprintf("Error querying database: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+		if err := convertVerification(records, selection.For(nil)); err != nil {
+			msg := fmt.Sprintf("Error converting units: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, msg)
+		}
+
+		resp := models.VerificationResponseBody{
+			Overall:   newVerificationResults(verification.Combine(records)),
+			Locations: newVerificationResults(records),
+		}
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+// convertVerification converts verification statistics to 'system' in place.
+// The statistics are differences between values, so temperatures are only
+// rescaled.
+func convertVerification(records []models.VerificationRecord, system units.System) error {
+	for i := range records {
+		record := &records[i]
+		to := record.Unit
+		switch record.Variable {
+		case models.VariableTemperature2M:
+			to = system.Temperature
+		case models.VariablePrecipitation:
+			to = system.Precipitation
+		}
+
+		for _, value := range []*float64{&record.MAE, &record.Bias, &record.RMSE} {
+			converted, err := units.ConvertDifference(*value, record.Unit, to)
+			if err != nil {
+				return err
+			}
+			*value = converted
+		}
+		record.Unit = to
+	}
+	return nil
+}
+
+func newVerificationResults(records []models.VerificationRecord) []models.VerificationResult {
+	results := make([]models.VerificationResult, len(records))
+	for i, record := range records {
+		results[i] = models.VerificationResult{
+			LocationID: record.LocationRecordID,
+			Variable:   record.Variable,
+			LeadHours:  record.LeadHours,
+			Count:      record.Count,
+			MAE:        record.MAE,
+			Bias:       record.Bias,
+			RMSE:       record.RMSE,
+			Unit:       record.Unit,
+		}
+	}
+	return results
+}
@@ -0,0 +1,283 @@
+// Package health checks the components the service depends on: the
+// database, the weather API, the freshness of the stored forecasts and the
+// job runner. Each component keeps the last error it reported, so that a
+// recovered component still shows why it failed.
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// Statuses of components and of the service. A degraded service still
+// serves requests, possibly with stale data.
+const (
+	StatusOK       = "OK"
+	StatusDegraded = "DEGRADED"
+	StatusError    = "ERROR"
+)
+
+// Defaults of Options.
+const (
+	DefaultDatabaseTimeout   = 2 * time.Second
+	DefaultWeatherAPITimeout = 5 * time.Second
+	DefaultWeatherAPITTL     = time.Minute
+)
+
+// Probe checks that a dependency is reachable.
+type Probe func(ctx context.Context) error
+
+// HTTPProbe returns a probe requesting 'url' with 'client'. The dependency
+// is reachable when it answers with a status below 500.
+func HTTPProbe(client *http.Client, url string) Probe {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+// Scheduler is the job runner, see jobs.Runner.
+type Scheduler interface {
+	Running() int
+	ShuttingDown() bool
+}
+
+type Options struct {
+	// DatabaseTimeout bounds the ping of the database.
+	DatabaseTimeout time.Duration
+	// WeatherAPITimeout bounds the probe of the weather API.
+	WeatherAPITimeout time.Duration
+	// WeatherAPITTL is how long the outcome of the probe of the weather API
+	// is reused, so that health checks do not flood it.
+	WeatherAPITTL time.Duration
+	// StaleAfter is the age above which the latest forecast of a location
+	// is stale. Zero disables the check.
+	StaleAfter time.Duration
+}
+
+// Checker checks the health of the service.
+type Checker struct {
+	db         database.Datastore
+	weatherAPI Probe
+	scheduler  Scheduler
+	opts       Options
+
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+
+	database  component
+	weather   component
+	forecasts component
+	jobs      component
+
+	// weatherMu serializes the probes of the weather API, so that
+	// concurrent checks share a single probe.
+	weatherMu sync.Mutex
+}
+
+// NewChecker creates a new Checker. 'weatherAPI' and 'scheduler' are
+// optional.
+func NewChecker(db database.Datastore, weatherAPI Probe, scheduler Scheduler, opts Options) *Checker {
+	if opts.DatabaseTimeout <= 0 {
+		opts.DatabaseTimeout = DefaultDatabaseTimeout
+	}
+	if opts.WeatherAPITimeout <= 0 {
+		opts.WeatherAPITimeout = DefaultWeatherAPITimeout
+	}
+	if opts.WeatherAPITTL <= 0 {
+		opts.WeatherAPITTL = DefaultWeatherAPITTL
+	}
+	return &Checker{db: db, weatherAPI: weatherAPI, scheduler: scheduler, opts: opts, Now: time.Now}
+}
+
+// Ready returns an error unless the service can serve requests: the
+// database answers within its timeout and the job runner is not shutting
+// down. The weather API is left out, since stored forecasts are served
+// without it.
+func (h *Checker) Ready(ctx context.Context) error {
+	if status := h.checkDatabase(ctx); status.Status == StatusError {
+		return fmt.Errorf("database: %s", status.Error)
+	}
+	if status := h.checkScheduler(); status.Status == StatusError {
+		return fmt.Errorf("scheduler: %s", status.Error)
+	}
+	return nil
+}
+
+// Check checks every component. The service is in error when the database
+// or the job runner is, and degraded when the weather API is unreachable or
+// forecasts are stale.
+func (h *Checker) Check(ctx context.Context) models.HealthStatusResponseBody {
+	body := models.HealthStatusResponseBody{
+		Database:   h.checkDatabase(ctx),
+		WeatherAPI: h.checkWeatherAPI(ctx),
+		Forecasts:  h.checkForecasts(ctx),
+		Scheduler:  h.checkScheduler(),
+	}
+	body.Status = worst(
+		body.Database.Status,
+		body.Scheduler.Status,
+		degrade(body.WeatherAPI.Status),
+		degrade(body.Forecasts.Status),
+	)
+	return body
+}
+
+func (h *Checker) checkDatabase(ctx context.Context) models.HealthComponent {
+	ctx, cancel := context.WithTimeout(ctx, h.opts.DatabaseTimeout)
+	defer cancel()
+
+	start := h.Now()
+	err := h.db.WithContext(ctx).HealthCheck()
+	return h.database.record(start, h.Now(), StatusError, err, nil)
+}
+
+// checkWeatherAPI probes the weather API, or returns the outcome of the
+// last probe if it is recent enough.
+func (h *Checker) checkWeatherAPI(ctx context.Context) models.HealthComponent {
+	if h.weatherAPI == nil {
+		return models.HealthComponent{Status: StatusOK, CheckedAt: h.Now(), Details: map[string]interface{}{"probe": "disabled"}}
+	}
+
+	h.weatherMu.Lock()
+	defer h.weatherMu.Unlock()
+
+	if last, ok := h.weather.last(); ok && h.Now().Sub(last.CheckedAt) < h.opts.WeatherAPITTL {
+		return last
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.opts.WeatherAPITimeout)
+	defer cancel()
+
+	start := h.Now()
+	err := h.weatherAPI(ctx)
+	return h.weather.record(start, h.Now(), StatusError, err, nil)
+}
+
+func (h *Checker) checkForecasts(ctx context.Context) models.HealthComponent {
+	if h.opts.StaleAfter <= 0 {
+		return models.HealthComponent{Status: StatusOK, CheckedAt: h.Now(), Details: map[string]interface{}{"check": "disabled"}}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.opts.DatabaseTimeout)
+	defer cancel()
+
+	start := h.Now()
+	db := h.db.WithContext(ctx)
+	var locations int64
+	err := db.Count(&models.LocationRecord{}, &locations)
+	var stale int64
+	if err == nil {
+		stale, err = database.CountStaleLocations(db, start.Add(-h.opts.StaleAfter))
+	}
+
+	details := map[string]interface{}{
+		"locations":       locations,
+		"stale_locations": stale,
+		"stale_after":     h.opts.StaleAfter.String(),
+	}
+	if err != nil {
+		return h.forecasts.record(start, h.Now(), StatusError, err, details)
+	}
+	if stale > 0 {
+		err = fmt.Errorf("%d of %d locations have no forecast newer than %s", stale, locations, h.opts.StaleAfter)
+	}
+	return h.forecasts.record(start, h.Now(), StatusDegraded, err, details)
+}
+
+func (h *Checker) checkScheduler() models.HealthComponent {
+	if h.scheduler == nil {
+		return models.HealthComponent{Status: StatusOK, CheckedAt: h.Now(), Details: map[string]interface{}{"scheduler": "disabled"}}
+	}
+
+	start := h.Now()
+	details := map[string]interface{}{
+		"running_jobs":  h.scheduler.Running(),
+		"shutting_down": h.scheduler.ShuttingDown(),
+	}
+	var err error
+	if h.scheduler.ShuttingDown() {
+		err = fmt.Errorf("job runner is shutting down")
+	}
+	return h.jobs.record(start, h.Now(), StatusError, err, details)
+}
+
+// component keeps the outcome of the last check of a component.
+type component struct {
+	mu      sync.Mutex
+	checked bool
+	status  models.HealthComponent
+}
+
+// record stores the outcome of a check that started at 'start' and ended at
+// 'end' and returns it. The component has 'failed' status if 'err' is set.
+func (c *component) record(start, end time.Time, failed string, err error, details map[string]interface{}) models.HealthComponent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := models.HealthComponent{
+		Status:      StatusOK,
+		LatencyMS:   float64(end.Sub(start).Microseconds()) / 1000,
+		CheckedAt:   end,
+		LastError:   c.status.LastError,
+		LastErrorAt: c.status.LastErrorAt,
+		Details:     details,
+	}
+	if err != nil {
+		status.Status = failed
+		status.Error = err.Error()
+		status.LastError = err.Error()
+		status.LastErrorAt = &end
+	}
+
+	c.checked = true
+	c.status = status
+	return status
+}
+
+func (c *component) last() (models.HealthComponent, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status, c.checked
+}
+
+// degrade turns the errors of the components the service can do without
+// into degradations.
+func degrade(status string) string {
+	if status == StatusError {
+		return StatusDegraded
+	}
+	return status
+}
+
+// worst returns the most severe of 'statuses'.
+func worst(statuses ...string) string {
+	result := StatusOK
+	for _, status := range statuses {
+		switch {
+		case status == StatusError:
+			return StatusError
+		case status == StatusDegraded:
+			result = StatusDegraded
+		}
+	}
+	return result
+}
@@ -0,0 +1,129 @@
+package health_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/database/dbtest"
+	"github.com/mick-io/duplo_go_cloud/internal/health"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// fakeDatastore fails its health checks while 'down' is set.
+type fakeDatastore struct {
+	database.Datastore
+	down *atomic.Bool
+}
+
+func (d *fakeDatastore) WithContext(ctx context.Context) database.Datastore {
+	return &fakeDatastore{Datastore: d.Datastore.WithContext(ctx), down: d.down}
+}
+
+func (d *fakeDatastore) HealthCheck() error {
+	if d.down.Load() {
+		return errors.New("connection refused")
+	}
+	return d.Datastore.HealthCheck()
+}
+
+type fakeScheduler struct {
+	shuttingDown bool
+}
+
+func (s *fakeScheduler) Running() int       { return 0 }
+func (s *fakeScheduler) ShuttingDown() bool { return s.shuttingDown }
+
+// fakeProbe counts its calls and fails while 'err' is set.
+type fakeProbe struct {
+	calls atomic.Int32
+	err   error
+}
+
+func (p *fakeProbe) probe(ctx context.Context) error {
+	p.calls.Add(1)
+	return p.err
+}
+
+// clock is a settable Checker.Now.
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time { return c.now }
+
+func TestCheckStatus(t *testing.T) {
+	tests := []struct {
+		name          string
+		databaseDown  bool
+		weatherErr    error
+		staleLocation bool
+		shuttingDown  bool
+		want          string
+		ready         bool
+	}{
+		{name: "healthy", want: health.StatusOK, ready: true},
+		{name: "weather API unreachable", weatherErr: errors.New("timeout"), want: health.StatusDegraded, ready: true},
+		{name: "stale forecasts", staleLocation: true, want: health.StatusDegraded, ready: true},
+		{name: "database down", databaseDown: true, want: health.StatusError},
+		{name: "scheduler shutting down", shuttingDown: true, want: health.StatusError},
+		{name: "database down, weather API unreachable", databaseDown: true, weatherErr: errors.New("timeout"), want: health.StatusError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := dbtest.NewDatastore(t)
+			if tt.staleLocation {
+				if err := store.Create(&models.LocationRecord{Latitude: 1, Longitude: 2}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			down := &atomic.Bool{}
+			down.Store(tt.databaseDown)
+			db := &fakeDatastore{Datastore: store, down: down}
+			probe := &fakeProbe{err: tt.weatherErr}
+			checker := health.NewChecker(db, probe.probe, &fakeScheduler{shuttingDown: tt.shuttingDown}, health.Options{StaleAfter: time.Hour})
+
+			if got := checker.Check(context.Background()); got.Status != tt.want {
+				t.Errorf("status = %s, want %s: %+v", got.Status, tt.want, got)
+			}
+			if err := checker.Ready(context.Background()); (err == nil) != tt.ready {
+				t.Errorf("Ready = %v, want ready %v", err, tt.ready)
+			}
+		})
+	}
+}
+
+func TestCheckCachesWeatherAPIProbe(t *testing.T) {
+	probe := &fakeProbe{err: errors.New("timeout")}
+	checker := health.NewChecker(dbtest.NewDatastore(t), probe.probe, nil, health.Options{WeatherAPITTL: time.Minute})
+	clock := &clock{now: time.Now()}
+	checker.Now = clock.Now
+
+	first := checker.Check(context.Background())
+	if first.WeatherAPI.Status != health.StatusError || probe.calls.Load() != 1 {
+		t.Fatalf("weather API = %+v after %d probes, want an error after 1", first.WeatherAPI, probe.calls.Load())
+	}
+
+	// Within the TTL the outcome of the last probe is reused, even though
+	// the weather API recovered
+	probe.err = nil
+	clock.now = clock.now.Add(59 * time.Second)
+	if got := checker.Check(context.Background()); got.WeatherAPI.Status != health.StatusError || probe.calls.Load() != 1 {
+		t.Errorf("weather API = %s after %d probes, want the cached error after 1", got.WeatherAPI.Status, probe.calls.Load())
+	}
+
+	// Past the TTL the weather API is probed again, and the last error is
+	// kept
+	clock.now = clock.now.Add(time.Second)
+	got := checker.Check(context.Background())
+	if got.WeatherAPI.Status != health.StatusOK || probe.calls.Load() != 2 {
+		t.Errorf("weather API = %s after %d probes, want OK after 2", got.WeatherAPI.Status, probe.calls.Load())
+	}
+	if got.WeatherAPI.LastError != "timeout" || got.WeatherAPI.LastErrorAt == nil || !got.WeatherAPI.LastErrorAt.Equal(first.WeatherAPI.CheckedAt) {
+		t.Errorf("last error = %q at %v, want %q at %v", got.WeatherAPI.LastError, got.WeatherAPI.LastErrorAt, "timeout", first.WeatherAPI.CheckedAt)
+	}
+}
@@ -0,0 +1,137 @@
+// Package history backfills the observed weather of locations from the
+// historical weather API.
+package history
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/mick-io/duplo_go_cloud/internal/api"
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/units"
+)
+
+// DefaultChunkDays is the number of days fetched per request when none is
+// configured.
+const DefaultChunkDays = 30
+
+// DateLayout is the layout of the dates of a window.
+const DateLayout = "2006-01-02"
+
+// batchSize is the number of rows written per query.
+const batchSize = 1000
+
+// Window is an inclusive range of UTC dates.
+type Window struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Chunks splits the window from 'start' to 'end' into consecutive windows of
+// at most 'days' days.
+func Chunks(start, end time.Time, days int) []Window {
+	if days <= 0 {
+		days = DefaultChunkDays
+	}
+
+	var windows []Window
+	for chunkStart := start; !chunkStart.After(end); chunkStart = chunkStart.AddDate(0, 0, days) {
+		chunkEnd := chunkStart.AddDate(0, 0, days-1)
+		if chunkEnd.After(end) {
+			chunkEnd = end
+		}
+		windows = append(windows, Window{Start: chunkStart, End: chunkEnd})
+	}
+	return windows
+}
+
+// Fetch gets the observed weather of a location within a window.
+func Fetch(ctx context.Context, client api.ArchiveAPIClient, loc *models.LocationRecord, window Window) (*models.Archive, error) {
+	opts := api.ArchiveOptions{
+		Latitude:  strconv.FormatFloat(loc.Latitude, 'f', -1, 64),
+		Longitude: strconv.FormatFloat(loc.Longitude, 'f', -1, 64),
+		StartDate: window.Start.Format(DateLayout),
+		EndDate:   window.End.Format(DateLayout),
+	}
+
+	var result models.Archive
+	if err := client.GetArchive(ctx, opts, &result); err != nil {
+		slog.ErrorContext(ctx, "Error fetching history", "location_id", loc.ID, "start", opts.StartDate, "end", opts.EndDate, "error", err)
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Store replaces the history of a location within a window with the hours
+// of 'data', so that storing the same window twice is harmless. The history
+// of a location is kept in a single set of units: hours are converted to the
+// units of the hours already stored, if any.
+func Store(db database.Datastore, locationID uint, window Window, data *models.Archive) error {
+	records, err := models.NewHistoryRecords(locationID, data)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx database.Datastore) error {
+		units := models.HistoryUnitsRecord{}
+		if err := tx.Find(&units, "location_record_id = ?", locationID); err != nil {
+			return err
+		}
+		if units.ID == 0 {
+			units = models.HistoryUnitsRecord{
+				LocationRecordID:  locationID,
+				TimeUnit:          data.HourlyUnits.Time,
+				Temperature2MUnit: data.HourlyUnits.Temperature2M,
+				PrecipitationUnit: data.HourlyUnits.Precipitation,
+			}
+			if err := tx.Save(&units); err != nil {
+				return err
+			}
+		}
+		if err := convertRecords(records, &data.HourlyUnits, &units); err != nil {
+			return err
+		}
+
+		err := tx.Delete(&models.HistoryRecord{}, "location_record_id = ? AND time >= ? AND time < ?",
+			locationID, window.Start, window.End.AddDate(0, 0, 1))
+		if err != nil {
+			return err
+		}
+
+		for start := 0; start < len(records); start += batchSize {
+			batch := records[start:min(start+batchSize, len(records))]
+			if err := tx.Create(&batch); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// convertRecords converts history records from the units of an archive
+// response to the stored units.
+func convertRecords(records []models.HistoryRecord, from *models.HourlyUnits, to *models.HistoryUnitsRecord) error {
+	for i := range records {
+		conversions := []struct {
+			value    *float64
+			from, to string
+		}{
+			{records[i].Temperature2M, from.Temperature2M, to.Temperature2MUnit},
+			{records[i].Precipitation, from.Precipitation, to.PrecipitationUnit},
+		}
+		for _, conversion := range conversions {
+			if conversion.value == nil || conversion.from == conversion.to {
+				continue
+			}
+			value, err := units.Convert(*conversion.value, conversion.from, conversion.to)
+			if err != nil {
+				return err
+			}
+			*conversion.value = value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/mick-io/duplo_go_cloud/internal/api"
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/history"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// TypeBackfill is the type of jobs that backfill the history of a location,
+// with a task per window of dates.
+const TypeBackfill = "backfill"
+
+// backfillAttempts is the number of times a window is fetched before its
+// task fails, waiting backfillBackoff, then twice as long, between attempts.
+const (
+	backfillAttempts = 3
+	backfillBackoff  = 2 * time.Second
+)
+
+var errMissingWindow = errors.New("task has no window")
+
+// BackfillHandler fetches and stores the history of the window of every
+// pending task, oldest first. Each window replaces the history it covers, so
+// a job interrupted by a shutdown resumes where it stopped, and failed
+// windows can be submitted again.
+func BackfillHandler(db database.Datastore, client api.ArchiveAPIClient) Handler {
+	return func(ctx context.Context, progress *Progress) error {
+		tasks, err := progress.PendingTasks()
+		if err != nil {
+			return err
+		}
+		sort.Slice(tasks, func(i, j int) bool {
+			return tasks[i].WindowStart != nil && tasks[j].WindowStart != nil &&
+				tasks[i].WindowStart.Before(*tasks[j].WindowStart)
+		})
+
+		for i := range tasks {
+			if ctx.Err() != nil {
+				return nil
+			}
+			task := &tasks[i]
+
+			if task.WindowStart == nil || task.WindowEnd == nil {
+				if err := progress.Finish(task, TaskFailed, errMissingWindow); err != nil {
+					return err
+				}
+				continue
+			}
+			window := history.Window{Start: *task.WindowStart, End: *task.WindowEnd}
+
+			var location models.LocationRecord
+			if err := db.Find(&location, task.LocationRecordID); err != nil {
+				return err
+			}
+			if location.ID == 0 {
+				if err := progress.Finish(task, TaskSkipped, errLocationDeleted); err != nil {
+					return err
+				}
+				continue
+			}
+
+			err := backfillWindow(ctx, db, client, &location, window)
+			if ctx.Err() != nil {
+				// Left pending for the runner to skip or resume
+				return nil
+			}
+
+			status := TaskSucceeded
+			if err != nil {
+				status = TaskFailed
+			}
+			if err := progress.Finish(task, status, err); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+func backfillWindow(ctx context.Context, db database.Datastore, client api.ArchiveAPIClient, loc *models.LocationRecord, window history.Window) error {
+	backoff := backfillBackoff
+	for attempt := 1; ; attempt++ {
+		data, err := history.Fetch(ctx, client, loc, window)
+		if err == nil {
+			return history.Store(db, loc.ID, window, data)
+		}
+		if attempt == backfillAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+			backoff *= 2
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/enrichment"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// TypeEnrichment is the type of jobs that enrich the location of each task.
+const TypeEnrichment = "enrichment"
+
+// DefaultEnrichmentInterval is the minimum interval between two locations
+// enriched by a job when none is configured. The Nominatim usage policy
+// allows a request per second.
+const DefaultEnrichmentInterval = time.Second
+
+// EnrichmentHandler enriches the location of every pending task, one at a
+// time and at most one every 'interval', and stores whatever the pipeline
+// resolved. A task fails when a step of the pipeline fails. Tasks
+// interrupted by cancellation or shutdown are left pending for the runner
+// to skip or resume.
+func EnrichmentHandler(db database.Datastore, enricher *enrichment.Pipeline, interval time.Duration) Handler {
+	if interval <= 0 {
+		interval = DefaultEnrichmentInterval
+	}
+
+	return func(ctx context.Context, progress *Progress) error {
+		tasks, err := progress.PendingTasks()
+		if err != nil {
+			return err
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for i := range tasks {
+			task := &tasks[i]
+
+			var location models.LocationRecord
+			if err := db.Find(&location, task.LocationRecordID); err != nil {
+				return err
+			}
+			if location.ID == 0 {
+				if err := progress.Finish(task, TaskSkipped, errLocationDeleted); err != nil {
+					return err
+				}
+				continue
+			}
+
+			// Waiting for the previous location to be an interval away
+			if i > 0 {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-ticker.C:
+				}
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			enrichErr := enricher.Run(&location)
+			if err := db.Save(&location); err != nil {
+				return err
+			}
+
+			status := TaskSucceeded
+			if enrichErr != nil {
+				status = TaskFailed
+			}
+			if err := progress.Finish(task, status, enrichErr); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,138 @@
+package jobs_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database/dbtest"
+	"github.com/mick-io/duplo_go_cloud/internal/enrichment"
+	"github.com/mick-io/duplo_go_cloud/internal/jobs"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// fakeStep names every location and records when it ran. It fails for the
+// latitudes in 'fail'.
+type fakeStep struct {
+	fail map[float64]bool
+
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (s *fakeStep) Name() string {
+	return "fake"
+}
+
+func (s *fakeStep) Enrich(loc *models.LocationRecord) error {
+	s.mu.Lock()
+	s.times = append(s.times, time.Now())
+	s.mu.Unlock()
+
+	loc.Name = "Somewhere"
+	if s.fail[loc.Latitude] {
+		return errors.New("no result")
+	}
+	return nil
+}
+
+func TestEnrichmentHandlerThrottles(t *testing.T) {
+	db := dbtest.NewDatastore(t)
+	locations := []models.LocationRecord{{Latitude: 1}, {Latitude: 2}, {Latitude: 3}}
+	if err := db.Create(&locations); err != nil {
+		t.Fatal(err)
+	}
+
+	const interval = 50 * time.Millisecond
+	step := &fakeStep{fail: map[float64]bool{2: true}}
+	runner := jobs.NewRunner(db)
+	runner.Register(jobs.TypeEnrichment, jobs.EnrichmentHandler(db, enrichment.NewPipeline(step), interval))
+
+	job := &models.JobRecord{Type: jobs.TypeEnrichment}
+	tasks := []models.JobTaskRecord{
+		{LocationRecordID: locations[0].ID},
+		{LocationRecordID: locations[1].ID},
+		{LocationRecordID: 999},
+		{LocationRecordID: locations[2].ID},
+	}
+	if err := runner.Submit(job, tasks); err != nil {
+		t.Fatal(err)
+	}
+
+	finished := waitJob(t, db, job.ID)
+	if finished.Status != jobs.StatusCompleted || finished.Succeeded != 2 || finished.Failed != 1 || finished.Skipped != 1 {
+		t.Errorf("job = %s with %d succeeded, %d failed, %d skipped, want completed with 2, 1, 1",
+			finished.Status, finished.Succeeded, finished.Failed, finished.Skipped)
+	}
+
+	step.mu.Lock()
+	defer step.mu.Unlock()
+	if len(step.times) != 3 {
+		t.Fatalf("enriched %d locations, want 3", len(step.times))
+	}
+	for i := 1; i < len(step.times); i++ {
+		// Ticks may be delivered slightly early
+		if gap := step.times[i].Sub(step.times[i-1]); gap < interval-5*time.Millisecond {
+			t.Errorf("locations %d and %d enriched %v apart, want at least %v", i-1, i, gap, interval)
+		}
+	}
+
+	// The results of a failing pipeline are kept
+	stored := []models.LocationRecord{}
+	if err := db.Find(&stored); err != nil {
+		t.Fatal(err)
+	}
+	for _, location := range stored {
+		if location.Name != "Somewhere" {
+			t.Errorf("location %d name = %q, want the enriched name", location.ID, location.Name)
+		}
+		if failed := location.Latitude == 2; failed != (location.EnrichedAt == nil) {
+			t.Errorf("location %d enriched at %v, want it set only if every step succeeded", location.ID, location.EnrichedAt)
+		}
+	}
+}
+
+func TestEnrichmentHandlerCancel(t *testing.T) {
+	db := dbtest.NewDatastore(t)
+	locations := []models.LocationRecord{{Latitude: 1}, {Latitude: 2}, {Latitude: 3}}
+	if err := db.Create(&locations); err != nil {
+		t.Fatal(err)
+	}
+
+	step := &fakeStep{}
+	runner := jobs.NewRunner(db)
+	runner.Register(jobs.TypeEnrichment, jobs.EnrichmentHandler(db, enrichment.NewPipeline(step), time.Hour))
+
+	job := &models.JobRecord{Type: jobs.TypeEnrichment}
+	tasks := make([]models.JobTaskRecord, len(locations))
+	for i, location := range locations {
+		tasks[i] = models.JobTaskRecord{LocationRecordID: location.ID}
+	}
+	if err := runner.Submit(job, tasks); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second location waits an hour for its turn
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		step.mu.Lock()
+		n := len(step.times)
+		step.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("first location not enriched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := runner.Cancel(job.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	finished := waitJob(t, db, job.ID)
+	if finished.Status != jobs.StatusCancelled || finished.Skipped != 2 {
+		t.Errorf("job = %s with %d skipped, want cancelled with 2", finished.Status, finished.Skipped)
+	}
+}
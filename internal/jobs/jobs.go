@@ -0,0 +1,348 @@
+// Package jobs runs long-running work, such as refreshing every location,
+// in the background. Jobs and their tasks are persisted so that their
+// progress can be polled and so that unfinished jobs are resumed when the
+// server restarts.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/metrics"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+const (
+	TaskPending   = "pending"
+	TaskSucceeded = "succeeded"
+	TaskFailed    = "failed"
+	TaskSkipped   = "skipped"
+)
+
+var (
+	// ErrCancelled is the cause of a job's context when it was cancelled
+	// through Cancel.
+	ErrCancelled = errors.New("job cancelled")
+	// ErrShutdown is the cause of a job's context when the runner is shutting
+	// down. Such jobs are left running in the database and resumed on start.
+	ErrShutdown = errors.New("runner shutting down")
+	// ErrNotFound is returned by Cancel when the job does not exist.
+	ErrNotFound = errors.New("job not found")
+	// ErrFinished is returned by Cancel when the job has already finished.
+	ErrFinished = errors.New("job already finished")
+)
+
+// Handler does the work of a job. It should persist the outcome of each
+// task as it finishes and return once the context is done. Progress
+// counters on the job are saved by the handler through Progress.
+type Handler func(ctx context.Context, job *Progress) error
+
+// Runner runs jobs in background goroutines.
+type Runner struct {
+	db       database.Datastore
+	handlers map[string]Handler
+
+	ctx      context.Context
+	shutdown context.CancelCauseFunc
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	cancels map[uint]context.CancelCauseFunc
+}
+
+// NewRunner creates a new Runner.
+func NewRunner(db database.Datastore) *Runner {
+	ctx, shutdown := context.WithCancelCause(context.Background())
+	return &Runner{
+		db:       db,
+		handlers: map[string]Handler{},
+		ctx:      ctx,
+		shutdown: shutdown,
+		cancels:  map[uint]context.CancelCauseFunc{},
+	}
+}
+
+// Register sets the handler for jobs of the given type.
+func (r *Runner) Register(jobType string, handler Handler) {
+	r.handlers[jobType] = handler
+}
+
+// Submit stores a new job and its tasks and starts it. The job is run on a
+// copy of 'job', which is left queued so that the caller can read it while
+// the job runs.
+func (r *Runner) Submit(job *models.JobRecord, tasks []models.JobTaskRecord) error {
+	if _, ok := r.handlers[job.Type]; !ok {
+		return fmt.Errorf("unknown job type: %q", job.Type)
+	}
+
+	job.Status = StatusQueued
+	job.Total = len(tasks)
+	err := r.db.Transaction(func(tx database.Datastore) error {
+		if err := tx.Create(job); err != nil {
+			return err
+		}
+		for i := range tasks {
+			tasks[i].JobRecordID = job.ID
+			tasks[i].Status = TaskPending
+		}
+		if len(tasks) == 0 {
+			return nil
+		}
+		return tx.Create(&tasks)
+	})
+	if err != nil {
+		return err
+	}
+
+	running := *job
+	r.start(&running)
+	return nil
+}
+
+// Resume restarts every job left queued or running by a previous process.
+// Jobs whose type has no registered handler are marked as failed.
+func (r *Runner) Resume() error {
+	unfinished := []models.JobRecord{}
+	if err := r.db.Find(&unfinished, "status IN ?", []string{StatusQueued, StatusRunning}); err != nil {
+		return err
+	}
+
+	for i := range unfinished {
+		job := &unfinished[i]
+		if _, ok := r.handlers[job.Type]; !ok {
+			r.finish(job, StatusFailed, fmt.Errorf("unknown job type: %q", job.Type))
+			continue
+		}
+		r.start(job)
+	}
+	return nil
+}
+
+// Cancel stops a queued or running job. Tasks that have not started are
+// marked as skipped.
+func (r *Runner) Cancel(id uint) error {
+	job := models.JobRecord{}
+	if err := r.db.Find(&job, id); err != nil {
+		return err
+	}
+	if job.ID == 0 {
+		return ErrNotFound
+	}
+	if job.Status != StatusQueued && job.Status != StatusRunning {
+		return ErrFinished
+	}
+
+	r.mu.Lock()
+	cancel, ok := r.cancels[id]
+	r.mu.Unlock()
+	if ok {
+		cancel(ErrCancelled)
+		return nil
+	}
+
+	// The job is not running in this process, so finish it directly.
+	if err := skipPendingTasks(r.db, id); err != nil {
+		return err
+	}
+	return r.finish(&job, StatusCancelled, nil)
+}
+
+// Shutdown stops every running job and waits for them to return, or for the
+// context to be done. Interrupted jobs are resumed by the next call to
+// Resume.
+func (r *Runner) Shutdown(ctx context.Context) error {
+	r.shutdown(ErrShutdown)
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ShuttingDown reports whether Shutdown was called.
+func (r *Runner) ShuttingDown() bool {
+	return r.ctx.Err() != nil
+}
+
+// Running returns the number of jobs currently running in this process.
+func (r *Runner) Running() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.cancels)
+}
+
+func (r *Runner) start(job *models.JobRecord) {
+	ctx, cancel := context.WithCancelCause(r.ctx)
+	r.mu.Lock()
+	r.cancels[job.ID] = cancel
+	r.mu.Unlock()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer func() {
+			r.mu.Lock()
+			delete(r.cancels, job.ID)
+			r.mu.Unlock()
+			cancel(nil)
+		}()
+
+		now := time.Now()
+		job.Status = StatusRunning
+		if job.StartedAt == nil {
+			job.StartedAt = &now
+		}
+		if err := r.db.Save(job); err != nil {
+			r.finish(job, StatusFailed, err)
+			return
+		}
+
+		progress := &Progress{db: r.db, job: job}
+		err := r.handlers[job.Type](ctx, progress)
+
+		switch {
+		case errors.Is(context.Cause(ctx), ErrShutdown):
+			// Left running so that it is resumed on the next start.
+		case errors.Is(context.Cause(ctx), ErrCancelled):
+			if err := skipPendingTasks(r.db, job.ID); err != nil {
+				r.finish(job, StatusFailed, err)
+				return
+			}
+			r.finish(job, StatusCancelled, nil)
+		case err != nil:
+			r.finish(job, StatusFailed, err)
+		default:
+			r.finish(job, StatusCompleted, nil)
+		}
+	}()
+}
+
+func (r *Runner) finish(job *models.JobRecord, status string, err error) error {
+	now := time.Now()
+	job.Status = status
+	job.FinishedAt = &now
+	if err != nil {
+		job.Error = err.Error()
+	}
+	if counts, countErr := countTasks(r.db, job.ID); countErr == nil {
+		job.Succeeded = counts[TaskSucceeded]
+		job.Failed = counts[TaskFailed]
+		job.Skipped = counts[TaskSkipped]
+		for taskStatus, n := range counts {
+			metrics.JobTasksFinished.WithLabelValues(job.Type, taskStatus).Add(float64(n))
+		}
+	}
+	metrics.JobsFinished.WithLabelValues(job.Type, status).Inc()
+
+	logger := slog.With("job_id", job.ID, "type", job.Type, "status", status)
+	if err != nil {
+		logger.Error("Job failed", "error", err)
+	} else {
+		logger.Info("Job finished", "succeeded", job.Succeeded, "failed", job.Failed, "skipped", job.Skipped)
+	}
+	if err := r.db.Save(job); err != nil {
+		logger.Error("Error saving finished job", "error", err)
+		return err
+	}
+	return nil
+}
+
+func skipPendingTasks(db database.Datastore, jobID uint) error {
+	pending := []models.JobTaskRecord{}
+	if err := db.Find(&pending, &models.JobTaskRecord{JobRecordID: jobID, Status: TaskPending}); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i := range pending {
+		pending[i].Status = TaskSkipped
+		pending[i].Error = ErrCancelled.Error()
+		pending[i].FinishedAt = &now
+		if err := db.Save(&pending[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func countTasks(db database.Datastore, jobID uint) (map[string]int, error) {
+	tasks := []models.JobTaskRecord{}
+	if err := db.Find(&tasks, &models.JobTaskRecord{JobRecordID: jobID}); err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{}
+	for _, task := range tasks {
+		counts[task.Status]++
+	}
+	return counts, nil
+}
+
+// Progress gives a handler access to its job and records task outcomes.
+// It is safe for concurrent use.
+type Progress struct {
+	db  database.Datastore
+	job *models.JobRecord
+	mu  sync.Mutex
+}
+
+// Job returns the job being run. It must not be modified.
+func (p *Progress) Job() *models.JobRecord {
+	return p.job
+}
+
+// PendingTasks returns the tasks of the job that have not finished yet.
+func (p *Progress) PendingTasks() ([]models.JobTaskRecord, error) {
+	tasks := []models.JobTaskRecord{}
+	err := p.db.Find(&tasks, &models.JobTaskRecord{JobRecordID: p.job.ID, Status: TaskPending})
+	return tasks, err
+}
+
+// Finish stores the outcome of a task and updates the job's counters.
+func (p *Progress) Finish(task *models.JobTaskRecord, status string, err error) error {
+	now := time.Now()
+	task.Status = status
+	task.FinishedAt = &now
+	if err != nil {
+		task.Error = err.Error()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.db.Transaction(func(tx database.Datastore) error {
+		if err := tx.Save(task); err != nil {
+			return err
+		}
+		switch status {
+		case TaskSucceeded:
+			p.job.Succeeded++
+		case TaskFailed:
+			p.job.Failed++
+		case TaskSkipped:
+			p.job.Skipped++
+		}
+		return tx.Save(p.job)
+	})
+}
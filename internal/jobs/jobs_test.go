@@ -0,0 +1,123 @@
+package jobs_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/database/dbtest"
+	"github.com/mick-io/duplo_go_cloud/internal/jobs"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+const typeTest = "test"
+
+// waitJob polls the stored job until it finishes.
+func waitJob(t *testing.T, db database.Datastore, id uint) models.JobRecord {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job := models.JobRecord{}
+		if err := db.Find(&job, id); err != nil {
+			t.Fatalf("reading job: %v", err)
+		}
+		if job.FinishedAt != nil {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %d did not finish", id)
+	return models.JobRecord{}
+}
+
+func TestSubmitLeavesCallerCopyQueued(t *testing.T) {
+	db := dbtest.NewDatastore(t)
+	runner := jobs.NewRunner(db)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	runner.Register(typeTest, func(ctx context.Context, progress *jobs.Progress) error {
+		close(started)
+		<-release
+		tasks, err := progress.PendingTasks()
+		if err != nil {
+			return err
+		}
+		for i := range tasks {
+			if err := progress.Finish(&tasks[i], jobs.TaskSucceeded, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	location := models.LocationRecord{Latitude: 1, Longitude: 2}
+	if err := db.Create(&location); err != nil {
+		t.Fatal(err)
+	}
+
+	job := &models.JobRecord{Type: typeTest}
+	tasks := []models.JobTaskRecord{{LocationRecordID: location.ID}}
+	if err := runner.Submit(job, tasks); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+
+	// Reading the submitted job while it runs, as the handler does to build
+	// its response, must neither race nor observe the runner's changes
+	<-started
+	if job.Status != jobs.StatusQueued || job.StartedAt != nil || job.FinishedAt != nil {
+		t.Errorf("submitted job = %q started=%v finished=%v, want queued", job.Status, job.StartedAt, job.FinishedAt)
+	}
+	close(release)
+
+	stored := waitJob(t, db, job.ID)
+	if stored.Status != jobs.StatusCompleted {
+		t.Errorf("stored status = %q, want %q", stored.Status, jobs.StatusCompleted)
+	}
+	if stored.Total != 1 || stored.Succeeded != 1 {
+		t.Errorf("stored total=%d succeeded=%d, want 1 and 1", stored.Total, stored.Succeeded)
+	}
+	if job.Status != jobs.StatusQueued {
+		t.Errorf("submitted job status changed to %q", job.Status)
+	}
+}
+
+func TestSubmitUnknownType(t *testing.T) {
+	runner := jobs.NewRunner(dbtest.NewDatastore(t))
+
+	if err := runner.Submit(&models.JobRecord{Type: "unknown"}, nil); err == nil {
+		t.Fatal("Submit succeeded for an unknown job type")
+	}
+}
+
+func TestCancelSkipsPendingTasks(t *testing.T) {
+	db := dbtest.NewDatastore(t)
+	runner := jobs.NewRunner(db)
+
+	started := make(chan struct{})
+	runner.Register(typeTest, func(ctx context.Context, progress *jobs.Progress) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	job := &models.JobRecord{Type: typeTest}
+	tasks := []models.JobTaskRecord{{LocationRecordID: 1}, {LocationRecordID: 2}}
+	if err := runner.Submit(job, tasks); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	<-started
+
+	if err := runner.Cancel(job.ID); err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	stored := waitJob(t, db, job.ID)
+	if stored.Status != jobs.StatusCancelled || stored.Skipped != 2 {
+		t.Errorf("stored status=%q skipped=%d, want cancelled and 2", stored.Status, stored.Skipped)
+	}
+	if err := runner.Cancel(job.ID); err != jobs.ErrFinished {
+		t.Errorf("second Cancel = %v, want %v", err, jobs.ErrFinished)
+	}
+}
@@ -0,0 +1,79 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/refresh"
+)
+
+// TypeRefresh is the type of jobs that refresh the forecast of the location
+// of each task.
+const TypeRefresh = "refresh"
+
+var errLocationDeleted = errors.New("location no longer exists")
+
+// RefreshHandler refreshes the location of every pending task with the
+// engine. Tasks interrupted by cancellation or shutdown are left pending for
+// the runner to skip or resume.
+func RefreshHandler(db database.Datastore, engine *refresh.Engine) Handler {
+	return func(ctx context.Context, progress *Progress) error {
+		tasks, err := progress.PendingTasks()
+		if err != nil || len(tasks) == 0 {
+			return err
+		}
+
+		ids := make([]uint, len(tasks))
+		for i, task := range tasks {
+			ids[i] = task.LocationRecordID
+		}
+		locations := []models.LocationRecord{}
+		if err := db.Find(&locations, ids); err != nil {
+			return err
+		}
+
+		found := make(map[uint]bool, len(locations))
+		for _, location := range locations {
+			found[location.ID] = true
+		}
+		byLocation := make(map[uint]*models.JobTaskRecord, len(tasks))
+		for i := range tasks {
+			task := &tasks[i]
+			if !found[task.LocationRecordID] {
+				if err := progress.Finish(task, TaskSkipped, errLocationDeleted); err != nil {
+					return err
+				}
+				continue
+			}
+			byLocation[task.LocationRecordID] = task
+		}
+
+		var mu sync.Mutex
+		var firstErr error
+		engine.Run(ctx, locations, func(result refresh.Result) {
+			task := byLocation[result.LocationID]
+
+			var err error
+			switch result.Status {
+			case refresh.StatusSucceeded:
+				task.ForecastRecordID = result.ForecastID
+				err = progress.Finish(task, TaskSucceeded, nil)
+			case refresh.StatusFailed:
+				err = progress.Finish(task, TaskFailed, result.Err)
+			}
+
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		})
+
+		return firstErr
+	}
+}
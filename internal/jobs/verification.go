@@ -0,0 +1,69 @@
+package jobs
+
+import (
+	"context"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/verification"
+)
+
+// TypeVerification is the type of jobs that verify the stored forecasts of
+// the location of each task against its observations.
+const TypeVerification = "verification"
+
+// VerificationHandler verifies the location of every pending task, replacing
+// its previous verification results. Tasks interrupted by cancellation or
+// shutdown are left pending for the runner to skip or resume.
+func VerificationHandler(db database.Datastore, leadTimes []int) Handler {
+	return func(ctx context.Context, progress *Progress) error {
+		tasks, err := progress.PendingTasks()
+		if err != nil {
+			return err
+		}
+
+		for i := range tasks {
+			if ctx.Err() != nil {
+				return nil
+			}
+			task := &tasks[i]
+
+			var location models.LocationRecord
+			if err := db.Find(&location, task.LocationRecordID); err != nil {
+				return err
+			}
+			if location.ID == 0 {
+				if err := progress.Finish(task, TaskSkipped, errLocationDeleted); err != nil {
+					return err
+				}
+				continue
+			}
+
+			records, err := verification.Verify(db, location.ID, leadTimes)
+			if err == nil {
+				err = db.Transaction(func(tx database.Datastore) error {
+					if err := tx.Delete(&models.VerificationRecord{}, "location_record_id = ?", location.ID); err != nil {
+						return err
+					}
+					if len(records) == 0 {
+						return nil
+					}
+					for j := range records {
+						records[j].JobRecordID = progress.Job().ID
+					}
+					return tx.Create(&records)
+				})
+			}
+
+			status := TaskSucceeded
+			if err != nil {
+				status = TaskFailed
+			}
+			if err := progress.Finish(task, status, err); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
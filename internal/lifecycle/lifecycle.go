@@ -0,0 +1,144 @@
+// Package lifecycle starts the components of the service and stops them
+// gracefully: on SIGINT or SIGTERM, or when a component fails, components
+// are stopped in the reverse order they were added, within a shared
+// deadline.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Exit codes of the service.
+const (
+	// ExitOK is returned when every component stopped cleanly after a
+	// signal.
+	ExitOK = 0
+	// ExitInit is returned when the service fails to initialize, before
+	// any component is started.
+	ExitInit = 1
+	// ExitFailed is returned when a component failed while running. The
+	// other components are still stopped gracefully.
+	ExitFailed = 2
+	// ExitShutdown is returned when a component failed to stop, or did not
+	// stop before the deadline.
+	ExitShutdown = 3
+)
+
+// DefaultTimeout bounds the shutdown when no timeout is configured.
+const DefaultTimeout = 30 * time.Second
+
+// Component is a part of the service with a lifecycle.
+type Component struct {
+	Name string
+	// Run, if set, runs the component. It blocks until the component fails
+	// or is stopped, and returns nil in the latter case.
+	Run func() error
+	// Stop, if set, stops the component, returning once it is stopped or
+	// 'ctx' is done.
+	Stop func(ctx context.Context) error
+}
+
+// Manager runs components until the service is asked to stop.
+type Manager struct {
+	// Timeout bounds the time taken to stop every component.
+	Timeout time.Duration
+	// Signals ask the service to stop. They default to SIGINT and SIGTERM.
+	Signals []os.Signal
+
+	components []Component
+}
+
+// NewManager creates a Manager stopping components within 'timeout'.
+func NewManager(timeout time.Duration) *Manager {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Manager{
+		Timeout: timeout,
+		Signals: []os.Signal{os.Interrupt, syscall.SIGTERM},
+	}
+}
+
+// Add adds a component. Components are run in the order they are added and
+// stopped in the reverse order, so that a component is stopped before the
+// components it depends on.
+func (m *Manager) Add(component Component) {
+	m.components = append(m.components, component)
+}
+
+// Run runs the components until a signal is received, 'ctx' is done or a
+// component fails, stops them and returns the exit code of the service. A
+// second signal received while stopping kills the process.
+func (m *Manager) Run(ctx context.Context) int {
+	ctx, stopSignals := signal.NotifyContext(ctx, m.Signals...)
+	defer stopSignals()
+
+	failed := make(chan error, len(m.components))
+	var wg sync.WaitGroup
+	for _, component := range m.components {
+		if component.Run == nil {
+			continue
+		}
+		component := component
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := component.Run(); err != nil {
+				failed <- fmt.Errorf("%s: %w", component.Name, err)
+			}
+		}()
+	}
+
+	code := ExitOK
+	select {
+	case <-ctx.Done():
+		slog.Info("Shutting down", "cause", context.Cause(ctx), "timeout", m.Timeout)
+	case err := <-failed:
+		slog.Error("Component failed, shutting down", "error", err, "timeout", m.Timeout)
+		code = ExitFailed
+	}
+	// Restoring the default behavior of the signals, so that a second
+	// signal kills the process
+	stopSignals()
+
+	if err := m.stop(); err != nil {
+		slog.Error("Error shutting down", "error", err)
+		return ExitShutdown
+	}
+
+	// The components were stopped, so their Run functions return
+	wg.Wait()
+	slog.Info("Shut down")
+	return code
+}
+
+// stop stops the components in the reverse order they were added. Every
+// component is stopped, even when stopping another one fails.
+func (m *Manager) stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	var errs []error
+	for i := len(m.components) - 1; i >= 0; i-- {
+		component := m.components[i]
+		if component.Stop == nil {
+			continue
+		}
+
+		start := time.Now()
+		if err := component.Stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", component.Name, err))
+			continue
+		}
+		slog.Info("Stopped", "component", component.Name, "duration", time.Since(start))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,164 @@
+package lifecycle_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mick-io/duplo_go_cloud/internal/lifecycle"
+)
+
+// recorder records the order components are stopped in.
+type recorder struct {
+	mu      sync.Mutex
+	stopped []string
+}
+
+// component returns a component running until it is stopped, or failing
+// with 'runErr' if set. Its Stop function returns 'stopErr'.
+func (r *recorder) component(name string, runErr, stopErr error) lifecycle.Component {
+	done := make(chan struct{})
+	var once sync.Once
+	return lifecycle.Component{
+		Name: name,
+		Run: func() error {
+			if runErr != nil {
+				return runErr
+			}
+			<-done
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			r.mu.Lock()
+			r.stopped = append(r.stopped, name)
+			r.mu.Unlock()
+			once.Do(func() { close(done) })
+			return stopErr
+		},
+	}
+}
+
+func TestRunExitCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		runErr  error
+		stopErr error
+		want    int
+		cancel  bool
+	}{
+		{
+			name:   "stopped cleanly",
+			cancel: true,
+			want:   lifecycle.ExitOK,
+		},
+		{
+			name:   "component failed",
+			runErr: errors.New("address already in use"),
+			want:   lifecycle.ExitFailed,
+		},
+		{
+			name:    "component failed to stop",
+			cancel:  true,
+			stopErr: errors.New("jobs still running"),
+			want:    lifecycle.ExitShutdown,
+		},
+		{
+			name:    "component failed, then failed to stop",
+			runErr:  errors.New("address already in use"),
+			stopErr: errors.New("jobs still running"),
+			want:    lifecycle.ExitShutdown,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &recorder{}
+			m := lifecycle.NewManager(time.Second)
+			m.Add(r.component("database", nil, nil))
+			m.Add(r.component("jobs", nil, tt.stopErr))
+			m.Add(r.component("server", tt.runErr, nil))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+
+			if got := m.Run(ctx); got != tt.want {
+				t.Errorf("Run = %d, want %d", got, tt.want)
+			}
+			// Every component is stopped, in the reverse order, even when
+			// one fails to stop
+			if want := []string{"server", "jobs", "database"}; !reflect.DeepEqual(r.stopped, want) {
+				t.Errorf("stopped %v, want %v", r.stopped, want)
+			}
+		})
+	}
+}
+
+func TestRunStopsOnSignal(t *testing.T) {
+	// Keeping SIGUSR1 from killing the test once Run restores its default
+	// behavior
+	ignored := make(chan os.Signal, 1)
+	signal.Notify(ignored, syscall.SIGUSR1)
+	defer signal.Stop(ignored)
+
+	m := lifecycle.NewManager(time.Second)
+	m.Signals = []os.Signal{syscall.SIGUSR1}
+	stopped := make(chan struct{})
+	m.Add(lifecycle.Component{
+		Name: "server",
+		Run: func() error {
+			<-stopped
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			close(stopped)
+			return nil
+		},
+	})
+
+	go func() {
+		// Sending the signal until Run has installed its handler
+		for {
+			syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+			select {
+			case <-stopped:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	if got := m.Run(context.Background()); got != lifecycle.ExitOK {
+		t.Errorf("Run = %d, want %d", got, lifecycle.ExitOK)
+	}
+}
+
+func TestRunShutdownTimeout(t *testing.T) {
+	m := lifecycle.NewManager(50 * time.Millisecond)
+	m.Add(lifecycle.Component{
+		Name: "jobs",
+		Stop: func(ctx context.Context) error {
+			<-ctx.Done()
+			return fmt.Errorf("waiting for jobs: %w", ctx.Err())
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if got := m.Run(ctx); got != lifecycle.ExitShutdown {
+		t.Errorf("Run = %d, want %d", got, lifecycle.ExitShutdown)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Run took %v, want the 50ms deadline", elapsed)
+	}
+}
@@ -0,0 +1,318 @@
+// Package locationio reads and writes locations in the bulk import and
+// export formats: CSV, JSON arrays and GeoJSON FeatureCollections.
+package locationio
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+type Format string
+
+const (
+	FormatCSV     Format = "csv"
+	FormatJSON    Format = "json"
+	FormatGeoJSON Format = "geojson"
+)
+
+var csvHeader = []string{"id", "latitude", "longitude", "name", "country", "admin_region", "country_code", "timezone", "elevation"}
+
+// Row is a single decoded location. Err is set when the row could not be
+// parsed, so that one malformed row does not fail the whole import.
+type Row struct {
+	Index    int
+	Location models.ReadLocationResponseBody
+	Err      error
+}
+
+// Body returns the row as a create request so it can be validated like any
+// other location.
+func (r *Row) Body() models.CreateLocationRequestBody {
+	return models.CreateLocationRequestBody{
+		Latitude:  r.Location.Latitude,
+		Longitude: r.Location.Longitude,
+	}
+}
+
+// Record returns the row as a new location record, ignoring its ID.
+func (r *Row) Record() *models.LocationRecord {
+	return &models.LocationRecord{
+		Latitude:    r.Location.Latitude,
+		Longitude:   r.Location.Longitude,
+		Name:        r.Location.Name,
+		Country:     r.Location.Country,
+		AdminRegion: r.Location.AdminRegion,
+		CountryCode: r.Location.CountryCode,
+		Timezone:    r.Location.Timezone,
+		Elevation:   r.Location.Elevation,
+	}
+}
+
+// ParseFormat parses a format name as used by the format query parameter.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case FormatCSV, FormatJSON, FormatGeoJSON:
+		return f, nil
+	}
+	return "", fmt.Errorf("unsupported format: %q", s)
+}
+
+// FormatFromContentType maps a request Content-Type to a format.
+func FormatFromContentType(contentType string) (Format, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("invalid content type: %q", contentType)
+	}
+
+	switch mediaType {
+	case "text/csv":
+		return FormatCSV, nil
+	case "application/json":
+		return FormatJSON, nil
+	case "application/geo+json":
+		return FormatGeoJSON, nil
+	}
+	return "", fmt.Errorf("unsupported content type: %q", contentType)
+}
+
+// ContentType returns the media type used when writing the format.
+func (f Format) ContentType() string {
+	switch f {
+	case FormatCSV:
+		return "text/csv"
+	case FormatGeoJSON:
+		return "application/geo+json"
+	}
+	return "application/json"
+}
+
+// Decode reads every location in r.
+func Decode(format Format, r io.Reader) ([]Row, error) {
+	switch format {
+	case FormatCSV:
+		return decodeCSV(r)
+	case FormatJSON:
+		return decodeJSON(r)
+	case FormatGeoJSON:
+		return decodeGeoJSON(r)
+	}
+	return nil, fmt.Errorf("unsupported format: %q", format)
+}
+
+// Encode writes the records to w.
+func Encode(format Format, w io.Writer, records []models.LocationRecord) error {
+	switch format {
+	case FormatCSV:
+		return encodeCSV(w, records)
+	case FormatJSON:
+		return encodeJSON(w, records)
+	case FormatGeoJSON:
+		return encodeGeoJSON(w, records)
+	}
+	return fmt.Errorf("unsupported format: %q", format)
+}
+
+func decodeCSV(r io.Reader) ([]Row, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "lat":
+			name = "latitude"
+		case "lon", "lng":
+			name = "longitude"
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["latitude"]; !ok {
+		return nil, errors.New("missing latitude column")
+	}
+	if _, ok := columns["longitude"]; !ok {
+		return nil, errors.New("missing longitude column")
+	}
+
+	rows := []Row{}
+	for i := 0; ; i++ {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				rows = append(rows, Row{Index: i, Err: err})
+				continue
+			}
+			return nil, err
+		}
+
+		value := func(column string) string {
+			idx, ok := columns[column]
+			if !ok || idx >= len(fields) {
+				return ""
+			}
+			return strings.TrimSpace(fields[idx])
+		}
+
+		row := Row{Index: i}
+		row.Location.Name = value("name")
+		row.Location.Country = value("country")
+		row.Location.AdminRegion = value("admin_region")
+		row.Location.CountryCode = value("country_code")
+		row.Location.Timezone = value("timezone")
+
+		if row.Location.Latitude, err = strconv.ParseFloat(value("latitude"), 64); err != nil {
+			row.Err = fmt.Errorf("invalid latitude: %w", err)
+		} else if row.Location.Longitude, err = strconv.ParseFloat(value("longitude"), 64); err != nil {
+			row.Err = fmt.Errorf("invalid longitude: %w", err)
+		} else if elevation := value("elevation"); elevation != "" {
+			if row.Location.Elevation, err = strconv.ParseFloat(elevation, 64); err != nil {
+				row.Err = fmt.Errorf("invalid elevation: %w", err)
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+func decodeJSON(r io.Reader) ([]Row, error) {
+	var raw []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	rows := make([]Row, len(raw))
+	for i, msg := range raw {
+		rows[i].Index = i
+		rows[i].Err = json.Unmarshal(msg, &rows[i].Location)
+	}
+	return rows, nil
+}
+
+type pointFeature struct {
+	Geometry struct {
+		Type        string    `json:"type"`
+		Coordinates []float64 `json:"coordinates"`
+	} `json:"geometry"`
+	Properties models.ReadLocationResponseBody `json:"properties"`
+}
+
+func decodeGeoJSON(r io.Reader) ([]Row, error) {
+	var collection struct {
+		Type     string            `json:"type"`
+		Features []json.RawMessage `json:"features"`
+	}
+	if err := json.NewDecoder(r).Decode(&collection); err != nil {
+		return nil, err
+	}
+	if collection.Type != "FeatureCollection" {
+		return nil, fmt.Errorf("expected a FeatureCollection, got %q", collection.Type)
+	}
+
+	rows := make([]Row, len(collection.Features))
+	for i, msg := range collection.Features {
+		rows[i].Index = i
+
+		var feature pointFeature
+		if err := json.Unmarshal(msg, &feature); err != nil {
+			rows[i].Err = err
+			continue
+		}
+		if feature.Geometry.Type != "Point" || len(feature.Geometry.Coordinates) < 2 {
+			rows[i].Err = errors.New("feature geometry must be a Point")
+			continue
+		}
+
+		rows[i].Location = feature.Properties
+		rows[i].Location.Longitude = feature.Geometry.Coordinates[0]
+		rows[i].Location.Latitude = feature.Geometry.Coordinates[1]
+	}
+	return rows, nil
+}
+
+func encodeCSV(w io.Writer, records []models.LocationRecord) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		err := writer.Write([]string{
+			strconv.FormatUint(uint64(record.ID), 10),
+			strconv.FormatFloat(record.Latitude, 'f', -1, 64),
+			strconv.FormatFloat(record.Longitude, 'f', -1, 64),
+			record.Name,
+			record.Country,
+			record.AdminRegion,
+			record.CountryCode,
+			record.Timezone,
+			strconv.FormatFloat(record.Elevation, 'f', -1, 64),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func encodeJSON(w io.Writer, records []models.LocationRecord) error {
+	locations := make([]models.ReadLocationResponseBody, len(records))
+	for i, record := range records {
+		locations[i] = newLocationBody(&record)
+	}
+	return json.NewEncoder(w).Encode(locations)
+}
+
+func encodeGeoJSON(w io.Writer, records []models.LocationRecord) error {
+	features := make([]models.Feature, len(records))
+	for i, record := range records {
+		properties := map[string]interface{}{}
+		body := newLocationBody(&record)
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(raw, &properties); err != nil {
+			return err
+		}
+		delete(properties, "latitude")
+		delete(properties, "longitude")
+
+		features[i] = models.NewPointFeature(record.ID, record.Latitude, record.Longitude, properties)
+	}
+	return json.NewEncoder(w).Encode(models.NewFeatureCollection(features))
+}
+
+func newLocationBody(record *models.LocationRecord) models.ReadLocationResponseBody {
+	return models.ReadLocationResponseBody{
+		ID:          record.ID,
+		Latitude:    record.Latitude,
+		Longitude:   record.Longitude,
+		Name:        record.Name,
+		Country:     record.Country,
+		AdminRegion: record.AdminRegion,
+		CountryCode: record.CountryCode,
+		Timezone:    record.Timezone,
+		Elevation:   record.Elevation,
+	}
+}
@@ -0,0 +1,124 @@
+package logging_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/logging"
+)
+
+// captureLogs makes the default logger write JSON records to the returned
+// buffer for the duration of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	logger, err := logging.New(buf, logging.Options{Level: "debug", Format: logging.FormatJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return buf
+}
+
+func TestMiddlewareRequestIDs(t *testing.T) {
+	logs := captureLogs(t)
+
+	// The upstream API receives the request ID through the transport
+	var upstreamID string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get(echo.HeaderXRequestID)
+	}))
+	defer upstream.Close()
+	client := &http.Client{}
+	logging.InstrumentClient(client)
+
+	e := echo.New()
+	e.Use(logging.Middleware())
+	e.GET("/locations/:id", func(c echo.Context) error {
+		req, err := http.NewRequestWithContext(c.Request().Context(), http.MethodGet, upstream.URL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return echo.NewHTTPError(http.StatusNotFound, "Location not found")
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		// want is the expected request ID, or "" for a generated one
+		want string
+	}{
+		{"client ID", "req-42", "req-42"},
+		{"missing ID", "", ""},
+		{"ID with spaces", "req 42", ""},
+		{"ID too long", strings.Repeat("a", 129), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			upstreamID = ""
+			req := httptest.NewRequest(http.MethodGet, "/locations/7", nil)
+			if tt.header != "" {
+				req.Header.Set(echo.HeaderXRequestID, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			id := rec.Header().Get(echo.HeaderXRequestID)
+			if tt.want != "" && id != tt.want {
+				t.Errorf("response ID = %q, want %q", id, tt.want)
+			}
+			if tt.want == "" && (len(id) != 32 || id == tt.header) {
+				t.Errorf("response ID = %q, want a generated ID", id)
+			}
+			if upstreamID != id {
+				t.Errorf("upstream ID = %q, want %q", upstreamID, id)
+			}
+
+			var record struct {
+				Level     string
+				RequestID string `json:"request_id"`
+				Route     string
+				Status    int
+				Error     string
+			}
+			if err := json.Unmarshal(logs.Bytes(), &record); err != nil {
+				t.Fatalf("decoding %q: %v", logs, err)
+			}
+			if record.RequestID != id || record.Route != "/locations/:id" || record.Status != http.StatusNotFound {
+				t.Errorf("record = %+v, want request %q on /locations/:id answered 404", record, id)
+			}
+			// Client errors are logged as warnings
+			if record.Level != "WARN" || record.Error == "" {
+				t.Errorf("record = %+v, want a warning with the error", record)
+			}
+		})
+	}
+}
+
+func TestNewRejectsInvalidOptions(t *testing.T) {
+	for _, opts := range []logging.Options{
+		{Level: "verbose"},
+		{Format: "xml"},
+	} {
+		if _, err := logging.New(&bytes.Buffer{}, opts); err == nil {
+			t.Errorf("New(%+v) succeeded", opts)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package logging
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Transport sends the request ID carried by the context of a request to an
+// upstream API in the X-Request-ID header.
+type Transport struct {
+	Base http.RoundTripper
+}
+
+// InstrumentClient sends the request IDs along with the requests made by
+// 'client'.
+func InstrumentClient(client *http.Client) {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &Transport{Base: base}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := RequestID(req.Context()); id != "" {
+		// The request is cloned since round trippers must not modify it.
+		req = req.Clone(req.Context())
+		req.Header.Set(echo.HeaderXRequestID, id)
+	}
+	return t.Base.RoundTrip(req)
+}
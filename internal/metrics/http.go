@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// unmatchedRoute labels the requests that matched no route, so that
+// arbitrary paths do not create new series.
+const unmatchedRoute = "unmatched"
+
+// Middleware records the count and latency of requests by route. Routes are
+// labeled with their template, e.g. "/locations/:id".
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+
+			status := c.Response().Status
+			if err != nil {
+				var httpErr *echo.HTTPError
+				if errors.As(err, &httpErr) {
+					status = httpErr.Code
+				} else if !c.Response().Committed {
+					status = http.StatusInternalServerError
+				}
+			}
+			route := c.Path()
+			if route == "" || status == http.StatusNotFound && route == "/*" {
+				route = unmatchedRoute
+			}
+
+			method := c.Request().Method
+			HTTPRequests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+			HTTPDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+			return err
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Package metrics exposes Prometheus metrics of the HTTP server, the
+// upstream APIs, the datastore, the refresh engine and the job runner.
+// Metrics are registered in Registry, which Handler serves.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace prefixes every metric of the service.
+const namespace = "duplo"
+
+// Registry holds the metrics of the service along with the Go runtime and
+// process metrics.
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+var (
+	// HTTPRequests counts the handled requests by method, route and status.
+	HTTPRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	// HTTPDuration observes the latency of the handled requests.
+	HTTPDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of HTTP requests by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// UpstreamRequests counts the calls to the upstream APIs by API,
+	// endpoint and outcome, see Outcome.
+	UpstreamRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "upstream",
+		Name:      "requests_total",
+		Help:      "Upstream API calls by API, endpoint and outcome.",
+	}, []string{"api", "endpoint", "outcome"})
+
+	// UpstreamDuration observes the latency of the calls to the upstream
+	// APIs.
+	UpstreamDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "upstream",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of upstream API calls by API and endpoint.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"api", "endpoint"})
+
+	// DatastoreDuration observes the duration of the statements run by the
+	// datastore by operation, table and outcome.
+	DatastoreDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "datastore",
+		Name:      "query_duration_seconds",
+		Help:      "Duration of datastore statements by operation, table and outcome.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation", "table", "outcome"})
+
+	// Refreshes counts the forecast refreshes by status and failed stage.
+	Refreshes = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "refresh",
+		Name:      "total",
+		Help:      "Forecast refreshes by status and, for failures, stage.",
+	}, []string{"status", "stage"})
+
+	// JobsFinished counts the finished jobs by type and status.
+	JobsFinished = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "jobs",
+		Name:      "finished_total",
+		Help:      "Finished background jobs by type and status.",
+	}, []string{"type", "status"})
+
+	// JobTasksFinished counts the tasks of finished jobs by job type and
+	// task status.
+	JobTasksFinished = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "jobs",
+		Name:      "tasks_finished_total",
+		Help:      "Tasks of finished background jobs by job type and task status.",
+	}, []string{"type", "status"})
+)
+
+// RegisterDBStats exposes the statistics of a database connection pool.
+func RegisterDBStats(db *sql.DB) error {
+	return Registry.Register(collectors.NewDBStatsCollector(db, "postgres"))
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
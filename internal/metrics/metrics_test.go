@@ -0,0 +1,141 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database/dbtest"
+	"github.com/mick-io/duplo_go_cloud/internal/metrics"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+func TestMiddlewareLabelsRoutes(t *testing.T) {
+	e := echo.New()
+	e.Use(metrics.Middleware())
+	e.GET("/locations/:id", func(c echo.Context) error {
+		if c.Param("id") == "404" {
+			return echo.NewHTTPError(http.StatusNotFound, "Location not found")
+		}
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/fails", func(c echo.Context) error {
+		return errors.New("boom")
+	})
+
+	tests := []struct {
+		target string
+		route  string
+		status string
+	}{
+		{"/locations/7", "/locations/:id", "200"},
+		{"/locations/404", "/locations/:id", "404"},
+		{"/fails", "/fails", "500"},
+		// Arbitrary paths share a single series
+		{"/wp-login.php", "unmatched", "404"},
+	}
+
+	for _, tt := range tests {
+		counter := metrics.HTTPRequests.WithLabelValues(http.MethodGet, tt.route, tt.status)
+		before := testutil.ToFloat64(counter)
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if got := testutil.ToFloat64(counter) - before; got != 1 {
+			t.Errorf("GET %s counted %v times as %s %s, want once", tt.target, got, tt.route, tt.status)
+		}
+	}
+}
+
+func TestOutcome(t *testing.T) {
+	timeout := &net.DNSError{IsTimeout: true}
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		want   string
+	}{
+		{"ok", http.StatusOK, nil, metrics.OutcomeOK},
+		{"rate limited", http.StatusTooManyRequests, nil, metrics.OutcomeRateLimited},
+		{"client error", http.StatusBadRequest, nil, metrics.OutcomeClientError},
+		{"server error", http.StatusBadGateway, nil, metrics.OutcomeServerError},
+		{"canceled", 0, context.Canceled, metrics.OutcomeCanceled},
+		{"deadline", 0, context.DeadlineExceeded, metrics.OutcomeTimeout},
+		{"network timeout", 0, timeout, metrics.OutcomeTimeout},
+		{"network error", 0, errors.New("connection refused"), metrics.OutcomeNetwork},
+	}
+
+	for _, tt := range tests {
+		var resp *http.Response
+		if tt.err == nil {
+			resp = &http.Response{StatusCode: tt.status}
+		}
+		if got := metrics.Outcome(resp, tt.err); got != tt.want {
+			t.Errorf("%s: Outcome = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStaleForecasts(t *testing.T) {
+	db := dbtest.NewDatastore(t)
+	ctxA, _ := dbtest.CreateTenant(t, db, "a")
+	ctxB, _ := dbtest.CreateTenant(t, db, "b")
+
+	// A location of each tenant with a recent forecast, one with an old
+	// forecast and one without any
+	for i, step := range []struct {
+		ctx      context.Context
+		forecast time.Duration
+	}{
+		{ctxA, time.Minute},
+		{ctxB, time.Minute},
+		{ctxA, 2 * time.Hour},
+		{ctxB, 0},
+	} {
+		tenant := db.WithContext(step.ctx)
+		location := models.LocationRecord{Name: string(rune('a' + i)), Latitude: float64(i)}
+		if err := tenant.Create(&location); err != nil {
+			t.Fatalf("creating location: %v", err)
+		}
+		if step.forecast == 0 {
+			continue
+		}
+		forecast := models.ForecastRecord{LocationRecordID: location.ID}
+		forecast.CreatedAt = time.Now().Add(-step.forecast)
+		if err := tenant.Create(&forecast); err != nil {
+			t.Fatalf("creating forecast: %v", err)
+		}
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(&metrics.StaleForecasts{DB: db, After: time.Hour})
+	want := `
+# HELP duplo_forecasts_stale_locations Locations without a forecast stored within the staleness threshold.
+# TYPE duplo_forecasts_stale_locations gauge
+duplo_forecasts_stale_locations 2
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStaleForecastsDisabled(t *testing.T) {
+	db := dbtest.NewDatastore(t)
+	if err := db.Create(&models.LocationRecord{Name: "a"}); err != nil {
+		t.Fatalf("creating location: %v", err)
+	}
+
+	for _, after := range []time.Duration{0, -time.Hour} {
+		collector := &metrics.StaleForecasts{DB: db, After: after}
+		if got := testutil.CollectAndCount(collector); got != 0 {
+			t.Errorf("After %v: collected %d samples, want none", after, got)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+)
+
+// staleQueryTimeout bounds the query run on every scrape.
+const staleQueryTimeout = 5 * time.Second
+
+var staleLocationsDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "forecasts", "stale_locations"),
+	"Locations without a forecast stored within the staleness threshold.",
+	nil, nil,
+)
+
+// StaleForecasts counts, on every scrape, the locations of every tenant
+// without a forecast stored within After. Nothing is reported when After is
+// not positive, as /health skips the check then.
+type StaleForecasts struct {
+	DB    database.Datastore
+	After time.Duration
+}
+
+// RegisterStaleForecasts exposes the number of locations without a forecast
+// stored within 'after'.
+func RegisterStaleForecasts(db database.Datastore, after time.Duration) error {
+	return Registry.Register(&StaleForecasts{DB: db, After: after})
+}
+
+// Describe implements prometheus.Collector.
+func (s *StaleForecasts) Describe(ch chan<- *prometheus.Desc) {
+	ch <- staleLocationsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (s *StaleForecasts) Collect(ch chan<- prometheus.Metric) {
+	if s.After <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), staleQueryTimeout)
+	defer cancel()
+
+	count, err := database.CountStaleLocations(s.DB.WithContext(ctx), time.Now().Add(-s.After))
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(staleLocationsDesc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(staleLocationsDesc, prometheus.GaugeValue, float64(count))
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"path"
+	"time"
+)
+
+// Outcomes of upstream API calls.
+const (
+	OutcomeOK          = "ok"
+	OutcomeCanceled    = "canceled"
+	OutcomeTimeout     = "timeout"
+	OutcomeNetwork     = "network_error"
+	OutcomeRateLimited = "rate_limited"
+	OutcomeClientError = "client_error"
+	OutcomeServerError = "server_error"
+)
+
+// Outcome classifies the result of an upstream API call.
+func Outcome(resp *http.Response, err error) string {
+	if err != nil {
+		var netErr net.Error
+		switch {
+		case errors.Is(err, context.Canceled):
+			return OutcomeCanceled
+		case errors.Is(err, context.DeadlineExceeded):
+			return OutcomeTimeout
+		case errors.As(err, &netErr) && netErr.Timeout():
+			return OutcomeTimeout
+		}
+		return OutcomeNetwork
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return OutcomeRateLimited
+	case resp.StatusCode >= 500:
+		return OutcomeServerError
+	case resp.StatusCode >= 400:
+		return OutcomeClientError
+	}
+	return OutcomeOK
+}
+
+// Transport records the count, latency and outcome of the requests to an
+// upstream API. Requests are labeled with the last element of their path,
+// e.g. "forecast" or "search".
+type Transport struct {
+	API  string
+	Base http.RoundTripper
+}
+
+// InstrumentClient records the requests made by 'client' to 'api'.
+func InstrumentClient(client *http.Client, api string) {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &Transport{API: api, Base: base}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := path.Base(req.URL.Path)
+	start := time.Now()
+	resp, err := t.Base.RoundTrip(req)
+
+	UpstreamRequests.WithLabelValues(t.API, endpoint, Outcome(resp, err)).Inc()
+	UpstreamDuration.WithLabelValues(t.API, endpoint).Observe(time.Since(start).Seconds())
+	return resp, err
+}
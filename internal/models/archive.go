@@ -0,0 +1,19 @@
+package models
+
+// Archive is a response of the historical weather API. Hours without data
+// are null.
+type Archive struct {
+	Latitude         float64       `json:"latitude"`
+	Longitude        float64       `json:"longitude"`
+	UTCOffsetSeconds int64         `json:"utc_offset_seconds"`
+	Timezone         string        `json:"timezone"`
+	Elevation        float64       `json:"elevation"`
+	HourlyUnits      HourlyUnits   `json:"hourly_units"`
+	Hourly           ArchiveHourly `json:"hourly"`
+}
+
+type ArchiveHourly struct {
+	Time          []string   `json:"time"`
+	Temperature2M []*float64 `json:"temperature_2m"`
+	Precipitation []*float64 `json:"precipitation"`
+}
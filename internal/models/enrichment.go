@@ -0,0 +1,35 @@
+package models
+
+type ReverseGeocoding struct {
+	Name        string                  `json:"name"`
+	DisplayName string                  `json:"display_name"`
+	Address     ReverseGeocodingAddress `json:"address"`
+}
+
+type ReverseGeocodingAddress struct {
+	Hamlet      string `json:"hamlet"`
+	Village     string `json:"village"`
+	Town        string `json:"town"`
+	City        string `json:"city"`
+	County      string `json:"county"`
+	State       string `json:"state"`
+	Country     string `json:"country"`
+	CountryCode string `json:"country_code"`
+}
+
+// PlaceName returns the most specific populated place in the address,
+// falling back to the feature name.
+func (r *ReverseGeocoding) PlaceName() string {
+	for _, name := range []string{r.Address.City, r.Address.Town, r.Address.Village, r.Address.Hamlet, r.Name, r.Address.County} {
+		if name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+type Timezone struct {
+	Timezone             string `json:"timezone" validate:"required"`
+	TimezoneAbbreviation string `json:"timezone_abbreviation"`
+	UTCOffsetSeconds     int64  `json:"utc_offset_seconds"`
+}
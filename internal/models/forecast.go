@@ -1,6 +1,20 @@
 package models
 
-import "github.com/go-playground/validator"
+import (
+	"time"
+
+	"github.com/go-playground/validator"
+)
+
+// hourlyTimeLayout is the layout of the local times in the hourly series.
+const hourlyTimeLayout = "2006-01-02T15:04"
+
+// ParseHourlyTime parses a local time from the hourly series using the
+// forecast's UTC offset.
+func ParseHourlyTime(value string, utcOffsetSeconds int64) (time.Time, error) {
+	zone := time.FixedZone("", int(utcOffsetSeconds))
+	return time.ParseInLocation(hourlyTimeLayout, value, zone)
+}
 
 func ValidateForecast(f Forecast) error {
 	validate := validator.New()
@@ -10,6 +24,18 @@ func ValidateForecast(f Forecast) error {
 			sl.ReportError(hourly.Time, "Time", "time", "len", "")
 			sl.ReportError(hourly.Temperature2M, "Temperature2M", "temperature_2m", "len", "")
 		}
+		if len(hourly.Time) != len(hourly.Precipitation) {
+			sl.ReportError(hourly.Precipitation, "Precipitation", "precipitation", "len", "")
+		}
+		if len(hourly.Time) != len(hourly.RelativeHumidity2M) {
+			sl.ReportError(hourly.RelativeHumidity2M, "RelativeHumidity2M", "relative_humidity_2m", "len", "")
+		}
+		if len(hourly.Time) != len(hourly.WindSpeed10M) {
+			sl.ReportError(hourly.WindSpeed10M, "WindSpeed10M", "wind_speed_10m", "len", "")
+		}
+		if len(hourly.Time) != len(hourly.SurfacePressure) {
+			sl.ReportError(hourly.SurfacePressure, "SurfacePressure", "surface_pressure", "len", "")
+		}
 	}, Hourly{})
 
 	err := validate.Struct(f)
@@ -32,11 +58,38 @@ type Forecast struct {
 }
 
 type Hourly struct {
-	Time          []string  `json:"time" validate:"required"`
-	Temperature2M []float64 `json:"temperature_2m" validate:"required"`
+	Time               []string  `json:"time" validate:"required"`
+	Temperature2M      []float64 `json:"temperature_2m" validate:"required"`
+	Precipitation      []float64 `json:"precipitation" validate:"required"`
+	RelativeHumidity2M []float64 `json:"relative_humidity_2m" validate:"required"`
+	WindSpeed10M       []float64 `json:"wind_speed_10m" validate:"required"`
+	SurfacePressure    []float64 `json:"surface_pressure" validate:"required"`
 }
 
 type HourlyUnits struct {
-	Time          string `json:"time" validate:"required"`
-	Temperature2M string `json:"temperature_2m" validate:"required"`
+	Time               string `json:"time" validate:"required"`
+	Temperature2M      string `json:"temperature_2m" validate:"required"`
+	Precipitation      string `json:"precipitation" validate:"required"`
+	RelativeHumidity2M string `json:"relative_humidity_2m" validate:"required"`
+	WindSpeed10M       string `json:"wind_speed_10m" validate:"required"`
+	SurfacePressure    string `json:"surface_pressure" validate:"required"`
+}
+
+type CurrentForecast struct {
+	Latitude     float64      `json:"latitude"`
+	Longitude    float64      `json:"longitude"`
+	CurrentUnits CurrentUnits `json:"current_units"`
+	Current      Current      `json:"current"`
+}
+
+type Current struct {
+	Time          string  `json:"time"`
+	Temperature2M float64 `json:"temperature_2m"`
+	Precipitation float64 `json:"precipitation"`
+}
+
+type CurrentUnits struct {
+	Time          string `json:"time"`
+	Temperature2M string `json:"temperature_2m"`
+	Precipitation string `json:"precipitation"`
 }
@@ -0,0 +1,19 @@
+package models
+
+type Geocoding struct {
+	Results []GeocodingResult `json:"results"`
+}
+
+type GeocodingResult struct {
+	ID          int64    `json:"id"`
+	Name        string   `json:"name"`
+	Latitude    float64  `json:"latitude"`
+	Longitude   float64  `json:"longitude"`
+	Elevation   float64  `json:"elevation"`
+	CountryCode string   `json:"country_code"`
+	Country     string   `json:"country"`
+	Admin1      string   `json:"admin1"`
+	Admin2      string   `json:"admin2"`
+	Timezone    string   `json:"timezone"`
+	Postcodes   []string `json:"postcodes"`
+}
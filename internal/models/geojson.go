@@ -0,0 +1,62 @@
+package models
+
+type FeatureCollection struct {
+	Type     string    `json:"type"`
+	BBox     []float64 `json:"bbox,omitempty"`
+	Features []Feature `json:"features"`
+}
+
+type Feature struct {
+	Type       string                 `json:"type"`
+	ID         interface{}            `json:"id,omitempty"`
+	Geometry   Geometry               `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type Geometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+func NewFeatureCollection(features []Feature) FeatureCollection {
+	if features == nil {
+		features = []Feature{}
+	}
+	return FeatureCollection{Type: "FeatureCollection", Features: features}
+}
+
+// NewPointFeature creates a Point feature. GeoJSON orders coordinates as
+// longitude, latitude.
+func NewPointFeature(id interface{}, latitude, longitude float64, properties map[string]interface{}) Feature {
+	return Feature{
+		Type: "Feature",
+		ID:   id,
+		Geometry: Geometry{
+			Type:        "Point",
+			Coordinates: []float64{longitude, latitude},
+		},
+		Properties: properties,
+	}
+}
+
+// NewPolygonFeature creates a Polygon feature from a single exterior ring of
+// latitude, longitude pairs. The ring is closed if it is not already.
+func NewPolygonFeature(id interface{}, ring [][2]float64, properties map[string]interface{}) Feature {
+	coordinates := make([][]float64, 0, len(ring)+1)
+	for _, point := range ring {
+		coordinates = append(coordinates, []float64{point[1], point[0]})
+	}
+	if len(ring) > 0 && ring[0] != ring[len(ring)-1] {
+		coordinates = append(coordinates, []float64{ring[0][1], ring[0][0]})
+	}
+
+	return Feature{
+		Type: "Feature",
+		ID:   id,
+		Geometry: Geometry{
+			Type:        "Polygon",
+			Coordinates: [][][]float64{coordinates},
+		},
+		Properties: properties,
+	}
+}
@@ -1,13 +1,31 @@
 package models
 
 import (
+	"sort"
+	"strings"
+	"time"
+
 	"gorm.io/gorm"
 )
 
 type LocationRecord struct {
 	gorm.Model
-	Latitude        float64
-	Longitude       float64
+	TenantID    uint `gorm:"index"`
+	Latitude    float64
+	Longitude   float64
+	Name        string
+	Country     string
+	AdminRegion string
+	CountryCode string
+	Timezone    string
+	Elevation   float64
+	// Tags label the location, e.g. to filter the forecast stream. They
+	// are stored normalized by NormalizeTags, comma separated.
+	Tags string
+	// Units is the unit system forecasts of the location are rendered in
+	// when a request does not select one. Empty selects the server default.
+	Units           string
+	EnrichedAt      *time.Time
 	ForecastRecords []ForecastRecord `gorm:"foreignKey:LocationRecordID"`
 }
 
@@ -18,9 +36,47 @@ func NewLocationRecord(loc *Forecast) *LocationRecord {
 	}
 }
 
+func NewGeocodedLocationRecord(place *GeocodingResult) *LocationRecord {
+	return &LocationRecord{
+		Latitude:    place.Latitude,
+		Longitude:   place.Longitude,
+		Name:        place.Name,
+		Country:     place.Country,
+		AdminRegion: place.Admin1,
+		CountryCode: place.CountryCode,
+		Timezone:    place.Timezone,
+		Elevation:   place.Elevation,
+	}
+}
+
+// TagList returns the tags of the location.
+func (l *LocationRecord) TagList() []string {
+	if l.Tags == "" {
+		return nil
+	}
+	return strings.Split(l.Tags, ",")
+}
+
+// NormalizeTags lowercases and trims 'tags', drops the empty and duplicate
+// ones, sorts them and joins them with commas for storage.
+func NormalizeTags(tags []string) string {
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	sort.Strings(normalized)
+	return strings.Join(normalized, ",")
+}
+
 type ForecastRecord struct {
 	gorm.Model
-	LocationRecordID     uint
+	LocationRecordID     uint `gorm:"index"`
 	GenerationtimeMS     float64
 	UTCOffsetSeconds     int64
 	Timezone             string
@@ -45,18 +101,26 @@ func NewForecastRecords(locationID uint, forecastData *Forecast) *ForecastRecord
 
 type HourlyRecord struct {
 	gorm.Model
-	ForecastRecordID uint
-	Time             string
-	Temperature2M    float64
+	ForecastRecordID   uint `gorm:"index"`
+	Time               string
+	Temperature2M      float64
+	Precipitation      float64
+	RelativeHumidity2M float64
+	WindSpeed10M       float64
+	SurfacePressure    float64
 }
 
 func NewHourlyRecord(forecastRecordID uint, data *Hourly) *[]HourlyRecord {
 	var hourlyRecords []HourlyRecord
 	for i, time := range data.Time {
 		hourlyRecord := HourlyRecord{
-			ForecastRecordID: forecastRecordID,
-			Time:             time,
-			Temperature2M:    data.Temperature2M[i],
+			ForecastRecordID:   forecastRecordID,
+			Time:               time,
+			Temperature2M:      data.Temperature2M[i],
+			Precipitation:      data.Precipitation[i],
+			RelativeHumidity2M: data.RelativeHumidity2M[i],
+			WindSpeed10M:       data.WindSpeed10M[i],
+			SurfacePressure:    data.SurfacePressure[i],
 		}
 		hourlyRecords = append(hourlyRecords, hourlyRecord)
 	}
@@ -65,15 +129,208 @@ func NewHourlyRecord(forecastRecordID uint, data *Hourly) *[]HourlyRecord {
 
 type HourlyUnitsRecord struct {
 	gorm.Model
-	ForecastRecordID  uint
-	TimeUnit          string
-	Temperature2MUnit string
+	ForecastRecordID       uint `gorm:"index"`
+	TimeUnit               string
+	Temperature2MUnit      string
+	PrecipitationUnit      string
+	RelativeHumidity2MUnit string
+	WindSpeed10MUnit       string
+	SurfacePressureUnit    string
 }
 
 func NewHourlyUnitsRecord(forecastRecordID uint, data *HourlyUnits) *HourlyUnitsRecord {
 	return &HourlyUnitsRecord{
-		ForecastRecordID:  forecastRecordID,
-		TimeUnit:          data.Time,
-		Temperature2MUnit: data.Temperature2M,
+		ForecastRecordID:       forecastRecordID,
+		TimeUnit:               data.Time,
+		Temperature2MUnit:      data.Temperature2M,
+		PrecipitationUnit:      data.Precipitation,
+		RelativeHumidity2MUnit: data.RelativeHumidity2M,
+		WindSpeed10MUnit:       data.WindSpeed10M,
+		SurfacePressureUnit:    data.SurfacePressure,
+	}
+}
+
+type JobRecord struct {
+	gorm.Model
+	TenantID   uint `gorm:"index"`
+	Type       string
+	Status     string
+	Total      int
+	Succeeded  int
+	Failed     int
+	Skipped    int
+	Error      string
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+	Tasks      []JobTaskRecord `gorm:"foreignKey:JobRecordID"`
+}
+
+type JobTaskRecord struct {
+	gorm.Model
+	JobRecordID      uint `gorm:"index"`
+	LocationRecordID uint
+	Status           string
+	ForecastRecordID uint
+	// WindowStart and WindowEnd bound the dates covered by tasks of jobs
+	// that work on a date range.
+	WindowStart *time.Time
+	WindowEnd   *time.Time
+	Error       string
+	FinishedAt  *time.Time
+}
+
+// Variables of the hourly series.
+const (
+	VariableTemperature2M = "temperature_2m"
+	VariablePrecipitation = "precipitation"
+)
+
+// Sources of observations.
+const (
+	ObservationSourceArchive = "archive"
+	ObservationSourceSensor  = "sensor"
+)
+
+// ObservationUnits are the units observations are stored in. They match
+// the units forecasts are fetched in.
+var ObservationUnits = HourlyUnits{
+	Time:          "iso8601",
+	Temperature2M: "°C",
+	Precipitation: "mm",
+}
+
+// ObservationRecord is an observed value of a variable at a location, for
+// the hour starting at Time (UTC).
+type ObservationRecord struct {
+	gorm.Model
+	LocationRecordID uint      `gorm:"index:idx_observation_location_time"`
+	Time             time.Time `gorm:"index:idx_observation_location_time"`
+	Variable         string
+	Value            float64
+	Unit             string
+	Source           string
+}
+
+// NewObservationRecords converts a historical weather response in UTC into
+// observation records, skipping hours without data.
+func NewObservationRecords(locationRecordID uint, data *Archive) ([]ObservationRecord, error) {
+	var records []ObservationRecord
+	for i, value := range data.Hourly.Time {
+		t, err := ParseHourlyTime(value, data.UTCOffsetSeconds)
+		if err != nil {
+			return nil, err
+		}
+
+		if i < len(data.Hourly.Temperature2M) && data.Hourly.Temperature2M[i] != nil {
+			records = append(records, ObservationRecord{
+				LocationRecordID: locationRecordID,
+				Time:             t.UTC(),
+				Variable:         VariableTemperature2M,
+				Value:            *data.Hourly.Temperature2M[i],
+				Unit:             data.HourlyUnits.Temperature2M,
+				Source:           ObservationSourceArchive,
+			})
+		}
+		if i < len(data.Hourly.Precipitation) && data.Hourly.Precipitation[i] != nil {
+			records = append(records, ObservationRecord{
+				LocationRecordID: locationRecordID,
+				Time:             t.UTC(),
+				Variable:         VariablePrecipitation,
+				Value:            *data.Hourly.Precipitation[i],
+				Unit:             data.HourlyUnits.Precipitation,
+				Source:           ObservationSourceArchive,
+			})
+		}
+	}
+	return records, nil
+}
+
+// VerificationRecord holds the error statistics of the forecasts of a
+// variable at a location for lead times up to LeadHours, and above the next
+// shorter configured lead time.
+type VerificationRecord struct {
+	gorm.Model
+	JobRecordID      uint
+	LocationRecordID uint `gorm:"index"`
+	Variable         string
+	LeadHours        int
+	Count            int
+	MAE              float64
+	Bias             float64
+	RMSE             float64
+	Unit             string
+}
+
+// HistoryRecord is an observed hour, starting at Time (UTC), backfilled from
+// the historical weather API. Variables without data are nil.
+type HistoryRecord struct {
+	gorm.Model
+	LocationRecordID uint      `gorm:"index:idx_history_location_time"`
+	Time             time.Time `gorm:"index:idx_history_location_time"`
+	Temperature2M    *float64
+	Precipitation    *float64
+}
+
+// NewHistoryRecords converts a historical weather response into history
+// records.
+func NewHistoryRecords(locationRecordID uint, data *Archive) ([]HistoryRecord, error) {
+	records := make([]HistoryRecord, 0, len(data.Hourly.Time))
+	for i, value := range data.Hourly.Time {
+		t, err := ParseHourlyTime(value, data.UTCOffsetSeconds)
+		if err != nil {
+			return nil, err
+		}
+
+		record := HistoryRecord{LocationRecordID: locationRecordID, Time: t.UTC()}
+		if i < len(data.Hourly.Temperature2M) {
+			record.Temperature2M = data.Hourly.Temperature2M[i]
+		}
+		if i < len(data.Hourly.Precipitation) {
+			record.Precipitation = data.Hourly.Precipitation[i]
+		}
+		records = append(records, record)
 	}
+	return records, nil
+}
+
+// HistoryUnitsRecord holds the units of the history of a location.
+type HistoryUnitsRecord struct {
+	gorm.Model
+	LocationRecordID  uint `gorm:"uniqueIndex"`
+	TimeUnit          string
+	Temperature2MUnit string
+	PrecipitationUnit string
+}
+
+// APIKeyRecord is an API key. Only the SHA-256 hash of the key is stored;
+// Prefix holds its first characters so that it can be recognized.
+type APIKeyRecord struct {
+	gorm.Model
+	TenantID   uint `gorm:"index"`
+	Name       string
+	Prefix     string
+	Hash       string `gorm:"uniqueIndex"`
+	Scopes     string
+	ExpiresAt  *time.Time
+	RevokedAt  *time.Time
+	LastUsedAt *time.Time
+}
+
+// TenantRecord is a team sharing the deployment. Locations, jobs and API
+// keys belong to a tenant, and forecasts and observations to the tenant of
+// their location. Quotas of zero fall back to the configured defaults.
+type TenantRecord struct {
+	gorm.Model
+	Name          string `gorm:"uniqueIndex"`
+	MaxLocations  int
+	RefreshBudget int
+}
+
+// RateLimitRecord is the request counter of a client in the current window
+// of a rate limit rule.
+type RateLimitRecord struct {
+	Key         string `gorm:"primaryKey"`
+	WindowStart time.Time
+	WindowEnd   time.Time `gorm:"index"`
+	Count       int
 }
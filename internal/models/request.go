@@ -1,12 +1,63 @@
 package models
 
 import (
+	"time"
+
 	"github.com/go-playground/validator"
 )
 
 type CreateLocationRequestBody struct {
-	Latitude  float64 `json:"latitude" validate:"required,min=-90,max=90"`
-	Longitude float64 `json:"longitude" validate:"required,min=-180,max=180"`
+	Latitude    float64  `json:"latitude" validate:"required_without_all=Query GeocodingID,min=-90,max=90"`
+	Longitude   float64  `json:"longitude" validate:"required_without_all=Query GeocodingID,min=-180,max=180"`
+	Query       string   `json:"query" validate:"omitempty,min=2"`
+	GeocodingID int64    `json:"geocoding_id" validate:"omitempty,min=1"`
+	Units       string   `json:"units"`
+	Tags        []string `json:"tags" validate:"max=20,dive,min=1,max=50,excludesall=0x2C"`
+}
+
+// UpdateLocationUnitsRequestBody sets the default unit system of a location.
+// An empty system selects the server default.
+type UpdateLocationUnitsRequestBody struct {
+	Units string `json:"units"`
+}
+
+// UpdateLocationTagsRequestBody replaces the tags of a location.
+type UpdateLocationTagsRequestBody struct {
+	Tags []string `json:"tags" validate:"max=20,dive,min=1,max=50,excludesall=0x2C"`
+}
+
+type CreateRefreshJobRequestBody struct {
+	LocationIDs []uint `json:"location_ids"`
+}
+
+type CreateVerificationJobRequestBody struct {
+	LocationIDs []uint `json:"location_ids"`
+}
+
+// ObservationRequestBody is an observed hour, in the unit system selected by
+// the request. Variables that were not observed are omitted.
+type ObservationRequestBody struct {
+	Time          time.Time `json:"time" validate:"required"`
+	Temperature2M *float64  `json:"temperature_2m"`
+	Precipitation *float64  `json:"precipitation" validate:"omitempty,min=0"`
+}
+
+type CreateObservationsRequestBody struct {
+	Observations []ObservationRequestBody `json:"observations" validate:"required,min=1,max=10000,dive"`
+}
+
+// SocketRequestBody is a message sent by a client over the forecast WebSocket.
+type SocketRequestBody struct {
+	Type        string `json:"type" validate:"required,oneof=subscribe unsubscribe refresh"`
+	LocationIDs []uint `json:"location_ids" validate:"required,min=1,dive,min=1"`
+}
+
+// CreateAPIKeyRequestBody creates an API key granted 'scopes'. A key without
+// an expiry date is valid until it is revoked.
+type CreateAPIKeyRequestBody struct {
+	Name      string     `json:"name" validate:"required,max=100"`
+	Scopes    []string   `json:"scopes" validate:"required,min=1,dive,oneof=locations:read locations:write forecast:refresh admin"`
+	ExpiresAt *time.Time `json:"expires_at"`
 }
 
 // type UpdateLocationRequestBody struct {
@@ -19,6 +70,26 @@ func (b *CreateLocationRequestBody) Validate() error {
 	return validate.Struct(b)
 }
 
+func (b *UpdateLocationTagsRequestBody) Validate() error {
+	validate := validator.New()
+	return validate.Struct(b)
+}
+
+func (b *CreateObservationsRequestBody) Validate() error {
+	validate := validator.New()
+	return validate.Struct(b)
+}
+
+func (b *CreateAPIKeyRequestBody) Validate() error {
+	validate := validator.New()
+	return validate.Struct(b)
+}
+
+func (b *SocketRequestBody) Validate() error {
+	validate := validator.New()
+	return validate.Struct(b)
+}
+
 // func (b *UpdateLocationRequestBody) Validate() error {
 // 	validate := validator.New()
 // 	return validate.Struct(b)
@@ -1,43 +1,396 @@
 package models
 
+import "time"
+
+type PageResponseBody struct {
+	Data       interface{} `json:"data"`
+	NextCursor *string     `json:"next_cursor"`
+}
+
 type HealthStatusResponseBody struct {
-	Status     string `json:"status"`
-	Database   string `json:"database"`
-	WeatherAPI string `json:"weather_api"`
+	Status     string          `json:"status"`
+	Database   HealthComponent `json:"database"`
+	WeatherAPI HealthComponent `json:"weather_api"`
+	Forecasts  HealthComponent `json:"forecasts"`
+	Scheduler  HealthComponent `json:"scheduler"`
+}
+
+// HealthComponent is the outcome of the last check of a component. The last
+// error is kept after the component recovers.
+type HealthComponent struct {
+	Status      string                 `json:"status"`
+	LatencyMS   float64                `json:"latency_ms"`
+	CheckedAt   time.Time              `json:"checked_at"`
+	Error       string                 `json:"error,omitempty"`
+	LastError   string                 `json:"last_error,omitempty"`
+	LastErrorAt *time.Time             `json:"last_error_at,omitempty"`
+	Details     map[string]interface{} `json:"details,omitempty"`
+}
+
+type ProbeResponseBody struct {
+	Status string `json:"status"`
 }
 
 type CreateLocationResponseBody struct {
-	ID        uint    `json:"id"`
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
+	ID          uint     `json:"id"`
+	Latitude    float64  `json:"latitude"`
+	Longitude   float64  `json:"longitude"`
+	Name        string   `json:"name,omitempty"`
+	Country     string   `json:"country,omitempty"`
+	AdminRegion string   `json:"admin_region,omitempty"`
+	CountryCode string   `json:"country_code,omitempty"`
+	Timezone    string   `json:"timezone,omitempty"`
+	Elevation   float64  `json:"elevation,omitempty"`
+	Units       string   `json:"units,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
 }
 
 type ReadLocationResponseBody struct {
-	ID        uint    `json:"id"`
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
+	ID          uint     `json:"id"`
+	Latitude    float64  `json:"latitude"`
+	Longitude   float64  `json:"longitude"`
+	Name        string   `json:"name,omitempty"`
+	Country     string   `json:"country,omitempty"`
+	AdminRegion string   `json:"admin_region,omitempty"`
+	CountryCode string   `json:"country_code,omitempty"`
+	Timezone    string   `json:"timezone,omitempty"`
+	Elevation   float64  `json:"elevation,omitempty"`
+	Units       string   `json:"units,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
 }
 
 type UpdateLocationResponseBody struct {
-	ID        uint    `json:"id"`
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
+	ID          uint    `json:"id"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	Name        string  `json:"name,omitempty"`
+	Country     string  `json:"country,omitempty"`
+	AdminRegion string  `json:"admin_region,omitempty"`
+	CountryCode string  `json:"country_code,omitempty"`
+	Timezone    string  `json:"timezone,omitempty"`
+	Elevation   float64 `json:"elevation,omitempty"`
 }
 
 type DeleteLocationResponseBody struct {
-	ID        uint    `json:"id"`
+	ID          uint    `json:"id"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	Name        string  `json:"name,omitempty"`
+	Country     string  `json:"country,omitempty"`
+	AdminRegion string  `json:"admin_region,omitempty"`
+	CountryCode string  `json:"country_code,omitempty"`
+	Timezone    string  `json:"timezone,omitempty"`
+	Elevation   float64 `json:"elevation,omitempty"`
+}
+
+type EnrichLocationResponseBody struct {
+	ID          uint       `json:"id"`
+	Latitude    float64    `json:"latitude"`
+	Longitude   float64    `json:"longitude"`
+	Name        string     `json:"name,omitempty"`
+	Country     string     `json:"country,omitempty"`
+	AdminRegion string     `json:"admin_region,omitempty"`
+	CountryCode string     `json:"country_code,omitempty"`
+	Timezone    string     `json:"timezone,omitempty"`
+	EnrichedAt  *time.Time `json:"enriched_at,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+type ImportLocationRowResult struct {
+	Row       int     `json:"row"`
+	Status    string  `json:"status"`
+	ID        uint    `json:"id,omitempty"`
 	Latitude  float64 `json:"latitude"`
 	Longitude float64 `json:"longitude"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type ImportLocationsResponseBody struct {
+	Created          int                       `json:"created"`
+	Duplicates       int                       `json:"duplicates"`
+	Invalid          int                       `json:"invalid"`
+	Failed           int                       `json:"failed"`
+	ForecastsPending bool                      `json:"forecasts_pending"`
+	ForecastsJobID   uint                      `json:"forecasts_job_id,omitempty"`
+	ForecastsError   string                    `json:"forecasts_error,omitempty"`
+	Rows             []ImportLocationRowResult `json:"rows"`
+}
+
+type GeocodingCandidatesResponseBody struct {
+	Message    string            `json:"message"`
+	Candidates []GeocodingResult `json:"candidates"`
 }
 
 type ReadForecastResponseBody struct {
-	Latitude             float64     `json:"latitude" validate:"required"`
-	Longitude            float64     `json:"longitude" validate:"required"`
-	GenerationtimeMS     float64     `json:"generationtime_ms" validate:"required"`
-	UTCOffsetSeconds     int64       `json:"utc_offset_seconds" validate:"required"`
-	Timezone             string      `json:"timezone" validate:"required"`
-	TimezoneAbbreviation string      `json:"timezone_abbreviation" validate:"required"`
-	Elevation            float64     `json:"elevation" validate:"required"`
-	HourlyUnits          HourlyUnits `json:"hourly_units" validate:"required"`
-	Hourly               Hourly      `json:"hourly" validate:"required"`
+	LocationID           uint                 `json:"location_id"`
+	Latitude             float64              `json:"latitude" validate:"required"`
+	Longitude            float64              `json:"longitude" validate:"required"`
+	GenerationtimeMS     float64              `json:"generationtime_ms" validate:"required"`
+	UTCOffsetSeconds     int64                `json:"utc_offset_seconds" validate:"required"`
+	Timezone             string               `json:"timezone" validate:"required"`
+	TimezoneAbbreviation string               `json:"timezone_abbreviation" validate:"required"`
+	Elevation            float64              `json:"elevation" validate:"required"`
+	HourlyUnits          HourlyUnits          `json:"hourly_units" validate:"required"`
+	Hourly               Hourly               `json:"hourly" validate:"required"`
+	Derived              *DerivedResponseBody `json:"derived,omitempty"`
+}
+
+// DerivedResponseBody holds the metrics derived from a forecast's hourly
+// series, in the unit of its temperatures. Metrics that were not requested,
+// or that need humidity and wind speed the forecast does not have, are
+// omitted.
+type DerivedResponseBody struct {
+	Unit        string              `json:"unit"`
+	HeatingBase *float64            `json:"heating_base,omitempty"`
+	CoolingBase *float64            `json:"cooling_base,omitempty"`
+	Hourly      *DerivedHourly      `json:"hourly,omitempty"`
+	Daily       []DegreeDayResponse `json:"daily,omitempty"`
+}
+
+type DerivedHourly struct {
+	Time                []string  `json:"time"`
+	HeatIndex           []float64 `json:"heat_index,omitempty"`
+	WindChill           []float64 `json:"wind_chill,omitempty"`
+	DewPoint2M          []float64 `json:"dew_point_2m,omitempty"`
+	ApparentTemperature []float64 `json:"apparent_temperature,omitempty"`
+}
+
+type DegreeDayResponse struct {
+	Date              string  `json:"date"`
+	MeanTemperature2M float64 `json:"mean_temperature_2m"`
+	HeatingDegreeDays float64 `json:"heating_degree_days"`
+	CoolingDegreeDays float64 `json:"cooling_degree_days"`
+}
+
+type RefreshResult struct {
+	LocationID uint   `json:"location_id"`
+	ForecastID uint   `json:"forecast_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type RefreshResponseBody struct {
+	Succeeded []RefreshResult `json:"succeeded"`
+	Failed    []RefreshResult `json:"failed"`
+	Skipped   []RefreshResult `json:"skipped"`
+}
+
+type JobResponseBody struct {
+	ID         uint                  `json:"id"`
+	Type       string                `json:"type"`
+	Status     string                `json:"status"`
+	Total      int                   `json:"total"`
+	Succeeded  int                   `json:"succeeded"`
+	Failed     int                   `json:"failed"`
+	Skipped    int                   `json:"skipped"`
+	Error      string                `json:"error,omitempty"`
+	CreatedAt  time.Time             `json:"created_at"`
+	StartedAt  *time.Time            `json:"started_at"`
+	FinishedAt *time.Time            `json:"finished_at"`
+	Tasks      []JobTaskResponseBody `json:"tasks,omitempty"`
+}
+
+type JobTaskResponseBody struct {
+	LocationID  uint       `json:"location_id"`
+	Status      string     `json:"status"`
+	ForecastID  uint       `json:"forecast_id,omitempty"`
+	WindowStart *time.Time `json:"window_start,omitempty"`
+	WindowEnd   *time.Time `json:"window_end,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+type CreateObservationsResponseBody struct {
+	LocationID uint      `json:"location_id"`
+	Stored     int       `json:"stored"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+}
+
+type VerificationResult struct {
+	LocationID uint    `json:"location_id,omitempty"`
+	Variable   string  `json:"variable"`
+	LeadHours  int     `json:"lead_hours"`
+	Count      int     `json:"count"`
+	MAE        float64 `json:"mae"`
+	Bias       float64 `json:"bias"`
+	RMSE       float64 `json:"rmse"`
+	Unit       string  `json:"unit"`
+}
+
+// VerificationResponseBody holds the latest verification results of each
+// location, and their combination over every location.
+type VerificationResponseBody struct {
+	Overall   []VerificationResult `json:"overall"`
+	Locations []VerificationResult `json:"locations"`
+}
+
+// ReadHistoryResponseBody holds the backfilled hours of a location in UTC.
+// Hours without data are null.
+type ReadHistoryResponseBody struct {
+	LocationID  uint          `json:"location_id"`
+	Latitude    float64       `json:"latitude"`
+	Longitude   float64       `json:"longitude"`
+	Timezone    string        `json:"timezone"`
+	HourlyUnits HourlyUnits   `json:"hourly_units"`
+	Hourly      ArchiveHourly `json:"hourly"`
+}
+
+// AlertFiredEvent reports that a forecast snapshot crosses the threshold
+// of an alert rule. Value is the most extreme forecast value, at Time, and
+// FirstTime is the first hour crossing the threshold.
+type AlertFiredEvent struct {
+	LocationID uint     `json:"location_id"`
+	ForecastID uint     `json:"forecast_id"`
+	Rule       string   `json:"rule"`
+	Variable   string   `json:"variable"`
+	Above      *float64 `json:"above,omitempty"`
+	Below      *float64 `json:"below,omitempty"`
+	Value      float64  `json:"value"`
+	Time       string   `json:"time"`
+	FirstTime  string   `json:"first_time"`
+	Hours      int      `json:"hours"`
+}
+
+type ForecastRefreshedEvent struct {
+	LocationID uint    `json:"location_id"`
+	ForecastID uint    `json:"forecast_id"`
+	Latitude   float64 `json:"latitude"`
+	Longitude  float64 `json:"longitude"`
+}
+
+// ForecastSnapshotRef identifies a stored forecast snapshot.
+type ForecastSnapshotRef struct {
+	ForecastID uint      `json:"forecast_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ForecastHourDiff compares a forecast hour between two snapshots. The
+// values of a snapshot that does not cover the hour are null, as are the
+// deltas.
+type ForecastHourDiff struct {
+	Time               string   `json:"time"`
+	Temperature2MFrom  *float64 `json:"temperature_2m_from"`
+	Temperature2MTo    *float64 `json:"temperature_2m_to"`
+	Temperature2MDelta *float64 `json:"temperature_2m_delta"`
+	PrecipitationFrom  *float64 `json:"precipitation_from"`
+	PrecipitationTo    *float64 `json:"precipitation_to"`
+	PrecipitationDelta *float64 `json:"precipitation_delta"`
+}
+
+// ForecastDayDiff compares the temperature extremes of a local day covered
+// by both snapshots.
+type ForecastDayDiff struct {
+	Date      string  `json:"date"`
+	HighFrom  float64 `json:"high_from"`
+	HighTo    float64 `json:"high_to"`
+	HighDelta float64 `json:"high_delta"`
+	LowFrom   float64 `json:"low_from"`
+	LowTo     float64 `json:"low_to"`
+	LowDelta  float64 `json:"low_delta"`
+}
+
+type HourChange struct {
+	Time  string  `json:"time"`
+	Delta float64 `json:"delta"`
+}
+
+type ForecastDiffSummary struct {
+	HoursCompared          int         `json:"hours_compared"`
+	HoursChanged           int         `json:"hours_changed"`
+	HoursAdded             int         `json:"hours_added"`
+	HoursRemoved           int         `json:"hours_removed"`
+	MaxTemperatureChange   *HourChange `json:"max_temperature_change"`
+	MeanTemperatureChange  float64     `json:"mean_temperature_change"`
+	MaxPrecipitationChange *HourChange `json:"max_precipitation_change"`
+	RainAppeared           *string     `json:"rain_appeared"`
+	RainDisappeared        *string     `json:"rain_disappeared"`
+}
+
+type ForecastDiffResponseBody struct {
+	LocationID  uint                `json:"location_id"`
+	From        ForecastSnapshotRef `json:"from"`
+	To          ForecastSnapshotRef `json:"to"`
+	HourlyUnits HourlyUnits         `json:"hourly_units"`
+	Summary     ForecastDiffSummary `json:"summary"`
+	Days        []ForecastDayDiff   `json:"days"`
+	Hours       []ForecastHourDiff  `json:"hours"`
+}
+
+// ForecastHour holds the values of a single forecast hour.
+type ForecastHour struct {
+	Time               string  `json:"time"`
+	Temperature2M      float64 `json:"temperature_2m"`
+	Precipitation      float64 `json:"precipitation"`
+	RelativeHumidity2M float64 `json:"relative_humidity_2m"`
+	WindSpeed10M       float64 `json:"wind_speed_10m"`
+	SurfacePressure    float64 `json:"surface_pressure"`
+}
+
+// SocketMessage is a message sent to a client over the forecast WebSocket.
+// Forecast deltas carry only the hours that changed since the previous
+// message for the same location; the first delta after subscribing carries
+// every hour.
+type SocketMessage struct {
+	Type        string         `json:"type"`
+	LocationID  uint           `json:"location_id,omitempty"`
+	LocationIDs []uint         `json:"location_ids,omitempty"`
+	ForecastID  uint           `json:"forecast_id,omitempty"`
+	HourlyUnits *HourlyUnits   `json:"hourly_units,omitempty"`
+	Changed     []ForecastHour `json:"changed,omitempty"`
+	Removed     []string       `json:"removed,omitempty"`
+	Error       string         `json:"error,omitempty"`
+}
+
+type CurrentConditions struct {
+	Time          string  `json:"time"`
+	Temperature2M float64 `json:"temperature_2m"`
+	Unit          string  `json:"unit"`
+}
+
+type SummaryStatistics struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Mean  float64 `json:"mean"`
+	Count int     `json:"count"`
+	Unit  string  `json:"unit"`
+}
+
+type ForecastRow struct {
+	LocationID uint      `json:"location_id" parquet:"location_id"`
+	Latitude   float64   `json:"lat" parquet:"lat"`
+	Longitude  float64   `json:"lon" parquet:"lon"`
+	ValidTime  time.Time `json:"valid_time" parquet:"valid_time,timestamp"`
+	Variable   string    `json:"variable" parquet:"variable,dict"`
+	Value      float64   `json:"value" parquet:"value"`
+	Unit       string    `json:"unit" parquet:"unit,dict"`
+}
+
+// APIKeyResponseBody describes an API key without its secret.
+type APIKeyResponseBody struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// CreateAPIKeyResponseBody holds a new API key. The key is only ever
+// returned by the request that created it.
+type CreateAPIKeyResponseBody struct {
+	APIKeyResponseBody
+	Key string `json:"key"`
+}
+
+// TenantResponseBody describes the quotas of the caller's tenant and its
+// usage. Limits of zero are unlimited.
+type TenantResponseBody struct {
+	ID            uint   `json:"id"`
+	Name          string `json:"name"`
+	MaxLocations  int    `json:"max_locations"`
+	Locations     int    `json:"locations"`
+	RefreshBudget int    `json:"refresh_budget"`
+	Refreshes     int    `json:"refreshes"`
 }
@@ -0,0 +1,190 @@
+// Package pagination parses and applies cursor based pagination, sorting and
+// sparse fieldsets for list endpoints.
+//
+// Pages are addressed with keyset cursors rather than offsets: a cursor holds
+// the sort value and ID of the last item on the previous page, and the next
+// page starts strictly after it. Items are always ordered by ID within equal
+// sort values, so pages are stable while rows are inserted or deleted.
+package pagination
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// Params are the pagination parameters of a list request.
+type Params struct {
+	Limit  int
+	Sort   string
+	Desc   bool
+	Fields []string
+
+	column string
+	cursor *cursor
+}
+
+type cursor struct {
+	Sort  string      `json:"s"`
+	Value interface{} `json:"v"`
+	ID    uint        `json:"id"`
+}
+
+// Parse reads the limit, cursor, sort and fields query parameters. 'sortable'
+// maps the sort names accepted in the query to database columns; a leading
+// '-' in the sort parameter sorts in descending order.
+func Parse(query url.Values, sortable map[string]string, defaultSort string) (Params, error) {
+	p := Params{Limit: DefaultLimit, Sort: defaultSort}
+
+	if param := query.Get("limit"); param != "" {
+		limit, err := strconv.Atoi(param)
+		if err != nil || limit < 1 || limit > MaxLimit {
+			return p, fmt.Errorf("limit must be between 1 and %d", MaxLimit)
+		}
+		p.Limit = limit
+	}
+
+	if param := query.Get("sort"); param != "" {
+		p.Sort = param
+	}
+	if strings.HasPrefix(p.Sort, "-") {
+		p.Desc = true
+		p.Sort = strings.TrimPrefix(p.Sort, "-")
+	}
+	column, ok := sortable[p.Sort]
+	if !ok {
+		return p, fmt.Errorf("cannot sort by %q", p.Sort)
+	}
+	p.column = column
+
+	if param := query.Get("cursor"); param != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(param)
+		if err != nil {
+			return p, errors.New("malformed cursor")
+		}
+		p.cursor = &cursor{}
+		if err := json.Unmarshal(raw, p.cursor); err != nil {
+			return p, errors.New("malformed cursor")
+		}
+		if p.cursor.Sort != p.sortKey() {
+			return p, errors.New("cursor was issued for a different sort")
+		}
+	}
+
+	if param := query.Get("fields"); param != "" {
+		for _, field := range strings.Split(param, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				p.Fields = append(p.Fields, field)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+func (p *Params) sortKey() string {
+	if p.Desc {
+		return "-" + p.Sort
+	}
+	return p.Sort
+}
+
+// Page returns the ordering and limit to query with. One more row than the
+// page size is requested so that HasMore can tell whether another page exists.
+func (p *Params) Page() database.Page {
+	dir := "ASC"
+	if p.Desc {
+		dir = "DESC"
+	}
+
+	order := fmt.Sprintf("%s %s", p.column, dir)
+	if p.column != "id" {
+		order += fmt.Sprintf(", id %s", dir)
+	}
+
+	return database.Page{Order: order, Limit: p.Limit + 1}
+}
+
+// Where returns the keyset condition selecting rows after the cursor, or nil
+// for the first page. The result can be passed as the 'where' arguments of
+// Datastore.FindPage.
+func (p *Params) Where() []interface{} {
+	if p.cursor == nil {
+		return nil
+	}
+
+	op := ">"
+	if p.Desc {
+		op = "<"
+	}
+
+	if p.column == "id" {
+		return []interface{}{fmt.Sprintf("id %s ?", op), p.cursor.ID}
+	}
+
+	cond := fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", p.column, op)
+	return []interface{}{cond, p.cursor.Value, p.cursor.Value, p.cursor.ID}
+}
+
+// HasMore reports whether a query that returned 'n' rows has another page.
+func (p *Params) HasMore(n int) bool {
+	return n > p.Limit
+}
+
+// NextCursor encodes a cursor pointing after the item with the given sort
+// value and ID.
+func (p *Params) NextCursor(value interface{}, id uint) string {
+	raw, _ := json.Marshal(cursor{Sort: p.sortKey(), Value: value, ID: id})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// NextLink returns the URL of the next page, preserving the other query
+// parameters of 'u'.
+func NextLink(u *url.URL, nextCursor string) string {
+	next := *u
+	query := next.Query()
+	query.Set("cursor", nextCursor)
+	next.RawQuery = query.Encode()
+	return next.String()
+}
+
+// SelectFields reduces each item to the requested JSON fields. Items are
+// returned unchanged when no fields were requested.
+func SelectFields[T any](items []T, fields []string) ([]interface{}, error) {
+	out := make([]interface{}, len(items))
+	for i, item := range items {
+		if len(fields) == 0 {
+			out[i] = item
+			continue
+		}
+
+		raw, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		all := map[string]interface{}{}
+		if err := json.Unmarshal(raw, &all); err != nil {
+			return nil, err
+		}
+
+		selected := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			if value, ok := all[field]; ok {
+				selected[field] = value
+			}
+		}
+		out[i] = selected
+	}
+	return out, nil
+}
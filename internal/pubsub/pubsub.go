@@ -0,0 +1,238 @@
+// Package pubsub is an in-process publish/subscribe hub for forecast events.
+// It keeps a bounded history of recent events so that subscribers that
+// reconnect can resume from the last event they received.
+package pubsub
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// EventForecastRefreshed is published when a new forecast snapshot has
+	// been stored for a location.
+	EventForecastRefreshed = "forecast.refreshed"
+	// EventAlertFired is published when a new forecast snapshot crosses
+	// the threshold of an alert rule.
+	EventAlertFired = "alert.fired"
+)
+
+// DefaultHistorySize is the number of events kept for replay when none is
+// configured.
+const DefaultHistorySize = 1000
+
+// subscriptionBuffer is the number of events buffered per subscriber.
+const subscriptionBuffer = 64
+
+type Event struct {
+	ID         uint64      `json:"id"`
+	Type       string      `json:"type"`
+	TenantID   uint        `json:"-"`
+	LocationID uint        `json:"location_id"`
+	Tags       []string    `json:"tags,omitempty"`
+	Time       time.Time   `json:"time"`
+	Data       interface{} `json:"data,omitempty"`
+}
+
+// Filter selects the events delivered to a subscription. Empty fields match
+// every event.
+type Filter struct {
+	// TenantID selects the events of the locations of a tenant.
+	TenantID    uint
+	Types       []string
+	LocationIDs []uint
+	// Tags selects the events of the locations with any of the tags.
+	Tags []string
+}
+
+func (f *Filter) matches(event *Event) bool {
+	if f.TenantID != 0 && f.TenantID != event.TenantID {
+		return false
+	}
+
+	if len(f.Types) > 0 {
+		found := false
+		for _, t := range f.Types {
+			if t == event.Type {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.Tags) > 0 && !anyTag(f.Tags, event.Tags) {
+		return false
+	}
+
+	if len(f.LocationIDs) > 0 {
+		for _, id := range f.LocationIDs {
+			if id == event.LocationID {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// anyTag reports whether 'tags' holds any of 'wanted'.
+func anyTag(wanted, tags []string) bool {
+	for _, w := range wanted {
+		for _, tag := range tags {
+			if tag == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Subscription receives published events matching its filter on C. C is
+// closed when the subscription is cancelled, when the hub is closed or when
+// the subscriber falls so far behind that its buffer fills up; a lagging
+// subscriber should resubscribe from the ID of the last event it received.
+type Subscription struct {
+	C <-chan Event
+
+	hub    *Hub
+	c      chan Event
+	filter Filter
+	closed bool
+	lagged bool
+}
+
+// Cancel stops the subscription and closes C.
+func (s *Subscription) Cancel() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.remove(s)
+}
+
+// Lagged reports whether C was closed because the subscriber fell behind.
+func (s *Subscription) Lagged() bool {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.lagged
+}
+
+// Hub fans published events out to subscribers.
+type Hub struct {
+	mu      sync.Mutex
+	nextID  uint64
+	history []Event
+	size    int
+	subs    map[*Subscription]struct{}
+	closed  bool
+}
+
+// NewHub creates a new Hub that keeps the last 'historySize' events for
+// replay. Event IDs start from the current time in milliseconds so that they
+// keep increasing across restarts.
+func NewHub(historySize int) *Hub {
+	if historySize <= 0 {
+		historySize = DefaultHistorySize
+	}
+	return &Hub{
+		nextID: uint64(time.Now().UnixMilli()),
+		size:   historySize,
+		subs:   map[*Subscription]struct{}{},
+	}
+}
+
+// Publish sends an event about a location of a tenant, labelled with the
+// tags of the location, to every matching subscriber and returns it.
+// Publish never blocks on slow subscribers.
+func (h *Hub) Publish(eventType string, tenantID, locationID uint, tags []string, data interface{}) Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextID++
+	event := Event{
+		ID:         h.nextID,
+		Type:       eventType,
+		TenantID:   tenantID,
+		LocationID: locationID,
+		Tags:       tags,
+		Time:       time.Now(),
+		Data:       data,
+	}
+
+	h.history = append(h.history, event)
+	if len(h.history) > h.size {
+		h.history = h.history[len(h.history)-h.size:]
+	}
+
+	for sub := range h.subs {
+		if !sub.filter.matches(&event) {
+			continue
+		}
+		select {
+		case sub.c <- event:
+		default:
+			sub.lagged = true
+			h.remove(sub)
+		}
+	}
+
+	return event
+}
+
+// Subscribe registers a subscription. If 'lastEventID' is not zero, the
+// matching events published after it that are still in the history are
+// returned for replay, oldest first. Once the hub is closed, the returned
+// subscription is already closed.
+func (h *Hub) Subscribe(filter Filter, lastEventID uint64) (*Subscription, []Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := make(chan Event, subscriptionBuffer)
+	sub := &Subscription{C: c, hub: h, c: c, filter: filter}
+	h.subs[sub] = struct{}{}
+	if h.closed {
+		h.remove(sub)
+	}
+
+	var replay []Event
+	if lastEventID != 0 {
+		for i := range h.history {
+			if h.history[i].ID > lastEventID && filter.matches(&h.history[i]) {
+				replay = append(replay, h.history[i])
+			}
+		}
+	}
+
+	return sub, replay
+}
+
+// Subscribers returns the number of active subscriptions.
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// Close closes every subscription and the subscriptions made afterwards, so
+// that streaming clients disconnect and reconnect to another instance of the
+// service.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for sub := range h.subs {
+		h.remove(sub)
+	}
+}
+
+// remove must be called with h.mu held.
+func (h *Hub) remove(sub *Subscription) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	delete(h.subs, sub)
+	close(sub.c)
+}
@@ -0,0 +1,59 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is the minimum interval between removals of the expired
+// counters of a store.
+const sweepInterval = time.Minute
+
+type counter struct {
+	start time.Time
+	reset time.Time
+	count int
+}
+
+// MemoryStore counts requests in memory. Counters are not shared between
+// instances of the service.
+type MemoryStore struct {
+	mu        sync.Mutex
+	counters  map[string]*counter
+	lastSweep time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{counters: map[string]*counter{}}
+}
+
+// Take implements Store.
+func (s *MemoryStore) Take(_ context.Context, key string, start time.Time, window time.Duration) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if start.Sub(s.lastSweep) >= sweepInterval {
+		s.sweep(start)
+		s.lastSweep = start
+	}
+
+	c, ok := s.counters[key]
+	if !ok || !c.start.Equal(start) {
+		c = &counter{start: start, reset: start.Add(window)}
+		s.counters[key] = c
+	}
+	c.count++
+
+	return Result{Count: c.count, Reset: c.reset}, nil
+}
+
+// sweep removes the counters of windows ended before 'now'.
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, c := range s.counters {
+		if !c.reset.After(now) {
+			delete(s.counters, key)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// takeQuery counts a request in a single statement, restarting the counter
+// when the stored window is over, so that concurrent instances never lose
+// a request.
+const takeQuery = `
+INSERT INTO rate_limit_records (key, window_start, window_end, count)
+VALUES (?, ?, ?, 1)
+ON CONFLICT (key) DO UPDATE SET
+	count = CASE
+		WHEN rate_limit_records.window_start = excluded.window_start THEN rate_limit_records.count + 1
+		ELSE 1
+	END,
+	window_start = excluded.window_start,
+	window_end = excluded.window_end
+RETURNING count`
+
+// sweepQuery removes the counters of windows ended before a time. Counters
+// stored before their window end was recorded are removed too.
+const sweepQuery = `DELETE FROM rate_limit_records WHERE window_end <= ? OR window_end IS NULL`
+
+// PostgresStore counts requests in the rate_limit_records table, so that the
+// limits apply across every instance of the service sharing the database.
+type PostgresStore struct {
+	db *gorm.DB
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// NewPostgresStore returns a store counting requests in 'db'. The table is
+// created by database.Initialize.
+func NewPostgresStore(db *gorm.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// Take implements Store. The counters of ended windows are removed at most
+// once per sweepInterval by each store.
+func (s *PostgresStore) Take(ctx context.Context, key string, start time.Time, window time.Duration) (Result, error) {
+	if s.sweepDue(start) {
+		if err := s.db.WithContext(ctx).Exec(sweepQuery, start.UTC()).Error; err != nil {
+			slog.ErrorContext(ctx, "Error removing expired rate limit counters", "error", err)
+		}
+	}
+
+	var count int
+	reset := start.Add(window)
+	if err := s.db.WithContext(ctx).Raw(takeQuery, key, start.UTC(), reset.UTC()).Scan(&count).Error; err != nil {
+		return Result{}, err
+	}
+	return Result{Count: count, Reset: reset}, nil
+}
+
+// sweepDue reports whether the expired counters should be removed, and
+// records the sweep if so.
+func (s *PostgresStore) sweepDue(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return false
+	}
+	s.lastSweep = now
+	return true
+}
@@ -0,0 +1,166 @@
+// Package ratelimit limits the number of requests each client can make in
+// fixed time windows. Counters are kept in a Store, in memory for a single
+// instance or in Postgres for deployments running several instances.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/auth"
+)
+
+// Rule allows Requests requests per Window to each client. Rules with the
+// same name share their counters.
+type Rule struct {
+	Name     string
+	Requests int
+	Window   time.Duration
+}
+
+// Enabled reports whether the rule limits anything.
+func (r Rule) Enabled() bool {
+	return r.Requests > 0 && r.Window > 0
+}
+
+// Result is the state of a counter after a request was counted.
+type Result struct {
+	// Count is the number of requests made in the window, this one
+	// included.
+	Count int
+	// Reset is the end of the window.
+	Reset time.Time
+}
+
+// Store counts requests.
+type Store interface {
+	// Take counts a request of 'key' in the window of 'window' starting at
+	// 'start' and returns the state of its counter.
+	Take(ctx context.Context, key string, start time.Time, window time.Duration) (Result, error)
+}
+
+// KeyFunc returns the client a request is counted against.
+type KeyFunc func(c echo.Context) string
+
+// ClientKey counts requests against the authenticated principal, or against
+// the IP address of unauthenticated requests.
+func ClientKey(c echo.Context) string {
+	if principal := auth.PrincipalFrom(c); principal != nil {
+		return principal.Subject
+	}
+	return IPKey(c)
+}
+
+// IPKey counts requests against their IP address. It is meant for the rules
+// enforced before authentication.
+func IPKey(c echo.Context) string {
+	return "ip:" + c.RealIP()
+}
+
+// LimitError is returned by Allow when a client exceeded a rule.
+type LimitError struct {
+	Rule Rule
+	// RetryAfter is the time left until the window of the rule resets.
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("Rate limit of %d requests per %s exceeded", e.Rule.Requests, e.Rule.Window)
+}
+
+// Limiter enforces rules on requests.
+type Limiter struct {
+	Store Store
+	// Key returns the client a request is counted against. It defaults to
+	// ClientKey.
+	Key KeyFunc
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// NewLimiter returns a limiter counting requests in 'store'.
+func NewLimiter(store Store) *Limiter {
+	return &Limiter{Store: store, Key: ClientKey, Now: time.Now}
+}
+
+// Limit rejects the requests of clients that exceeded 'rule' with 429 Too
+// Many Requests and a Retry-After header. Every response carries the
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers of the
+// rule. Requests are let through when the store fails, so that an outage of
+// the store does not take the service down.
+func (l *Limiter) Limit(rule Rule) echo.MiddlewareFunc {
+	return l.LimitBy(rule, func(c echo.Context) string { return l.Key(c) })
+}
+
+// LimitBy is like Limit, but counts requests against the client returned by
+// 'key' rather than by the Key of the limiter.
+func (l *Limiter) LimitBy(rule Rule, key KeyFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if !rule.Enabled() {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			now := l.Now()
+			result, err := l.take(c.Request().Context(), rule, key(c), now)
+			if err != nil {
+				return next(c)
+			}
+
+			reset := int(math.Ceil(result.Reset.Sub(now).Seconds()))
+			header := c.Response().Header()
+			header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rule.Requests, int(rule.Window.Seconds())))
+			header.Set("RateLimit-Limit", strconv.Itoa(rule.Requests))
+			header.Set("RateLimit-Remaining", strconv.Itoa(max(rule.Requests-result.Count, 0)))
+			header.Set("RateLimit-Reset", strconv.Itoa(reset))
+
+			if result.Count > rule.Requests {
+				header.Set(echo.HeaderRetryAfter, strconv.Itoa(reset))
+				limitErr := &LimitError{Rule: rule, RetryAfter: result.Reset.Sub(now)}
+				return echo.NewHTTPError(http.StatusTooManyRequests, limitErr.Error())
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// Allow counts a request of 'client' against 'rule' and returns a
+// *LimitError if the client exceeded it. It enforces rules on requests made
+// outside of a route, e.g. the messages of a WebSocket. Like Limit, it lets
+// requests through when the store fails.
+func (l *Limiter) Allow(ctx context.Context, rule Rule, client string) error {
+	if !rule.Enabled() {
+		return nil
+	}
+
+	now := l.Now()
+	result, err := l.take(ctx, rule, client, now)
+	if err != nil {
+		return nil
+	}
+	if result.Count > rule.Requests {
+		return &LimitError{Rule: rule, RetryAfter: result.Reset.Sub(now)}
+	}
+	return nil
+}
+
+// take counts a request of 'client' in the current window of 'rule'. Store
+// errors are logged.
+func (l *Limiter) take(ctx context.Context, rule Rule, client string, now time.Time) (Result, error) {
+	start := now.Truncate(rule.Window)
+	key := fmt.Sprintf("%s:%s", rule.Name, client)
+
+	result, err := l.Store.Take(ctx, key, start, rule.Window)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error counting request", "key", key, "error", err)
+	}
+	return result, err
+}
@@ -0,0 +1,238 @@
+package ratelimit_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/auth"
+	"github.com/mick-io/duplo_go_cloud/internal/database/dbtest"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/ratelimit"
+)
+
+func TestStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) ratelimit.Store{
+		"memory": func(t *testing.T) ratelimit.Store {
+			return ratelimit.NewMemoryStore()
+		},
+		"postgres": func(t *testing.T) ratelimit.Store {
+			return ratelimit.NewPostgresStore(dbtest.Open(t))
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			ctx := context.Background()
+			window := time.Minute
+			start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+			take := func(key string, start time.Time) ratelimit.Result {
+				t.Helper()
+				result, err := store.Take(ctx, key, start, window)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return result
+			}
+
+			for want := 1; want <= 3; want++ {
+				result := take("a", start)
+				if result.Count != want || !result.Reset.Equal(start.Add(window)) {
+					t.Errorf("Take = %+v, want count %d reset at %v", result, want, start.Add(window))
+				}
+			}
+
+			// Keys are counted apart
+			if result := take("b", start); result.Count != 1 {
+				t.Errorf("count of another key = %d, want 1", result.Count)
+			}
+
+			// The next window starts over
+			next := start.Add(window)
+			if result := take("a", next); result.Count != 1 || !result.Reset.Equal(next.Add(window)) {
+				t.Errorf("Take in next window = %+v, want count 1 reset at %v", result, next.Add(window))
+			}
+			if result := take("a", next); result.Count != 2 {
+				t.Errorf("count in next window = %d, want 2", result.Count)
+			}
+		})
+	}
+}
+
+func TestPostgresStoreRemovesExpiredCounters(t *testing.T) {
+	db := dbtest.Open(t)
+	store := ratelimit.NewPostgresStore(db)
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, take := range []struct {
+		key    string
+		start  time.Time
+		window time.Duration
+	}{
+		{"minute:a", start, time.Minute},
+		{"hour:a", start, time.Hour},
+		// Counting a request a few windows later removes the counters of
+		// the ended windows only
+		{"minute:b", start.Add(5 * time.Minute), time.Minute},
+	} {
+		if _, err := store.Take(ctx, take.key, take.start, take.window); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := []string{}
+	if err := db.Model(&models.RateLimitRecord{}).Order("key").Pluck("key", &keys).Error; err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"hour:a", "minute:b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("stored counters %v, want %v", keys, want)
+	}
+}
+
+// failingStore fails to count every request.
+type failingStore struct{}
+
+func (failingStore) Take(context.Context, string, time.Time, time.Duration) (ratelimit.Result, error) {
+	return ratelimit.Result{}, errors.New("connection refused")
+}
+
+// serve runs a request from 'ip' through 'middleware' and returns the HTTP
+// status of the outcome and the response headers.
+func serve(middleware []echo.MiddlewareFunc, ip string) (int, http.Header) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/locations", nil)
+	req.RemoteAddr = ip + ":1234"
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	handler := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	var httpErr *echo.HTTPError
+	if err := handler(c); errors.As(err, &httpErr) {
+		return httpErr.Code, rec.Header()
+	}
+	return rec.Code, rec.Header()
+}
+
+func TestLimit(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 15, 0, time.UTC)
+	limiter := ratelimit.NewLimiter(ratelimit.NewMemoryStore())
+	limiter.Now = func() time.Time { return now }
+	limit := []echo.MiddlewareFunc{limiter.Limit(ratelimit.Rule{Name: "default", Requests: 2, Window: time.Minute})}
+
+	for i := 1; i <= 2; i++ {
+		status, header := serve(limit, "192.0.2.1")
+		if status != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want %d", i, status, http.StatusOK)
+		}
+		if got := header.Get("RateLimit-Remaining"); got != strconv.Itoa(2-i) {
+			t.Errorf("request %d: RateLimit-Remaining = %q, want %d", i, got, 2-i)
+		}
+	}
+
+	status, header := serve(limit, "192.0.2.1")
+	if status != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", status, http.StatusTooManyRequests)
+	}
+	if got := header.Get(echo.HeaderRetryAfter); got != "45" {
+		t.Errorf("Retry-After = %q, want %q", got, "45")
+	}
+
+	// Other clients are counted apart
+	if status, _ := serve(limit, "192.0.2.2"); status != http.StatusOK {
+		t.Errorf("status of another client = %d, want %d", status, http.StatusOK)
+	}
+
+	// The next window starts over
+	now = now.Add(time.Minute)
+	if status, _ := serve(limit, "192.0.2.1"); status != http.StatusOK {
+		t.Errorf("status in next window = %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestLimitLetsRequestsThroughOnStoreFailure(t *testing.T) {
+	limiter := ratelimit.NewLimiter(failingStore{})
+	limit := []echo.MiddlewareFunc{limiter.Limit(ratelimit.Rule{Name: "default", Requests: 1, Window: time.Minute})}
+
+	for i := 0; i < 3; i++ {
+		if status, _ := serve(limit, "192.0.2.1"); status != http.StatusOK {
+			t.Fatalf("status = %d, want %d", status, http.StatusOK)
+		}
+	}
+}
+
+// rejectingAuthenticator rejects every request as carrying invalid
+// credentials.
+type rejectingAuthenticator struct{}
+
+func (rejectingAuthenticator) Authenticate(*http.Request) (*auth.Principal, error) {
+	return nil, &auth.CredentialsError{Reason: "unknown key"}
+}
+
+func TestIPLimitAppliesBeforeAuthentication(t *testing.T) {
+	limiter := ratelimit.NewLimiter(ratelimit.NewMemoryStore())
+	chain := []echo.MiddlewareFunc{
+		limiter.LimitBy(ratelimit.Rule{Name: "ip", Requests: 3, Window: time.Minute}, ratelimit.IPKey),
+		auth.Authenticate(rejectingAuthenticator{}),
+		limiter.Limit(ratelimit.Rule{Name: "default", Requests: 100, Window: time.Minute}),
+	}
+
+	for i := 0; i < 3; i++ {
+		if status, _ := serve(chain, "192.0.2.1"); status != http.StatusUnauthorized {
+			t.Fatalf("status = %d, want %d", status, http.StatusUnauthorized)
+		}
+	}
+	if status, _ := serve(chain, "192.0.2.1"); status != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want %d once the flood is limited", status, http.StatusTooManyRequests)
+	}
+	if status, _ := serve(chain, "192.0.2.2"); status != http.StatusUnauthorized {
+		t.Errorf("status of another IP = %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+
+	if got := ratelimit.ClientKey(c); got != "ip:192.0.2.1" {
+		t.Errorf("ClientKey = %q, want %q", got, "ip:192.0.2.1")
+	}
+
+	// Authenticated requests are counted against their principal
+	authenticate := auth.Authenticate(staticAuthenticator{&auth.Principal{Subject: "key:12"}})
+	err := authenticate(func(c echo.Context) error {
+		if got := ratelimit.ClientKey(c); got != "key:12" {
+			t.Errorf("ClientKey = %q, want %q", got, "key:12")
+		}
+		if got := ratelimit.IPKey(c); got != "ip:192.0.2.1" {
+			t.Errorf("IPKey = %q, want %q", got, "ip:192.0.2.1")
+		}
+		return nil
+	})(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// staticAuthenticator authenticates every request as its principal.
+type staticAuthenticator struct {
+	principal *auth.Principal
+}
+
+func (a staticAuthenticator) Authenticate(*http.Request) (*auth.Principal, error) {
+	return a.principal, nil
+}
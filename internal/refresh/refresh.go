@@ -0,0 +1,233 @@
+// Package refresh fetches the latest forecasts of stored locations from the
+// weather API and stores them as new snapshots.
+package refresh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+
+	"github.com/mick-io/duplo_go_cloud/internal/alerts"
+	"github.com/mick-io/duplo_go_cloud/internal/api"
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/metrics"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/pubsub"
+)
+
+// DefaultConcurrency is the number of workers used when none is configured.
+const DefaultConcurrency = 4
+
+type Status string
+
+const (
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+	StatusSkipped   Status = "skipped"
+)
+
+type Stage string
+
+const (
+	StageFetch    Stage = "fetch"
+	StageValidate Stage = "validate"
+	StageStore    Stage = "store"
+)
+
+// Error is a refresh failure together with the stage it happened in.
+type Error struct {
+	Stage Stage
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Upstream reports whether the error was caused by the weather API rather
+// than by this service.
+func (e *Error) Upstream() bool {
+	return e.Stage == StageFetch || e.Stage == StageValidate
+}
+
+// Result is the outcome of refreshing a single location.
+type Result struct {
+	LocationID uint
+	Status     Status
+	ForecastID uint
+	Err        error
+}
+
+type Options struct {
+	// Concurrency is the maximum number of locations refreshed at once.
+	Concurrency int
+	// Hub, if set, receives a pubsub.EventForecastRefreshed event for every
+	// stored snapshot, and a pubsub.EventAlertFired event for every alert
+	// rule the snapshot crosses.
+	Hub    *pubsub.Hub
+	Alerts []alerts.Rule
+}
+
+// Engine refreshes forecasts using a bounded pool of workers.
+type Engine struct {
+	db     database.Datastore
+	client api.WeatherAPIClient
+	opts   Options
+}
+
+// NewEngine creates a new Engine.
+func NewEngine(db database.Datastore, client api.WeatherAPIClient, opts Options) *Engine {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	return &Engine{db: db, client: client, opts: opts}
+}
+
+// Refresh fetches and stores the forecast of a single location and returns
+// the ID of the stored forecast. Returned errors are *Error values.
+func (e *Engine) Refresh(ctx context.Context, loc *models.LocationRecord) (uint, error) {
+	// Fetching forecast data
+	resp := models.Forecast{}
+	opts := api.ForecastOptions{
+		Latitude:  strconv.FormatFloat(loc.Latitude, 'f', 6, 64),
+		Longitude: strconv.FormatFloat(loc.Longitude, 'f', 6, 64),
+	}
+	if err := e.client.GetForecast(ctx, opts, &resp); err != nil {
+		return 0, &Error{Stage: StageFetch, Err: err}
+	}
+
+	// Validating forecast data
+	if err := models.ValidateForecast(resp); err != nil {
+		return 0, &Error{Stage: StageValidate, Err: err}
+	}
+
+	// Storing forecast data. The snapshot is written in a single transaction
+	// so that a failure never leaves a forecast without its hourly series,
+	// bound to the context so that its spans belong to the caller's trace.
+	forecast := models.NewForecastRecords(loc.ID, &resp)
+	err := e.db.WithContext(ctx).Transaction(func(tx database.Datastore) error {
+		if err := tx.Create(forecast); err != nil {
+			return fmt.Errorf("storing forecast: %w", err)
+		}
+		hourly := models.NewHourlyRecord(forecast.ID, &resp.Hourly)
+		if len(*hourly) > 0 {
+			if err := tx.Create(hourly); err != nil {
+				return fmt.Errorf("storing hourly records: %w", err)
+			}
+		}
+		units := models.NewHourlyUnitsRecord(forecast.ID, &resp.HourlyUnits)
+		if err := tx.Create(units); err != nil {
+			return fmt.Errorf("storing unit records: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, &Error{Stage: StageStore, Err: err}
+	}
+
+	if e.opts.Hub != nil {
+		tags := loc.TagList()
+		e.opts.Hub.Publish(pubsub.EventForecastRefreshed, loc.TenantID, loc.ID, tags, models.ForecastRefreshedEvent{
+			LocationID: loc.ID,
+			ForecastID: forecast.ID,
+			Latitude:   loc.Latitude,
+			Longitude:  loc.Longitude,
+		})
+		for _, alert := range alerts.Evaluate(e.opts.Alerts, &resp.Hourly) {
+			alert.LocationID = loc.ID
+			alert.ForecastID = forecast.ID
+			e.opts.Hub.Publish(pubsub.EventAlertFired, loc.TenantID, loc.ID, tags, alert)
+		}
+	}
+
+	return forecast.ID, nil
+}
+
+// Run refreshes the given locations and returns one result per location, in
+// the same order. If 'onResult' is not nil it is called as each location
+// finishes; it may be called concurrently from several workers.
+//
+// Locations that have not been started when the context is done are
+// reported as skipped, and in-flight requests are aborted.
+func (e *Engine) Run(ctx context.Context, locations []models.LocationRecord, onResult func(Result)) []Result {
+	results := make([]Result, len(locations))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	workers := e.opts.Concurrency
+	if workers > len(locations) {
+		workers = len(locations)
+	}
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = e.refreshOne(ctx, &locations[i])
+				if onResult != nil {
+					onResult(results[i])
+				}
+			}
+		}()
+	}
+
+	for i := range locations {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			results[i] = Result{LocationID: locations[i].ID, Status: StatusSkipped, Err: ctx.Err()}
+			if onResult != nil {
+				onResult(results[i])
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+func (e *Engine) refreshOne(ctx context.Context, loc *models.LocationRecord) Result {
+	result := e.refreshLocation(ctx, loc)
+
+	stage := ""
+	var refreshErr *Error
+	if result.Status == StatusFailed && errors.As(result.Err, &refreshErr) {
+		stage = string(refreshErr.Stage)
+	}
+	metrics.Refreshes.WithLabelValues(string(result.Status), stage).Inc()
+
+	switch result.Status {
+	case StatusFailed:
+		slog.ErrorContext(ctx, "Error refreshing forecast", "location_id", loc.ID, "stage", stage, "error", result.Err)
+	case StatusSkipped:
+		slog.DebugContext(ctx, "Forecast refresh skipped", "location_id", loc.ID, "error", result.Err)
+	}
+
+	return result
+}
+
+func (e *Engine) refreshLocation(ctx context.Context, loc *models.LocationRecord) Result {
+	if err := ctx.Err(); err != nil {
+		return Result{LocationID: loc.ID, Status: StatusSkipped, Err: err}
+	}
+
+	forecastID, err := e.Refresh(ctx, loc)
+	if err != nil {
+		// A request aborted by cancellation is reported as skipped rather
+		// than as an upstream failure.
+		if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			return Result{LocationID: loc.ID, Status: StatusSkipped, Err: ctx.Err()}
+		}
+		return Result{LocationID: loc.ID, Status: StatusFailed, Err: err}
+	}
+
+	return Result{LocationID: loc.ID, Status: StatusSucceeded, ForecastID: forecastID}
+}
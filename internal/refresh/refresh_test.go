@@ -0,0 +1,378 @@
+package refresh_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mick-io/duplo_go_cloud/internal/alerts"
+	"github.com/mick-io/duplo_go_cloud/internal/api"
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/database/dbtest"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/pubsub"
+	"github.com/mick-io/duplo_go_cloud/internal/refresh"
+)
+
+// fakeClient answers GetForecast with a valid forecast. Calls wait for
+// 'gate' to be closed, if set, or for their context to be done.
+type fakeClient struct {
+	api.WeatherAPIClient
+
+	gate chan struct{}
+	// errs maps latitudes to the error returned for them.
+	errs map[string]error
+	// invalid holds the latitudes answered with an invalid forecast.
+	invalid map[string]bool
+
+	calls    atomic.Int32
+	inFlight atomic.Int32
+	maxMu    sync.Mutex
+	max      int32
+}
+
+func (f *fakeClient) GetForecast(ctx context.Context, opts api.ForecastOptions, result *models.Forecast) error {
+	f.calls.Add(1)
+	n := f.inFlight.Add(1)
+	defer f.inFlight.Add(-1)
+	f.maxMu.Lock()
+	if n > f.max {
+		f.max = n
+	}
+	f.maxMu.Unlock()
+
+	if f.gate != nil {
+		select {
+		case <-f.gate:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err := f.errs[opts.Latitude]; err != nil {
+		return err
+	}
+	*result = newForecast()
+	if f.invalid[opts.Latitude] {
+		result.Hourly.Temperature2M = result.Hourly.Temperature2M[:1]
+	}
+	return nil
+}
+
+func (f *fakeClient) maxInFlight() int32 {
+	f.maxMu.Lock()
+	defer f.maxMu.Unlock()
+	return f.max
+}
+
+func newForecast() models.Forecast {
+	return models.Forecast{
+		Latitude:             1,
+		Longitude:            2,
+		GenerationtimeMS:     0.5,
+		UTCOffsetSeconds:     3600,
+		Timezone:             "Europe/Paris",
+		TimezoneAbbreviation: "CET",
+		Elevation:            35,
+		HourlyUnits: models.HourlyUnits{
+			Time:               "iso8601",
+			Temperature2M:      "°C",
+			Precipitation:      "mm",
+			RelativeHumidity2M: "%",
+			WindSpeed10M:       "km/h",
+			SurfacePressure:    "hPa",
+		},
+		Hourly: models.Hourly{
+			Time:               []string{"2024-01-01T00:00", "2024-01-01T01:00"},
+			Temperature2M:      []float64{1, 2},
+			Precipitation:      []float64{0, 0.2},
+			RelativeHumidity2M: []float64{80, 85},
+			WindSpeed10M:       []float64{10, 12},
+			SurfacePressure:    []float64{1013, 1012},
+		},
+	}
+}
+
+// fakeDatastore fails to store hourly records when 'failHourly' is set, in
+// transactions too.
+type fakeDatastore struct {
+	database.Datastore
+	failHourly bool
+}
+
+func (d *fakeDatastore) WithContext(ctx context.Context) database.Datastore {
+	return &fakeDatastore{Datastore: d.Datastore.WithContext(ctx), failHourly: d.failHourly}
+}
+
+func (d *fakeDatastore) Create(value interface{}) error {
+	if _, ok := value.(*[]models.HourlyRecord); ok && d.failHourly {
+		return errors.New("disk full")
+	}
+	return d.Datastore.Create(value)
+}
+
+func (d *fakeDatastore) Transaction(fn func(tx database.Datastore) error) error {
+	return d.Datastore.Transaction(func(tx database.Datastore) error {
+		return fn(&fakeDatastore{Datastore: tx, failHourly: d.failHourly})
+	})
+}
+
+// createLocations stores 'n' locations, with latitudes 1 to n.
+func createLocations(t *testing.T, db database.Datastore, n int) []models.LocationRecord {
+	t.Helper()
+
+	locations := make([]models.LocationRecord, n)
+	for i := range locations {
+		locations[i] = models.LocationRecord{Latitude: float64(i + 1), Longitude: 2}
+	}
+	if err := db.Create(&locations); err != nil {
+		t.Fatalf("creating locations: %v", err)
+	}
+	return locations
+}
+
+func countRecords(t *testing.T, db database.Datastore, model interface{}) int64 {
+	t.Helper()
+
+	var count int64
+	if err := db.Count(model, &count); err != nil {
+		t.Fatalf("counting records: %v", err)
+	}
+	return count
+}
+
+func TestRunBoundsConcurrency(t *testing.T) {
+	db := dbtest.NewDatastore(t)
+	locations := createLocations(t, db, 10)
+	client := &fakeClient{gate: make(chan struct{})}
+	engine := refresh.NewEngine(db, client, refresh.Options{Concurrency: 3})
+
+	done := make(chan []refresh.Result)
+	go func() {
+		done <- engine.Run(context.Background(), locations, nil)
+	}()
+
+	// Holding the first requests until the pool is full, and a while longer
+	// to catch any worker beyond the bound
+	deadline := time.Now().Add(5 * time.Second)
+	for client.inFlight.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("in flight = %d, want 3", client.inFlight.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(client.gate)
+	results := <-done
+
+	if got := client.maxInFlight(); got != 3 {
+		t.Errorf("max in flight = %d, want 3", got)
+	}
+	for i, result := range results {
+		if result.Status != refresh.StatusSucceeded || result.LocationID != locations[i].ID || result.ForecastID == 0 {
+			t.Errorf("results[%d] = %+v, want success for location %d", i, result, locations[i].ID)
+		}
+	}
+	if got := countRecords(t, db, &models.ForecastRecord{}); got != 10 {
+		t.Errorf("stored %d forecasts, want 10", got)
+	}
+}
+
+func TestRunCancellationSkipsLocations(t *testing.T) {
+	db := dbtest.NewDatastore(t)
+	locations := createLocations(t, db, 3)
+	client := &fakeClient{gate: make(chan struct{})}
+	engine := refresh.NewEngine(db, client, refresh.Options{Concurrency: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	reported := []refresh.Result{}
+	done := make(chan []refresh.Result)
+	go func() {
+		done <- engine.Run(ctx, locations, func(result refresh.Result) {
+			mu.Lock()
+			defer mu.Unlock()
+			reported = append(reported, result)
+		})
+	}()
+
+	// Cancelling while the first request is in flight
+	for client.inFlight.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	results := <-done
+
+	for i, result := range results {
+		if result.Status != refresh.StatusSkipped || !errors.Is(result.Err, context.Canceled) {
+			t.Errorf("results[%d] = %+v, want skipped with %v", i, result, context.Canceled)
+		}
+	}
+	if len(reported) != len(locations) {
+		t.Errorf("onResult called %d times, want %d", len(reported), len(locations))
+	}
+	if got := client.calls.Load(); got != 1 {
+		t.Errorf("client called %d times, want 1", got)
+	}
+	if got := countRecords(t, db, &models.ForecastRecord{}); got != 0 {
+		t.Errorf("stored %d forecasts, want 0", got)
+	}
+}
+
+func TestRunDoneContextSkipsEveryLocation(t *testing.T) {
+	db := dbtest.NewDatastore(t)
+	locations := createLocations(t, db, 5)
+	client := &fakeClient{}
+	engine := refresh.NewEngine(db, client, refresh.Options{Concurrency: 2})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for i, result := range engine.Run(ctx, locations, nil) {
+		if result.Status != refresh.StatusSkipped {
+			t.Errorf("results[%d].Status = %q, want %q", i, result.Status, refresh.StatusSkipped)
+		}
+	}
+	if got := client.calls.Load(); got != 0 {
+		t.Errorf("client called %d times, want 0", got)
+	}
+}
+
+func TestRunReportsFailures(t *testing.T) {
+	db := dbtest.NewDatastore(t)
+	locations := createLocations(t, db, 3)
+	client := &fakeClient{
+		errs:    map[string]error{"1.000000": errors.New("502 Bad Gateway")},
+		invalid: map[string]bool{"2.000000": true},
+	}
+	engine := refresh.NewEngine(db, client, refresh.Options{})
+
+	results := engine.Run(context.Background(), locations, nil)
+
+	tests := []struct {
+		status refresh.Status
+		stage  refresh.Stage
+	}{
+		{refresh.StatusFailed, refresh.StageFetch},
+		{refresh.StatusFailed, refresh.StageValidate},
+		{refresh.StatusSucceeded, ""},
+	}
+	for i, tt := range tests {
+		result := results[i]
+		if result.Status != tt.status {
+			t.Errorf("results[%d].Status = %q, want %q", i, result.Status, tt.status)
+			continue
+		}
+		if tt.stage == "" {
+			continue
+		}
+		var refreshErr *refresh.Error
+		if !errors.As(result.Err, &refreshErr) || refreshErr.Stage != tt.stage || !refreshErr.Upstream() {
+			t.Errorf("results[%d].Err = %v, want upstream error at stage %q", i, result.Err, tt.stage)
+		}
+	}
+	if got := countRecords(t, db, &models.ForecastRecord{}); got != 1 {
+		t.Errorf("stored %d forecasts, want 1", got)
+	}
+}
+
+func TestRefreshStoresSnapshot(t *testing.T) {
+	db := dbtest.NewDatastore(t)
+	loc := createLocations(t, db, 1)[0]
+	hub := pubsub.NewHub(0)
+	sub, _ := hub.Subscribe(pubsub.Filter{}, 0)
+	engine := refresh.NewEngine(db, &fakeClient{}, refresh.Options{Hub: hub})
+
+	forecastID, err := engine.Refresh(context.Background(), &loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := countRecords(t, db, &models.HourlyRecord{}); got != 2 {
+		t.Errorf("stored %d hourly records, want 2", got)
+	}
+	if got := countRecords(t, db, &models.HourlyUnitsRecord{}); got != 1 {
+		t.Errorf("stored %d unit records, want 1", got)
+	}
+	select {
+	case event := <-sub.C:
+		data, ok := event.Data.(models.ForecastRefreshedEvent)
+		if event.Type != pubsub.EventForecastRefreshed || !ok || data.ForecastID != forecastID {
+			t.Errorf("event = %+v, want %s for forecast %d", event, pubsub.EventForecastRefreshed, forecastID)
+		}
+	default:
+		t.Error("no event published")
+	}
+}
+
+func TestRefreshRollsBackFailedWrite(t *testing.T) {
+	db := &fakeDatastore{Datastore: dbtest.NewDatastore(t), failHourly: true}
+	loc := createLocations(t, db, 1)[0]
+	hub := pubsub.NewHub(0)
+	sub, _ := hub.Subscribe(pubsub.Filter{}, 0)
+	engine := refresh.NewEngine(db, &fakeClient{}, refresh.Options{Hub: hub})
+
+	_, err := engine.Refresh(context.Background(), &loc)
+	var refreshErr *refresh.Error
+	if !errors.As(err, &refreshErr) || refreshErr.Stage != refresh.StageStore || refreshErr.Upstream() {
+		t.Fatalf("error = %v, want store error", err)
+	}
+
+	// The forecast created before the failure is rolled back
+	if got := countRecords(t, db, &models.ForecastRecord{}); got != 0 {
+		t.Errorf("stored %d forecasts, want 0", got)
+	}
+	if got := countRecords(t, db, &models.HourlyUnitsRecord{}); got != 0 {
+		t.Errorf("stored %d unit records, want 0", got)
+	}
+	if hub.Subscribers() != 1 || len(sub.C) != 0 {
+		t.Error("event published for a failed write")
+	}
+}
+
+func TestRefreshPublishesAlerts(t *testing.T) {
+	db := dbtest.NewDatastore(t)
+	loc := models.LocationRecord{Latitude: 1, Longitude: 2, Tags: models.NormalizeTags([]string{"North", "coast"})}
+	if err := db.Create(&loc); err != nil {
+		t.Fatal(err)
+	}
+	hub := pubsub.NewHub(0)
+	tagged, _ := hub.Subscribe(pubsub.Filter{Types: []string{pubsub.EventAlertFired}, Tags: []string{"north"}}, 0)
+	untagged, _ := hub.Subscribe(pubsub.Filter{Tags: []string{"south"}}, 0)
+
+	warm, windy, humid := 1.5, 20.0, 82.0
+	engine := refresh.NewEngine(db, &fakeClient{}, refresh.Options{Hub: hub, Alerts: []alerts.Rule{
+		{Name: "warm", Variable: "temperature_2m", Above: &warm},
+		{Name: "windy", Variable: "wind_speed_10m", Above: &windy},
+		{Name: "dry", Variable: "relative_humidity_2m", Below: &humid},
+	}})
+
+	forecastID, err := engine.Refresh(context.Background(), &loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := []string{}
+	for len(tagged.C) > 0 {
+		event := <-tagged.C
+		data, ok := event.Data.(models.AlertFiredEvent)
+		if !ok || data.LocationID != loc.ID || data.ForecastID != forecastID {
+			t.Errorf("event = %+v, want an alert of location %d and forecast %d", event, loc.ID, forecastID)
+		}
+		if len(event.Tags) != 2 || event.Tags[0] != "coast" || event.Tags[1] != "north" {
+			t.Errorf("event tags = %v, want [coast north]", event.Tags)
+		}
+		rules = append(rules, data.Rule)
+	}
+	if len(rules) != 2 || rules[0] != "warm" || rules[1] != "dry" {
+		t.Errorf("fired %v, want [warm dry]", rules)
+	}
+	if len(untagged.C) != 0 {
+		t.Errorf("%d events delivered to a subscription to another tag", len(untagged.C))
+	}
+}
@@ -1,22 +1,132 @@
 package routes
 
 import (
+	"time"
+
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 
 	"github.com/mick-io/duplo_go_cloud/internal/api"
+	"github.com/mick-io/duplo_go_cloud/internal/auth"
 	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/derived"
+	"github.com/mick-io/duplo_go_cloud/internal/enrichment"
 	"github.com/mick-io/duplo_go_cloud/internal/handlers"
+	"github.com/mick-io/duplo_go_cloud/internal/health"
+	"github.com/mick-io/duplo_go_cloud/internal/jobs"
+	"github.com/mick-io/duplo_go_cloud/internal/logging"
+	"github.com/mick-io/duplo_go_cloud/internal/metrics"
+	"github.com/mick-io/duplo_go_cloud/internal/pubsub"
+	"github.com/mick-io/duplo_go_cloud/internal/ratelimit"
+	"github.com/mick-io/duplo_go_cloud/internal/refresh"
+	"github.com/mick-io/duplo_go_cloud/internal/tenancy"
+	"github.com/mick-io/duplo_go_cloud/internal/tracing"
+	"github.com/mick-io/duplo_go_cloud/internal/units"
 )
 
-func Initialize(e *echo.Echo, db database.Datastore, client api.WeatherAPIClient) {
-	e.GET("/health", handlers.HealthCheckHandler(db))
+// RateLimits are the rate limits of the routes. IP applies to every
+// authenticated route per IP address, before the credentials are checked.
+// Default applies to every authenticated route, and Expensive to the routes
+// calling the weather API and to the refresh messages of forecast
+// WebSockets.
+type RateLimits struct {
+	Limiter   *ratelimit.Limiter
+	IP        ratelimit.Rule
+	Default   ratelimit.Rule
+	Expensive ratelimit.Rule
+}
+
+// Dependencies are the services shared by the route handlers.
+type Dependencies struct {
+	Datastore      database.Datastore
+	Health         *health.Checker
+	Authenticators []auth.Authenticator
+	RateLimits     RateLimits
+	WeatherClient  api.WeatherAPIClient
+	ArchiveClient  api.ArchiveAPIClient
+	Geocoder       api.GeocodingAPIClient
+	Enricher       *enrichment.Pipeline
+	RefreshEngine  *refresh.Engine
+	RefreshTimeout time.Duration
+	BackfillChunk  int
+	DegreeDayBases derived.Bases
+	DefaultUnits   units.System
+	Jobs           *jobs.Runner
+	Tenancy        *tenancy.Enforcer
+	Hub            *pubsub.Hub
+	Heartbeat      time.Duration
+	Socket         handlers.SocketOptions
+}
+
+func Initialize(e *echo.Echo, deps Dependencies) {
+	db := deps.Datastore
+
+	e.Use(tracing.Middleware())
+	e.Use(logging.Middleware())
+	e.Use(metrics.Middleware())
+	// Recovering below the observability middlewares so that panics are
+	// traced, logged and counted as the 500s they are answered with
+	e.Use(middleware.Recover())
+	e.Use(handlers.DefaultUnits(deps.DefaultUnits))
+
+	e.GET("/health", handlers.HealthCheckHandler(deps.Health))
+	e.GET("/livez", handlers.Livez())
+	e.GET("/readyz", handlers.Readyz(deps.Health))
+	e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+
+	// Every other route requires authentication and the scope it is
+	// registered with, and is rate limited per client. Requests are first
+	// limited per IP address, so that requests failing authentication are
+	// limited too.
+	limiter := deps.RateLimits.Limiter
+	api := e.Group("",
+		limiter.LimitBy(deps.RateLimits.IP, ratelimit.IPKey),
+		auth.Authenticate(deps.Authenticators...),
+		limiter.Limit(deps.RateLimits.Default),
+	)
+	expensive := limiter.Limit(deps.RateLimits.Expensive)
+	socket := deps.Socket
+	socket.Limiter = limiter
+	socket.RefreshLimit = deps.RateLimits.Expensive
+	read := auth.Require(auth.ScopeLocationsRead)
+	write := auth.Require(auth.ScopeLocationsWrite)
+	refresh := auth.Require(auth.ScopeForecastRefresh)
+	admin := auth.Require(auth.ScopeAdmin)
+
+	api.POST("/locations", handlers.CreateLocation(db, deps.RefreshEngine, deps.Geocoder, deps.Enricher, deps.Tenancy), write, expensive)
+	api.GET("/locations", handlers.ReadLocations(db), read)
+	api.POST("/locations/import", handlers.ImportLocations(db, deps.Jobs, deps.Tenancy), write, expensive)
+	api.GET("/locations/export", handlers.ExportLocations(db), read)
+	// api.PUT("/locations/:id", handlers.UpdateLocation(db), write)
+	api.DELETE("/locations/:id", handlers.DeleteLocationByID(db), write)
+	api.PUT("/locations/:id/units", handlers.UpdateLocationUnits(db), write)
+	api.PUT("/locations/:id/tags", handlers.UpdateLocationTags(db), write)
+	api.GET("/locations/:id/forecast", handlers.ReadLocationForecast(db, deps.DegreeDayBases), read)
+	api.GET("/locations/:id/forecast/diff", handlers.ReadForecastDiff(db), read)
+	api.POST("/locations/:id/observations", handlers.CreateObservations(db), write)
+	api.POST("/locations/:id/observations/archive", handlers.ImportObservations(db, deps.ArchiveClient), write, expensive)
+	api.POST("/locations/:id/backfill", handlers.CreateBackfill(db, deps.Jobs, deps.BackfillChunk), refresh, expensive)
+	api.GET("/locations/:id/history", handlers.ReadHistory(db), read)
+	api.DELETE("/locations", handlers.DeleteLocationByLatLong(db), write)
+
+	api.GET("/forecast", handlers.ReadStoredForecast(db, deps.DegreeDayBases), read)
+	api.GET("/forecast/stream", handlers.StreamForecast(deps.Hub, deps.Heartbeat), read)
+	api.GET("/forecast/ws", handlers.ForecastSocket(db, deps.RefreshEngine, deps.Tenancy, deps.Hub, socket), read)
+	api.GET("/forecast/grid", handlers.ReadForecastGrid(deps.WeatherClient), read, expensive)
+	api.PUT("/forecast/latest", handlers.ReadLatestForecast(db, deps.RefreshEngine, deps.Tenancy, deps.RefreshTimeout), refresh, expensive)
+
+	api.POST("/jobs/refresh", handlers.CreateRefreshJob(db, deps.Jobs, deps.Tenancy), refresh, expensive)
+	api.POST("/jobs/verification", handlers.CreateVerificationJob(db, deps.Jobs), refresh)
+	api.GET("/jobs/:id", handlers.ReadJob(db), read)
+	api.DELETE("/jobs/:id", handlers.CancelJob(db, deps.Jobs), refresh)
+
+	api.GET("/verification", handlers.ReadVerification(db), read)
 
-	e.POST("/locations", handlers.CreateLocation(db, client))
-	e.GET("/locations", handlers.ReadLocations(db))
-	// e.PUT("/locations/:id", handlers.UpdateLocation(db))
-	e.DELETE("/locations/:id", handlers.DeleteLocationByID(db))
-	e.DELETE("/locations", handlers.DeleteLocationByLatLong(db))
+	api.GET("/tenant", handlers.ReadTenant(db, deps.Tenancy), read)
 
-	e.GET("/forecast", handlers.ReadStoredForecast(db))
-	e.PUT("/forecast/latest", handlers.ReadLatestForecast(db, client))
+	api.POST("/admin/locations/enrich", handlers.EnrichLocations(db, deps.Jobs), admin, expensive)
+	api.POST("/admin/locations/:id/enrich", handlers.EnrichLocationByID(db, deps.Enricher), admin, expensive)
+	api.POST("/admin/keys", handlers.CreateAPIKey(db), admin)
+	api.GET("/admin/keys", handlers.ReadAPIKeys(db), admin)
+	api.DELETE("/admin/keys/:id", handlers.RevokeAPIKey(db), admin)
 }
@@ -0,0 +1,63 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mick-io/duplo_go_cloud/internal/auth"
+	"github.com/mick-io/duplo_go_cloud/internal/database/dbtest"
+	"github.com/mick-io/duplo_go_cloud/internal/ratelimit"
+)
+
+func TestInvalidCredentialsAreRateLimited(t *testing.T) {
+	db := dbtest.NewDatastore(t)
+	e := echo.New()
+	Initialize(e, Dependencies{
+		Datastore:      db,
+		Authenticators: []auth.Authenticator{auth.NewKeyAuthenticator(db)},
+		RateLimits: RateLimits{
+			Limiter: ratelimit.NewLimiter(ratelimit.NewMemoryStore()),
+			IP:      ratelimit.Rule{Name: "ip", Requests: 3, Window: time.Hour},
+			Default: ratelimit.Rule{Name: "default", Requests: 100, Window: time.Hour},
+		},
+	})
+
+	statuses := []int{}
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/locations", nil)
+		req.Header.Set(auth.HeaderAPIKey, auth.KeyPrefix+"guessed")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		statuses = append(statuses, rec.Code)
+	}
+
+	want := []int{401, 401, 401, 429, 429}
+	for i := range want {
+		if statuses[i] != want[i] {
+			t.Fatalf("statuses = %v, want %v", statuses, want)
+		}
+	}
+}
+
+func TestHandlerPanicsAnswer500(t *testing.T) {
+	e := echo.New()
+	Initialize(e, Dependencies{
+		Datastore: dbtest.NewDatastore(t),
+		RateLimits: RateLimits{
+			Limiter: ratelimit.NewLimiter(ratelimit.NewMemoryStore()),
+		},
+	})
+	e.GET("/panics", func(c echo.Context) error {
+		panic("boom")
+	})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/panics", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+}
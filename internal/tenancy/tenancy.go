@@ -0,0 +1,164 @@
+// Package tenancy enforces the quotas of the tenants sharing the deployment:
+// the number of locations they store and the number of forecasts refreshed
+// for them per day.
+package tenancy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+)
+
+// Quotas enforced by an Enforcer.
+const (
+	QuotaLocations     = "locations"
+	QuotaRefreshBudget = "refresh_budget"
+)
+
+// RefreshWindow is the period refresh budgets apply to.
+const RefreshWindow = 24 * time.Hour
+
+// Limits are the quotas of a tenant. Zero means unlimited.
+type Limits struct {
+	MaxLocations  int
+	RefreshBudget int
+}
+
+// QuotaError is returned when an operation would exceed a quota.
+type QuotaError struct {
+	Quota string
+	Limit int
+}
+
+func (e *QuotaError) Error() string {
+	switch e.Quota {
+	case QuotaLocations:
+		return fmt.Sprintf("location quota of %d exceeded", e.Limit)
+	case QuotaRefreshBudget:
+		return fmt.Sprintf("refresh budget of %d per day exceeded", e.Limit)
+	}
+	return fmt.Sprintf("%s quota of %d exceeded", e.Quota, e.Limit)
+}
+
+// Enforcer resolves the quotas of tenants and their usage.
+type Enforcer struct {
+	// Defaults apply to the tenants whose own limits are zero.
+	Defaults Limits
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// NewEnforcer returns an enforcer applying 'defaults' to the tenants without
+// limits of their own.
+func NewEnforcer(defaults Limits) *Enforcer {
+	return &Enforcer{Defaults: defaults, Now: time.Now}
+}
+
+// Quota is the quotas of a tenant together with its current usage.
+type Quota struct {
+	TenantID  uint
+	Name      string
+	Limits    Limits
+	Locations int
+	Refreshes int
+}
+
+// AllowLocations returns a *QuotaError if storing 'n' more locations would
+// exceed the location quota.
+func (q *Quota) AllowLocations(n int) error {
+	if q.Limits.MaxLocations > 0 && q.Locations+n > q.Limits.MaxLocations {
+		return &QuotaError{Quota: QuotaLocations, Limit: q.Limits.MaxLocations}
+	}
+	return nil
+}
+
+// AllowRefreshes returns a *QuotaError if refreshing 'n' more forecasts
+// would exceed the refresh budget.
+func (q *Quota) AllowRefreshes(n int) error {
+	if q.Limits.RefreshBudget > 0 && q.Refreshes+n > q.Limits.RefreshBudget {
+		return &QuotaError{Quota: QuotaRefreshBudget, Limit: q.Limits.RefreshBudget}
+	}
+	return nil
+}
+
+// Quota returns the quotas and usage of the tenant carried by 'ctx'. 'db'
+// must be bound to the same tenant. Without a tenant nothing is limited.
+func (e *Enforcer) Quota(ctx context.Context, db database.Datastore) (*Quota, error) {
+	tenantID, ok := database.TenantFrom(ctx)
+	if !ok {
+		return &Quota{}, nil
+	}
+
+	var tenant models.TenantRecord
+	if err := db.Find(&tenant, tenantID); err != nil {
+		return nil, err
+	}
+	quota := &Quota{
+		TenantID: tenantID,
+		Name:     tenant.Name,
+		Limits:   e.Defaults,
+	}
+	if tenant.MaxLocations > 0 {
+		quota.Limits.MaxLocations = tenant.MaxLocations
+	}
+	if tenant.RefreshBudget > 0 {
+		quota.Limits.RefreshBudget = tenant.RefreshBudget
+	}
+
+	var locations int64
+	if err := db.Count(&models.LocationRecord{}, &locations); err != nil {
+		return nil, err
+	}
+	var refreshes int64
+	since := e.Now().Add(-RefreshWindow)
+	if err := db.Count(&models.ForecastRecord{}, &refreshes, "created_at > ?", since); err != nil {
+		return nil, err
+	}
+	quota.Locations = int(locations)
+	quota.Refreshes = int(refreshes)
+
+	return quota, nil
+}
+
+// WithQuota runs 'fn' in a transaction with the quotas and usage of the
+// tenant carried by 'ctx'. The tenant is locked until the transaction ends,
+// so that concurrent calls for a tenant run one after the other and the
+// records stored with 'tx' cannot exceed the quotas checked by 'fn'. 'db'
+// must be bound to the same tenant.
+func (e *Enforcer) WithQuota(ctx context.Context, db database.Datastore, fn func(tx database.Datastore, quota *Quota) error) error {
+	return db.Transaction(func(tx database.Datastore) error {
+		if tenantID, ok := database.TenantFrom(ctx); ok {
+			if err := tx.Lock(&models.TenantRecord{}, tenantID); err != nil {
+				return err
+			}
+		}
+		quota, err := e.Quota(ctx, tx)
+		if err != nil {
+			return err
+		}
+		return fn(tx, quota)
+	})
+}
+
+// AllowLocations returns a *QuotaError if storing 'n' more locations would
+// exceed the location quota of the tenant carried by 'ctx'.
+func (e *Enforcer) AllowLocations(ctx context.Context, db database.Datastore, n int) error {
+	quota, err := e.Quota(ctx, db)
+	if err != nil {
+		return err
+	}
+	return quota.AllowLocations(n)
+}
+
+// AllowRefreshes returns a *QuotaError if refreshing 'n' more forecasts
+// would exceed the refresh budget of the tenant carried by 'ctx'.
+func (e *Enforcer) AllowRefreshes(ctx context.Context, db database.Datastore, n int) error {
+	quota, err := e.Quota(ctx, db)
+	if err != nil {
+		return err
+	}
+	return quota.AllowRefreshes(n)
+}
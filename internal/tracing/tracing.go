@@ -0,0 +1,124 @@
+// Package tracing records OpenTelemetry spans of the HTTP server, the
+// upstream APIs and the datastore, and propagates the W3C trace context to
+// the upstream APIs. Spans are exported as configured by Setup.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation is the name of the tracer of the service.
+const instrumentation = "github.com/mick-io/duplo_go_cloud"
+
+// Exporters of the spans.
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+// Options configures the export of the spans.
+type Options struct {
+	// Exporter is ExporterNone, ExporterStdout or ExporterOTLP. It defaults
+	// to ExporterNone.
+	Exporter string
+	// Endpoint is the URL of the OTLP/HTTP collector. It defaults to the
+	// OTEL_EXPORTER_OTLP_ENDPOINT environment variable.
+	Endpoint string
+	// ServiceName names the service in the exported spans.
+	ServiceName string
+	// SampleRatio is the ratio of the traces started by the service that
+	// are sampled. Traces started upstream follow the decision of their
+	// parent.
+	SampleRatio float64
+}
+
+// Setup installs the tracer provider exporting spans as described by
+// 'opts', along with the W3C trace context propagator. The returned
+// function flushes the pending spans and stops the exporter.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch opts.Exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterOTLP:
+		otlpOpts := []otlptracehttp.Option{}
+		if opts.Endpoint != "" {
+			otlpOpts = append(otlpOpts, otlptracehttp.WithEndpointURL(opts.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, otlpOpts...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter: %q", opts.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := NewProvider(sdktrace.NewBatchSpanProcessor(exporter), opts)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// NewProvider returns a tracer provider sending the spans of the service to
+// 'processor'. Installing it with otel.SetTracerProvider and a
+// sdktrace.NewSimpleSpanProcessor over an in-memory exporter captures the
+// spans synchronously.
+func NewProvider(processor sdktrace.SpanProcessor, opts Options) *sdktrace.TracerProvider {
+	ratio := opts.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	name := opts.ServiceName
+	if name == "" {
+		name = "duplo_go_cloud"
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(name))),
+	)
+}
+
+// Tracer returns the tracer of the service, backed by the provider
+// installed by Setup.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentation)
+}
+
+// Start starts a span named 'name' as a child of the span of 'ctx'.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends 'span', recording '*err' when it is set. It is meant to be
+// deferred with a pointer to the named error result of the traced
+// function.
+func End(span trace.Span, err *error) {
+	if err != nil && *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
@@ -0,0 +1,210 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/mick-io/duplo_go_cloud/internal/api"
+	"github.com/mick-io/duplo_go_cloud/internal/database/dbtest"
+	"github.com/mick-io/duplo_go_cloud/internal/handlers"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/refresh"
+	"github.com/mick-io/duplo_go_cloud/internal/tenancy"
+	"github.com/mick-io/duplo_go_cloud/internal/tracing"
+)
+
+// Trace context of the request, as sent by a caller that traces it.
+const (
+	callerTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	callerSpanID  = "00f067aa0ba902b7"
+	traceparent   = "00-" + callerTraceID + "-" + callerSpanID + "-01"
+)
+
+// installExporter installs a tracer provider exporting spans to memory as
+// they end, and the propagators of Setup.
+func installExporter(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+
+	previous := otel.GetTracerProvider()
+	if _, err := tracing.Setup(context.Background(), tracing.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	exporter := tracetest.NewInMemoryExporter()
+	provider := tracing.NewProvider(sdktrace.NewSimpleSpanProcessor(exporter), tracing.Options{})
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		provider.Shutdown(context.Background())
+		otel.SetTracerProvider(previous)
+	})
+	return exporter
+}
+
+// forecastServer answers every request with a valid forecast and records the
+// traceparent headers it receives.
+type forecastServer struct {
+	*httptest.Server
+	mu           sync.Mutex
+	traceparents []string
+}
+
+func newForecastServer(t *testing.T) *forecastServer {
+	t.Helper()
+
+	forecast := models.Forecast{
+		Latitude:             1,
+		Longitude:            2,
+		GenerationtimeMS:     0.5,
+		UTCOffsetSeconds:     3600,
+		Timezone:             "Europe/Paris",
+		TimezoneAbbreviation: "CET",
+		Elevation:            35,
+		HourlyUnits: models.HourlyUnits{
+			Time:               "iso8601",
+			Temperature2M:      "°C",
+			Precipitation:      "mm",
+			RelativeHumidity2M: "%",
+			WindSpeed10M:       "m/s",
+			SurfacePressure:    "hPa",
+		},
+		Hourly: models.Hourly{
+			Time:               []string{"2024-01-01T00:00"},
+			Temperature2M:      []float64{1},
+			Precipitation:      []float64{0},
+			RelativeHumidity2M: []float64{80},
+			WindSpeed10M:       []float64{3},
+			SurfacePressure:    []float64{1013},
+		},
+	}
+
+	s := &forecastServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.traceparents = append(s.traceparents, r.Header.Get("traceparent"))
+		s.mu.Unlock()
+		json.NewEncoder(w).Encode(forecast)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestRequestSpanTree(t *testing.T) {
+	exporter := installExporter(t)
+	upstream := newForecastServer(t)
+
+	db := dbtest.NewDatastore(t)
+	if err := db.Create(&models.LocationRecord{Latitude: 1, Longitude: 2}); err != nil {
+		t.Fatal(err)
+	}
+	client := api.NewClient(upstream.URL)
+	tracing.InstrumentClient(client.HTTPClient, "forecast")
+	engine := refresh.NewEngine(db, client, refresh.Options{})
+
+	e := echo.New()
+	e.Use(tracing.Middleware())
+	e.PUT("/forecast/latest", handlers.ReadLatestForecast(db, engine, tenancy.NewEnforcer(tenancy.Limits{}), 0))
+
+	// Ignoring the spans of the fixtures
+	exporter.Reset()
+
+	req := httptest.NewRequest(http.MethodPut, "/forecast/latest", nil)
+	req.Header.Set("traceparent", traceparent)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	spans := exporter.GetSpans()
+	byID := map[trace.SpanID]tracetest.SpanStub{}
+	for _, span := range spans {
+		byID[span.SpanContext.SpanID()] = span
+		if got := span.SpanContext.TraceID().String(); got != callerTraceID {
+			t.Errorf("span %q has trace ID %s, want the caller's %s", span.Name, got, callerTraceID)
+		}
+	}
+	parentName := func(span tracetest.SpanStub) string {
+		return byID[span.Parent.SpanID()].Name
+	}
+	// hasAncestor reports whether 'name' is an ancestor of 'span'.
+	hasAncestor := func(span tracetest.SpanStub, name string) bool {
+		for {
+			parent, ok := byID[span.Parent.SpanID()]
+			if !ok {
+				return false
+			}
+			if parent.Name == name {
+				return true
+			}
+			span = parent
+		}
+	}
+
+	const serverName = "PUT /forecast/latest"
+	counts := map[string]int{}
+	for _, span := range spans {
+		switch {
+		case span.Name == serverName:
+			counts["server"]++
+			if span.SpanKind != trace.SpanKindServer {
+				t.Errorf("server span kind = %v, want %v", span.SpanKind, trace.SpanKindServer)
+			}
+			if got := span.Parent.SpanID().String(); got != callerSpanID {
+				t.Errorf("server span parent = %s, want the caller's %s", got, callerSpanID)
+			}
+		case strings.HasPrefix(span.Name, "datastore."):
+			counts["datastore"]++
+			if !hasAncestor(span, serverName) {
+				t.Errorf("span %q is not under the server span", span.Name)
+			}
+		case span.Name == "api.GetForecast":
+			counts["api"]++
+			if got := parentName(span); got != serverName {
+				t.Errorf("span %q has parent %q, want %q", span.Name, got, serverName)
+			}
+		case span.Name == "GET forecast":
+			counts["client"]++
+			if span.SpanKind != trace.SpanKindClient {
+				t.Errorf("client span kind = %v, want %v", span.SpanKind, trace.SpanKindClient)
+			}
+			if got := parentName(span); got != "api.GetForecast" {
+				t.Errorf("span %q has parent %q, want %q", span.Name, got, "api.GetForecast")
+			}
+		default:
+			t.Errorf("unexpected span %q", span.Name)
+		}
+	}
+	if counts["server"] != 1 || counts["api"] != 1 || counts["client"] != 1 {
+		t.Errorf("got %v spans, want one server, api and client span", counts)
+	}
+	// The locations are read, then the snapshot is stored in a transaction
+	if counts["datastore"] < 2 {
+		t.Errorf("got %d datastore spans, want the read and the transaction", counts["datastore"])
+	}
+
+	// The upstream request continues the trace from the client span
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+	if len(upstream.traceparents) != 1 {
+		t.Fatalf("upstream received %d requests, want 1", len(upstream.traceparents))
+	}
+	for _, span := range spans {
+		if span.Name != "GET forecast" {
+			continue
+		}
+		want := "00-" + callerTraceID + "-" + span.SpanContext.SpanID().String() + "-01"
+		if got := upstream.traceparents[0]; got != want {
+			t.Errorf("upstream traceparent = %q, want %q", got, want)
+		}
+	}
+}
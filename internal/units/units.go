@@ -0,0 +1,279 @@
+// Package units converts weather values between unit systems. Units are
+// identified by the strings the forecast API uses in its responses, so
+// stored unit columns can be passed to the conversions as they are.
+package units
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Units of the converted quantities.
+const (
+	Celsius    = "°C"
+	Fahrenheit = "°F"
+
+	MetersPerSecond   = "m/s"
+	KilometersPerHour = "km/h"
+	MilesPerHour      = "mp/h"
+	Knots             = "kn"
+
+	Millimeters = "mm"
+	Inches      = "inch"
+
+	Hectopascals         = "hPa"
+	InchesOfMercury      = "inHg"
+	MillimetersOfMercury = "mmHg"
+)
+
+// Names of the unit systems.
+const (
+	NameMetric   = "metric"
+	NameImperial = "imperial"
+	NameCustom   = "custom"
+)
+
+// System is the set of units values are rendered in.
+type System struct {
+	Name          string
+	Temperature   string
+	WindSpeed     string
+	Precipitation string
+	Pressure      string
+}
+
+// Canonical is the system values are stored in.
+var Canonical = System{
+	Name:          NameMetric,
+	Temperature:   Celsius,
+	WindSpeed:     MetersPerSecond,
+	Precipitation: Millimeters,
+	Pressure:      Hectopascals,
+}
+
+// Metric is the system selected with "metric".
+var Metric = System{
+	Name:          NameMetric,
+	Temperature:   Celsius,
+	WindSpeed:     KilometersPerHour,
+	Precipitation: Millimeters,
+	Pressure:      Hectopascals,
+}
+
+// Imperial is the system selected with "imperial".
+var Imperial = System{
+	Name:          NameImperial,
+	Temperature:   Fahrenheit,
+	WindSpeed:     MilesPerHour,
+	Precipitation: Inches,
+	Pressure:      InchesOfMercury,
+}
+
+// aliases maps the unit names accepted in custom systems, which follow the
+// forecast API's request parameters, to unit strings.
+var aliases = map[string]map[string]string{
+	"temperature": {
+		"celsius":    Celsius,
+		"fahrenheit": Fahrenheit,
+	},
+	"wind_speed": {
+		"ms":  MetersPerSecond,
+		"kmh": KilometersPerHour,
+		"mph": MilesPerHour,
+		"kn":  Knots,
+	},
+	"precipitation": {
+		"mm":   Millimeters,
+		"inch": Inches,
+	},
+	"pressure": {
+		"hpa":  Hectopascals,
+		"inhg": InchesOfMercury,
+		"mmhg": MillimetersOfMercury,
+	},
+}
+
+// Quantities lists the quantities that can be set in a custom system.
+var Quantities = []string{"temperature", "wind_speed", "precipitation", "pressure"}
+
+// Parse parses a unit system specification: "metric", "imperial" or
+// "custom" followed by semicolon-separated quantity=unit pairs, e.g.
+// "custom; temperature=celsius; wind_speed=kn". Quantities missing from a
+// custom system are metric.
+func Parse(spec string) (System, error) {
+	parts := strings.Split(spec, ";")
+	name := strings.ToLower(strings.TrimSpace(parts[0]))
+
+	switch name {
+	case NameMetric, NameImperial:
+		if len(parts) > 1 {
+			return System{}, fmt.Errorf("the %s system takes no units", name)
+		}
+		if name == NameImperial {
+			return Imperial, nil
+		}
+		return Metric, nil
+	case NameCustom:
+	default:
+		return System{}, fmt.Errorf("unknown unit system: %q", name)
+	}
+
+	custom := Metric
+	custom.Name = NameCustom
+	for _, part := range parts[1:] {
+		quantity, unit, ok := strings.Cut(part, "=")
+		if !ok {
+			return System{}, fmt.Errorf("invalid unit: %q", strings.TrimSpace(part))
+		}
+		if err := custom.Set(strings.TrimSpace(quantity), strings.TrimSpace(unit)); err != nil {
+			return System{}, err
+		}
+	}
+	return custom, nil
+}
+
+// Set sets the unit of a quantity by its name, e.g. "celsius" or "kn".
+func (s *System) Set(quantity, unit string) error {
+	names, ok := aliases[quantity]
+	if !ok {
+		return fmt.Errorf("unknown quantity: %q", quantity)
+	}
+	value, ok := names[strings.ToLower(unit)]
+	if !ok {
+		return fmt.Errorf("unknown %s unit: %q", quantity, unit)
+	}
+
+	switch quantity {
+	case "temperature":
+		s.Temperature = value
+	case "wind_speed":
+		s.WindSpeed = value
+	case "precipitation":
+		s.Precipitation = value
+	case "pressure":
+		s.Pressure = value
+	}
+	return nil
+}
+
+// String returns the specification of the system, which Parse accepts.
+func (s System) String() string {
+	if s.Name != NameCustom {
+		return s.Name
+	}
+
+	var b strings.Builder
+	b.WriteString(NameCustom)
+	for _, quantity := range Quantities {
+		unit := s.Unit(quantity)
+		for name, value := range aliases[quantity] {
+			if value == unit {
+				fmt.Fprintf(&b, "; %s=%s", quantity, name)
+			}
+		}
+	}
+	return b.String()
+}
+
+// Unit returns the unit of a quantity.
+func (s System) Unit(quantity string) string {
+	switch quantity {
+	case "temperature":
+		return s.Temperature
+	case "wind_speed":
+		return s.WindSpeed
+	case "precipitation":
+		return s.Precipitation
+	case "pressure":
+		return s.Pressure
+	}
+	return ""
+}
+
+// factors holds the scale of each unit relative to the canonical unit of
+// its quantity, e.g. 1 km/h = 1/3.6 m/s.
+var factors = map[string]float64{
+	MetersPerSecond:   1,
+	KilometersPerHour: 1 / 3.6,
+	MilesPerHour:      1609.344 / 3600,
+	Knots:             1852.0 / 3600,
+
+	Millimeters: 1,
+	Inches:      25.4,
+
+	Hectopascals:         1,
+	InchesOfMercury:      33.8638866667,
+	MillimetersOfMercury: 1.33322387415,
+}
+
+// quantityOf maps each unit to its quantity, to reject conversions between
+// quantities.
+var quantityOf = map[string]string{
+	Celsius:    "temperature",
+	Fahrenheit: "temperature",
+
+	MetersPerSecond:   "wind_speed",
+	KilometersPerHour: "wind_speed",
+	MilesPerHour:      "wind_speed",
+	Knots:             "wind_speed",
+
+	Millimeters: "precipitation",
+	Inches:      "precipitation",
+
+	Hectopascals:         "pressure",
+	InchesOfMercury:      "pressure",
+	MillimetersOfMercury: "pressure",
+}
+
+// Convert converts a value from one unit to another of the same quantity.
+func Convert(value float64, from, to string) (float64, error) {
+	if from == to {
+		return value, nil
+	}
+	if err := compatible(from, to); err != nil {
+		return 0, err
+	}
+
+	if quantityOf[from] == "temperature" {
+		if from == Fahrenheit {
+			return (value - 32) * 5 / 9, nil
+		}
+		return value*9/5 + 32, nil
+	}
+	return value * factors[from] / factors[to], nil
+}
+
+// ConvertDifference converts a difference between two values, such as a
+// change or an error, from one unit to another. It only differs from
+// Convert for temperatures, whose scales have different origins.
+func ConvertDifference(value float64, from, to string) (float64, error) {
+	if from == to {
+		return value, nil
+	}
+	if err := compatible(from, to); err != nil {
+		return 0, err
+	}
+
+	if quantityOf[from] == "temperature" {
+		if from == Fahrenheit {
+			return value * 5 / 9, nil
+		}
+		return value * 9 / 5, nil
+	}
+	return value * factors[from] / factors[to], nil
+}
+
+func compatible(from, to string) error {
+	fromQuantity, ok := quantityOf[from]
+	if !ok {
+		return fmt.Errorf("unsupported unit: %q", from)
+	}
+	toQuantity, ok := quantityOf[to]
+	if !ok {
+		return fmt.Errorf("unsupported unit: %q", to)
+	}
+	if fromQuantity != toQuantity {
+		return fmt.Errorf("cannot convert %s to %s", from, to)
+	}
+	return nil
+}
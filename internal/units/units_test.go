@@ -0,0 +1,132 @@
+package units_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/mick-io/duplo_go_cloud/internal/units"
+)
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		value    float64
+		from, to string
+		want     float64
+	}{
+		{0, units.Celsius, units.Fahrenheit, 32},
+		{100, units.Celsius, units.Fahrenheit, 212},
+		{-40, units.Fahrenheit, units.Celsius, -40},
+		{98.6, units.Fahrenheit, units.Celsius, 37},
+		{10, units.MetersPerSecond, units.KilometersPerHour, 36},
+		{36, units.KilometersPerHour, units.MetersPerSecond, 10},
+		{60, units.MilesPerHour, units.KilometersPerHour, 96.56064},
+		{1, units.Knots, units.MetersPerSecond, 0.5144444},
+		{25.4, units.Millimeters, units.Inches, 1},
+		{1013.25, units.Hectopascals, units.InchesOfMercury, 29.92126},
+		{760, units.MillimetersOfMercury, units.Hectopascals, 1013.25},
+		{12, units.Knots, units.Knots, 12},
+	}
+
+	for _, tt := range tests {
+		got, err := units.Convert(tt.value, tt.from, tt.to)
+		if err != nil {
+			t.Errorf("Convert(%v, %s, %s): %v", tt.value, tt.from, tt.to, err)
+			continue
+		}
+		// The factors are accurate to about a millionth
+		if math.Abs(got-tt.want) > 1e-6*math.Max(1, math.Abs(tt.want)) {
+			t.Errorf("Convert(%v, %s, %s) = %v, want %v", tt.value, tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestConvertDifference(t *testing.T) {
+	tests := []struct {
+		value    float64
+		from, to string
+		want     float64
+	}{
+		// Temperature differences are scaled without an offset
+		{10, units.Celsius, units.Fahrenheit, 18},
+		{9, units.Fahrenheit, units.Celsius, 5},
+		{10, units.MetersPerSecond, units.KilometersPerHour, 36},
+	}
+
+	for _, tt := range tests {
+		got, err := units.ConvertDifference(tt.value, tt.from, tt.to)
+		if err != nil || math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("ConvertDifference(%v, %s, %s) = %v, %v, want %v", tt.value, tt.from, tt.to, got, err, tt.want)
+		}
+	}
+}
+
+func TestConvertRejectsIncompatibleUnits(t *testing.T) {
+	tests := []struct{ from, to string }{
+		{units.Celsius, units.MetersPerSecond},
+		{units.Millimeters, units.Hectopascals},
+		{"K", units.Celsius},
+		{units.Celsius, "K"},
+	}
+
+	for _, tt := range tests {
+		if _, err := units.Convert(1, tt.from, tt.to); err == nil {
+			t.Errorf("Convert(1, %s, %s) succeeded", tt.from, tt.to)
+		}
+		if _, err := units.ConvertDifference(1, tt.from, tt.to); err == nil {
+			t.Errorf("ConvertDifference(1, %s, %s) succeeded", tt.from, tt.to)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	custom := units.Metric
+	custom.Name = units.NameCustom
+	custom.Temperature = units.Fahrenheit
+	custom.WindSpeed = units.Knots
+
+	tests := []struct {
+		spec string
+		want units.System
+	}{
+		{"metric", units.Metric},
+		{" Imperial ", units.Imperial},
+		{"custom; temperature=fahrenheit; wind_speed=KN", custom},
+		{"custom", units.System{
+			Name:          units.NameCustom,
+			Temperature:   units.Celsius,
+			WindSpeed:     units.KilometersPerHour,
+			Precipitation: units.Millimeters,
+			Pressure:      units.Hectopascals,
+		}},
+	}
+
+	for _, tt := range tests {
+		got, err := units.Parse(tt.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+		// The specification of a system parses back to the system
+		if again, err := units.Parse(got.String()); err != nil || again != got {
+			t.Errorf("Parse(%q) = %+v, %v, want %+v", got.String(), again, err, got)
+		}
+	}
+}
+
+func TestParseRejectsInvalidSystems(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"nautical",
+		"metric; temperature=fahrenheit",
+		"custom; temperature",
+		"custom; altitude=feet",
+		"custom; temperature=kelvin",
+	} {
+		if _, err := units.Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded", spec)
+		}
+	}
+}
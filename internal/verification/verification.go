@@ -0,0 +1,315 @@
+// Package verification scores stored forecasts against observed weather.
+package verification
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/units"
+)
+
+// DefaultLeadTimes are the lead time buckets, in hours, used when none are
+// configured.
+var DefaultLeadTimes = []int{24, 48, 72, 120, 168}
+
+// batchSize is the number of rows written per query.
+const batchSize = 1000
+
+// forecastBatchSize is the number of forecasts whose hourly series are read
+// per query.
+const forecastBatchSize = 50
+
+// StoreObservations saves observations of a location, replacing those
+// already stored for the same hour and variable, and returns the number of
+// observations stored. Of the records for the same hour and variable, the
+// last one is kept.
+func StoreObservations(db database.Datastore, locationID uint, records []models.ObservationRecord) (int, error) {
+	records = dedupeObservations(records)
+	times := map[string][]time.Time{}
+	for _, record := range records {
+		times[record.Variable] = append(times[record.Variable], record.Time)
+	}
+
+	err := db.Transaction(func(tx database.Datastore) error {
+		for variable, values := range times {
+			for start := 0; start < len(values); start += batchSize {
+				end := min(start+batchSize, len(values))
+				err := tx.Delete(&models.ObservationRecord{},
+					"location_record_id = ? AND variable = ? AND time IN ?", locationID, variable, values[start:end])
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		for start := 0; start < len(records); start += batchSize {
+			end := min(start+batchSize, len(records))
+			batch := records[start:end]
+			if err := tx.Create(&batch); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(records), nil
+}
+
+// dedupeObservations returns the records with a single record per variable
+// and hour: the last one, at the position of the first. Times are converted
+// to UTC, so that the same hour is stored and deleted the same way.
+func dedupeObservations(records []models.ObservationRecord) []models.ObservationRecord {
+	type key struct {
+		variable string
+		time     int64
+	}
+	index := make(map[key]int, len(records))
+	deduped := make([]models.ObservationRecord, 0, len(records))
+	for _, record := range records {
+		record.Time = record.Time.UTC()
+		k := key{record.Variable, record.Time.UnixNano()}
+		if i, ok := index[k]; ok {
+			deduped[i] = record
+			continue
+		}
+		index[k] = len(deduped)
+		deduped = append(deduped, record)
+	}
+	return deduped
+}
+
+// stats accumulates the errors of a variable at a lead time bucket.
+type stats struct {
+	count              int
+	sum, sumAbs, sumSq float64
+	unit               string
+}
+
+func (s *stats) add(err float64) {
+	s.count++
+	s.sum += err
+	s.sumAbs += math.Abs(err)
+	s.sumSq += err * err
+}
+
+type statsKey struct {
+	variable  string
+	leadHours int
+}
+
+// Verify compares every stored forecast of a location with its
+// observations. Each forecast hour is assigned to the shortest lead time in
+// 'leadTimes' that is not shorter than the time between the forecast being
+// stored and the hour; hours past the longest lead time and hours before the
+// forecast was stored are ignored. Forecast values are converted to the
+// units of the observations; values that cannot be are ignored. The
+// returned records are not saved.
+func Verify(db database.Datastore, locationID uint, leadTimes []int) ([]models.VerificationRecord, error) {
+	if len(leadTimes) == 0 {
+		leadTimes = DefaultLeadTimes
+	}
+	leadTimes = append([]int(nil), leadTimes...)
+	sort.Ints(leadTimes)
+	maxLead := time.Duration(leadTimes[len(leadTimes)-1]) * time.Hour
+
+	// Loading observations
+	observations := []models.ObservationRecord{}
+	if err := db.Find(&observations, "location_record_id = ?", locationID); err != nil {
+		return nil, err
+	}
+	if len(observations) == 0 {
+		return nil, nil
+	}
+
+	observed := map[string]map[int64]*models.ObservationRecord{}
+	first, last := observations[0].Time, observations[0].Time
+	for i := range observations {
+		observation := &observations[i]
+		if observed[observation.Variable] == nil {
+			observed[observation.Variable] = map[int64]*models.ObservationRecord{}
+		}
+		observed[observation.Variable][observation.Time.Unix()] = observation
+		if observation.Time.Before(first) {
+			first = observation.Time
+		}
+		if observation.Time.After(last) {
+			last = observation.Time
+		}
+	}
+
+	// Loading the forecasts that can cover the observed hours
+	forecasts := []models.ForecastRecord{}
+	err := db.FindPage(&forecasts, database.Page{Order: "id"},
+		"location_record_id = ? AND created_at BETWEEN ? AND ?", locationID, first.Add(-maxLead), last)
+	if err != nil {
+		return nil, err
+	}
+
+	acc := map[statsKey]*stats{}
+	for start := 0; start < len(forecasts); start += forecastBatchSize {
+		batch := forecasts[start:min(start+forecastBatchSize, len(forecasts))]
+		if err := accumulate(db, batch, observed, leadTimes, acc); err != nil {
+			return nil, err
+		}
+	}
+
+	records := make([]models.VerificationRecord, 0, len(acc))
+	for key, s := range acc {
+		records = append(records, newVerificationRecord(locationID, key, s))
+	}
+	sortRecords(records)
+
+	return records, nil
+}
+
+// accumulate adds the errors of a batch of forecasts to 'acc'.
+func accumulate(db database.Datastore, forecasts []models.ForecastRecord, observed map[string]map[int64]*models.ObservationRecord, leadTimes []int, acc map[statsKey]*stats) error {
+	ids := make([]uint, len(forecasts))
+	byID := make(map[uint]*models.ForecastRecord, len(forecasts))
+	for i := range forecasts {
+		ids[i] = forecasts[i].ID
+		byID[forecasts[i].ID] = &forecasts[i]
+	}
+
+	unitRecords := []models.HourlyUnitsRecord{}
+	if err := db.Find(&unitRecords, "forecast_record_id IN ?", ids); err != nil {
+		return err
+	}
+	unitsByID := make(map[uint]*models.HourlyUnitsRecord, len(unitRecords))
+	for i := range unitRecords {
+		unitsByID[unitRecords[i].ForecastRecordID] = &unitRecords[i]
+	}
+
+	hourly := []models.HourlyRecord{}
+	if err := db.Find(&hourly, "forecast_record_id IN ?", ids); err != nil {
+		return err
+	}
+
+	for _, record := range hourly {
+		forecast, unit := byID[record.ForecastRecordID], unitsByID[record.ForecastRecordID]
+		if unit == nil {
+			continue
+		}
+
+		validTime, err := models.ParseHourlyTime(record.Time, forecast.UTCOffsetSeconds)
+		if err != nil {
+			return err
+		}
+		leadHours := leadBucket(validTime.Sub(forecast.CreatedAt), leadTimes)
+		if leadHours == 0 {
+			continue
+		}
+
+		values := []struct {
+			variable, unit string
+			value          float64
+		}{
+			{models.VariableTemperature2M, unit.Temperature2MUnit, record.Temperature2M},
+			{models.VariablePrecipitation, unit.PrecipitationUnit, record.Precipitation},
+		}
+		for _, v := range values {
+			observation, ok := observed[v.variable][validTime.Unix()]
+			if !ok {
+				continue
+			}
+			// Forecasts stored before values were fetched in the canonical
+			// units are converted to the units of the observation
+			value, err := units.Convert(v.value, v.unit, observation.Unit)
+			if err != nil {
+				continue
+			}
+
+			key := statsKey{variable: v.variable, leadHours: leadHours}
+			s, ok := acc[key]
+			if !ok {
+				s = &stats{unit: observation.Unit}
+				acc[key] = s
+			}
+			s.add(value - observation.Value)
+		}
+	}
+
+	return nil
+}
+
+// leadBucket returns the shortest lead time, in hours, that is not shorter
+// than 'lead', or zero if 'lead' is negative or exceeds every lead time.
+func leadBucket(lead time.Duration, leadTimes []int) int {
+	if lead < 0 {
+		return 0
+	}
+	for _, hours := range leadTimes {
+		if lead <= time.Duration(hours)*time.Hour {
+			return hours
+		}
+	}
+	return 0
+}
+
+func newVerificationRecord(locationID uint, key statsKey, s *stats) models.VerificationRecord {
+	n := float64(s.count)
+	return models.VerificationRecord{
+		LocationRecordID: locationID,
+		Variable:         key.variable,
+		LeadHours:        key.leadHours,
+		Count:            s.count,
+		MAE:              s.sumAbs / n,
+		Bias:             s.sum / n,
+		RMSE:             math.Sqrt(s.sumSq / n),
+		Unit:             s.unit,
+	}
+}
+
+// Combine merges the statistics of several locations into statistics per
+// variable, unit and lead time, weighting each location by its count. The
+// LocationRecordID of the combined records is zero.
+func Combine(records []models.VerificationRecord) []models.VerificationRecord {
+	type combineKey struct {
+		statsKey
+		unit string
+	}
+
+	acc := map[combineKey]*stats{}
+	for _, record := range records {
+		key := combineKey{statsKey{record.Variable, record.LeadHours}, record.Unit}
+		s, ok := acc[key]
+		if !ok {
+			s = &stats{unit: record.Unit}
+			acc[key] = s
+		}
+		n := float64(record.Count)
+		s.count += record.Count
+		s.sum += record.Bias * n
+		s.sumAbs += record.MAE * n
+		s.sumSq += record.RMSE * record.RMSE * n
+	}
+
+	combined := make([]models.VerificationRecord, 0, len(acc))
+	for key, s := range acc {
+		if s.count == 0 {
+			continue
+		}
+		combined = append(combined, newVerificationRecord(0, key.statsKey, s))
+	}
+	sortRecords(combined)
+
+	return combined
+}
+
+func sortRecords(records []models.VerificationRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.LocationRecordID != b.LocationRecordID {
+			return a.LocationRecordID < b.LocationRecordID
+		}
+		if a.Variable != b.Variable {
+			return a.Variable < b.Variable
+		}
+		return a.LeadHours < b.LeadHours
+	})
+}
@@ -0,0 +1,55 @@
+package verification_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mick-io/duplo_go_cloud/internal/database/dbtest"
+	"github.com/mick-io/duplo_go_cloud/internal/models"
+	"github.com/mick-io/duplo_go_cloud/internal/verification"
+)
+
+func TestStoreObservationsDedupes(t *testing.T) {
+	db := dbtest.NewDatastore(t)
+	location := models.LocationRecord{Latitude: 1, Longitude: 2}
+	if err := db.Create(&location); err != nil {
+		t.Fatal(err)
+	}
+	noon := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+	observation := func(hour time.Time, variable string, value float64) models.ObservationRecord {
+		return models.ObservationRecord{LocationRecordID: location.ID, Time: hour, Variable: variable, Value: value}
+	}
+
+	if _, err := verification.StoreObservations(db, location.ID, []models.ObservationRecord{
+		observation(noon, models.VariableTemperature2M, 20),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	paris := time.FixedZone("CEST", 2*3600)
+	stored, err := verification.StoreObservations(db, location.ID, []models.ObservationRecord{
+		observation(noon, models.VariableTemperature2M, 21),
+		observation(noon, models.VariablePrecipitation, 0),
+		observation(noon.Add(time.Hour), models.VariableTemperature2M, 22),
+		// The same hour in another timezone, which replaces the first
+		observation(noon.In(paris), models.VariableTemperature2M, 23),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != 3 {
+		t.Errorf("stored %d observations, want 3", stored)
+	}
+
+	records := []models.ObservationRecord{}
+	if err := db.Find(&records, &models.ObservationRecord{LocationRecordID: location.ID, Variable: models.VariableTemperature2M}); err != nil {
+		t.Fatal(err)
+	}
+	values := map[time.Time]float64{}
+	for _, record := range records {
+		values[record.Time.UTC()] = record.Value
+	}
+	if len(records) != 2 || values[noon] != 23 || values[noon.Add(time.Hour)] != 22 {
+		t.Errorf("stored temperatures %v, want 23 at noon and 22 an hour later", values)
+	}
+}